@@ -5,12 +5,13 @@ go 1.16
 require (
 	github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment v0.0.0-20210508215351-37548fd5a5c0
 	github.com/gofrs/uuid v4.0.0+incompatible // indirect
+	github.com/gorilla/mux v1.8.0
 	github.com/jackc/pgtype v1.7.0
 	github.com/jackc/pgx/v4 v4.11.0
 	github.com/lib/pq v1.10.1 // indirect
 	github.com/oklog/ulid/v2 v2.0.2
 	github.com/prometheus/client_golang v1.10.0
 	github.com/shopspring/decimal v1.2.0 // indirect
-	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b // indirect
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
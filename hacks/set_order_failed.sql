@@ -1,3 +0,0 @@
-UPDATE order_fulfillment.customer_order
-SET order_status = 'FAILED'
-WHERE customer_order_id = 'ORDER-01F68QJZ7SMA511HJZ6YE1H9D5';
@@ -4,31 +4,103 @@ import (
 	"fmt"
 	"context"
 	"net/http"
+	"errors"
+	"time"
 
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/auth"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders"
-	//prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/quotes"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/promotions"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/reconciliation"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/webhooks"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/notifications"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fairness"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/listings"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/eligibility"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/waitlist"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders/statemachine"
+	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
 )
 
 type ApiServicer interface {
 	ordf.DefaultApiServicer
 	IPNWebhook(w http.ResponseWriter, r *http.Request)
+	PostQuotes(ctx context.Context, request orders.OrderRequest) (ordf.ImplResponse, error)
+	PostOrderRequest(ctx context.Context, request orders.OrderRequest) (ordf.ImplResponse, error)
+	PostOrderPayments(ctx context.Context, orderID string) (ordf.ImplResponse, error)
+	GetOrderHistory(ctx context.Context, orderID string) (ordf.ImplResponse, error)
+	// streams Server-Sent Events, so it writes the response itself like IPNWebhook
+	OrderEvents(w http.ResponseWriter, r *http.Request, orderID string)
+	GetOrderPoll(ctx context.Context, orderID string, lastStatus string, timeout time.Duration) (ordf.ImplResponse, error)
+	GetOrderSearch(ctx context.Context, search orders.OrderSearchRequest) (ordf.ImplResponse, error)
+	GetAdminPromotions(ctx context.Context) (ordf.ImplResponse, error)
+	PostAdminPromotions(ctx context.Context, code novellia_database.PromotionCode) (ordf.ImplResponse, error)
+	PostAdminPromotionDisable(ctx context.Context, code string) (ordf.ImplResponse, error)
+	PostAdminOrderAction(ctx context.Context, orderID string, action string, request orders.AdminOrderAction) (ordf.ImplResponse, error)
+	GetAdminReconciliation(ctx context.Context, from time.Time, to time.Time) (ordf.ImplResponse, error)
+	GetAdminWebhookDeadLetters(ctx context.Context) (ordf.ImplResponse, error)
+	PostAdminWebhookReplay(ctx context.Context, deliveryID string) (ordf.ImplResponse, error)
+	GetFairnessSeeds(ctx context.Context) (ordf.ImplResponse, error)
+	GetFairnessCatalog(ctx context.Context) (ordf.ImplResponse, error)
+	GetOrderPulls(ctx context.Context, orderID string) (ordf.ImplResponse, error)
+	PostAdminFairnessSeeds(ctx context.Context) (ordf.ImplResponse, error)
+	PostAdminFairnessSeedReveal(ctx context.Context, saleSeedID string) (ordf.ImplResponse, error)
+	GetProductListings(ctx context.Context) (ordf.ImplResponse, error)
+	GetProductListing(ctx context.Context, productID string) (ordf.ImplResponse, error)
+	// how long product listings may be cached by clients
+	ProductListingsCacheTTL() time.Duration
+	GetSalePhases(ctx context.Context) (ordf.ImplResponse, error)
+	PutAdminAllowlist(ctx context.Context, allowlistID string, request eligibility.AllowlistRequest) (ordf.ImplResponse, error)
+	PostAdminProductCacheInvalidate(ctx context.Context) (ordf.ImplResponse, error)
+	PostWaitlist(ctx context.Context, request waitlist.JoinRequest) (ordf.ImplResponse, error)
+	GetWaitlistEntry(ctx context.Context, waitlistEntryID string) (ordf.ImplResponse, error)
 }
 
 type ApiService struct{
 	nowPaymentsService now_payments.Service
 	ordersService orders.Service
+	promotionsService promotions.Service
+	reconciliationService reconciliation.Service
+	webhooksService webhooks.Service
+	fairnessService fairness.Service
+	listingsService listings.Service
+	phasesService phases.Service
+	eligibilityService eligibility.Service
+	productsService products.Service
+	waitlistService waitlist.Service
 }
 
 // NewApiService creates an api service
 func NewApiService(
 	nowPaymentsService now_payments.Service,
 	ordersService orders.Service,
+	promotionsService promotions.Service,
+	reconciliationService reconciliation.Service,
+	webhooksService webhooks.Service,
+	fairnessService fairness.Service,
+	listingsService listings.Service,
+	phasesService phases.Service,
+	eligibilityService eligibility.Service,
+	productsService products.Service,
+	waitlistService waitlist.Service,
 	) ApiServicer {
 	return &ApiService {
 		nowPaymentsService: nowPaymentsService,
 		ordersService: ordersService,
+		promotionsService: promotionsService,
+		reconciliationService: reconciliationService,
+		webhooksService: webhooksService,
+		fairnessService: fairnessService,
+		listingsService: listingsService,
+		phasesService: phasesService,
+		eligibilityService: eligibilityService,
+		productsService: productsService,
+		waitlistService: waitlistService,
 	}
 }
 
@@ -51,8 +123,7 @@ func (s *ApiService) GetStatus(ctx context.Context) (ordf.ImplResponse, error) {
 
 // Gets an order by id
 func (s *ApiService) GetOrders(ctx context.Context, orderId string) (ordf.ImplResponse, error) {
-	// TODO: implement long polling on separate polling API
-	// will need to update SDK to pass in last known state and check for change
+	// clients waiting for a change should use GET /orders/{order_id}/poll or /events instead of polling this
 	order, err := s.ordersService.GetOrder(ctx, orderId)
 	if err != nil {
 		return ordf.Response(500, nil), err
@@ -63,9 +134,16 @@ func (s *ApiService) GetOrders(ctx context.Context, orderId string) (ordf.ImplRe
 
 // Creates an order and returns the order_id
 func (s *ApiService) PostOrders(ctx context.Context, order ordf.Order) (ordf.ImplResponse, error) {
-	orderID, err := s.ordersService.CreateOrder(ctx, order)
+	return s.PostOrderRequest(ctx, orders.OrderRequest{
+		Order: order,
+	})
+}
+
+// Creates an order priced by a quote and returns the order_id
+func (s *ApiService) PostOrderRequest(ctx context.Context, request orders.OrderRequest) (ordf.ImplResponse, error) {
+	orderID, err := s.ordersService.CreateOrder(ctx, request)
 	if err != nil {
-		return ordf.Response(500, nil), err
+		return ordf.Response(orderErrorCode(err), nil), err
 	}
 
 	return ordf.Response(200, ordf.OrderCreated{
@@ -73,6 +151,303 @@ func (s *ApiService) PostOrders(ctx context.Context, order ordf.Order) (ordf.Imp
 	}), nil
 }
 
+// Issues a new payment for an order whose payment expired, returning the updated order
+func (s *ApiService) PostOrderPayments(ctx context.Context, orderID string) (ordf.ImplResponse, error) {
+	order, err := s.ordersService.ReissuePayment(ctx, orderID)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(201, order), nil
+}
+
+// Validates and prices an order, returning a signed quote
+func (s *ApiService) PostQuotes(ctx context.Context, request orders.OrderRequest) (ordf.ImplResponse, error) {
+	quote, err := s.ordersService.QuoteOrder(ctx, request)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(200, quote), nil
+}
+
+// Gets the status history of an order
+func (s *ApiService) GetOrderHistory(ctx context.Context, orderID string) (ordf.ImplResponse, error) {
+	history, err := s.ordersService.GetOrderHistory(ctx, orderID)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(200, history), nil
+}
+
+// Lists orders matching a search, newest first
+func (s *ApiService) GetOrderSearch(ctx context.Context, search orders.OrderSearchRequest) (ordf.ImplResponse, error) {
+	result, err := s.ordersService.SearchOrders(ctx, search)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(200, result), nil
+}
+
+// maps quote, discount code, payment and NowPayments errors to a status code the client can act on
+func orderErrorCode(err error) int {
+	switch {
+	case errors.Is(err, quotes.ErrQuoteNotFound), errors.Is(err, promotions.ErrCodeNotFound), errors.Is(err, orders.ErrOrderNotFound):
+		return 404
+	case errors.Is(err, webhooks.ErrDeadLetterNotFound), errors.Is(err, fairness.ErrSeedNotFound):
+		return 404
+	case errors.Is(err, listings.ErrListingNotFound):
+		return 404
+	case errors.Is(err, quotes.ErrQuoteExpired), errors.Is(err, quotes.ErrQuoteRedeemed), errors.Is(err, orders.ErrPaymentNotReissuable):
+		return 409
+	case errors.Is(err, orders.ErrFulfillmentInProgress):
+		return 409
+	case errors.Is(err, statemachine.ErrInvalidTransition), errors.Is(err, fairness.ErrSeedActive):
+		return 409
+	case errors.Is(err, products.ErrOutOfStock), errors.Is(err, phases.ErrNotPurchasable):
+		return 409
+	case errors.Is(err, eligibility.ErrNotEligible):
+		return 403
+	case errors.Is(err, novellia_database.ErrPurchaseCapReached), errors.Is(err, novellia_database.ErrPurchaseLimitReached):
+		return 409
+	case errors.Is(err, eligibility.ErrInvalidProof), errors.Is(err, eligibility.ErrInvalidAllowlist):
+		return 400
+	case errors.Is(err, orders.ErrReasonRequired), errors.Is(err, orders.ErrInvalidDeliveryAddress), errors.Is(err, orders.ErrInvalidSearch):
+		return 400
+	case errors.Is(err, notifications.ErrInvalidContact), errors.Is(err, waitlist.ErrInvalidRequest):
+		return 400
+	case errors.Is(err, waitlist.ErrEntryNotFound):
+		return 404
+	case errors.Is(err, orders.ErrStockUnavailable), errors.Is(err, waitlist.ErrInStock), errors.Is(err, waitlist.ErrAlreadyWaiting):
+		return 409
+	case errors.Is(err, novellia_database.ErrWaitlistReservationUnavailable):
+		return 409
+	case errors.Is(err, promotions.ErrCodeNotApplicable), errors.Is(err, novellia_database.ErrPromotionCodeUnavailable):
+		return 409
+	case errors.Is(err, now_payments.ErrMinAmount), errors.Is(err, now_payments.ErrInvalidAmount):
+		return 422
+	case errors.Is(err, now_payments.ErrRateLimited):
+		return 503
+	default:
+		return 500
+	}
+}
+
+// Lists promotion codes
+func (s *ApiService) GetAdminPromotions(ctx context.Context) (ordf.ImplResponse, error) {
+	codes, err := s.promotionsService.GetCodes(ctx)
+	if err != nil {
+		return ordf.Response(500, nil), err
+	}
+
+	return ordf.Response(200, codes), nil
+}
+
+// Creates a promotion code
+func (s *ApiService) PostAdminPromotions(ctx context.Context, code novellia_database.PromotionCode) (ordf.ImplResponse, error) {
+	err := s.promotionsService.CreateCode(ctx, code)
+	if err != nil {
+		return ordf.Response(400, nil), err
+	}
+
+	return ordf.Response(201, nil), nil
+}
+
+// Disables a promotion code
+func (s *ApiService) PostAdminPromotionDisable(ctx context.Context, code string) (ordf.ImplResponse, error) {
+	err := s.promotionsService.DisableCode(ctx, code)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(200, nil), nil
+}
+
+// Applies an operator intervention to an order, returning the order's status history
+// action is one of paid, fail, retry-fulfillment, delivery-address, cancel or refunded
+func (s *ApiService) PostAdminOrderAction(ctx context.Context, orderID string, action string, request orders.AdminOrderAction) (ordf.ImplResponse, error) {
+	request.ActorID = auth.ActorID(ctx)
+
+	var err error
+	switch action {
+	case orders.ADMIN_ACTION_PAID:
+		err = s.ordersService.MarkOrderPaid(ctx, orderID, request)
+	case orders.ADMIN_ACTION_FAIL:
+		err = s.ordersService.FailOrder(ctx, orderID, request)
+	case orders.ADMIN_ACTION_RETRY_FULFILLMENT:
+		err = s.ordersService.RetryFulfillment(ctx, orderID, request)
+	case orders.ADMIN_ACTION_DELIVERY_ADDRESS:
+		err = s.ordersService.ChangeDeliveryAddress(ctx, orderID, request)
+	case orders.ADMIN_ACTION_CANCEL:
+		err = s.ordersService.CancelOrder(ctx, orderID, request)
+	case orders.ADMIN_ACTION_REFUNDED:
+		err = s.ordersService.RecordRefund(ctx, orderID, request)
+	default:
+		return ordf.Response(404, nil), fmt.Errorf("unknown order action: %s", action)
+	}
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+	fmt.Printf("Admin %s on order %s by %s: %s\n", action, orderID, request.ActorID, request.Reason)
+
+	return s.GetOrderHistory(ctx, orderID)
+}
+
+// Reconciles payments created in [from, to) against NowPayments, the body is a *reconciliation.Report
+func (s *ApiService) GetAdminReconciliation(ctx context.Context, from time.Time, to time.Time) (ordf.ImplResponse, error) {
+	report, err := s.reconciliationService.Reconcile(ctx, from, to)
+	if err != nil {
+		return ordf.Response(500, nil), err
+	}
+
+	return ordf.Response(200, report), nil
+}
+
+// Lists webhook deliveries that ran out of attempts
+func (s *ApiService) GetAdminWebhookDeadLetters(ctx context.Context) (ordf.ImplResponse, error) {
+	deadLetters, err := s.webhooksService.GetDeadLetters(ctx)
+	if err != nil {
+		return ordf.Response(500, nil), err
+	}
+
+	return ordf.Response(200, deadLetters), nil
+}
+
+// Queues a dead-lettered webhook for delivery again
+func (s *ApiService) PostAdminWebhookReplay(ctx context.Context, deliveryID string) (ordf.ImplResponse, error) {
+	err := s.webhooksService.ReplayDeadLetter(ctx, deliveryID)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(202, nil), nil
+}
+
+// Lists sale seeds, each seed is only included once it was revealed
+func (s *ApiService) GetFairnessSeeds(ctx context.Context) (ordf.ImplResponse, error) {
+	seeds, err := s.fairnessService.GetSeeds(ctx)
+	if err != nil {
+		return ordf.Response(500, nil), err
+	}
+
+	return ordf.Response(200, seeds), nil
+}
+
+// Gets the bundle definitions pulls are drawn from
+func (s *ApiService) GetFairnessCatalog(ctx context.Context) (ordf.ImplResponse, error) {
+	return ordf.Response(200, s.fairnessService.GetCatalog()), nil
+}
+
+// Gets an order's bundle pulls with the inputs needed to recompute them
+func (s *ApiService) GetOrderPulls(ctx context.Context, orderID string) (ordf.ImplResponse, error) {
+	pulls, err := s.fairnessService.GetOrderPulls(ctx, orderID)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(200, pulls), nil
+}
+
+// Ends the running sale and starts a new one, returning the new seed's hash
+func (s *ApiService) PostAdminFairnessSeeds(ctx context.Context) (ordf.ImplResponse, error) {
+	seed, err := s.fairnessService.RotateSeed(ctx)
+	if err != nil {
+		return ordf.Response(500, nil), err
+	}
+	fmt.Printf("Sale seed rotated to %s by %s\n", seed.SaleSeedID, auth.ActorID(ctx))
+
+	return ordf.Response(201, seed), nil
+}
+
+// Reveals the seed of an ended sale
+func (s *ApiService) PostAdminFairnessSeedReveal(ctx context.Context, saleSeedID string) (ordf.ImplResponse, error) {
+	seed, err := s.fairnessService.RevealSeed(ctx, saleSeedID)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+	fmt.Printf("Sale seed %s revealed by %s\n", saleSeedID, auth.ActorID(ctx))
+
+	return ordf.Response(200, seed), nil
+}
+
+// Lists products with their prices, availability, bundle odds and unreserved stock
+func (s *ApiService) GetProductListings(ctx context.Context) (ordf.ImplResponse, error) {
+	productListings, err := s.listingsService.GetListings(ctx)
+	if err != nil {
+		return ordf.Response(500, nil), err
+	}
+
+	return ordf.Response(200, productListings), nil
+}
+
+// Gets a product's listing
+func (s *ApiService) GetProductListing(ctx context.Context, productID string) (ordf.ImplResponse, error) {
+	listing, err := s.listingsService.GetListing(ctx, productID)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(200, listing), nil
+}
+
+func (s *ApiService) ProductListingsCacheTTL() time.Duration {
+	return s.listingsService.CacheTTL()
+}
+
+// Gets the sale phase schedule with the phase running now
+func (s *ApiService) GetSalePhases(ctx context.Context) (ordf.ImplResponse, error) {
+	return ordf.Response(200, s.phasesService.GetStatus(time.Now())), nil
+}
+
+// Replaces the addresses of an allowlist used by sale phase eligibility rules
+func (s *ApiService) PutAdminAllowlist(ctx context.Context, allowlistID string, request eligibility.AllowlistRequest) (ordf.ImplResponse, error) {
+	count, err := s.eligibilityService.PutAllowlist(ctx, allowlistID, request.Addresses)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+	fmt.Printf("Allowlist %s replaced by %s\n", allowlistID, auth.ActorID(ctx))
+
+	return ordf.Response(200, eligibility.AllowlistResult{
+		AllowlistID: allowlistID,
+		Addresses: count,
+	}), nil
+}
+
+// Reloads products from the database and drops cached listings, for changes made while the product change listener was down
+func (s *ApiService) PostAdminProductCacheInvalidate(ctx context.Context) (ordf.ImplResponse, error) {
+	s.productsService.InvalidateProducts()
+	s.listingsService.Invalidate()
+	_, err := s.productsService.GetProducts(ctx)
+	if err != nil {
+		return ordf.Response(500, nil), err
+	}
+	fmt.Printf("Product cache invalidated by %s\n", auth.ActorID(ctx))
+
+	return ordf.Response(200, s.productsService.GetCacheStatus()), nil
+}
+
+// Queues a delivery address for a sold-out product, stock is reserved for it in turn
+func (s *ApiService) PostWaitlist(ctx context.Context, request waitlist.JoinRequest) (ordf.ImplResponse, error) {
+	entry, err := s.waitlistService.Join(ctx, request)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(200, entry), nil
+}
+
+// Gets a waitlist entry with its place in line and reservation
+func (s *ApiService) GetWaitlistEntry(ctx context.Context, waitlistEntryID string) (ordf.ImplResponse, error) {
+	entry, err := s.waitlistService.GetEntry(ctx, waitlistEntryID)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(200, entry), nil
+}
+
 type IPNResponse struct {
 	Code string
 	Body interface{}
@@ -80,28 +455,25 @@ type IPNResponse struct {
 
 // receives NowPayments IPN callbacks
 func (s *ApiService) IPNWebhook(w http.ResponseWriter, r *http.Request) {
-	// return 200 on success, otherwise nothing (NowPayments will retry)
-
-	/*
-	ctx := context.Background()
+	// return 200 on success, otherwise an error status so that NowPayments retries
 
 	// cryptographically validate webhook payload
 	payment, err := s.nowPaymentsService.IPNWebhookValidate(r)
 	if err != nil {
-		fmt.Printf("Failed to validate IPNWebhook: %+v", err)
+		fmt.Printf("Failed to validate IPNWebhook: %+v\n", err)
 		prometheus_monitoring.TickNowPaymentsIPNFailed()
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	// update order in database
-	err = s.ordersService.IPNUpdateOrder(ctx, *payment)
+	err = s.ordersService.IPNUpdateOrder(r.Context(), *payment)
 	if err != nil {
-		fmt.Printf("Failed to update order in IPNWebhook: %+v", err)
+		fmt.Printf("Failed to update order in IPNWebhook: %+v\n", err)
 		prometheus_monitoring.TickNowPaymentsIPNFailed()
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	*/
 
-	fmt.Printf("Hit IPN\n")
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,544 @@
+package api
+
+import (
+	"fmt"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"strconv"
+	"time"
+
+	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/auth"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/reconciliation"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/eligibility"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/waitlist"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// used when a reconciliation request does not give a range
+	defaultReconciliationRange = 24 * time.Hour
+)
+
+// binds routes that are not part of the SDK yet, mirroring ordf.DefaultApiController
+// mux serves the first route registered for a path, so this is passed to ordf.NewRouter before the SDK controller it overrides
+type ApiController struct {
+	service ApiServicer
+	auth auth.Service
+}
+
+// roles required for each admin order action, unknown actions are left to the service
+var adminOrderActionRoles = map[string]string{
+	orders.ADMIN_ACTION_PAID: auth.ROLE_ADMIN,
+	orders.ADMIN_ACTION_CANCEL: auth.ROLE_ADMIN,
+	orders.ADMIN_ACTION_REFUNDED: auth.ROLE_ADMIN,
+	orders.ADMIN_ACTION_FAIL: auth.ROLE_OPERATOR,
+	orders.ADMIN_ACTION_RETRY_FULFILLMENT: auth.ROLE_OPERATOR,
+	orders.ADMIN_ACTION_DELIVERY_ADDRESS: auth.ROLE_SUPPORT,
+}
+
+// NewApiController creates an api controller for routes not in the SDK
+// admin routes are authorized with authService
+func NewApiController(s ApiServicer, authService auth.Service) ordf.Router {
+	return &ApiController{
+		service: s,
+		auth: authService,
+	}
+}
+
+// Routes returns all of the api routes for the ApiController
+func (c *ApiController) Routes() ordf.Routes {
+	return ordf.Routes{
+		{
+			Name: "PostQuotes",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/quotes",
+			HandlerFunc: c.PostQuotes,
+		},
+		// overrides the SDK route to accept a quote_id
+		{
+			Name: "PostOrders",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/orders",
+			HandlerFunc: c.PostOrders,
+		},
+		// overrides the SDK route to search orders when no order_id is given
+		{
+			Name: "GetOrders",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/orders",
+			HandlerFunc: c.GetOrders,
+		},
+		{
+			Name: "PostOrderPayments",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/orders/{order_id}/payments",
+			HandlerFunc: c.PostOrderPayments,
+		},
+		{
+			Name: "GetOrderEvents",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/orders/{order_id}/events",
+			HandlerFunc: c.GetOrderEvents,
+		},
+		{
+			Name: "GetOrderPoll",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/orders/{order_id}/poll",
+			HandlerFunc: c.GetOrderPoll,
+		},
+		{
+			Name: "GetOrderHistory",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/orders/{order_id}/history",
+			// reasons and actor IDs are written by operators for each other
+			HandlerFunc: c.auth.Require(auth.ROLE_SUPPORT, c.GetOrderHistory),
+		},
+		{
+			Name: "GetAdminPromotions",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/admin/promotions",
+			HandlerFunc: c.auth.Require(auth.ROLE_SUPPORT, c.GetAdminPromotions),
+		},
+		{
+			Name: "PostAdminPromotions",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/admin/promotions",
+			HandlerFunc: c.auth.Require(auth.ROLE_OPERATOR, c.PostAdminPromotions),
+		},
+		{
+			Name: "PostAdminPromotionDisable",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/admin/promotions/{code}/disable",
+			HandlerFunc: c.auth.Require(auth.ROLE_OPERATOR, c.PostAdminPromotionDisable),
+		},
+		{
+			Name: "PostAdminOrderAction",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/admin/orders/{order_id}/{action}",
+			HandlerFunc: c.PostAdminOrderAction,
+		},
+		{
+			Name: "GetAdminReconciliation",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/admin/reconciliation",
+			HandlerFunc: c.auth.Require(auth.ROLE_VIEWER, c.GetAdminReconciliation),
+		},
+		{
+			Name: "GetAdminWebhookDeadLetters",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/admin/webhooks/dead-letters",
+			HandlerFunc: c.auth.Require(auth.ROLE_SUPPORT, c.GetAdminWebhookDeadLetters),
+		},
+		{
+			Name: "PostAdminWebhookReplay",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/admin/webhooks/dead-letters/{delivery_id}/replay",
+			HandlerFunc: c.auth.Require(auth.ROLE_OPERATOR, c.PostAdminWebhookReplay),
+		},
+		{
+			Name: "GetFairnessSeeds",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/fairness/seeds",
+			HandlerFunc: c.GetFairnessSeeds,
+		},
+		{
+			Name: "GetFairnessCatalog",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/fairness/catalog",
+			HandlerFunc: c.GetFairnessCatalog,
+		},
+		{
+			Name: "GetOrderPulls",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/orders/{order_id}/pulls",
+			HandlerFunc: c.GetOrderPulls,
+		},
+		{
+			Name: "PostAdminFairnessSeeds",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/admin/fairness/seeds",
+			HandlerFunc: c.auth.Require(auth.ROLE_OPERATOR, c.PostAdminFairnessSeeds),
+		},
+		{
+			Name: "PostAdminFairnessSeedReveal",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/admin/fairness/seeds/{sale_seed_id}/reveal",
+			HandlerFunc: c.auth.Require(auth.ROLE_OPERATOR, c.PostAdminFairnessSeedReveal),
+		},
+		{
+			Name: "GetProducts",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/products",
+			HandlerFunc: c.GetProducts,
+		},
+		{
+			Name: "GetProduct",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/products/{product_id}",
+			HandlerFunc: c.GetProduct,
+		},
+		{
+			Name: "GetSalePhases",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/sale-phases",
+			HandlerFunc: c.GetSalePhases,
+		},
+		{
+			Name: "PutAdminAllowlist",
+			Method: strings.ToUpper("Put"),
+			Pattern: "/order-fulfillment/v0/admin/allowlists/{allowlist_id}",
+			HandlerFunc: c.auth.Require(auth.ROLE_OPERATOR, c.PutAdminAllowlist),
+		},
+		{
+			Name: "PostAdminProductCacheInvalidate",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/admin/products/cache/invalidate",
+			HandlerFunc: c.auth.Require(auth.ROLE_OPERATOR, c.PostAdminProductCacheInvalidate),
+		},
+		{
+			Name: "PostWaitlist",
+			Method: strings.ToUpper("Post"),
+			Pattern: "/order-fulfillment/v0/waitlist",
+			HandlerFunc: c.PostWaitlist,
+		},
+		{
+			Name: "GetWaitlistEntry",
+			Method: strings.ToUpper("Get"),
+			Pattern: "/order-fulfillment/v0/waitlist/{waitlist_entry_id}",
+			HandlerFunc: c.GetWaitlistEntry,
+		},
+	}
+}
+
+// encodes a service result the same way the SDK controller does
+func encodeResult(w http.ResponseWriter, result ordf.ImplResponse, err error) {
+	//If an error occured, encode the error with the status code
+	if err != nil {
+		ordf.EncodeJSONResponse(err.Error(), &result.Code, w)
+		return
+	}
+	//If no error, encode the body and the result code
+	ordf.EncodeJSONResponse(result.Body, &result.Code, w)
+}
+
+// PostQuotes - prices an order
+func (c *ApiController) PostQuotes(w http.ResponseWriter, r *http.Request) {
+	request := &orders.OrderRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := c.service.PostQuotes(r.Context(), *request)
+	encodeResult(w, result, err)
+}
+
+// PostOrders - creates an order from a quote
+func (c *ApiController) PostOrders(w http.ResponseWriter, r *http.Request) {
+	request := &orders.OrderRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := c.service.PostOrderRequest(r.Context(), *request)
+	encodeResult(w, result, err)
+}
+
+// GetOrders - gets an order by order_id, or lists orders matching the other parameters for support staff
+// status, payment_status, delivery_address, product_id, created_from, created_to, updated_from, updated_to (RFC3339), cursor and limit
+func (c *ApiController) GetOrders(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if orderID := query.Get("order_id"); orderID != "" {
+		result, err := c.service.GetOrders(r.Context(), orderID)
+		encodeResult(w, result, err)
+		return
+	}
+	c.auth.Require(auth.ROLE_SUPPORT, c.getOrderSearch)(w, r)
+}
+
+func (c *ApiController) getOrderSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	search := orders.OrderSearchRequest{
+		OrderStatus: query.Get("status"),
+		PaymentStatus: query.Get("payment_status"),
+		DeliveryAddress: query.Get("delivery_address"),
+		ProductID: query.Get("product_id"),
+		Cursor: query.Get("cursor"),
+	}
+
+	times := map[string]**time.Time{
+		"created_from": &search.CreatedFrom,
+		"created_to": &search.CreatedTo,
+		"updated_from": &search.UpdatedFrom,
+		"updated_to": &search.UpdatedTo,
+	}
+	for param, field := range times {
+		if query.Get(param) == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, query.Get(param))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		*field = &t
+	}
+	if query.Get("limit") != "" {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		search.Limit = limit
+	}
+
+	result, err := c.service.GetOrderSearch(r.Context(), search)
+	encodeResult(w, result, err)
+}
+
+// PostOrderPayments - re-issues an expired payment for an order
+func (c *ApiController) PostOrderPayments(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["order_id"]
+
+	result, err := c.service.PostOrderPayments(r.Context(), orderID)
+	encodeResult(w, result, err)
+}
+
+// GetOrderEvents - streams an order's status changes as Server-Sent Events
+func (c *ApiController) GetOrderEvents(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["order_id"]
+
+	c.service.OrderEvents(w, r, orderID)
+}
+
+// GetOrderPoll - gets an order once its status differs from status, or after timeout seconds
+func (c *ApiController) GetOrderPoll(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["order_id"]
+	query := r.URL.Query()
+	var timeout time.Duration
+	if query.Get("timeout") != "" {
+		seconds, err := strconv.Atoi(query.Get("timeout"))
+		if err != nil || seconds < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	result, err := c.service.GetOrderPoll(r.Context(), orderID, query.Get("status"), timeout)
+	encodeResult(w, result, err)
+}
+
+// GetOrderHistory - lists the status transitions of an order
+func (c *ApiController) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["order_id"]
+
+	result, err := c.service.GetOrderHistory(r.Context(), orderID)
+	encodeResult(w, result, err)
+}
+
+// GetAdminPromotions - lists promotion codes
+func (c *ApiController) GetAdminPromotions(w http.ResponseWriter, r *http.Request) {
+	result, err := c.service.GetAdminPromotions(r.Context())
+	encodeResult(w, result, err)
+}
+
+// PostAdminPromotions - creates a promotion code
+func (c *ApiController) PostAdminPromotions(w http.ResponseWriter, r *http.Request) {
+	code := &novellia_database.PromotionCode{}
+	if err := json.NewDecoder(r.Body).Decode(&code); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := c.service.PostAdminPromotions(r.Context(), *code)
+	encodeResult(w, result, err)
+}
+
+// PostAdminPromotionDisable - disables a promotion code, orders already placed with it are unaffected
+func (c *ApiController) PostAdminPromotionDisable(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+
+	result, err := c.service.PostAdminPromotionDisable(r.Context(), code)
+	encodeResult(w, result, err)
+}
+
+// PostAdminOrderAction - applies an operator intervention to an order, the role required depends on the action
+func (c *ApiController) PostAdminOrderAction(w http.ResponseWriter, r *http.Request) {
+	role, ok := adminOrderActionRoles[mux.Vars(r)["action"]]
+	if !ok {
+		role = auth.ROLE_ADMIN
+	}
+	c.auth.Require(role, c.postAdminOrderAction)(w, r)
+}
+
+func (c *ApiController) postAdminOrderAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	request := &orders.AdminOrderAction{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := c.service.PostAdminOrderAction(r.Context(), vars["order_id"], vars["action"], *request)
+	encodeResult(w, result, err)
+}
+
+// GetAdminReconciliation - reconciles payments against NowPayments
+// from and to are RFC3339 and default to the last day, format is json (default) or csv
+func (c *ApiController) GetAdminReconciliation(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	to := time.Now().UTC()
+	if query.Get("to") != "" {
+		t, err := time.Parse(time.RFC3339, query.Get("to"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-defaultReconciliationRange)
+	if query.Get("from") != "" {
+		t, err := time.Parse(time.RFC3339, query.Get("from"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := c.service.GetAdminReconciliation(r.Context(), from, to)
+	report, ok := result.Body.(*reconciliation.Report)
+	if err != nil || !ok || format != "csv" {
+		encodeResult(w, result, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	w.WriteHeader(result.Code)
+	report.WriteCSV(w)
+}
+
+// GetAdminWebhookDeadLetters - lists webhook deliveries that ran out of attempts
+func (c *ApiController) GetAdminWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	result, err := c.service.GetAdminWebhookDeadLetters(r.Context())
+	encodeResult(w, result, err)
+}
+
+// PostAdminWebhookReplay - queues a dead-lettered webhook for delivery again
+func (c *ApiController) PostAdminWebhookReplay(w http.ResponseWriter, r *http.Request) {
+	deliveryID := mux.Vars(r)["delivery_id"]
+
+	result, err := c.service.PostAdminWebhookReplay(r.Context(), deliveryID)
+	encodeResult(w, result, err)
+}
+
+// GetFairnessSeeds - lists sale seed hashes, with the seeds of ended sales once revealed
+func (c *ApiController) GetFairnessSeeds(w http.ResponseWriter, r *http.Request) {
+	result, err := c.service.GetFairnessSeeds(r.Context())
+	encodeResult(w, result, err)
+}
+
+// GetFairnessCatalog - gets the bundle definitions pulls are drawn from
+func (c *ApiController) GetFairnessCatalog(w http.ResponseWriter, r *http.Request) {
+	result, err := c.service.GetFairnessCatalog(r.Context())
+	encodeResult(w, result, err)
+}
+
+// GetOrderPulls - gets an order's bundle pulls and their derivation inputs
+func (c *ApiController) GetOrderPulls(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["order_id"]
+
+	result, err := c.service.GetOrderPulls(r.Context(), orderID)
+	encodeResult(w, result, err)
+}
+
+// PostAdminFairnessSeeds - ends the running sale and commits to a new seed
+func (c *ApiController) PostAdminFairnessSeeds(w http.ResponseWriter, r *http.Request) {
+	result, err := c.service.PostAdminFairnessSeeds(r.Context())
+	encodeResult(w, result, err)
+}
+
+// PostAdminFairnessSeedReveal - publishes the seed of an ended sale
+func (c *ApiController) PostAdminFairnessSeedReveal(w http.ResponseWriter, r *http.Request) {
+	saleSeedID := mux.Vars(r)["sale_seed_id"]
+
+	result, err := c.service.PostAdminFairnessSeedReveal(r.Context(), saleSeedID)
+	encodeResult(w, result, err)
+}
+
+// sets Cache-Control on successful product listings, which are cached for the same time by the service
+func (c *ApiController) setProductsCacheControl(w http.ResponseWriter, result ordf.ImplResponse, err error) {
+	if err == nil && result.Code == http.StatusOK {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(c.service.ProductListingsCacheTTL().Seconds())))
+	}
+}
+
+// GetProducts - lists products with their prices, availability, bundle odds and unreserved stock
+func (c *ApiController) GetProducts(w http.ResponseWriter, r *http.Request) {
+	result, err := c.service.GetProductListings(r.Context())
+	c.setProductsCacheControl(w, result, err)
+	encodeResult(w, result, err)
+}
+
+// GetProduct - gets a product's listing
+func (c *ApiController) GetProduct(w http.ResponseWriter, r *http.Request) {
+	productID := mux.Vars(r)["product_id"]
+
+	result, err := c.service.GetProductListing(r.Context(), productID)
+	c.setProductsCacheControl(w, result, err)
+	encodeResult(w, result, err)
+}
+
+// GetSalePhases - gets the sale phase schedule with the phase running now
+func (c *ApiController) GetSalePhases(w http.ResponseWriter, r *http.Request) {
+	result, err := c.service.GetSalePhases(r.Context())
+	encodeResult(w, result, err)
+}
+
+// PutAdminAllowlist - replaces the addresses of an allowlist
+func (c *ApiController) PutAdminAllowlist(w http.ResponseWriter, r *http.Request) {
+	allowlistID := mux.Vars(r)["allowlist_id"]
+	request := eligibility.AllowlistRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := c.service.PutAdminAllowlist(r.Context(), allowlistID, request)
+	encodeResult(w, result, err)
+}
+
+// PostAdminProductCacheInvalidate - reloads products and drops cached listings
+func (c *ApiController) PostAdminProductCacheInvalidate(w http.ResponseWriter, r *http.Request) {
+	result, err := c.service.PostAdminProductCacheInvalidate(r.Context())
+	encodeResult(w, result, err)
+}
+
+// PostWaitlist - queues a delivery address for a sold-out product
+func (c *ApiController) PostWaitlist(w http.ResponseWriter, r *http.Request) {
+	request := waitlist.JoinRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := c.service.PostWaitlist(r.Context(), request)
+	encodeResult(w, result, err)
+}
+
+// GetWaitlistEntry - gets a waitlist entry with its place in line and reservation
+func (c *ApiController) GetWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+	result, err := c.service.GetWaitlistEntry(r.Context(), mux.Vars(r)["waitlist_entry_id"])
+	encodeResult(w, result, err)
+}
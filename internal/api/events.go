@@ -0,0 +1,105 @@
+package api
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"net/http"
+	"encoding/json"
+
+	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/events"
+)
+
+const (
+	// comments sent on idle streams so that proxies keep them open
+	eventStreamKeepAlive = 15 * time.Second
+)
+
+// starts a Server-Sent Events response, returning false if the writer cannot stream
+func startEventStream(w http.ResponseWriter) (http.Flusher, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// disables response buffering in nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return flusher, true
+}
+
+// writes an order event as a "status" event
+func writeOrderEvent(w http.ResponseWriter, flusher http.Flusher, event events.OrderEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+	if err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// Streams an order's status changes as Server-Sent Events, starting with its current status
+// the stream ends once the order reaches a final status
+func (s *ApiService) OrderEvents(w http.ResponseWriter, r *http.Request, orderID string) {
+	ctx := r.Context()
+	subscription, err := s.ordersService.SubscribeOrder(ctx, orderID)
+	if err != nil {
+		code := orderErrorCode(err)
+		ordf.EncodeJSONResponse(err.Error(), &code, w)
+		return
+	}
+	defer subscription.Close()
+
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+	err = writeOrderEvent(w, flusher, events.OrderEvent{
+		OrderID: orderID,
+		To: subscription.Status,
+		Reason: "current status",
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil || subscription.Final {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-subscription.Events:
+			err = writeOrderEvent(w, flusher, event)
+			if err != nil || s.ordersService.IsFinalStatus(event.To) {
+				return
+			}
+		case <-keepAlive.C:
+			_, err = fmt.Fprintf(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Gets an order once its status differs from lastStatus, or after timeout
+func (s *ApiService) GetOrderPoll(ctx context.Context, orderID string, lastStatus string, timeout time.Duration) (ordf.ImplResponse, error) {
+	order, err := s.ordersService.WaitForOrderUpdate(ctx, orderID, lastStatus, timeout)
+	if err != nil {
+		return ordf.Response(orderErrorCode(err), nil), err
+	}
+
+	return ordf.Response(200, order), nil
+}
@@ -3,8 +3,23 @@ package api
 import (
 	"context"
 	"net/http"
+	"time"
 
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/events"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/quotes"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/promotions"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/reconciliation"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/webhooks"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fairness"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/listings"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/eligibility"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/waitlist"
 )
 
 type MockedApiService struct{}
@@ -63,6 +78,545 @@ func (s *MockedApiService) PostOrders(context.Context, ordf.Order) (ordf.ImplRes
 	return ordf.Response(200, orderCreated), nil
 }
 
+// Creates an order priced by a quote and returns the order_id
+func (s *MockedApiService) PostOrderRequest(ctx context.Context, request orders.OrderRequest) (ordf.ImplResponse, error) {
+	return s.PostOrders(ctx, request.Order)
+}
+
+// Issues a new payment for an order whose payment expired, returning the updated order
+func (s *MockedApiService) PostOrderPayments(ctx context.Context, orderID string) (ordf.ImplResponse, error) {
+	order := orders.OrderDetails{
+		Order: ordf.Order{
+			Items: []ordf.OrderItems{
+				ordf.OrderItems{
+					ProductId: "PROD-01D78XYFJ1PRM1WPBAOU8JQMNV",
+					Quantity: 4,
+				},
+			},
+			Customer: ordf.OrderCustomer{
+				DeliveryAddress: "addr1",
+			},
+			Payment: ordf.OrderPayment{
+				PaymentAddress: "addr2",
+				PriceCurrencyId: "ada",
+				PriceAmount: 23,
+				PaymentStatus: "WAITING",
+			},
+			OrderStatus: "AWAITING_PAYMENT",
+			Description: "Occulta Novellia Presale Order",
+			OrderId: orderID,
+		},
+		Payments: []orders.PaymentAttempt{
+			orders.PaymentAttempt{
+				PaymentID: "5077125051",
+				PaymentStatus: "EXPIRED",
+				PayAddress: "addr1",
+				PayAmount: 22,
+				ActuallyPaid: 10,
+				CreatedAt: "2021-05-22T21:00:00Z",
+			},
+			orders.PaymentAttempt{
+				PaymentID: "5077125052",
+				PaymentStatus: "WAITING",
+				PayAddress: "addr2",
+				PayAmount: 12,
+				Active: true,
+				CreatedAt: "2021-05-22T23:00:00Z",
+			},
+		},
+		ActuallyPaid: 10,
+	}
+
+	return ordf.Response(201, order), nil
+}
+
+// Lists orders matching a search
+func (s *MockedApiService) GetOrderSearch(ctx context.Context, search orders.OrderSearchRequest) (ordf.ImplResponse, error) {
+	result := orders.OrderSearchResult{
+		Orders: []novellia_database.OrderSummary{
+			novellia_database.OrderSummary{
+				OrderID: "ORDER-01D78XYFJ1PRM1WPBCBT3VHMNV",
+				OrderStatus: "AWAITING_PAYMENT",
+				PaymentStatus: "waiting",
+				DeliveryAddress: "addr1",
+				PriceCurrencyID: "ada",
+				PriceAmount: 20,
+				ProductIDs: []string{"PROD-01D78XYFJ1PRM1WPBAOU8JQMNV", "PROD-01D78XYFJ1PRM1WPBCBT3VHMNV"},
+				CreatedAt: time.Date(2021, 5, 22, 21, 0, 0, 0, time.UTC),
+				UpdatedAt: time.Date(2021, 5, 22, 21, 0, 1, 0, time.UTC),
+			},
+		},
+	}
+
+	return ordf.Response(200, result), nil
+}
+
+// Streams a mocked order from payment to fulfillment
+func (s *MockedApiService) OrderEvents(w http.ResponseWriter, r *http.Request, orderID string) {
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+
+	statuses := []string{"AWAITING_PAYMENT", "PAID", "FILLED"}
+	from := ""
+	for i, status := range statuses {
+		if i > 0 {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		err := writeOrderEvent(w, flusher, events.OrderEvent{
+			OrderID: orderID,
+			From: from,
+			To: status,
+			Reason: "mocked",
+			CreatedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			return
+		}
+		from = status
+	}
+}
+
+// Gets a mocked order without waiting
+func (s *MockedApiService) GetOrderPoll(ctx context.Context, orderID string, lastStatus string, timeout time.Duration) (ordf.ImplResponse, error) {
+	return s.GetOrders(ctx, orderID)
+}
+
+// Gets the status history of an order
+func (s *MockedApiService) GetOrderHistory(ctx context.Context, orderID string) (ordf.ImplResponse, error) {
+	createdAt := time.Date(2021, 5, 22, 21, 0, 0, 0, time.UTC)
+	history := []novellia_database.StatusTransition{
+		novellia_database.StatusTransition{
+			OrderID: orderID,
+			To: "PENDING",
+			Reason: "created from quote QUOTE-01D78XYFJ1PRM1WPBCBT3VHMNV",
+			Actor: "customer",
+			CreatedAt: createdAt,
+		},
+		novellia_database.StatusTransition{
+			OrderID: orderID,
+			From: "PENDING",
+			To: "AWAITING_PAYMENT",
+			Reason: "payment 5077125051 created",
+			Actor: "customer",
+			CreatedAt: createdAt.Add(time.Second),
+		},
+	}
+
+	return ordf.Response(200, history), nil
+}
+
+// Validates and prices an order, returning a signed quote
+func (s *MockedApiService) PostQuotes(ctx context.Context, request orders.OrderRequest) (ordf.ImplResponse, error) {
+	now := time.Now().UTC()
+	quote := quotes.Quote{
+		QuoteID: "QUOTE-01D78XYFJ1PRM1WPBCBT3VHMNV",
+		Items: []quotes.LineItem{
+			quotes.LineItem{
+				ProductID: "PROD-01D78XYFJ1PRM1WPBAOU8JQMNV",
+				Quantity: 4,
+				PriceUnitAmount: 5,
+				PriceAmount: 20,
+			},
+		},
+		PriceCurrencyID: "ada",
+		Breakdown: fees.Breakdown{
+			Subtotal: 20,
+			Fees: []fees.Fee{
+				fees.Fee{
+					Name: "processing",
+					Type: fees.FEE_TYPE_FLAT,
+					Amount: 1,
+				},
+			},
+			MinADADeposit: 2,
+			Total: 23,
+		},
+		PaymentAmount: 22,
+		CreatedAt: now,
+		ExpiresAt: now.Add(10 * time.Minute),
+	}
+	if request.DiscountCode != "" {
+		quote.Discount = &promotions.Discount{
+			Code: request.DiscountCode,
+			Type: promotions.DISCOUNT_TYPE_FLAT,
+			Amount: 2,
+		}
+		quote.Subtotal = 18
+		quote.Total = 21
+		quote.PaymentAmount = 20
+	}
+
+	return ordf.Response(200, orders.QuoteDetails{
+		Quote: quote,
+		PaymentEstimate: &orders.PaymentEstimate{
+			PriceAmount: quote.PaymentAmount,
+			PriceCurrency: "ada",
+			PayCurrency: "ada",
+			MinAmount: 1,
+			EstimatedPayAmount: quote.PaymentAmount,
+		},
+	}), nil
+}
+
+// Lists webhook deliveries that ran out of attempts
+func (s *MockedApiService) GetAdminWebhookDeadLetters(ctx context.Context) (ordf.ImplResponse, error) {
+	deadLetters := []novellia_database.WebhookDeadLetter{
+		novellia_database.WebhookDeadLetter{
+			DeliveryID: "WEBHOOK-01D78XYFJ1PRM1WPBCBT3VHMNV",
+			EndpointName: "storefront",
+			EventType: webhooks.EVENT_ORDER_PAID,
+			OrderID: "ORDER-01D78XYFJ1PRM1WPBCBT3VHMNV",
+			Payload: `{"created_at":"2021-05-22T21:00:00Z","data":{"from":"AWAITING_PAYMENT","order_id":"ORDER-01D78XYFJ1PRM1WPBCBT3VHMNV","reason":"payment finished","to":"PAID"},"id":"EVENT-01D78XYFJ1PRM1WPBCBT3VHMNV","type":"order.paid"}`,
+			Attempts: 10,
+			LastError: "endpoint responded 503: ",
+			CreatedAt: time.Date(2021, 5, 23, 21, 0, 0, 0, time.UTC),
+		},
+	}
+
+	return ordf.Response(200, deadLetters), nil
+}
+
+// Queues a dead-lettered webhook for delivery again
+func (s *MockedApiService) PostAdminWebhookReplay(ctx context.Context, deliveryID string) (ordf.ImplResponse, error) {
+	return ordf.Response(202, nil), nil
+}
+
+// Lists promotion codes
+func (s *MockedApiService) GetAdminPromotions(ctx context.Context) (ordf.ImplResponse, error) {
+	codes := []novellia_database.PromotionCode{
+		novellia_database.PromotionCode{
+			Code: "LAUNCH10",
+			DiscountType: promotions.DISCOUNT_TYPE_PERCENTAGE,
+			DiscountValue: 0.1,
+			MaxUses: 100,
+			MaxUsesPerAddress: 1,
+			ProductIDs: []string{},
+		},
+	}
+
+	return ordf.Response(200, codes), nil
+}
+
+// Creates a promotion code
+func (s *MockedApiService) PostAdminPromotions(ctx context.Context, code novellia_database.PromotionCode) (ordf.ImplResponse, error) {
+	return ordf.Response(201, nil), nil
+}
+
+// Disables a promotion code
+func (s *MockedApiService) PostAdminPromotionDisable(ctx context.Context, code string) (ordf.ImplResponse, error) {
+	return ordf.Response(200, nil), nil
+}
+
+// Applies an operator intervention to an order
+func (s *MockedApiService) PostAdminOrderAction(ctx context.Context, orderID string, action string, request orders.AdminOrderAction) (ordf.ImplResponse, error) {
+	if request.Reason == "" {
+		return ordf.Response(400, nil), orders.ErrReasonRequired
+	}
+	return s.GetOrderHistory(ctx, orderID)
+}
+
+// Reconciles payments against NowPayments
+func (s *MockedApiService) GetAdminReconciliation(ctx context.Context, from time.Time, to time.Time) (ordf.ImplResponse, error) {
+	report := reconciliation.Report{
+		From: from,
+		To: to,
+		GeneratedAt: time.Now().UTC(),
+		PaymentsChecked: 2,
+		Counts: map[string]int{
+			reconciliation.DISCREPANCY_PAID_NOT_FILLED: 1,
+			reconciliation.DISCREPANCY_FILLED_NOT_PAID: 0,
+			reconciliation.DISCREPANCY_AMOUNT_MISMATCH: 0,
+			reconciliation.DISCREPANCY_PAYMENT_WITHOUT_ORDER: 0,
+		},
+		Discrepancies: []reconciliation.Discrepancy{
+			reconciliation.Discrepancy{
+				Type: reconciliation.DISCREPANCY_PAID_NOT_FILLED,
+				OrderID: "ORDER-01D78XYFJ1PRM1WPBCBT3VHMNV",
+				Detail: "payment finished but order is PAID",
+			},
+		},
+	}
+
+	return ordf.Response(200, &report), nil
+}
+
+// Lists sale seeds
+func (s *MockedApiService) GetFairnessSeeds(ctx context.Context) (ordf.ImplResponse, error) {
+	endedAt := time.Date(2021, 5, 30, 21, 0, 0, 0, time.UTC)
+	revealedAt := time.Date(2021, 5, 31, 21, 0, 0, 0, time.UTC)
+	seeds := []novellia_database.SaleSeed{
+		novellia_database.SaleSeed{
+			SaleSeedID: "SEED-01D78XYFJ1PRM1WPBCBT3VHMNW",
+			SeedHash: "9c56cc51b374c3ba189210d5b6d4bf57790d351c96c47c02190ecf1e430635ab",
+			CatalogHash: "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26",
+			Active: true,
+			CreatedAt: endedAt,
+		},
+		novellia_database.SaleSeed{
+			SaleSeedID: "SEED-01D78XYFJ1PRM1WPBCBT3VHMNV",
+			SeedHash: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			CatalogHash: "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26",
+			Seed: "666f6f",
+			CreatedAt: time.Date(2021, 5, 22, 21, 0, 0, 0, time.UTC),
+			EndedAt: &endedAt,
+			RevealedAt: &revealedAt,
+		},
+	}
+
+	return ordf.Response(200, seeds), nil
+}
+
+// Gets the bundle definitions
+func (s *MockedApiService) GetFairnessCatalog(ctx context.Context) (ordf.ImplResponse, error) {
+	catalog := products.Catalog{
+		Pools: map[string][]string{
+			"rare": []string{"PROD-01D78XYFJ1PRM1WPBAOU8JQMNV"},
+			"common": []string{"PROD-01D78XYFJ1PRM1WPBCBT3VHMNV"},
+		},
+		Bundles: []products.Bundle{
+			products.Bundle{
+				ProductID: "PROD-01D78XYFJ1PRM1WPBCBT3VHMNW",
+				Name: "Booster Pack",
+				Size: 1,
+				Slots: []products.BundleSlot{
+					products.BundleSlot{
+						Type: products.SLOT_WEIGHTED,
+						Count: 1,
+						Weights: []products.PoolWeight{
+							products.PoolWeight{Pool: "rare", Weight: 1},
+							products.PoolWeight{Pool: "common", Weight: 99},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return ordf.Response(200, &catalog), nil
+}
+
+// Gets an order's bundle pulls
+func (s *MockedApiService) GetOrderPulls(ctx context.Context, orderID string) (ordf.ImplResponse, error) {
+	replayed := true
+	verified := false
+	pulls := []fairness.PullProof{
+		fairness.PullProof{
+			OrderPull: novellia_database.OrderPull{
+				ItemIndex: 0,
+				ProductID: "PROD-01D78XYFJ1PRM1WPBCBT3VHMNW",
+				SaleSeedID: "SEED-01D78XYFJ1PRM1WPBCBT3VHMNV",
+				UnpackedProductIDs: []string{"PROD-01D78XYFJ1PRM1WPBCBT3VHMNV"},
+				// the rare was sold out
+				Odds: []novellia_database.DrawOdds{
+					novellia_database.DrawOdds{
+						Slot: 0,
+						Pools: []novellia_database.PoolOdds{
+							novellia_database.PoolOdds{
+								Pool: "common",
+								Weight: 99,
+								Products: []string{"PROD-01D78XYFJ1PRM1WPBCBT3VHMNV"},
+							},
+						},
+						ProductID: "PROD-01D78XYFJ1PRM1WPBCBT3VHMNV",
+					},
+				},
+			},
+			Message: fairness.Message(orderID, 0),
+			SeedHash: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			CatalogHash: "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26",
+			Seed: "666f6f",
+			ReducedOdds: true,
+			Replayed: &replayed,
+			Verified: &verified,
+		},
+	}
+
+	return ordf.Response(200, pulls), nil
+}
+
+// Starts a new sale
+func (s *MockedApiService) PostAdminFairnessSeeds(ctx context.Context) (ordf.ImplResponse, error) {
+	seed := novellia_database.SaleSeed{
+		SaleSeedID: "SEED-01D78XYFJ1PRM1WPBCBT3VHMNW",
+		SeedHash: "9c56cc51b374c3ba189210d5b6d4bf57790d351c96c47c02190ecf1e430635ab",
+		CatalogHash: "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26",
+		Active: true,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	return ordf.Response(201, &seed), nil
+}
+
+// Reveals the seed of an ended sale
+func (s *MockedApiService) PostAdminFairnessSeedReveal(ctx context.Context, saleSeedID string) (ordf.ImplResponse, error) {
+	endedAt := time.Date(2021, 5, 30, 21, 0, 0, 0, time.UTC)
+	revealedAt := time.Now().UTC()
+	seed := novellia_database.SaleSeed{
+		SaleSeedID: saleSeedID,
+		SeedHash: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		CatalogHash: "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26",
+		Seed: "666f6f",
+		CreatedAt: time.Date(2021, 5, 22, 21, 0, 0, 0, time.UTC),
+		EndedAt: &endedAt,
+		RevealedAt: &revealedAt,
+	}
+
+	return ordf.Response(200, &seed), nil
+}
+
+// Lists products
+func (s *MockedApiService) GetProductListings(ctx context.Context) (ordf.ImplResponse, error) {
+	listed := time.Date(2021, 5, 22, 21, 0, 0, 0, time.UTC)
+	productListings := []listings.Listing{
+		listings.Listing{
+			ProductID: "PROD-01D78XYFJ1PRM1WPBAOU8JQMNV",
+			PriceUnitAmount: 5,
+			PriceCurrencyID: "ada",
+			MaxOrderSize: 10,
+			DateListed: &listed,
+			DateAvailable: &listed,
+			Available: true,
+			NativeTokenID: "b2a5e2e5b0e0c2c4b6a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9.Rare",
+			Stock: 4,
+		},
+		listings.Listing{
+			ProductID: "PROD-01D78XYFJ1PRM1WPBCBT3VHMNV",
+			PriceUnitAmount: 1,
+			PriceCurrencyID: "ada",
+			MaxOrderSize: 10,
+			DateListed: &listed,
+			DateAvailable: &listed,
+			Available: true,
+			NativeTokenID: "b2a5e2e5b0e0c2c4b6a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9.Common",
+			Stock: 96,
+		},
+		listings.Listing{
+			ProductID: "PROD-01D78XYFJ1PRM1WPBCBT3VHMNW",
+			PriceUnitAmount: 3,
+			PriceCurrencyID: "ada",
+			MaxOrderSize: 5,
+			DateListed: &listed,
+			DateAvailable: &listed,
+			Available: true,
+			Stock: 100,
+			Bundle: &listings.BundleListing{
+				Name: "Booster Pack",
+				Size: 1,
+				Slots: []listings.SlotListing{
+					listings.SlotListing{
+						Type: products.SLOT_WEIGHTED,
+						Count: 1,
+						Products: []listings.ProductOdds{
+							listings.ProductOdds{ProductID: "PROD-01D78XYFJ1PRM1WPBAOU8JQMNV", Pool: "rare", Probability: 0.01},
+							listings.ProductOdds{ProductID: "PROD-01D78XYFJ1PRM1WPBCBT3VHMNV", Pool: "common", Probability: 0.99},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return ordf.Response(200, productListings), nil
+}
+
+// Gets a product's listing
+func (s *MockedApiService) GetProductListing(ctx context.Context, productID string) (ordf.ImplResponse, error) {
+	result, _ := s.GetProductListings(ctx)
+	for _, listing := range result.Body.([]listings.Listing) {
+		if listing.ProductID == productID {
+			return ordf.Response(200, listing), nil
+		}
+	}
+	return ordf.Response(404, nil), listings.ErrListingNotFound
+}
+
+func (s *MockedApiService) ProductListingsCacheTTL() time.Duration {
+	return 15 * time.Second
+}
+
+// Gets the sale phase schedule
+func (s *MockedApiService) GetSalePhases(ctx context.Context) (ordf.ImplResponse, error) {
+	preOrderStart := time.Date(2021, 5, 22, 16, 0, 0, 0, time.UTC)
+	generalStart := time.Date(2021, 5, 22, 21, 0, 0, 0, time.UTC)
+	status := phases.Status{
+		Schedule: phases.Schedule{
+			TimeZone: "America/Los_Angeles",
+			NotDirectlyPurchasable: []string{"PROD-01D78XYFJ1PRM1WPBAOU8JQMNV"},
+			Phases: []phases.Phase{
+				phases.Phase{
+					Name: "pre-order",
+					Start: preOrderStart,
+					End: &generalStart,
+					Products: []string{"PROD-01D78XYFJ1PRM1WPBCBT3VHMNW"},
+					Prices: map[string]float64{"PROD-01D78XYFJ1PRM1WPBCBT3VHMNW": 2.5},
+				},
+				phases.Phase{
+					Name: "general",
+					Start: generalStart,
+					Products: []string{},
+				},
+			},
+		},
+		Current: "general",
+	}
+
+	return ordf.Response(200, status), nil
+}
+
+// Replaces the addresses of an allowlist
+func (s *MockedApiService) PutAdminAllowlist(ctx context.Context, allowlistID string, request eligibility.AllowlistRequest) (ordf.ImplResponse, error) {
+	return ordf.Response(200, eligibility.AllowlistResult{
+		AllowlistID: allowlistID,
+		Addresses: len(request.Addresses),
+	}), nil
+}
+
+// Reloads products and drops cached listings
+func (s *MockedApiService) PostAdminProductCacheInvalidate(ctx context.Context) (ordf.ImplResponse, error) {
+	loadedAt := time.Now()
+	expiresAt := loadedAt.Add(5 * time.Minute)
+	return ordf.Response(200, products.CacheStatus{
+		Products: 3,
+		LoadedAt: &loadedAt,
+		ExpiresAt: &expiresAt,
+	}), nil
+}
+
+// Queues a delivery address for a sold-out product
+func (s *MockedApiService) PostWaitlist(ctx context.Context, request waitlist.JoinRequest) (ordf.ImplResponse, error) {
+	return ordf.Response(200, novellia_database.WaitlistEntry{
+		WaitlistEntryID: "WAITLIST-01F4NAFJCAG5JDEGMR0XQARBW2",
+		ProductID: request.ProductID,
+		NativeTokenID: "policy.token",
+		DeliveryAddress: request.DeliveryAddress,
+		Quantity: request.Quantity,
+		Status: novellia_database.WAITLIST_STATUS_WAITING,
+		CreatedAt: time.Now(),
+		Ahead: 2,
+	}), nil
+}
+
+// Gets a waitlist entry
+func (s *MockedApiService) GetWaitlistEntry(ctx context.Context, waitlistEntryID string) (ordf.ImplResponse, error) {
+	reservedUntil := time.Now().Add(30 * time.Minute)
+	return ordf.Response(200, novellia_database.WaitlistEntry{
+		WaitlistEntryID: waitlistEntryID,
+		ProductID: "PROD-01D78XYFJ1PRM1WPBCBT3VHMNW",
+		NativeTokenID: "policy.token",
+		DeliveryAddress: "addr1",
+		Quantity: 1,
+		Status: novellia_database.WAITLIST_STATUS_RESERVED,
+		ReservedUntil: &reservedUntil,
+		CreatedAt: time.Now().Add(-24 * time.Hour),
+	}), nil
+}
+
 // receives NowPayments IPN callbacks
 func (s *MockedApiService) IPNWebhook(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
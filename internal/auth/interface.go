@@ -0,0 +1,13 @@
+package auth
+
+import (
+	"net/http"
+)
+
+type Service interface {
+	// identifies the caller from an API key or a bearer JWT
+	Authenticate(r *http.Request) (*Identity, error)
+	// rejects callers without at least role, passing the identity to next in the request context
+	// mutating requests are written to the audit log
+	Require(role string, next http.HandlerFunc) http.HandlerFunc
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"math/big"
+	"io/ioutil"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/base64"
+)
+
+const (
+	defaultRoleClaim = "role"
+	// allowed clock difference for exp and nbf
+	jwtLeeway = 30 * time.Second
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// a JSON Web Key Set, only RSA keys are used
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N string `json:"n"`
+		E string `json:"e"`
+	} `json:"keys"`
+}
+
+// verifies HS256 and RS256 tokens, each is rejected if its key is not configured
+type jwtVerifier struct {
+	hs256Secret []byte
+	// kid -> key
+	rsaKeys map[string]*rsa.PublicKey
+	issuer string
+	audience string
+	roleClaim string
+}
+
+func loadJWKS(path string) (map[string]*rsa.PublicKey, error) {
+	keys := map[string]*rsa.PublicKey{}
+	if path == "" {
+		return keys, nil
+	}
+
+	jwksBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS: %v", err)
+	}
+	var set jwks
+	err = json.Unmarshal(jwksBytes, &set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %v", err)
+	}
+
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JWKS key %s modulus: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JWKS key %s exponent: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func newJWTVerifier(hs256Secret string, jwksPath string, issuer string, audience string, roleClaim string) (*jwtVerifier, error) {
+	rsaKeys, err := loadJWKS(jwksPath)
+	if err != nil {
+		return nil, err
+	}
+	if roleClaim == "" {
+		roleClaim = defaultRoleClaim
+	}
+	return &jwtVerifier{
+		hs256Secret: []byte(hs256Secret),
+		rsaKeys: rsaKeys,
+		issuer: issuer,
+		audience: audience,
+		roleClaim: roleClaim,
+	}, nil
+}
+
+func (v *jwtVerifier) rsaKey(kid string) (*rsa.PublicKey, error) {
+	if key, ok := v.rsaKeys[kid]; ok {
+		return key, nil
+	}
+	// tokens without a kid are accepted when there is only one key
+	if kid == "" && len(v.rsaKeys) == 1 {
+		for _, key := range v.rsaKeys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown key %s", ErrUnauthenticated, kid)
+}
+
+func (v *jwtVerifier) verifySignature(header jwtHeader, signingInput string, signature []byte) error {
+	hash := sha256.Sum256([]byte(signingInput))
+	switch header.Alg {
+	case "HS256":
+		if len(v.hs256Secret) == 0 {
+			return fmt.Errorf("%w: HS256 is not enabled", ErrUnauthenticated)
+		}
+		mac := hmac.New(sha256.New, v.hs256Secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+		}
+		return nil
+	case "RS256":
+		key, err := v.rsaKey(header.Kid)
+		if err != nil {
+			return err
+		}
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+		if err != nil {
+			return fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %s", ErrUnauthenticated, header.Alg)
+	}
+}
+
+// aud can be a string or a list of strings
+func hasAudience(claim interface{}, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *jwtVerifier) verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrUnauthenticated)
+	}
+	var header jwtHeader
+	err = json.Unmarshal(headerBytes, &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrUnauthenticated)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrUnauthenticated)
+	}
+	err = v.verifySignature(header, parts[0] + "." + parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claimsBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrUnauthenticated)
+	}
+	claims := map[string]interface{}{}
+	err = json.Unmarshal(claimsBytes, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrUnauthenticated)
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w: token has no expiry", ErrUnauthenticated)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("%w: token expired", ErrUnauthenticated)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("%w: token not valid yet", ErrUnauthenticated)
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, fmt.Errorf("%w: wrong issuer", ErrUnauthenticated)
+	}
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return nil, fmt.Errorf("%w: wrong audience", ErrUnauthenticated)
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrUnauthenticated)
+	}
+	role, _ := claims[v.roleClaim].(string)
+	if _, ok := roleRanks[role]; !ok {
+		return nil, fmt.Errorf("%w: token has unknown role %s", ErrUnauthenticated, role)
+	}
+
+	return &Identity{
+		Subject: subject,
+		Role: role,
+		Method: AUTH_METHOD_JWT,
+	}, nil
+}
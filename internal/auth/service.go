@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"fmt"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"crypto/subtle"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+)
+
+// roles in increasing order of privilege, each can do everything the ones before it can
+const (
+	// reads reports and metrics
+	ROLE_VIEWER = "viewer"
+	// reads promotions and changes delivery addresses
+	ROLE_SUPPORT = "support"
+	// manages promotions and fails or retries orders
+	ROLE_OPERATOR = "operator"
+	// marks orders paid and cancels them with a refund
+	ROLE_ADMIN = "admin"
+)
+
+const (
+	AUTH_METHOD_API_KEY = "api-key"
+	AUTH_METHOD_JWT = "jwt"
+)
+
+const (
+	apiKeyHeader = "X-Api-Key"
+	// name recorded for config admin.api-key
+	legacyAdminKeyName = "admin"
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden = errors.New("forbidden")
+)
+
+var roleRanks = map[string]int{
+	ROLE_VIEWER: 1,
+	ROLE_SUPPORT: 2,
+	ROLE_OPERATOR: 3,
+	ROLE_ADMIN: 4,
+}
+
+// an authenticated caller
+type Identity struct {
+	// API key name or JWT subject
+	Subject string
+	Role string
+	Method string
+}
+
+// checks that an identity has at least a role
+func (i *Identity) HasRole(role string) bool {
+	return roleRanks[i.Role] > 0 && roleRanks[i.Role] >= roleRanks[role]
+}
+
+type contextKey struct{}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(*Identity)
+	return identity, ok && identity != nil
+}
+
+// the subject recorded as the actor of an operation, empty if unauthenticated
+func ActorID(ctx context.Context) string {
+	identity, ok := IdentityFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return identity.Subject
+}
+
+type apiKey struct {
+	name string
+	key string
+	role string
+}
+
+// the parts of novellia_database.Service used to record mutating requests
+type AuditLog interface {
+	InsertAuditLog(ctx context.Context, entry novellia_database.AuditLogEntry) error
+}
+
+type ServiceImpl struct {
+	apiKeys []apiKey
+	jwtVerifier *jwtVerifier
+	// mutating requests are only printed if nil
+	auditLog AuditLog
+}
+
+// creates a new ServiceImpl from auth and admin in the config
+func New(cfg *config.Config, auditLog AuditLog) (*ServiceImpl, error) {
+	s := ServiceImpl{
+		apiKeys: []apiKey{},
+		auditLog: auditLog,
+	}
+
+	if cfg.Admin.APIKey != "" {
+		s.apiKeys = append(s.apiKeys, apiKey{
+			name: legacyAdminKeyName,
+			key: cfg.Admin.APIKey,
+			role: ROLE_ADMIN,
+		})
+	}
+	for _, k := range cfg.Auth.APIKeys {
+		if _, ok := roleRanks[k.Role]; !ok {
+			return nil, fmt.Errorf("API key %s has unknown role: %s", k.Name, k.Role)
+		}
+		if k.Name == "" || k.Key == "" {
+			return nil, fmt.Errorf("API keys require a name and key")
+		}
+		s.apiKeys = append(s.apiKeys, apiKey{
+			name: k.Name,
+			key: k.Key,
+			role: k.Role,
+		})
+	}
+
+	verifier, err := newJWTVerifier(
+		cfg.Auth.JWT.HS256Secret,
+		cfg.Auth.JWT.JWKSPath,
+		cfg.Auth.JWT.Issuer,
+		cfg.Auth.JWT.Audience,
+		cfg.Auth.JWT.RoleClaim,
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.jwtVerifier = verifier
+
+	return &s, nil
+}
+
+func (s *ServiceImpl) authenticateAPIKey(key string) (*Identity, error) {
+	// compare against every key so that timing does not reveal which matched, the first configured match wins
+	var match *apiKey
+	for i := range s.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.apiKeys[i].key)) == 1 && match == nil {
+			match = &s.apiKeys[i]
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("%w: unknown API key", ErrUnauthenticated)
+	}
+	return &Identity{
+		Subject: match.name,
+		Role: match.role,
+		Method: AUTH_METHOD_API_KEY,
+	}, nil
+}
+
+func (s *ServiceImpl) Authenticate(r *http.Request) (*Identity, error) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return s.authenticateAPIKey(key)
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return nil, fmt.Errorf("%w: no credentials", ErrUnauthenticated)
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	// API keys can be sent as bearer tokens for clients that only support those, e.g. Prometheus
+	if strings.Count(token, ".") != 2 {
+		return s.authenticateAPIKey(token)
+	}
+	return s.jwtVerifier.verify(token)
+}
+
+// captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func isMutating(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+}
+
+func (s *ServiceImpl) Require(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, err := s.Authenticate(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !identity.HasRole(role) {
+			fmt.Printf("Forbidden: %s (%s) requires %s for %s %s\n", identity.Subject, identity.Role, role, r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		r = r.WithContext(WithIdentity(r.Context(), identity))
+		if !isMutating(r.Method) {
+			next(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next(recorder, r)
+
+		entry := novellia_database.AuditLogEntry{
+			ActorID: identity.Subject,
+			ActorRole: identity.Role,
+			AuthMethod: identity.Method,
+			RequestMethod: r.Method,
+			RequestPath: r.URL.Path,
+			StatusCode: recorder.statusCode,
+		}
+		fmt.Printf("Audit: %+v\n", entry)
+		if s.auditLog != nil {
+			err = s.auditLog.InsertAuditLog(r.Context(), entry)
+			if err != nil {
+				fmt.Printf("Failed to insert audit log: %+v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package auth_test
+
+import (
+	"fmt"
+	"time"
+	"testing"
+	"context"
+	"math/big"
+	"io/ioutil"
+	"path/filepath"
+	"net/http"
+	"net/http/httptest"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/base64"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/auth"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+)
+
+const (
+	testHS256Secret = "test-secret"
+	testAudience = "order-fulfillment"
+	testKid = "test-key"
+)
+
+type testAuditLog struct {
+	entries []novellia_database.AuditLogEntry
+}
+
+func (l *testAuditLog) InsertAuditLog(ctx context.Context, entry novellia_database.AuditLogEntry) error {
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal JWT segment: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signHS256(t *testing.T, secret string, claims map[string]interface{}) string {
+	signingInput := encodeSegment(t, map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signingInput := encodeSegment(t, map[string]string{"alg": "RS256", "typ": "JWT", "kid": testKid}) + "." + encodeSegment(t, claims)
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("failed to sign JWT: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// writes a JWKS with the public half of key
+func writeJWKS(t *testing.T, key *rsa.PrivateKey) string {
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": testKid,
+				"use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			},
+		},
+	}
+	b, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("failed to marshal JWKS: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err = ioutil.WriteFile(path, b, 0600)
+	if err != nil {
+		t.Fatalf("failed to write JWKS: %v", err)
+	}
+	return path
+}
+
+func newService(t *testing.T, jwksPath string, auditLog auth.AuditLog) *auth.ServiceImpl {
+	cfgYAML := fmt.Sprintf(`
+admin:
+  api-key: legacy-key
+auth:
+  api-keys:
+    - name: grafana
+      key: viewer-key
+      role: viewer
+    - name: ops
+      key: operator-key
+      role: operator
+  jwt:
+    hs256-secret: %s
+    jwks-path: %q
+    audience: %s
+`, testHS256Secret, jwksPath, testAudience)
+	var cfg config.Config
+	err := yaml.Unmarshal([]byte(cfgYAML), &cfg)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+
+	s, err := auth.New(&cfg, auditLog)
+	if err != nil {
+		t.Fatalf("failed to create auth service: %v", err)
+	}
+	return s
+}
+
+func TestAuthenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	s := newService(t, writeJWKS(t, rsaKey), nil)
+
+	now := time.Now()
+	claims := func(role string) map[string]interface{} {
+		return map[string]interface{}{
+			"sub": "alice",
+			"role": role,
+			"aud": []string{"other", testAudience},
+			"exp": now.Add(time.Hour).Unix(),
+		}
+	}
+	expired := claims(auth.ROLE_ADMIN)
+	expired["exp"] = now.Add(-time.Hour).Unix()
+	wrongAudience := claims(auth.ROLE_ADMIN)
+	wrongAudience["aud"] = "other"
+	noExpiry := claims(auth.ROLE_ADMIN)
+	delete(noExpiry, "exp")
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		header string
+		value string
+		subject string
+		role string
+	}{
+		{"legacy admin key", "X-Api-Key", "legacy-key", "admin", auth.ROLE_ADMIN},
+		{"configured key", "X-Api-Key", "viewer-key", "grafana", auth.ROLE_VIEWER},
+		{"key as bearer token", "Authorization", "Bearer operator-key", "ops", auth.ROLE_OPERATOR},
+		{"unknown key", "X-Api-Key", "nope", "", ""},
+		{"no credentials", "", "", "", ""},
+		{"HS256", "Authorization", "Bearer " + signHS256(t, testHS256Secret, claims(auth.ROLE_SUPPORT)), "alice", auth.ROLE_SUPPORT},
+		{"RS256", "Authorization", "Bearer " + signRS256(t, rsaKey, claims(auth.ROLE_ADMIN)), "alice", auth.ROLE_ADMIN},
+		{"HS256 wrong secret", "Authorization", "Bearer " + signHS256(t, "wrong", claims(auth.ROLE_ADMIN)), "", ""},
+		{"RS256 wrong key", "Authorization", "Bearer " + signRS256(t, otherKey, claims(auth.ROLE_ADMIN)), "", ""},
+		{"expired", "Authorization", "Bearer " + signHS256(t, testHS256Secret, expired), "", ""},
+		{"no expiry", "Authorization", "Bearer " + signHS256(t, testHS256Secret, noExpiry), "", ""},
+		{"wrong audience", "Authorization", "Bearer " + signHS256(t, testHS256Secret, wrongAudience), "", ""},
+		{"unknown role", "Authorization", "Bearer " + signHS256(t, testHS256Secret, claims("root")), "", ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/order-fulfillment/v0/admin/promotions", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+
+		identity, err := s.Authenticate(r)
+		if test.subject == "" {
+			if err == nil {
+				t.Errorf("%s: expected authentication to fail, got %+v", test.name, identity)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to authenticate: %v", test.name, err)
+			continue
+		}
+		if identity.Subject != test.subject || identity.Role != test.role {
+			t.Errorf("%s: expected %s (%s), got %s (%s)", test.name, test.subject, test.role, identity.Subject, identity.Role)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	auditLog := &testAuditLog{}
+	s := newService(t, "", auditLog)
+
+	var actorID string
+	handler := s.Require(auth.ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		actorID = auth.ActorID(r.Context())
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	tests := []struct {
+		method string
+		apiKey string
+		statusCode int
+		actorID string
+	}{
+		{http.MethodPost, "", http.StatusUnauthorized, ""},
+		{http.MethodPost, "viewer-key", http.StatusForbidden, ""},
+		{http.MethodPost, "operator-key", http.StatusAccepted, "ops"},
+		{http.MethodPost, "legacy-key", http.StatusAccepted, "admin"},
+		{http.MethodGet, "operator-key", http.StatusAccepted, "ops"},
+	}
+
+	for _, test := range tests {
+		actorID = ""
+		r := httptest.NewRequest(test.method, "/order-fulfillment/v0/admin/promotions", nil)
+		r.Header.Set("X-Api-Key", test.apiKey)
+		w := httptest.NewRecorder()
+
+		handler(w, r)
+		if w.Code != test.statusCode {
+			t.Errorf("%s with %q: expected %d, got %d", test.method, test.apiKey, test.statusCode, w.Code)
+		}
+		if actorID != test.actorID {
+			t.Errorf("%s with %q: expected actor %q, got %q", test.method, test.apiKey, test.actorID, actorID)
+		}
+	}
+
+	// only the authorized POSTs are audited
+	if len(auditLog.entries) != 2 {
+		t.Fatalf("expected 2 audit log entries, got %+v", auditLog.entries)
+	}
+	entry := auditLog.entries[0]
+	if entry.ActorID != "ops" || entry.ActorRole != auth.ROLE_OPERATOR || entry.AuthMethod != auth.AUTH_METHOD_API_KEY || entry.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected audit log entry: %+v", entry)
+	}
+}
@@ -0,0 +1,176 @@
+package address
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cardano addresses as described in CIP-19, only on mainnet
+
+const (
+	bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	mainnetAddressPrefix = "addr"
+	mainnetStakePrefix = "stake"
+	// header types of reward addresses with a key hash or script hash stake credential
+	stakeKeyHeader = 0xe0
+	stakeScriptHeader = 0xf0
+	mainnet = 1
+)
+
+func bech32Polymod(values []byte) uint32 {
+	generator := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk & 0x1ffffff) << 5 ^ uint32(v)
+		for i := 0; i < 5; i += 1 {
+			if (top >> i) & 1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func hrpExpand(hrp string) []byte {
+	values := []byte{}
+	for _, c := range hrp {
+		values = append(values, byte(c >> 5))
+	}
+	values = append(values, 0)
+	for _, c := range hrp {
+		values = append(values, byte(c & 31))
+	}
+	return values
+}
+
+// decodes a bech32 string into its human readable part and data bytes
+// unlike BIP 173 there is no length limit, Cardano addresses are longer than 90 characters
+func decodeBech32(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, fmt.Errorf("bech32 %s mixes case", s)
+	}
+	s = strings.ToLower(s)
+	separator := strings.LastIndex(s, "1")
+	if separator < 1 || separator + 7 > len(s) {
+		return "", nil, fmt.Errorf("bech32 %s has no separator", s)
+	}
+	hrp := s[:separator]
+
+	values := hrpExpand(hrp)
+	data := []byte{}
+	for _, c := range s[separator + 1:] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return "", nil, fmt.Errorf("bech32 %s has invalid character %q", s, c)
+		}
+		data = append(data, byte(v))
+	}
+	if bech32Polymod(append(values, data...)) != 1 {
+		return "", nil, fmt.Errorf("bech32 %s has invalid checksum", s)
+	}
+
+	// regroup the 5 bit values, without the checksum, into bytes
+	decoded := []byte{}
+	acc := uint32(0)
+	bits := uint(0)
+	for _, v := range data[:len(data) - 6] {
+		acc = acc << 5 | uint32(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			decoded = append(decoded, byte(acc >> bits))
+		}
+	}
+	if bits >= 5 || acc & (1 << bits - 1) != 0 {
+		return "", nil, fmt.Errorf("bech32 %s has invalid padding", s)
+	}
+	return hrp, decoded, nil
+}
+
+// decodes a bech32 Shelley mainnet address into its header and credentials
+func Decode(address string) ([]byte, error) {
+	hrp, addressBytes, err := decodeBech32(address)
+	if err != nil {
+		return nil, err
+	}
+	if hrp != mainnetAddressPrefix || len(addressBytes) < 29 || addressBytes[0] & 0x0f != mainnet {
+		return nil, fmt.Errorf("%s is not a mainnet address", address)
+	}
+	return addressBytes, nil
+}
+
+// checks that address is a bech32 Shelley mainnet address
+func Validate(address string) error {
+	_, err := Decode(address)
+	return err
+}
+
+// decodes an address, also returning its payment key hash
+// script addresses have no key to sign with, so they are rejected
+func PaymentKeyHash(address string) ([]byte, []byte, error) {
+	addressBytes, err := Decode(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	// base, pointer and enterprise addresses with a key hash payment part
+	switch addressBytes[0] >> 4 {
+	case 0, 2, 4, 6:
+		return addressBytes, addressBytes[1:29], nil
+	}
+	return nil, nil, fmt.Errorf("%s does not have a key hash payment part", address)
+}
+
+// the stake address of a base address, e.g. stake1u..., empty for addresses without a stake credential
+// pointer addresses only reference their stake credential on chain, so they have none here
+func StakeAddress(address string) (string, error) {
+	addressBytes, err := Decode(address)
+	if err != nil {
+		return "", err
+	}
+	addressType := addressBytes[0] >> 4
+	if addressType > 3 {
+		return "", nil
+	}
+	if len(addressBytes) != 57 {
+		return "", fmt.Errorf("%s is not a base address", address)
+	}
+
+	// base address types 2 and 3 have a script stake credential
+	header := byte(stakeKeyHeader)
+	if addressType & 2 == 2 {
+		header = stakeScriptHeader
+	}
+	return Encode(mainnetStakePrefix, append([]byte{header | mainnet}, addressBytes[29:]...)), nil
+}
+
+// encodes data as bech32 with the human readable part hrp
+func Encode(hrp string, data []byte) string {
+	values := []byte{}
+	acc := uint32(0)
+	bits := uint(0)
+	for _, b := range data {
+		acc = acc << 8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc >> bits) & 31)
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(acc << (5 - bits)) & 31)
+	}
+
+	polymod := bech32Polymod(append(append(hrpExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+	for i := 0; i < 6; i += 1 {
+		values = append(values, byte(polymod >> (5 * (5 - i))) & 31)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteString("1")
+	for _, v := range values {
+		sb.WriteByte(bech32Charset[v])
+	}
+	return sb.String()
+}
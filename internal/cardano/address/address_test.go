@@ -0,0 +1,53 @@
+package address_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano/address"
+)
+
+// test vectors from CIP-19
+const (
+	baseAddress = "addr1qx2fxv2umyhttkxyxp8x0dlpdt3k6cwng5pxj3jhsydzer3n0d3vllmyqwsx5wktcd8cc3sq835lu7drv2xwl2wywfgse35a3x"
+	enterpriseAddress = "addr1vx2fxv2umyhttkxyxp8x0dlpdt3k6cwng5pxj3jhsydzers66hrl8"
+	scriptAddress = "addr1w8phkx6acpnf78fuvxn0mkew3l0fd058hzquvz7w36x4gtcyjy7wx"
+	stakeAddress = "stake1uyehkck0lajq8gr28t9uxnuvgcqrc6070x3k9r8048z8y5gh6ffgw"
+	paymentKeyHash = "9493315cd92eb5d8c4304e67b7e16ae36d61d34502694657811a2c8e"
+)
+
+func TestAddress(t *testing.T) {
+	for _, a := range []string{baseAddress, enterpriseAddress} {
+		_, keyHash, err := address.PaymentKeyHash(a)
+		if err != nil || hex.EncodeToString(keyHash) != paymentKeyHash {
+			t.Errorf("unexpected payment key hash of %s %x: %v", a, keyHash, err)
+		}
+	}
+	_, _, err := address.PaymentKeyHash(scriptAddress)
+	if err == nil {
+		t.Errorf("expected script address to have no payment key hash")
+	}
+
+	stake, err := address.StakeAddress(baseAddress)
+	if err != nil || stake != stakeAddress {
+		t.Errorf("expected stake address %s, got %s: %v", stakeAddress, stake, err)
+	}
+	stake, err = address.StakeAddress(enterpriseAddress)
+	if err != nil || stake != "" {
+		t.Errorf("expected enterprise address to have no stake address, got %s: %v", stake, err)
+	}
+
+	keyHash, _ := hex.DecodeString(paymentKeyHash)
+	testnetAddress := address.Encode("addr_test", append([]byte{0x60}, keyHash...))
+	invalid := []string{testnetAddress, stakeAddress, baseAddress[:len(baseAddress) - 1] + "q", "addr1"}
+	for _, a := range invalid {
+		if address.Validate(a) == nil {
+			t.Errorf("expected %s to be invalid", a)
+		}
+	}
+
+	addressBytes, err := address.Decode(enterpriseAddress)
+	if err != nil || address.Encode("addr", addressBytes) != enterpriseAddress {
+		t.Errorf("expected %s to round trip, got %x: %v", enterpriseAddress, addressBytes, err)
+	}
+}
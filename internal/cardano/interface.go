@@ -5,13 +5,19 @@ import (
 	"math/big"
 
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
 )
 
 type Service interface {
-	NativeTokensFromOrder(ctx context.Context, order *ordf.Order) (map[string]*big.Int, error)
+	// unpacks an order's bundles with draws derived from seed, returning its native tokens and the pulls to record with them
+	// draws skip products with no unreserved stock left and the odds they were made with are recorded in the pulls
+	// a nil seed draws from a shared source without checking stock and returns no pulls, for estimates
+	NativeTokensFromOrder(ctx context.Context, order *ordf.Order, seed *novellia_database.SaleSeed) (map[string]*big.Int, []novellia_database.OrderPull, error)
+	// every native token an order could be unpacked into and the number of units it unpacks into, for pricing before the draw
+	PossibleNativeTokens(ctx context.Context, order *ordf.Order) ([]string, int, error)
 	GetUTXOs(address string, filenameSalt string) (*UTXOs, error)
 	GetTTL() (*big.Int, error)
-	WriteRawTX(deliveryAddress string, nativeTokens map[string]*big.Int, utxos *UTXOs, txRawPathOut string, feeLovelace *big.Int, ttl *big.Int) (int, int, error)
+	WriteRawTX(deliveryAddress string, nativeTokens map[string]*big.Int, utxos *UTXOs, txRawPathOut string, feeLovelace *big.Int, ttl *big.Int, depositLovelace *big.Int) (int, int, error)
 	GetFee(txRawPath string, txInCount, txOutCount int) (*big.Int, error)
 	SignTX(txRawPath string, txSignedOutPath string) error
 	SubmitTX(txSignedPath string) error
@@ -21,4 +27,6 @@ type Service interface {
 	ValidateAddress(address string) (error)
 	GetStock(addresses []string) (map[string]*big.Int, error)
 	HotWalletAddress() string
+	// native tokens in the hot wallet less those reserved by orders and the minimum kept in the wallet, clipped to 0
+	GetUnreservedStock(ctx context.Context) (map[string]*big.Int, error)
 }
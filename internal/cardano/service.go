@@ -16,7 +16,9 @@ import (
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fairness"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/constants"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
 	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
 )
@@ -38,6 +40,7 @@ type UTXOs struct {
 type ServiceImpl struct {
 	novelliaDatabaseService novellia_database.Service
 	productsService products.Service
+	feesService fees.Service
 	hotWalletSigningKeyPath string
 	hotWalletAddress string
 	scriptsPath string
@@ -46,7 +49,7 @@ type ServiceImpl struct {
 }
 
 // creates a new ServiceImpl
-func New(novelliaDatabaseService novellia_database.Service, productsService products.Service) (*ServiceImpl, error) {
+func New(novelliaDatabaseService novellia_database.Service, productsService products.Service, feesService fees.Service) (*ServiceImpl, error) {
 	cfg, err := config.GetConfig()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get config from env")
@@ -55,6 +58,7 @@ func New(novelliaDatabaseService novellia_database.Service, productsService prod
 	return &ServiceImpl {
 		novelliaDatabaseService: novelliaDatabaseService,
 		productsService: productsService,
+		feesService: feesService,
 		hotWalletSigningKeyPath: cfg.Cardano.HotWalletSigningKeyPath,
 		hotWalletAddress: cfg.Cardano.HotWalletAddress,
 		scriptsPath: cfg.Cardano.ScriptsPath,
@@ -63,30 +67,59 @@ func New(novelliaDatabaseService novellia_database.Service, productsService prod
 	}, nil
 }
 
-func (s *ServiceImpl) NativeTokensFromOrder(ctx context.Context, order *ordf.Order) (map[string]*big.Int, error) {
+func (s *ServiceImpl) NativeTokensFromOrder(ctx context.Context, order *ordf.Order, seed *novellia_database.SaleSeed) (map[string]*big.Int, []novellia_database.OrderPull, error) {
 		// get products list
-		products, err := s.productsService.GetProducts(ctx)
+		productsByID, err := s.productsService.GetProducts(ctx)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+
+		var seedBytes []byte
+		var stock products.Stock
+		if seed != nil {
+			seedBytes, err = fairness.DecodeSeed(seed.Seed)
+			if err != nil {
+				return nil, nil, err
+			}
+			stock, err = s.productStock(ctx, productsByID)
+			if err != nil {
+				return nil, nil, err
+			}
 		}
 
 		// generate native token list
 		tokenQuantities := map[string]*big.Int{}
+		pulls := []novellia_database.OrderPull{}
+		itemIndex := 0
 		for _, item := range order.Items {
 			for i := 0; i < int(item.Quantity); i++ {
 				// unpack bundle
-				// we iterate for each quantity so that random functions for bundles produce different outcomes
-				unpackedProductIDs, err := s.productsService.UnpackBundleProduct(item.ProductId)
+				// we iterate for each quantity so that each unit is drawn from its own stream
+				var r products.Rand
+				if seed != nil {
+					r = fairness.NewRand(seedBytes, order.OrderId, itemIndex)
+				}
+				unpackedProductIDs, odds, err := s.productsService.UnpackBundleProduct(item.ProductId, r, stock)
 				if err != nil {
-					return nil, fmt.Errorf("failed to unpack productID %s: %+v", item.ProductId, err)
+					return nil, nil, fmt.Errorf("failed to unpack productID %s: %w", item.ProductId, err)
+				}
+				if seed != nil && s.productsService.GetCatalog().Bundle(item.ProductId) != nil {
+					pulls = append(pulls, novellia_database.OrderPull{
+						ItemIndex: itemIndex,
+						ProductID: item.ProductId,
+						SaleSeedID: seed.SaleSeedID,
+						UnpackedProductIDs: unpackedProductIDs,
+						Odds: odds,
+					})
 				}
+				itemIndex += 1
 	
 				for j := 0; j < len(unpackedProductIDs); j++ {
 					var nativeTokenID string
-					if _, ok := products[unpackedProductIDs[j]]; ok {
-						nativeTokenID = products[unpackedProductIDs[j]].NativeTokenID
+					if _, ok := productsByID[unpackedProductIDs[j]]; ok {
+						nativeTokenID = productsByID[unpackedProductIDs[j]].NativeTokenID
 					} else {
-						return nil, fmt.Errorf("invalid product ID from unpack %s not found", unpackedProductIDs[j])
+						return nil, nil, fmt.Errorf("invalid product ID from unpack %s not found", unpackedProductIDs[j])
 					}
 					if _, ok := tokenQuantities[nativeTokenID]; !ok {
 						tokenQuantities[nativeTokenID] = big.NewInt(0)
@@ -96,7 +129,45 @@ func (s *ServiceImpl) NativeTokensFromOrder(ctx context.Context, order *ordf.Ord
 			}	
 		}
 
-		return tokenQuantities, nil
+		return tokenQuantities, pulls, nil
+}
+
+func (s *ServiceImpl) PossibleNativeTokens(ctx context.Context, order *ordf.Order) ([]string, int, error) {
+	productsByID, err := s.productsService.GetProducts(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nativeTokenIDs := []string{}
+	units := 0
+	for _, item := range order.Items {
+		contents, size := s.productsService.GetCatalog().Contents(item.ProductId)
+		for _, productID := range contents {
+			product, ok := productsByID[productID]
+			if !ok {
+				return nil, 0, fmt.Errorf("invalid product ID %s in %s not found", productID, item.ProductId)
+			}
+			nativeTokenIDs = append(nativeTokenIDs, product.NativeTokenID)
+		}
+		units += size * int(item.Quantity)
+	}
+	return nativeTokenIDs, units, nil
+}
+
+// units of each product left to draw, from the unreserved stock of its native token
+func (s *ServiceImpl) productStock(ctx context.Context, productsByID map[string]novellia_database.Product) (products.Stock, error) {
+	unreserved, err := s.GetUnreservedStock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unreserved stock: %v", err)
+	}
+
+	stock := products.Stock{}
+	for productID, product := range productsByID {
+		if quantity, ok := unreserved[product.NativeTokenID]; ok && quantity.IsInt64() {
+			stock[productID] = quantity.Int64()
+		}
+	}
+	return stock, nil
 }
 
 func (s *ServiceImpl) GetUTXOs(address string, filenameSalt string) (*UTXOs, error) {
@@ -220,9 +291,9 @@ func (s *ServiceImpl) processUTXO(utxo UTXO, currentTokens map[string]*big.Int,
 	return txIn, txOut
 }
 
-func (s *ServiceImpl) WriteRawTX(deliveryAddress string, nativeTokens map[string]*big.Int, utxos *UTXOs, txRawPathOut string, feeLovelace *big.Int, ttl *big.Int) (int, int, error) {	
+func (s *ServiceImpl) WriteRawTX(deliveryAddress string, nativeTokens map[string]*big.Int, utxos *UTXOs, txRawPathOut string, feeLovelace *big.Int, ttl *big.Int, depositLovelace *big.Int) (int, int, error) {	
 	// add min-ada, we will manually subtract the fee from this
-	minLovelace := big.NewInt(constants.MinADA * 1000000)
+	minLovelace := big.NewInt(0).Set(depositLovelace)
 	nativeTokens["lovelace"] = minLovelace
 
 	currentTokensIn := map[string]*big.Int{}
@@ -361,12 +432,43 @@ func (s *ServiceImpl) GetTXID(txSignedPath string) (string, error) {
 	return string(out), nil
 }
 
+// gets the min-ada deposit paid with an order, which is sent back with the native tokens
+func (s *ServiceImpl) depositLovelace(ctx context.Context, orderID string, tokenQuantities map[string]*big.Int) (*big.Int, error) {
+	nativeTokenIDs := []string{}
+	for nativeTokenID := range tokenQuantities {
+		nativeTokenIDs = append(nativeTokenIDs, nativeTokenID)
+	}
+	minLovelace := big.NewInt(s.feesService.MinLovelace(nativeTokenIDs))
+
+	orderFees, err := s.novelliaDatabaseService.QueryOrderFees(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	// orders placed before the fee breakdown was recorded integrated the deposit into their prices
+	if len(orderFees) == 0 {
+		return big.NewInt(constants.LegacyMinADALovelace), nil
+	}
+
+	deposit := fees.BreakdownFromOrderFees(0, orderFees).MinADADeposit
+	depositLovelace, _ := big.NewFloat(deposit * 1000000).Int(nil)
+	if depositLovelace.Cmp(minLovelace) == -1 {
+		return nil, fmt.Errorf("deposit paid for order %s is less than min-ada, %d < %d", orderID, depositLovelace, minLovelace)
+	}
+
+	return depositLovelace, nil
+}
+
 func (s *ServiceImpl) SubmitOrder(ctx context.Context, order *ordf.Order) (string, error) {
 	tokenQuantities, err := s.novelliaDatabaseService.QueryOrderNativeTokens(ctx, order.OrderId)
 	if err != nil {
 		return "", err
 	}
 
+	depositLovelace, err := s.depositLovelace(ctx, order.OrderId, tokenQuantities)
+	if err != nil {
+		return "", err
+	}
+
 	ttl, err := s.GetTTL()
 	if err != nil {
 		return "", err
@@ -377,7 +479,7 @@ func (s *ServiceImpl) SubmitOrder(ctx context.Context, order *ordf.Order) (strin
 		return "", err
 	}
 	txRawPath := fmt.Sprintf("tx_%s.raw", order.OrderId)
-	txInCount, txOutCount, err := s.WriteRawTX(order.Customer.DeliveryAddress, tokenQuantities, utxos, txRawPath, big.NewInt(0), ttl)
+	txInCount, txOutCount, err := s.WriteRawTX(order.Customer.DeliveryAddress, tokenQuantities, utxos, txRawPath, big.NewInt(0), ttl, depositLovelace)
 	if err != nil {
 		return "", err
 	}
@@ -392,7 +494,7 @@ func (s *ServiceImpl) SubmitOrder(ctx context.Context, order *ordf.Order) (strin
 	if err != nil {
 		return "", err
 	}
-	_, _, err = s.WriteRawTX(order.Customer.DeliveryAddress, tokenQuantities, utxos, txRawPath, fee, ttl)
+	_, _, err = s.WriteRawTX(order.Customer.DeliveryAddress, tokenQuantities, utxos, txRawPath, fee, ttl, depositLovelace)
 	if err != nil {
 		return "", err
 	}
@@ -434,6 +536,37 @@ func (s *ServiceImpl) ValidateAddress(address string) (error) {
 	return nil
 }
 
+func (s *ServiceImpl) GetUnreservedStock(ctx context.Context) (map[string]*big.Int, error) {
+	reservedTokens, err := s.novelliaDatabaseService.QueryReservedNativeTokens(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reserved native tokens: %v", err)
+	}
+
+	availableTokens, err := s.GetStock([]string{s.HotWalletAddress()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query available (wallet) native tokens: %v", err)
+	}
+
+	unreserved := map[string]*big.Int{}
+	for nativeTokenID, available := range availableTokens {
+		amountReserved := big.NewInt(0)
+		if _, ok := reservedTokens[nativeTokenID]; ok {
+			amountReserved = reservedTokens[nativeTokenID]
+		}
+
+		// available - reserved - min-leftover in hot wallet
+		adjustedStockAvailable := big.NewInt(0).Sub(available, amountReserved)
+		adjustedStockAvailable = big.NewInt(0).Sub(adjustedStockAvailable, big.NewInt(constants.MinUnreservedStockPerNativeToken))
+		// if stock leftover is negative, clip to 0
+		if adjustedStockAvailable.Cmp(big.NewInt(0)) == -1 {
+			adjustedStockAvailable = big.NewInt(0)
+		}
+		unreserved[nativeTokenID] = adjustedStockAvailable
+	}
+
+	return unreserved, nil
+}
+
 func (s *ServiceImpl) GetStock(addresses []string) (map[string]*big.Int, error) {
 	tokens := map[string]*big.Int{}
 	for _, address := range addresses {
@@ -10,6 +10,7 @@ import (
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
 )
 
@@ -39,8 +40,15 @@ func setupTest(ctx context.Context) (novellia_database.Service, products.Service
 		return nil, nil, nil, err
 	}
 
-	productsService := products.New(novelliaDatabaseService)
-	cardanoService, err := cardano.New(novelliaDatabaseService, productsService)
+	productsService, err := products.NewFromConfig(config, novelliaDatabaseService)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	feesService, err := fees.NewFromConfig(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cardanoService, err := cardano.New(novelliaDatabaseService, productsService, feesService)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -71,12 +79,12 @@ func TestNativeTokensFromOrder(t *testing.T) {
 		Description: "Test Order",
 	}
 
-	n, err := cardanoService.NativeTokensFromOrder(ctx, &order)
+	n, _, err := cardanoService.NativeTokensFromOrder(ctx, &order, nil)
 	if err != nil {
 		t.Errorf("failed to get native tokens from order: %+v", err)
 	}
 	
-	starterDeckCards, err := productsService.UnpackBundleProduct("PROD-01F4NAFJCAG5JDEGMR0XQARBW2")
+	starterDeckCards, _, err := productsService.UnpackBundleProduct("PROD-01F4NAFJCAG5JDEGMR0XQARBW2", nil, nil)
 	if err != nil {
 		t.Errorf("failed to unpack starter deck: %+v", err)
 	}
@@ -154,7 +162,7 @@ func TestWriteRawTX(t *testing.T) {
 		Description: "Test Order",
 	}
 
-	tokenQuantities, err := cardanoService.NativeTokensFromOrder(ctx, &order)
+	tokenQuantities, _, err := cardanoService.NativeTokensFromOrder(ctx, &order, nil)
 	if err != nil {
 		t.Errorf("failed to get native tokens from order: %v", err)
 	}
@@ -169,7 +177,7 @@ func TestWriteRawTX(t *testing.T) {
 		t.Errorf("failed to get UTXOs: %v", err)
 	}
 	txRawPath := fmt.Sprintf("tx_%s.raw", order.OrderId)
-	txInCount, txOutCount, err := cardanoService.WriteRawTX(order.Customer.DeliveryAddress, tokenQuantities, utxos, txRawPath, big.NewInt(0), ttl)
+	txInCount, txOutCount, err := cardanoService.WriteRawTX(order.Customer.DeliveryAddress, tokenQuantities, utxos, txRawPath, big.NewInt(0), ttl, big.NewInt(2000000))
 	if err != nil {
 		t.Errorf("failed to write raw TX without fee: %v", err)
 	}
@@ -184,7 +192,7 @@ func TestWriteRawTX(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to get UTXOs: %v", err)
 	}
-	_, _, err = cardanoService.WriteRawTX(order.Customer.DeliveryAddress, tokenQuantities, utxos, txRawPath, fee, ttl)
+	_, _, err = cardanoService.WriteRawTX(order.Customer.DeliveryAddress, tokenQuantities, utxos, txRawPath, fee, ttl, big.NewInt(2000000))
 	if err != nil {
 		t.Errorf("failed to write raw TX with fee: %v", err)
 	}
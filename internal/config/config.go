@@ -30,6 +30,26 @@ type Config struct {
 		IsSandbox bool `yaml:"is-sandbox"`
 		IPNSecretKey string `yaml:"ipn-secret-key"`
 		IPNCallbackURL string `yaml:"ipn-callback-url"`
+		// overrides the NowPayments API URL, e.g. to point at the emulator
+		BaseURL string `yaml:"base-url"`
+		// runs the NowPayments emulator in-process instead of calling NowPayments
+		Emulated bool `yaml:"emulated"`
+		// states emulated payments move through after being created
+		EmulatorScript []struct {
+			Status string `yaml:"status"`
+			AfterSeconds int `yaml:"after-seconds"`
+			// fraction of pay_amount actually paid once in this state
+			PaidFraction float64 `yaml:"paid-fraction"`
+		} `yaml:"emulator-script"`
+		// defaults are used for zero values
+		TimeoutSeconds int `yaml:"timeout-seconds"`
+		MaxRetries int `yaml:"max-retries"`
+		RetryBaseDelayMilliseconds int `yaml:"retry-base-delay-ms"`
+		// how long minimum amounts and estimates are cached for
+		CacheTTLSeconds int `yaml:"cache-ttl-seconds"`
+		// dashboard login, required to list payments for reconciliation
+		Email string `yaml:"email"`
+		Password string `yaml:"password"`
 	} `yaml:"now-payments"`
 	Cardano struct {
 		HotWalletSigningKeyPath string `yaml:"hot-wallet-signing-key-path"`
@@ -37,6 +57,113 @@ type Config struct {
 		ScriptsPath string `yaml:"scripts-path"`
 		ProtocolParamsPath string `yaml:"protocol-params-path"`
 	} `yaml:"cardano"`
+	Products struct {
+		// YAML defining how bundle products are unpacked, see config/catalog.yaml
+		CatalogPath string `yaml:"catalog-path"`
+		// how long products are cached when no change is notified, defaults to 300
+		CacheTTLSeconds int `yaml:"cache-ttl-seconds"`
+		// how long GET /products responses are cached, defaults to 15
+		ListingCacheTTLSeconds int `yaml:"listing-cache-ttl-seconds"`
+	} `yaml:"products"`
+	Sales struct {
+		// YAML scheduling sale phases, see config/sale_phases.yaml, unset means products are sold whenever they are available
+		PhasesPath string `yaml:"phases-path"`
+	} `yaml:"sales"`
+	Waitlist struct {
+		// how long stock is held for a waitlisted customer to order, defaults to 30
+		ReservationMinutes int `yaml:"reservation-minutes"`
+		// how often freed stock is reserved for waiting customers, defaults to 60
+		CheckIntervalSeconds int `yaml:"check-interval-seconds"`
+	} `yaml:"waitlist"`
+	Quotes struct {
+		SigningKey string `yaml:"signing-key"`
+		TTLSeconds int `yaml:"ttl-seconds"`
+	} `yaml:"quotes"`
+	Fees struct {
+		Rules []struct {
+			Name string `yaml:"name"`
+			// "percentage" or "flat"
+			Type string `yaml:"type"`
+			Rate float64 `yaml:"rate"`
+			Amount float64 `yaml:"amount"`
+		} `yaml:"rules"`
+		// processing fees are waived during these windows, times are RFC3339
+		PromoWindows []struct {
+			Name string `yaml:"name"`
+			Start string `yaml:"start"`
+			End string `yaml:"end"`
+		} `yaml:"promo-windows"`
+		// minUTxOValue protocol parameter
+		MinUTxOLovelace int64 `yaml:"min-utxo-lovelace"`
+	} `yaml:"fees"`
+	Reconciliation struct {
+		// the reconciliation job is disabled if either is 0, GET /admin/reconciliation is always available
+		IntervalMinutes int `yaml:"interval-minutes"`
+		// how far back each run looks
+		LookbackHours int `yaml:"lookback-hours"`
+	} `yaml:"reconciliation"`
+	Admin struct {
+		// API key with the admin role, kept for existing deployments, see auth.api-keys
+		APIKey string `yaml:"api-key"`
+	} `yaml:"admin"`
+	Auth struct {
+		// sent in the X-Api-Key header or as a bearer token
+		APIKeys []struct {
+			// recorded as the actor
+			Name string `yaml:"name"`
+			Key string `yaml:"key"`
+			// viewer, support, operator or admin
+			Role string `yaml:"role"`
+		} `yaml:"api-keys"`
+		// bearer tokens, each algorithm is disabled if its key is not set
+		JWT struct {
+			HS256Secret string `yaml:"hs256-secret"`
+			// JSON Web Key Set with the RS256 public keys
+			JWKSPath string `yaml:"jwks-path"`
+			// checked when set
+			Issuer string `yaml:"issuer"`
+			Audience string `yaml:"audience"`
+			// claim holding the role, defaults to "role"
+			RoleClaim string `yaml:"role-claim"`
+		} `yaml:"jwt"`
+		// requires the viewer role for /metrics
+		ProtectMetrics bool `yaml:"protect-metrics"`
+	} `yaml:"auth"`
+	Webhooks struct {
+		// each endpoint receives the events it lists, or every event if it lists none
+		Endpoints []struct {
+			Name string `yaml:"name"`
+			URL string `yaml:"url"`
+			// signs payloads in the X-Novellia-Sig header
+			Secret string `yaml:"secret"`
+			// order.created, order.paid, order.submitted, order.failed or order.refunded
+			Events []string `yaml:"events"`
+		} `yaml:"endpoints"`
+		// defaults are used for zero values
+		MaxAttempts int `yaml:"max-attempts"`
+		RetryBaseDelaySeconds int `yaml:"retry-base-delay-seconds"`
+		TimeoutSeconds int `yaml:"timeout-seconds"`
+	} `yaml:"webhooks"`
+	Notifications struct {
+		// directory with payment_received.tmpl, tokens_sent.tmpl and refund_issued.tmpl
+		TemplatesPath string `yaml:"templates-path"`
+		// transaction IDs are appended to this for links in tokens_sent
+		ExplorerTxURL string `yaml:"explorer-tx-url"`
+		// email is disabled if host is not set
+		SMTP struct {
+			Host string `yaml:"host"`
+			Port int `yaml:"port"`
+			Username string `yaml:"username"`
+			Password string `yaml:"password"`
+			From string `yaml:"from"`
+			// runs an in-memory SMTP sink on host:port instead of sending email, for local runs
+			Sink bool `yaml:"sink"`
+		} `yaml:"smtp"`
+		// defaults are used for zero values
+		MaxAttempts int `yaml:"max-attempts"`
+		RetryBaseDelaySeconds int `yaml:"retry-base-delay-seconds"`
+		TimeoutSeconds int `yaml:"timeout-seconds"`
+	} `yaml:"notifications"`
 	Mocked bool `yaml:"mocked"`
 }
 
@@ -2,8 +2,8 @@ package constants
 
 const (
 	ISO8601DateFormat = "2006-01-02T15:04:05-0700"
-	MinADA = 4
-	OrderFee = 1
 	TTLOffset = 10000
+	// min-ada that prices included before fees were charged on top of them, sent back with orders that have no fee breakdown
+	LegacyMinADALovelace = 4000000
 	MinUnreservedStockPerNativeToken = 20
 )
@@ -0,0 +1,163 @@
+package eligibility
+
+import (
+	"fmt"
+	"encoding/binary"
+)
+
+// just enough CBOR (RFC 8949) to read CIP-30 COSE_Sign1 and COSE_Key structures
+// maps decode to map[interface{}]interface{} keyed by int64 or string, integers to int64, tags are dropped
+
+const (
+	cborUint = 0
+	cborNegInt = 1
+	cborBytes = 2
+	cborText = 3
+	cborArray = 4
+	cborMap = 5
+	cborTag = 6
+	cborSimple = 7
+	// nesting allowed before the input is rejected
+	cborMaxDepth = 16
+)
+
+func cborHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, fmt.Errorf("unexpected end of CBOR")
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return 0, 0, nil, fmt.Errorf("unexpected end of CBOR")
+		}
+		var n uint64
+		for _, b := range data[:size] {
+			n = n << 8 | uint64(b)
+		}
+		return major, n, data[size:], nil
+	default:
+		return 0, 0, nil, fmt.Errorf("unsupported CBOR additional info %d", info)
+	}
+}
+
+func cborDecode(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, fmt.Errorf("CBOR nested too deeply")
+	}
+	major, n, rest, err := cborHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case cborUint, cborNegInt:
+		if n > 1 << 63 - 1 {
+			return nil, nil, fmt.Errorf("CBOR integer out of range")
+		}
+		if major == cborNegInt {
+			return -1 - int64(n), rest, nil
+		}
+		return int64(n), rest, nil
+	case cborBytes, cborText:
+		if uint64(len(rest)) < n {
+			return nil, nil, fmt.Errorf("unexpected end of CBOR")
+		}
+		if major == cborText {
+			return string(rest[:n]), rest[n:], nil
+		}
+		return rest[:n], rest[n:], nil
+	case cborArray:
+		// every item takes at least a byte
+		if uint64(len(rest)) < n {
+			return nil, nil, fmt.Errorf("unexpected end of CBOR")
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], rest, err = cborDecode(rest, depth + 1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, rest, nil
+	case cborMap:
+		if uint64(len(rest)) < 2 * n {
+			return nil, nil, fmt.Errorf("unexpected end of CBOR")
+		}
+		m := map[interface{}]interface{}{}
+		for i := uint64(0); i < n; i += 1 {
+			var key, value interface{}
+			key, rest, err = cborDecode(rest, depth + 1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("unsupported CBOR map key %T", key)
+			}
+			value, rest, err = cborDecode(rest, depth + 1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+	case cborTag:
+		return cborDecode(rest, depth + 1)
+	default:
+		switch n {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22:
+			return nil, rest, nil
+		}
+		return nil, nil, fmt.Errorf("unsupported CBOR simple value %d", n)
+	}
+}
+
+// decodes a single CBOR item, rejecting trailing bytes
+func cborUnmarshal(data []byte) (interface{}, error) {
+	value, rest, err := cborDecode(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after CBOR item", len(rest))
+	}
+	return value, nil
+}
+
+func cborAppendHead(out []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(out, major << 5 | byte(n))
+	case n <= 0xff:
+		return append(out, major << 5 | 24, byte(n))
+	case n <= 0xffff:
+		return append(append(out, major << 5 | 25), byte(n >> 8), byte(n))
+	case n <= 0xffffffff:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(n))
+		return append(append(out, major << 5 | 26), b...)
+	default:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, n)
+		return append(append(out, major << 5 | 27), b...)
+	}
+}
+
+func cborAppendBytes(out []byte, b []byte) []byte {
+	return append(cborAppendHead(out, cborBytes, uint64(len(b))), b...)
+}
+
+func cborAppendText(out []byte, s string) []byte {
+	return append(cborAppendHead(out, cborText, uint64(len(s))), s...)
+}
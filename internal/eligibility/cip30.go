@@ -0,0 +1,144 @@
+package eligibility
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/blake2b"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano/address"
+)
+
+const (
+	// the message a wallet signs with CIP-30 signData, followed by the order's delivery address
+	proofMessagePrefix = "order-fulfillment eligibility: "
+	// COSE algorithm EdDSA, key type OKP and curve Ed25519
+	coseAlgEdDSA = -8
+	coseKeyTypeOKP = 1
+	coseCurveEd25519 = 6
+)
+
+var (
+	ErrInvalidProof = errors.New("invalid eligibility proof")
+)
+
+// a CIP-30 signData result proving control of a wallet address other than the delivery address
+type WalletProof struct {
+	// bech32 address passed to signData
+	Address string `json:"address"`
+	// hex COSE_Sign1
+	Signature string `json:"signature"`
+	// hex COSE_Key
+	Key string `json:"key"`
+}
+
+// the payload a wallet must sign, hex encoded, to prove eligibility for an order to deliveryAddress
+func ProofMessage(deliveryAddress string) string {
+	return proofMessagePrefix + deliveryAddress
+}
+
+// the hash Cardano uses for key hashes
+func blake2b224(b []byte) []byte {
+	hash, err := blake2b.New(28, nil)
+	if err != nil {
+		panic(err)
+	}
+	hash.Write(b)
+	return hash.Sum(nil)
+}
+
+func coseBytes(m map[interface{}]interface{}, key interface{}) []byte {
+	b, _ := m[key].([]byte)
+	return b
+}
+
+func coseInt(m map[interface{}]interface{}, key interface{}) (int64, bool) {
+	v, ok := m[key].(int64)
+	return v, ok
+}
+
+// verifies a CIP-30 signData proof of proof.Address over ProofMessage(deliveryAddress)
+func VerifyProof(proof WalletProof, deliveryAddress string) error {
+	addressBytes, keyHash, err := address.PaymentKeyHash(proof.Address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+
+	keyCBOR, err := hex.DecodeString(proof.Key)
+	if err != nil {
+		return fmt.Errorf("%w: key is not hex", ErrInvalidProof)
+	}
+	decoded, err := cborUnmarshal(keyCBOR)
+	if err != nil {
+		return fmt.Errorf("%w: key: %v", ErrInvalidProof, err)
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("%w: key is not a COSE_Key", ErrInvalidProof)
+	}
+	kty, _ := coseInt(key, int64(1))
+	crv, _ := coseInt(key, int64(-1))
+	publicKey := coseBytes(key, int64(-2))
+	if kty != coseKeyTypeOKP || crv != coseCurveEd25519 || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: key is not an Ed25519 public key", ErrInvalidProof)
+	}
+	if !bytes.Equal(blake2b224(publicKey), keyHash) {
+		return fmt.Errorf("%w: key does not belong to %s", ErrInvalidProof, proof.Address)
+	}
+
+	signatureCBOR, err := hex.DecodeString(proof.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: signature is not hex", ErrInvalidProof)
+	}
+	decoded, err = cborUnmarshal(signatureCBOR)
+	if err != nil {
+		return fmt.Errorf("%w: signature: %v", ErrInvalidProof, err)
+	}
+	sign1, ok := decoded.([]interface{})
+	if !ok || len(sign1) != 4 {
+		return fmt.Errorf("%w: signature is not a COSE_Sign1", ErrInvalidProof)
+	}
+	protectedCBOR, ok1 := sign1[0].([]byte)
+	unprotected, ok2 := sign1[1].(map[interface{}]interface{})
+	payload, ok3 := sign1[2].([]byte)
+	signature, ok4 := sign1[3].([]byte)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return fmt.Errorf("%w: signature is not a COSE_Sign1 with a payload", ErrInvalidProof)
+	}
+	decoded, err = cborUnmarshal(protectedCBOR)
+	if err != nil {
+		return fmt.Errorf("%w: protected header: %v", ErrInvalidProof, err)
+	}
+	protected, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("%w: protected header is not a map", ErrInvalidProof)
+	}
+	if alg, _ := coseInt(protected, int64(1)); alg != coseAlgEdDSA {
+		return fmt.Errorf("%w: signature is not EdDSA", ErrInvalidProof)
+	}
+	if !bytes.Equal(coseBytes(protected, "address"), addressBytes) {
+		return fmt.Errorf("%w: signature was not made for %s", ErrInvalidProof, proof.Address)
+	}
+
+	message := []byte(ProofMessage(deliveryAddress))
+	// wallets may sign a hash of long payloads instead
+	if hashed, _ := unprotected["hashed"].(bool); hashed {
+		message = blake2b224(message)
+	}
+	if !bytes.Equal(payload, message) {
+		return fmt.Errorf("%w: signed payload is not the eligibility message for %s", ErrInvalidProof, deliveryAddress)
+	}
+
+	sigStructure := cborAppendHead(nil, cborArray, 4)
+	sigStructure = cborAppendText(sigStructure, "Signature1")
+	sigStructure = cborAppendBytes(sigStructure, protectedCBOR)
+	sigStructure = cborAppendBytes(sigStructure, []byte{})
+	sigStructure = cborAppendBytes(sigStructure, payload)
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), sigStructure, signature) {
+		return fmt.Errorf("%w: signature does not verify", ErrInvalidProof)
+	}
+	return nil
+}
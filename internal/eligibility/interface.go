@@ -0,0 +1,16 @@
+package eligibility
+
+import (
+	"context"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+)
+
+type Service interface {
+	// checks that an order of units to deliveryAddress may be placed in phase, optionally proving a wallet's eligibility with proof
+	// returns what the order counts against the phase's per-address cap, nil when the phase has no eligibility rules
+	CheckEligible(ctx context.Context, phase *phases.Phase, deliveryAddress string, units int64, proof *WalletProof) (*novellia_database.OrderEligibility, error)
+	// replaces the addresses of an allowlist, returning how many it has
+	PutAllowlist(ctx context.Context, allowlistID string, addresses []string) (int, error)
+}
@@ -0,0 +1,183 @@
+package eligibility
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano/address"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+)
+
+const (
+	maxAllowlistAddresses = 100000
+)
+
+var (
+	ErrNotEligible = errors.New("not eligible to order in this sale phase")
+	ErrInvalidAllowlist = errors.New("invalid allowlist")
+	allowlistIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+)
+
+// the body of PUT /admin/allowlists/{allowlist_id}, replacing the allowlist's addresses
+type AllowlistRequest struct {
+	Addresses []string `json:"addresses"`
+}
+
+type AllowlistResult struct {
+	AllowlistID string `json:"allowlist_id"`
+	// unique addresses on the allowlist
+	Addresses int `json:"addresses"`
+}
+
+// the allowlist and cap queries of novellia_database.Service
+type Store interface {
+	ReplaceAllowlist(ctx context.Context, allowlistID string, addresses []string) error
+	QueryAllowlisted(ctx context.Context, allowlistID string, addresses []string) (bool, error)
+	QueryEligibilityUnits(ctx context.Context, salePhase string, address string) (int64, error)
+}
+
+// native tokens held by addresses, implemented by cardano.Service with a UTXO query
+type HoldingsSource interface {
+	GetStock(addresses []string) (map[string]*big.Int, error)
+}
+
+type ServiceImpl struct {
+	store Store
+	holdingsSource HoldingsSource
+}
+
+// creates a new ServiceImpl
+func New(store Store, holdingsSource HoldingsSource) *ServiceImpl {
+	return &ServiceImpl{
+		store: store,
+		holdingsSource: holdingsSource,
+	}
+}
+
+// whether address holds enough of any one policy in holds
+func (s *ServiceImpl) meetsHoldings(address string, holds []phases.Holding) (bool, error) {
+	tokens, err := s.holdingsSource.GetStock([]string{address})
+	if err != nil {
+		return false, fmt.Errorf("failed to query holdings of %s: %v", address, err)
+	}
+	for _, holding := range holds {
+		held := big.NewInt(0)
+		for nativeTokenID, quantity := range tokens {
+			// native token IDs are <policy ID>.<asset name>
+			if strings.HasPrefix(nativeTokenID, holding.PolicyID + ".") {
+				held.Add(held, quantity)
+			}
+		}
+		if held.Cmp(big.NewInt(holding.Quantity)) >= 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *ServiceImpl) CheckEligible(ctx context.Context, phase *phases.Phase, deliveryAddress string, units int64, proof *WalletProof) (*novellia_database.OrderEligibility, error) {
+	if phase == nil || phase.Eligibility == nil {
+		return nil, nil
+	}
+	rules := phase.Eligibility
+
+	addresses := []string{deliveryAddress}
+	if proof != nil {
+		err := VerifyProof(*proof, deliveryAddress)
+		if err != nil {
+			return nil, err
+		}
+		if proof.Address != deliveryAddress {
+			addresses = append(addresses, proof.Address)
+		}
+	}
+
+	// the order counts against the cap of every address that qualified, so an eligible address cannot lift its cap with a proof from an empty wallet
+	qualified := []string{}
+	for _, address := range addresses {
+		ok, err := s.qualifies(ctx, rules, address)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			qualified = append(qualified, address)
+		}
+	}
+	if len(qualified) == 0 {
+		return nil, fmt.Errorf("%w: %s is not on the allowlist or does not hold the required tokens for %s", ErrNotEligible, strings.Join(addresses, ", "), phase.Name)
+	}
+
+	if rules.MaxUnitsPerAddress > 0 {
+		for _, address := range qualified {
+			ordered, err := s.store.QueryEligibilityUnits(ctx, phase.Name, address)
+			if err != nil {
+				return nil, fmt.Errorf("failed to query units ordered by %s: %v", address, err)
+			}
+			if ordered + units > rules.MaxUnitsPerAddress {
+				return nil, fmt.Errorf("%w: %s has ordered %d of %d units allowed in %s", novellia_database.ErrPurchaseCapReached, address, ordered, rules.MaxUnitsPerAddress, phase.Name)
+			}
+		}
+	}
+
+	return &novellia_database.OrderEligibility{
+		SalePhase: phase.Name,
+		Addresses: qualified,
+		Units: units,
+		MaxUnits: rules.MaxUnitsPerAddress,
+	}, nil
+}
+
+// whether address is on the allowlist or holds the tokens, anyone qualifies if the phase has neither
+func (s *ServiceImpl) qualifies(ctx context.Context, rules *phases.Eligibility, address string) (bool, error) {
+	if rules.Allowlist == "" && len(rules.Holds) == 0 {
+		return true, nil
+	}
+	if rules.Allowlist != "" {
+		allowlisted, err := s.store.QueryAllowlisted(ctx, rules.Allowlist, []string{address})
+		if err != nil {
+			return false, fmt.Errorf("failed to query allowlist %s: %v", rules.Allowlist, err)
+		}
+		if allowlisted {
+			return true, nil
+		}
+	}
+	if len(rules.Holds) > 0 {
+		return s.meetsHoldings(address, rules.Holds)
+	}
+	return false, nil
+}
+
+func (s *ServiceImpl) PutAllowlist(ctx context.Context, allowlistID string, addresses []string) (int, error) {
+	if !allowlistIDPattern.MatchString(allowlistID) {
+		return 0, fmt.Errorf("%w: ID must be lowercase letters, digits and dashes, got %q", ErrInvalidAllowlist, allowlistID)
+	}
+	if len(addresses) > maxAllowlistAddresses {
+		return 0, fmt.Errorf("%w: at most %d addresses, got %d", ErrInvalidAllowlist, maxAllowlistAddresses, len(addresses))
+	}
+
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, allowlisted := range addresses {
+		allowlisted = strings.TrimSpace(allowlisted)
+		err := address.Validate(allowlisted)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrInvalidAllowlist, err)
+		}
+		if !seen[allowlisted] {
+			seen[allowlisted] = true
+			unique = append(unique, allowlisted)
+		}
+	}
+
+	err := s.store.ReplaceAllowlist(ctx, allowlistID, unique)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Printf("Replaced allowlist %s with %d addresses\n", allowlistID, len(unique))
+	return len(unique), nil
+}
@@ -0,0 +1,243 @@
+package eligibility_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano/address"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/eligibility"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+)
+
+const (
+	policyID = "0123456789abcdef0123456789abcdef0123456789abcdef01234567"
+)
+
+// CBOR heads for lengths below 256, which is all the test structures need
+func cborHead(major byte, n int) []byte {
+	if n < 24 {
+		return []byte{major << 5 | byte(n)}
+	}
+	return []byte{major << 5 | 24, byte(n)}
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, len(b)), b...)
+}
+
+// a wallet with an enterprise mainnet address
+type testWallet struct {
+	privateKey ed25519.PrivateKey
+	publicKey ed25519.PublicKey
+	addressBytes []byte
+	address string
+}
+
+func newTestWallet(t *testing.T) *testWallet {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	hash, _ := blake2b.New(28, nil)
+	hash.Write(publicKey)
+	addressBytes := append([]byte{0x61}, hash.Sum(nil)...)
+	return &testWallet{
+		privateKey: privateKey,
+		publicKey: publicKey,
+		addressBytes: addressBytes,
+		address: address.Encode("addr", addressBytes),
+	}
+}
+
+// signs message the way CIP-30 signData does
+func (w *testWallet) signData(message string) eligibility.WalletProof {
+	// {1: -8, "address": bytes}
+	protected := append([]byte{0xa2, 0x01, 0x27, 0x67}, "address"...)
+	protected = append(protected, cborBytes(w.addressBytes)...)
+	// ["Signature1", protected, h'', payload]
+	sigStructure := append([]byte{0x84, 0x6a}, "Signature1"...)
+	sigStructure = append(sigStructure, cborBytes(protected)...)
+	sigStructure = append(sigStructure, 0x40)
+	sigStructure = append(sigStructure, cborBytes([]byte(message))...)
+	signature := ed25519.Sign(w.privateKey, sigStructure)
+
+	// [protected, {"hashed": false}, payload, signature]
+	sign1 := append([]byte{0x84}, cborBytes(protected)...)
+	sign1 = append(sign1, 0xa1, 0x66)
+	sign1 = append(sign1, "hashed"...)
+	sign1 = append(sign1, 0xf4)
+	sign1 = append(sign1, cborBytes([]byte(message))...)
+	sign1 = append(sign1, cborBytes(signature)...)
+	// {1: 1, 3: -8, -1: 6, -2: public key}
+	key := append([]byte{0xa4, 0x01, 0x01, 0x03, 0x27, 0x20, 0x06, 0x21}, cborBytes(w.publicKey)...)
+
+	return eligibility.WalletProof{
+		Address: w.address,
+		Signature: hex.EncodeToString(sign1),
+		Key: hex.EncodeToString(key),
+	}
+}
+
+func TestVerifyProof(t *testing.T) {
+	wallet := newTestWallet(t)
+	other := newTestWallet(t)
+	deliveryAddress := other.address
+
+	proof := wallet.signData(eligibility.ProofMessage(deliveryAddress))
+	err := eligibility.VerifyProof(proof, deliveryAddress)
+	if err != nil {
+		t.Fatalf("expected proof to verify, got %v", err)
+	}
+
+	invalid := map[string]eligibility.WalletProof{
+		"other delivery address": wallet.signData(eligibility.ProofMessage(wallet.address)),
+		"other message": wallet.signData(deliveryAddress),
+		"other wallet's address": eligibility.WalletProof{Address: other.address, Signature: proof.Signature, Key: proof.Key},
+		"other wallet's key": eligibility.WalletProof{Address: wallet.address, Signature: proof.Signature, Key: other.signData("").Key},
+		"truncated signature": eligibility.WalletProof{Address: wallet.address, Signature: proof.Signature[:len(proof.Signature) - 2], Key: proof.Key},
+		"testnet address": eligibility.WalletProof{Address: address.Encode("addr_test", append([]byte{0x60}, wallet.addressBytes[1:]...)), Signature: proof.Signature, Key: proof.Key},
+	}
+	for name, proof := range invalid {
+		err := eligibility.VerifyProof(proof, deliveryAddress)
+		if !errors.Is(err, eligibility.ErrInvalidProof) {
+			t.Errorf("expected %s to be rejected with ErrInvalidProof, got %v", name, err)
+		}
+	}
+}
+
+type testStore struct {
+	allowlists map[string][]string
+	// units ordered by address
+	units map[string]int64
+}
+
+func (s *testStore) ReplaceAllowlist(ctx context.Context, allowlistID string, addresses []string) error {
+	s.allowlists[allowlistID] = addresses
+	return nil
+}
+
+func (s *testStore) QueryAllowlisted(ctx context.Context, allowlistID string, addresses []string) (bool, error) {
+	for _, allowlisted := range s.allowlists[allowlistID] {
+		for _, address := range addresses {
+			if address == allowlisted {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (s *testStore) QueryEligibilityUnits(ctx context.Context, salePhase string, address string) (int64, error) {
+	return s.units[address], nil
+}
+
+type testHoldings map[string]map[string]*big.Int
+
+func (h testHoldings) GetStock(addresses []string) (map[string]*big.Int, error) {
+	return h[addresses[0]], nil
+}
+
+func TestCheckEligible(t *testing.T) {
+	ctx := context.Background()
+	allowlisted := newTestWallet(t)
+	holder := newTestWallet(t)
+	customer := newTestWallet(t)
+
+	store := &testStore{allowlists: map[string][]string{}, units: map[string]int64{}}
+	holdings := testHoldings{
+		holder.address: map[string]*big.Int{
+			"lovelace": big.NewInt(5000000),
+			policyID + ".Draculi": big.NewInt(1),
+			policyID + ".Occulta": big.NewInt(1),
+		},
+	}
+	s := eligibility.New(store, holdings)
+
+	_, err := s.PutAllowlist(ctx, "pre-sale", []string{allowlisted.address, allowlisted.address, "addr1invalid"})
+	if !errors.Is(err, eligibility.ErrInvalidAllowlist) {
+		t.Errorf("expected invalid address to be rejected, got %v", err)
+	}
+	count, err := s.PutAllowlist(ctx, "pre-sale", []string{allowlisted.address, " " + allowlisted.address})
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 unique allowlisted address, got %d: %v", count, err)
+	}
+
+	phase := &phases.Phase{
+		Name: "pre-order",
+		Eligibility: &phases.Eligibility{
+			Allowlist: "pre-sale",
+			Holds: []phases.Holding{phases.Holding{PolicyID: policyID, Quantity: 2}},
+			MaxUnitsPerAddress: 3,
+		},
+	}
+
+	orderEligibility, err := s.CheckEligible(ctx, &phases.Phase{Name: "general"}, customer.address, 10, nil)
+	if err != nil || orderEligibility != nil {
+		t.Errorf("expected anyone to order in a phase without rules, got %+v: %v", orderEligibility, err)
+	}
+
+	orderEligibility, err = s.CheckEligible(ctx, phase, allowlisted.address, 2, nil)
+	if err != nil || strings.Join(orderEligibility.Addresses, ",") != allowlisted.address || orderEligibility.MaxUnits != 3 {
+		t.Errorf("expected allowlisted address to be eligible, got %+v: %v", orderEligibility, err)
+	}
+	store.units[allowlisted.address] = 2
+	_, err = s.CheckEligible(ctx, phase, allowlisted.address, 2, nil)
+	if !errors.Is(err, novellia_database.ErrPurchaseCapReached) {
+		t.Errorf("expected cap to be reached, got %v", err)
+	}
+
+	_, err = s.CheckEligible(ctx, phase, customer.address, 1, nil)
+	if !errors.Is(err, eligibility.ErrNotEligible) {
+		t.Errorf("expected customer not to be eligible, got %v", err)
+	}
+
+	// the holder proves its wallet and has the tokens delivered elsewhere, counting against its own cap
+	proof := holder.signData(eligibility.ProofMessage(customer.address))
+	orderEligibility, err = s.CheckEligible(ctx, phase, customer.address, 3, &proof)
+	if err != nil || strings.Join(orderEligibility.Addresses, ",") != holder.address {
+		t.Errorf("expected holder's proof to make customer eligible, got %+v: %v", orderEligibility, err)
+	}
+	_, err = s.CheckEligible(ctx, phase, allowlisted.address, 1, &proof)
+	if !errors.Is(err, eligibility.ErrInvalidProof) {
+		t.Errorf("expected proof for another delivery address to be rejected, got %v", err)
+	}
+
+	// a proof from a wallet that does not qualify leaves the order counting against the allowlisted delivery address
+	proof = customer.signData(eligibility.ProofMessage(allowlisted.address))
+	_, err = s.CheckEligible(ctx, phase, allowlisted.address, 2, &proof)
+	if !errors.Is(err, novellia_database.ErrPurchaseCapReached) {
+		t.Errorf("expected cap of allowlisted delivery address to apply despite proof, got %v", err)
+	}
+	orderEligibility, err = s.CheckEligible(ctx, phase, allowlisted.address, 1, &proof)
+	if err != nil || strings.Join(orderEligibility.Addresses, ",") != allowlisted.address {
+		t.Errorf("expected order to count against allowlisted delivery address only, got %+v: %v", orderEligibility, err)
+	}
+
+	// when both addresses qualify the order counts against both caps
+	holdings[allowlisted.address] = holdings[holder.address]
+	proof = allowlisted.signData(eligibility.ProofMessage(holder.address))
+	store.units[holder.address] = 0
+	orderEligibility, err = s.CheckEligible(ctx, phase, holder.address, 1, &proof)
+	if err != nil || strings.Join(orderEligibility.Addresses, ",") != holder.address + "," + allowlisted.address {
+		t.Errorf("expected order to count against both qualifying addresses, got %+v: %v", orderEligibility, err)
+	}
+	_, err = s.CheckEligible(ctx, phase, holder.address, 2, &proof)
+	if !errors.Is(err, novellia_database.ErrPurchaseCapReached) {
+		t.Errorf("expected cap of either qualifying address to apply, got %v", err)
+	}
+	delete(holdings, allowlisted.address)
+
+	phase.Eligibility.Holds[0].Quantity = 3
+	_, err = s.CheckEligible(ctx, phase, holder.address, 1, nil)
+	if !errors.Is(err, eligibility.ErrNotEligible) {
+		t.Errorf("expected holder without enough tokens not to be eligible, got %v", err)
+	}
+}
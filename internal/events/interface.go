@@ -0,0 +1,14 @@
+package events
+
+import (
+	"context"
+)
+
+type Service interface {
+	// sends an event to subscribers of its order on every instance
+	Publish(ctx context.Context, event OrderEvent)
+	// receives events for an order until the returned function is called
+	Subscribe(orderID string) (<-chan OrderEvent, func())
+	// receives events published by other instances, until ctx is done
+	Listen(ctx context.Context)
+}
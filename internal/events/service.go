@@ -0,0 +1,138 @@
+package events
+
+import (
+	"fmt"
+	"time"
+	"sync"
+	"context"
+	"encoding/json"
+
+	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
+)
+
+const (
+	// events are dropped for subscribers this far behind, who can re-read the order
+	subscriberBuffer = 16
+	listenRetryDelay = 5 * time.Second
+)
+
+// a change to an order, published whenever its status history is written
+type OrderEvent struct {
+	OrderID string `json:"order_id"`
+	// empty when the order was created
+	From string `json:"from"`
+	To string `json:"to"`
+	Reason string `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// carries events between instances, e.g. Postgres LISTEN/NOTIFY
+type Notifier interface {
+	NotifyOrderEvent(ctx context.Context, payload string) error
+	// blocks calling handler with each payload until ctx is done or the connection fails
+	ListenOrderEvents(ctx context.Context, handler func(payload string)) error
+}
+
+type ServiceImpl struct {
+	// events are only delivered in-process if nil
+	notifier Notifier
+	subscribersMutex sync.Mutex
+	// order ID -> subscriber channels
+	subscribers map[string]map[chan OrderEvent]struct{}
+}
+
+// creates a new ServiceImpl, fanning out through notifier if it is not nil
+func New(notifier Notifier) *ServiceImpl {
+	return &ServiceImpl{
+		notifier: notifier,
+		subscribers: make(map[string]map[chan OrderEvent]struct{}),
+	}
+}
+
+func (s *ServiceImpl) Publish(ctx context.Context, event OrderEvent) {
+	if s.notifier == nil {
+		s.deliver(event)
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("Failed to marshal order event: %+v\n", err)
+		return
+	}
+	// delivered to this instance's subscribers by Listen
+	err = s.notifier.NotifyOrderEvent(ctx, string(payload))
+	if err != nil {
+		fmt.Printf("Failed to notify order event for %s, delivering locally: %+v\n", event.OrderID, err)
+		s.deliver(event)
+	}
+}
+
+func (s *ServiceImpl) Subscribe(orderID string) (<-chan OrderEvent, func()) {
+	ch := make(chan OrderEvent, subscriberBuffer)
+
+	s.subscribersMutex.Lock()
+	if s.subscribers[orderID] == nil {
+		s.subscribers[orderID] = make(map[chan OrderEvent]struct{})
+	}
+	s.subscribers[orderID][ch] = struct{}{}
+	s.subscribersMutex.Unlock()
+	prometheus_monitoring.AddOrderEventSubscribers(1)
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			s.subscribersMutex.Lock()
+			delete(s.subscribers[orderID], ch)
+			if len(s.subscribers[orderID]) == 0 {
+				delete(s.subscribers, orderID)
+			}
+			s.subscribersMutex.Unlock()
+			prometheus_monitoring.AddOrderEventSubscribers(-1)
+		})
+	}
+	return ch, unsubscribe
+}
+
+// sends an event to this instance's subscribers without blocking
+func (s *ServiceImpl) deliver(event OrderEvent) {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+
+	for ch := range s.subscribers[event.OrderID] {
+		select {
+		case ch <- event:
+		default:
+			fmt.Printf("Dropped order event for slow subscriber to %s\n", event.OrderID)
+		}
+	}
+}
+
+func (s *ServiceImpl) handleNotification(payload string) {
+	var event OrderEvent
+	err := json.Unmarshal([]byte(payload), &event)
+	if err != nil {
+		fmt.Printf("Failed to unmarshal order event %s: %+v\n", payload, err)
+		return
+	}
+	s.deliver(event)
+}
+
+func (s *ServiceImpl) Listen(ctx context.Context) {
+	if s.notifier == nil {
+		return
+	}
+
+	go func() {
+		for {
+			prometheus_monitoring.SetOrderEventsListenerStatus(1)
+			err := s.notifier.ListenOrderEvents(ctx, s.handleNotification)
+			prometheus_monitoring.SetOrderEventsListenerStatus(0)
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("Listen error (order events), reconnecting: %+v\n", err)
+			time.Sleep(listenRetryDelay)
+		}
+	}()
+}
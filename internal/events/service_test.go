@@ -0,0 +1,91 @@
+package events_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/events"
+)
+
+// stands in for Postgres, delivering notifications to every listener
+type testNotifier struct {
+	notifications chan string
+}
+
+func (n *testNotifier) NotifyOrderEvent(ctx context.Context, payload string) error {
+	n.notifications <- payload
+	return nil
+}
+
+func (n *testNotifier) ListenOrderEvents(ctx context.Context, handler func(payload string)) error {
+	for {
+		select {
+		case payload := <-n.notifications:
+			handler(payload)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func receive(t *testing.T, ch <-chan events.OrderEvent) events.OrderEvent {
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+	return events.OrderEvent{}
+}
+
+func TestPublishLocal(t *testing.T) {
+	ctx := context.Background()
+	s := events.New(nil)
+
+	ch, unsubscribe := s.Subscribe("ORDER-1")
+	other, unsubscribeOther := s.Subscribe("ORDER-2")
+	defer unsubscribeOther()
+
+	s.Publish(ctx, events.OrderEvent{OrderID: "ORDER-1", From: "AWAITING_PAYMENT", To: "PAID"})
+	event := receive(t, ch)
+	if event.To != "PAID" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	select {
+	case event := <-other:
+		t.Errorf("event delivered to another order: %+v", event)
+	default:
+	}
+
+	unsubscribe()
+	// unsubscribing twice is harmless
+	unsubscribe()
+	s.Publish(ctx, events.OrderEvent{OrderID: "ORDER-1", From: "PAID", To: "FILLED"})
+	select {
+	case event := <-ch:
+		t.Errorf("event delivered after unsubscribing: %+v", event)
+	default:
+	}
+}
+
+func TestPublishNotifier(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// published on one instance, received on another
+	notifier := &testNotifier{notifications: make(chan string, 1)}
+	publisher := events.New(notifier)
+	subscriber := events.New(notifier)
+	subscriber.Listen(ctx)
+
+	ch, unsubscribe := subscriber.Subscribe("ORDER-1")
+	defer unsubscribe()
+
+	createdAt := time.Date(2021, 5, 22, 21, 0, 0, 0, time.UTC)
+	publisher.Publish(ctx, events.OrderEvent{OrderID: "ORDER-1", From: "PAID", To: "FILLED", Reason: "test", CreatedAt: createdAt})
+	event := receive(t, ch)
+	if event.From != "PAID" || event.To != "FILLED" || event.Reason != "test" || !event.CreatedAt.Equal(createdAt) {
+		t.Errorf("unexpected event: %+v", event)
+	}
+}
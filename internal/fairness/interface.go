@@ -0,0 +1,23 @@
+package fairness
+
+import (
+	"context"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+)
+
+type Service interface {
+	// the seed of the running sale, a sale is started if none is running
+	ActiveSeed(ctx context.Context) (*novellia_database.SaleSeed, error)
+	// ends the running sale and starts a new one with a fresh seed, returned without its secret
+	RotateSeed(ctx context.Context) (*novellia_database.SaleSeed, error)
+	// publishes the seed of a sale that has ended
+	RevealSeed(ctx context.Context, saleSeedID string) (*novellia_database.SaleSeed, error)
+	// every seed, with the secret only for revealed ones
+	GetSeeds(ctx context.Context) ([]novellia_database.SaleSeed, error)
+	// an order's pulls with what is needed to recompute them, verified once their seed is revealed
+	GetOrderPulls(ctx context.Context, orderID string) ([]PullProof, error)
+	// the bundle definitions pulls are drawn from
+	GetCatalog() *products.Catalog
+}
@@ -0,0 +1,74 @@
+package fairness
+
+import (
+	"fmt"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+)
+
+// a deterministic source for one unit of a bundle, anyone with the revealed seed can reproduce its draws
+// block i of the stream is HMAC-SHA256(seed, "<order_id>:<item_index>:<i>"), read as big-endian uint64s
+type Rand struct {
+	seed []byte
+	message string
+	block int
+	buffer []byte
+}
+
+// creates the source for the unit at itemIndex in an order, seed is the raw seed bytes
+func NewRand(seed []byte, orderID string, itemIndex int) *Rand {
+	return &Rand{
+		seed: seed,
+		message: Message(orderID, itemIndex),
+	}
+}
+
+// the HMAC message a unit's stream is derived from, before the block counter
+func Message(orderID string, itemIndex int) string {
+	return fmt.Sprintf("%s:%d", orderID, itemIndex)
+}
+
+// hex SHA-256 of the seed bytes, published before the seed is used
+func HashSeed(seed []byte) string {
+	sum := sha256.Sum256(seed)
+	return hex.EncodeToString(sum[:])
+}
+
+// decodes a hex seed
+func DecodeSeed(seed string) ([]byte, error) {
+	b, err := hex.DecodeString(seed)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid sale seed")
+	}
+	return b, nil
+}
+
+func (r *Rand) Uint64() uint64 {
+	if len(r.buffer) < 8 {
+		mac := hmac.New(sha256.New, r.seed)
+		fmt.Fprintf(mac, "%s:%d", r.message, r.block)
+		r.buffer = mac.Sum(nil)
+		r.block += 1
+	}
+	v := binary.BigEndian.Uint64(r.buffer[:8])
+	r.buffer = r.buffer[8:]
+	return v
+}
+
+// uniform in [0, n), values in the top of the range that would bias the result are skipped
+func (r *Rand) Intn(n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+	bound := uint64(n)
+	limit := math.MaxUint64 - math.MaxUint64 % bound
+	for {
+		v := r.Uint64()
+		if v < limit {
+			return int(v % bound)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package fairness
+
+import (
+	"fmt"
+	"context"
+	"errors"
+	"crypto/rand"
+	"encoding/hex"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+)
+
+const (
+	seedBytes = 32
+)
+
+var (
+	ErrSeedNotFound = errors.New("sale seed not found")
+	ErrSeedActive = errors.New("sale seed is still in use, rotate it before revealing")
+)
+
+// an order's pull with the inputs needed to recompute it
+type PullProof struct {
+	novellia_database.OrderPull
+	// HMAC message before the block counter, see Rand
+	Message string `json:"message"`
+	SeedHash string `json:"seed_hash"`
+	// hash of the catalog committed with the seed
+	CatalogHash string `json:"catalog_hash"`
+	// only once revealed
+	Seed string `json:"seed,omitempty"`
+	// whether the recorded odds leave out products of the catalog that had no stock, which the seed does not commit to, set once the seed is revealed
+	ReducedOdds bool `json:"reduced_odds"`
+	// whether recomputing the pull from the revealed seed with its recorded odds gives the same products, nil before the seed is revealed
+	Replayed *bool `json:"replayed"`
+	// whether the pull replayed with the catalog's full odds and the catalog is the one committed with the seed, nil before the seed is revealed
+	// pulls with reduced odds are never verified, only replayed
+	Verified *bool `json:"verified"`
+}
+
+// the parts of novellia_database.Service used to manage seeds
+type Store interface {
+	GenerateULID(prefix string) string
+	QueryActiveSaleSeed(ctx context.Context) (*novellia_database.SaleSeed, error)
+	QuerySaleSeeds(ctx context.Context) ([]novellia_database.SaleSeed, error)
+	InsertSaleSeed(ctx context.Context, seed novellia_database.SaleSeed, end bool) (bool, error)
+	RevealSaleSeed(ctx context.Context, saleSeedID string) (bool, error)
+	QueryOrderPulls(ctx context.Context, orderID string) ([]novellia_database.OrderPull, error)
+}
+
+type ServiceImpl struct {
+	store Store
+	productsService products.Service
+}
+
+// creates a new ServiceImpl
+func New(store Store, productsService products.Service) *ServiceImpl {
+	return &ServiceImpl{
+		store: store,
+		productsService: productsService,
+	}
+}
+
+func (s *ServiceImpl) newSeed() (*novellia_database.SaleSeed, error) {
+	b := make([]byte, seedBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate sale seed: %v", err)
+	}
+
+	return &novellia_database.SaleSeed{
+		SaleSeedID: s.store.GenerateULID("SEED"),
+		SeedHash: HashSeed(b),
+		CatalogHash: s.productsService.GetCatalog().Hash(),
+		Seed: hex.EncodeToString(b),
+		Active: true,
+	}, nil
+}
+
+// hides the seed unless it was revealed
+func redact(seed novellia_database.SaleSeed) novellia_database.SaleSeed {
+	if seed.RevealedAt == nil {
+		seed.Seed = ""
+	}
+	return seed
+}
+
+func (s *ServiceImpl) ActiveSeed(ctx context.Context) (*novellia_database.SaleSeed, error) {
+	seed, err := s.store.QueryActiveSaleSeed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if seed != nil {
+		if seed.CatalogHash != s.productsService.GetCatalog().Hash() {
+			fmt.Printf("ActiveSeed warning: catalog changed since sale %s started, rotate the seed so that its pulls can be verified\n", seed.SaleSeedID)
+		}
+		return seed, nil
+	}
+
+	seed, err = s.newSeed()
+	if err != nil {
+		return nil, err
+	}
+	// another instance may have started a sale since, in which case its seed is used
+	_, err = s.store.InsertSaleSeed(ctx, *seed, false)
+	if err != nil {
+		return nil, err
+	}
+	seed, err = s.store.QueryActiveSaleSeed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if seed == nil {
+		return nil, fmt.Errorf("failed to start a sale")
+	}
+	fmt.Printf("Started sale with seed %s (hash %s)\n", seed.SaleSeedID, seed.SeedHash)
+	return seed, nil
+}
+
+func (s *ServiceImpl) RotateSeed(ctx context.Context) (*novellia_database.SaleSeed, error) {
+	seed, err := s.newSeed()
+	if err != nil {
+		return nil, err
+	}
+	inserted, err := s.store.InsertSaleSeed(ctx, *seed, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate sale seed: %v", err)
+	}
+	if !inserted {
+		return nil, fmt.Errorf("failed to rotate sale seed, another sale was started at the same time")
+	}
+
+	redacted := redact(*seed)
+	return &redacted, nil
+}
+
+func (s *ServiceImpl) RevealSeed(ctx context.Context, saleSeedID string) (*novellia_database.SaleSeed, error) {
+	revealed, err := s.store.RevealSaleSeed(ctx, saleSeedID)
+	if err != nil {
+		return nil, err
+	}
+
+	seeds, err := s.store.QuerySaleSeeds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, seed := range seeds {
+		if seed.SaleSeedID != saleSeedID {
+			continue
+		}
+		if !revealed {
+			return nil, fmt.Errorf("%w: %s", ErrSeedActive, saleSeedID)
+		}
+		return &seed, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrSeedNotFound, saleSeedID)
+}
+
+func (s *ServiceImpl) GetSeeds(ctx context.Context) ([]novellia_database.SaleSeed, error) {
+	seeds, err := s.store.QuerySaleSeeds(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range seeds {
+		seeds[i] = redact(seeds[i])
+	}
+	return seeds, nil
+}
+
+// recomputes a pull from its revealed seed and the odds recorded with it, returning whether it replayed and whether the odds were reduced
+func (s *ServiceImpl) replay(orderID string, pull novellia_database.OrderPull, seed string) (bool, bool) {
+	b, err := DecodeSeed(seed)
+	if err != nil {
+		return false, false
+	}
+	unpacked, reduced, err := s.productsService.ReplayBundleProduct(pull.ProductID, NewRand(b, orderID, pull.ItemIndex), pull.Odds)
+	if err != nil || len(unpacked) != len(pull.UnpackedProductIDs) {
+		return false, reduced
+	}
+	for i := range unpacked {
+		if unpacked[i] != pull.UnpackedProductIDs[i] {
+			return false, reduced
+		}
+	}
+	return true, reduced
+}
+
+func (s *ServiceImpl) GetOrderPulls(ctx context.Context, orderID string) ([]PullProof, error) {
+	pulls, err := s.store.QueryOrderPulls(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	seeds, err := s.store.QuerySaleSeeds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seedsByID := map[string]novellia_database.SaleSeed{}
+	for _, seed := range seeds {
+		seedsByID[seed.SaleSeedID] = seed
+	}
+
+	proofs := []PullProof{}
+	for _, pull := range pulls {
+		seed := redact(seedsByID[pull.SaleSeedID])
+		proof := PullProof{
+			OrderPull: pull,
+			Message: Message(orderID, pull.ItemIndex),
+			SeedHash: seed.SeedHash,
+			CatalogHash: seed.CatalogHash,
+			Seed: seed.Seed,
+		}
+		if seed.Seed != "" {
+			replayed, reduced := s.replay(orderID, pull, seed.Seed)
+			// replays use the current catalog, which only proves the pull if it is the committed one
+			verified := replayed && !reduced && seed.CatalogHash != "" && seed.CatalogHash == s.productsService.GetCatalog().Hash()
+			proof.ReducedOdds = reduced
+			proof.Replayed = &replayed
+			proof.Verified = &verified
+		}
+		proofs = append(proofs, proof)
+	}
+	return proofs, nil
+}
+
+func (s *ServiceImpl) GetCatalog() *products.Catalog {
+	return s.productsService.GetCatalog()
+}
@@ -0,0 +1,260 @@
+package fairness_test
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"errors"
+	"testing"
+	"encoding/hex"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fairness"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+)
+
+const (
+	catalogPath = "../../config/catalog.yaml"
+	boosterProductID = "PROD-01F4NAF8MANXDT26MGA5E0QXNJ"
+	// 31 zero bytes and a one
+	testSeed = "0000000000000000000000000000000000000000000000000000000000000001"
+)
+
+// keeps seeds and pulls in memory
+type testStore struct {
+	ids int
+	seeds []novellia_database.SaleSeed
+	pulls map[string][]novellia_database.OrderPull
+}
+
+func (s *testStore) GenerateULID(prefix string) string {
+	s.ids += 1
+	return fmt.Sprintf("%s-%d", prefix, s.ids)
+}
+
+func (s *testStore) QueryActiveSaleSeed(ctx context.Context) (*novellia_database.SaleSeed, error) {
+	for i := range s.seeds {
+		if s.seeds[i].Active {
+			seed := s.seeds[i]
+			return &seed, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *testStore) QuerySaleSeeds(ctx context.Context) ([]novellia_database.SaleSeed, error) {
+	seeds := make([]novellia_database.SaleSeed, len(s.seeds))
+	copy(seeds, s.seeds)
+	return seeds, nil
+}
+
+func (s *testStore) InsertSaleSeed(ctx context.Context, seed novellia_database.SaleSeed, end bool) (bool, error) {
+	for i := range s.seeds {
+		if !s.seeds[i].Active {
+			continue
+		}
+		if !end {
+			return false, nil
+		}
+		now := time.Now()
+		s.seeds[i].Active = false
+		s.seeds[i].EndedAt = &now
+	}
+	s.seeds = append(s.seeds, seed)
+	return true, nil
+}
+
+func (s *testStore) RevealSaleSeed(ctx context.Context, saleSeedID string) (bool, error) {
+	for i := range s.seeds {
+		if s.seeds[i].SaleSeedID == saleSeedID && !s.seeds[i].Active {
+			now := time.Now()
+			s.seeds[i].RevealedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *testStore) QueryOrderPulls(ctx context.Context, orderID string) ([]novellia_database.OrderPull, error) {
+	return s.pulls[orderID], nil
+}
+
+func TestRand(t *testing.T) {
+	seed, err := fairness.DecodeSeed(testSeed)
+	if err != nil {
+		t.Fatalf("failed to decode seed: %v", err)
+	}
+	if fairness.HashSeed(seed) != "ec4916dd28fc4c10d78e287ca5d9cc51ee1ae73cbfde08c6b37324cbfaac8bc5" {
+		t.Errorf("unexpected seed hash %s", fairness.HashSeed(seed))
+	}
+
+	// HMAC-SHA256(seed, "ORDER-1:0:0") read as big-endian uint64s
+	r := fairness.NewRand(seed, "ORDER-1", 0)
+	for _, expected := range []uint64{9184690037387001293, 8385998660644527313} {
+		v := r.Uint64()
+		if v != expected {
+			t.Errorf("expected %d, got %d", expected, v)
+		}
+	}
+
+	a := fairness.NewRand(seed, "ORDER-1", 1)
+	b := fairness.NewRand(seed, "ORDER-1", 1)
+	other := fairness.NewRand(seed, "ORDER-1", 2)
+	differs := false
+	for i := 0; i < 100; i++ {
+		x := a.Intn(100)
+		if x < 0 || x >= 100 {
+			t.Fatalf("Intn out of range: %d", x)
+		}
+		if b.Intn(100) != x {
+			t.Fatalf("expected the same draws for the same inputs")
+		}
+		if other.Intn(100) != x {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Errorf("expected different draws for different item indexes")
+	}
+
+	_, err = fairness.DecodeSeed("not hex")
+	if err == nil {
+		t.Errorf("expected an invalid seed to fail")
+	}
+}
+
+func TestGetOrderPulls(t *testing.T) {
+	ctx := context.Background()
+
+	catalog, err := products.LoadCatalog(catalogPath)
+	if err != nil {
+		t.Fatalf("failed to load catalog: %v", err)
+	}
+	productsService := products.New(nil, catalog, 0)
+	store := &testStore{
+		pulls: make(map[string][]novellia_database.OrderPull),
+	}
+	s := fairness.New(store, productsService)
+
+	// the first order starts a sale
+	active, err := s.ActiveSeed(ctx)
+	if err != nil {
+		t.Fatalf("failed to get active seed: %v", err)
+	}
+	seedBytes, _ := hex.DecodeString(active.Seed)
+	if active.SeedHash != fairness.HashSeed(seedBytes) {
+		t.Errorf("seed hash does not match seed")
+	}
+	again, err := s.ActiveSeed(ctx)
+	if err != nil || again.SaleSeedID != active.SaleSeedID {
+		t.Fatalf("expected the same sale, got %+v: %v", again, err)
+	}
+
+	// the rares are sold out, so the odds recorded with the pull leave them out
+	stock := products.Stock{}
+	for _, productID := range catalog.Pools["occulta-novellia-kinda-rare"] {
+		stock[productID] = 10
+	}
+	for _, productID := range catalog.Pools["occulta-novellia-not-that-rare"] {
+		stock[productID] = 10
+	}
+	unpacked, odds, err := productsService.UnpackBundleProduct(boosterProductID, fairness.NewRand(seedBytes, "ORDER-1", 0), stock)
+	if err != nil {
+		t.Fatalf("failed to unpack booster: %v", err)
+	}
+	legacy, _, err := productsService.UnpackBundleProduct(boosterProductID, fairness.NewRand(seedBytes, "ORDER-1", 2), nil)
+	if err != nil {
+		t.Fatalf("failed to unpack booster: %v", err)
+	}
+	store.pulls["ORDER-1"] = []novellia_database.OrderPull{
+		novellia_database.OrderPull{
+			ItemIndex: 0,
+			ProductID: boosterProductID,
+			SaleSeedID: active.SaleSeedID,
+			UnpackedProductIDs: unpacked,
+			Odds: odds,
+		},
+		// recorded with products that were not drawn
+		novellia_database.OrderPull{
+			ItemIndex: 1,
+			ProductID: boosterProductID,
+			SaleSeedID: active.SaleSeedID,
+			UnpackedProductIDs: []string{unpacked[0], unpacked[1], "PROD-NOT-IN-CATALOG"},
+			Odds: odds,
+		},
+		// recorded before odds were, checked against the full catalog
+		novellia_database.OrderPull{
+			ItemIndex: 2,
+			ProductID: boosterProductID,
+			SaleSeedID: active.SaleSeedID,
+			UnpackedProductIDs: legacy,
+		},
+	}
+
+	// the seed stays secret while the sale is running
+	proofs, err := s.GetOrderPulls(ctx, "ORDER-1")
+	if err != nil {
+		t.Fatalf("failed to get pulls: %v", err)
+	}
+	if len(proofs) != 3 || proofs[0].Seed != "" || proofs[0].Verified != nil || proofs[0].SeedHash != active.SeedHash || proofs[0].Message != "ORDER-1:0" {
+		t.Fatalf("unexpected pulls before reveal %+v", proofs)
+	}
+	_, err = s.RevealSeed(ctx, active.SaleSeedID)
+	if !errors.Is(err, fairness.ErrSeedActive) {
+		t.Errorf("expected ErrSeedActive, got %v", err)
+	}
+	_, err = s.RevealSeed(ctx, "SEED-UNKNOWN")
+	if !errors.Is(err, fairness.ErrSeedNotFound) {
+		t.Errorf("expected ErrSeedNotFound, got %v", err)
+	}
+
+	rotated, err := s.RotateSeed(ctx)
+	if err != nil {
+		t.Fatalf("failed to rotate seed: %v", err)
+	}
+	if rotated.Seed != "" || rotated.SaleSeedID == active.SaleSeedID {
+		t.Errorf("expected a new seed without its secret, got %+v", rotated)
+	}
+	revealed, err := s.RevealSeed(ctx, active.SaleSeedID)
+	if err != nil || revealed.Seed != active.Seed {
+		t.Fatalf("expected the seed to be revealed, got %+v: %v", revealed, err)
+	}
+
+	proofs, err = s.GetOrderPulls(ctx, "ORDER-1")
+	if err != nil {
+		t.Fatalf("failed to get pulls: %v", err)
+	}
+	if proofs[0].CatalogHash != catalog.Hash() {
+		t.Errorf("expected the catalog to be committed with the seed, got %s", proofs[0].CatalogHash)
+	}
+	// the sold out rares were left out of the odds, so the pull replays but is not verified
+	if proofs[0].Seed != active.Seed || proofs[0].Replayed == nil || !*proofs[0].Replayed || !proofs[0].ReducedOdds || proofs[0].Verified == nil || *proofs[0].Verified {
+		t.Errorf("expected the pull to replay with reduced odds, got %+v", proofs[0])
+	}
+	if proofs[1].Replayed == nil || *proofs[1].Replayed || proofs[1].Verified == nil || *proofs[1].Verified {
+		t.Errorf("expected the tampered pull not to verify, got %+v", proofs[1])
+	}
+	if proofs[2].ReducedOdds || proofs[2].Verified == nil || !*proofs[2].Verified {
+		t.Errorf("expected the pull without odds to verify, got %+v", proofs[2])
+	}
+
+	// a catalog other than the committed one proves nothing, even if the pull still replays
+	catalog.OutOfStock = products.OUT_OF_STOCK_FAIL
+	proofs, err = s.GetOrderPulls(ctx, "ORDER-1")
+	if err != nil {
+		t.Fatalf("failed to get pulls: %v", err)
+	}
+	if proofs[2].Replayed == nil || !*proofs[2].Replayed || proofs[2].Verified == nil || *proofs[2].Verified {
+		t.Errorf("expected the pull not to verify against a changed catalog, got %+v", proofs[2])
+	}
+
+	seeds, err := s.GetSeeds(ctx)
+	if err != nil {
+		t.Fatalf("failed to get seeds: %v", err)
+	}
+	for _, seed := range seeds {
+		if (seed.RevealedAt == nil) != (seed.Seed == "") {
+			t.Errorf("expected only revealed seeds to be published, got %+v", seed)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package fees
+
+import (
+	"time"
+)
+
+type Service interface {
+	// breaks down the total due for a subtotal and the min-ada of the output the tokens will be delivered in
+	Calculate(subtotal float64, minLovelace int64, at time.Time) (*Breakdown, error)
+	// minimum lovelace that must accompany the native tokens in a single output
+	MinLovelace(nativeTokenIDs []string) int64
+	// most MinLovelace can be for an output of at most maxAssets of nativeTokenIDs, for bundles whose contents are not drawn yet
+	MaxMinLovelace(nativeTokenIDs []string, maxAssets int) int64
+}
@@ -0,0 +1,309 @@
+package fees
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+)
+
+const (
+	FEE_TYPE_PERCENTAGE = "percentage"
+	FEE_TYPE_FLAT = "flat"
+	FEE_TYPE_DEPOSIT = "deposit"
+)
+
+const (
+	MinADADepositFeeName = "min_ada_deposit"
+	lovelacePerADA = 1000000
+)
+
+// Mary era min-ada calculation, https://docs.cardano.org/native-tokens/minimum-ada-value-requirement
+const (
+	utxoEntrySizeWithoutVal = 27
+	coinSize = 0
+	policyIDSize = 28
+)
+
+// a fee as configured
+type FeeRule struct {
+	Name string
+	Type string
+	// fraction of the subtotal for FEE_TYPE_PERCENTAGE, e.g. 0.01 is 1%
+	Rate float64
+	// ADA for FEE_TYPE_FLAT
+	Amount float64
+}
+
+// a window of time in which processing fees are waived
+type PromoWindow struct {
+	Name string
+	Start time.Time
+	End time.Time
+}
+
+// a fee as charged on an order
+type Fee struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Amount float64 `json:"amount"`
+	// set to the promo window that waived the fee
+	WaivedBy string `json:"waived_by,omitempty"`
+}
+
+type Breakdown struct {
+	Subtotal float64 `json:"subtotal"`
+	// processing fees, these are not requested from NowPayments so that they can cover its cut
+	Fees []Fee `json:"fees"`
+	// ADA sent back with the native tokens
+	MinADADeposit float64 `json:"min_ada_deposit"`
+	// total due from the customer, subtotal + fees + deposit
+	Total float64 `json:"total"`
+}
+
+// sum of processing fees, excluding the deposit
+func (b *Breakdown) FeesAmount() float64 {
+	var sum float64 = 0
+	for _, f := range b.Fees {
+		sum += f.Amount
+	}
+	return sum
+}
+
+// fees in the form stored with an order, the deposit is recorded as a fee of type FEE_TYPE_DEPOSIT
+func (b *Breakdown) OrderFees() []Fee {
+	orderFees := append([]Fee{}, b.Fees...)
+	return append(orderFees, Fee{
+		Name: MinADADepositFeeName,
+		Type: FEE_TYPE_DEPOSIT,
+		Amount: b.MinADADeposit,
+	})
+}
+
+// rebuilds a breakdown from the total and fees stored with an order
+func BreakdownFromOrderFees(total float64, orderFees []Fee) *Breakdown {
+	b := Breakdown{
+		Subtotal: total,
+		Fees: []Fee{},
+		Total: total,
+	}
+	for _, f := range orderFees {
+		if f.Type == FEE_TYPE_DEPOSIT {
+			b.MinADADeposit += f.Amount
+		} else {
+			b.Fees = append(b.Fees, f)
+		}
+		b.Subtotal = roundADA(b.Subtotal - f.Amount)
+	}
+	return &b
+}
+
+type ServiceImpl struct {
+	rules []FeeRule
+	promoWindows []PromoWindow
+	minUTxOLovelace int64
+}
+
+// creates a new ServiceImpl
+func New(rules []FeeRule, promoWindows []PromoWindow, minUTxOLovelace int64) (*ServiceImpl, error) {
+	// fees are stored by name with each order, so names must be unique and not collide with the deposit
+	names := map[string]bool{}
+	for _, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("fee of type %s has no name", r.Type)
+		}
+		if r.Name == MinADADepositFeeName {
+			return nil, fmt.Errorf("fee name %s is reserved for the min-ada deposit", r.Name)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("fee %s is configured more than once", r.Name)
+		}
+		names[r.Name] = true
+
+		switch r.Type {
+		case FEE_TYPE_PERCENTAGE:
+			if r.Rate < 0 || r.Rate >= 1 {
+				return nil, fmt.Errorf("fee %s rate must be in [0, 1), got %f", r.Name, r.Rate)
+			}
+		case FEE_TYPE_FLAT:
+			if r.Amount < 0 {
+				return nil, fmt.Errorf("fee %s amount cannot be negative, got %f", r.Name, r.Amount)
+			}
+		default:
+			return nil, fmt.Errorf("fee %s has unknown type: %s", r.Name, r.Type)
+		}
+	}
+	for _, w := range promoWindows {
+		if !w.End.After(w.Start) {
+			return nil, fmt.Errorf("promo window %s must end after it starts", w.Name)
+		}
+	}
+	if minUTxOLovelace <= 0 {
+		return nil, fmt.Errorf("min UTxO lovelace must be greater than 0, got %d", minUTxOLovelace)
+	}
+
+	return &ServiceImpl {
+		rules: rules,
+		promoWindows: promoWindows,
+		minUTxOLovelace: minUTxOLovelace,
+	}, nil
+}
+
+// rounds an ADA amount to lovelace precision
+func roundADA(amount float64) float64 {
+	return math.Round(amount * lovelacePerADA) / lovelacePerADA
+}
+
+// returns the promo window active at a time, if any
+func (s *ServiceImpl) activePromoWindow(at time.Time) *PromoWindow {
+	for i, w := range s.promoWindows {
+		if !at.Before(w.Start) && at.Before(w.End) {
+			return &s.promoWindows[i]
+		}
+	}
+	return nil
+}
+
+func (s *ServiceImpl) Calculate(subtotal float64, minLovelace int64, at time.Time) (*Breakdown, error) {
+	if subtotal <= 0 {
+		return nil, fmt.Errorf("subtotal must be greater than 0, got %f", subtotal)
+	}
+
+	b := Breakdown{
+		Subtotal: subtotal,
+		Fees: []Fee{},
+	}
+
+	promoWindow := s.activePromoWindow(at)
+	for _, r := range s.rules {
+		f := Fee{
+			Name: r.Name,
+			Type: r.Type,
+		}
+		if promoWindow != nil {
+			f.WaivedBy = promoWindow.Name
+		} else if r.Type == FEE_TYPE_PERCENTAGE {
+			f.Amount = roundADA(subtotal * r.Rate)
+		} else {
+			f.Amount = roundADA(r.Amount)
+		}
+		b.Fees = append(b.Fees, f)
+	}
+
+	// round the deposit up to whole ADA
+	b.MinADADeposit = math.Ceil(float64(minLovelace) / lovelacePerADA)
+	b.Total = roundADA(subtotal + b.FeesAmount() + b.MinADADeposit)
+
+	return &b, nil
+}
+
+func (s *ServiceImpl) MinLovelace(nativeTokenIDs []string) int64 {
+	if len(nativeTokenIDs) == 0 {
+		return s.minUTxOLovelace
+	}
+
+	// native token IDs are "policy_id.asset_name"
+	policyIDs := map[string]bool{}
+	assets := map[string]bool{}
+	assetNameBytes := 0
+	for _, id := range nativeTokenIDs {
+		if assets[id] {
+			continue
+		}
+		assets[id] = true
+
+		parts := strings.SplitN(id, ".", 2)
+		policyIDs[parts[0]] = true
+		if len(parts) == 2 {
+			assetNameBytes += len(parts[1])
+		}
+	}
+
+	return s.minLovelace(len(assets), assetNameBytes, len(policyIDs))
+}
+
+func (s *ServiceImpl) MaxMinLovelace(nativeTokenIDs []string, maxAssets int) int64 {
+	policyIDs := map[string]bool{}
+	assets := map[string]bool{}
+	assetNameLengths := []int{}
+	for _, id := range nativeTokenIDs {
+		if assets[id] {
+			continue
+		}
+		assets[id] = true
+
+		parts := strings.SplitN(id, ".", 2)
+		policyIDs[parts[0]] = true
+		if len(parts) == 2 {
+			assetNameLengths = append(assetNameLengths, len(parts[1]))
+		} else {
+			assetNameLengths = append(assetNameLengths, 0)
+		}
+	}
+	if maxAssets > len(assets) {
+		maxAssets = len(assets)
+	}
+	if maxAssets == 0 {
+		return s.minUTxOLovelace
+	}
+
+	// each term of the size is bounded on its own, the longest names and most policies need not come together
+	sort.Sort(sort.Reverse(sort.IntSlice(assetNameLengths)))
+	assetNameBytes := 0
+	for _, l := range assetNameLengths[:maxAssets] {
+		assetNameBytes += l
+	}
+	policies := len(policyIDs)
+	if policies > maxAssets {
+		policies = maxAssets
+	}
+	return s.minLovelace(maxAssets, assetNameBytes, policies)
+}
+
+func (s *ServiceImpl) minLovelace(assets int, assetNameBytes int, policies int) int64 {
+	// size of the multi-asset value in words
+	valueBytes := assets * 12 + assetNameBytes + policies * policyIDSize
+	size := int64(6 + (valueBytes + 7) / 8)
+
+	adaOnlyUTxOSize := int64(utxoEntrySizeWithoutVal + coinSize)
+	minLovelace := (s.minUTxOLovelace / adaOnlyUTxOSize) * (utxoEntrySizeWithoutVal + size)
+	if minLovelace < s.minUTxOLovelace {
+		return s.minUTxOLovelace
+	}
+	return minLovelace
+}
+
+// creates a new ServiceImpl from the fees section of the config
+func NewFromConfig(cfg *config.Config) (*ServiceImpl, error) {
+	rules := []FeeRule{}
+	for _, r := range cfg.Fees.Rules {
+		rules = append(rules, FeeRule{
+			Name: r.Name,
+			Type: r.Type,
+			Rate: r.Rate,
+			Amount: r.Amount,
+		})
+	}
+
+	promoWindows := []PromoWindow{}
+	for _, w := range cfg.Fees.PromoWindows {
+		start, err := time.Parse(time.RFC3339, w.Start)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse start of promo window %s: %v", w.Name, err)
+		}
+		end, err := time.Parse(time.RFC3339, w.End)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse end of promo window %s: %v", w.Name, err)
+		}
+		promoWindows = append(promoWindows, PromoWindow{
+			Name: w.Name,
+			Start: start,
+			End: end,
+		})
+	}
+
+	return New(rules, promoWindows, cfg.Fees.MinUTxOLovelace)
+}
@@ -0,0 +1,140 @@
+package fees_test
+
+import (
+	"testing"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
+)
+
+const (
+	policyID = "d5e6bf0500378d4f0da4e8dde6becec7621cd8cbf5cbb9b87013d4cc"
+)
+
+func TestMinLovelace(t *testing.T) {
+	service, err := fees.New([]fees.FeeRule{}, []fees.PromoWindow{}, 1000000)
+	if err != nil {
+		t.Fatalf("failed to create fees service: %+v", err)
+	}
+
+	// values from https://docs.cardano.org/native-tokens/minimum-ada-value-requirement
+	cases := []struct {
+		nativeTokenIDs []string
+		expected int64
+	}{
+		{[]string{}, 1000000},
+		{[]string{policyID + ".A"}, 1444443},
+		{[]string{policyID + ".A", policyID + ".A"}, 1444443},
+		{[]string{policyID + ".ABCDEFGHIJKLMNOPQRSTUVWXYZ012345"}, 1555554},
+		{[]string{policyID + ".A", policyID + ".B", policyID + ".C"}, 1555554},
+	}
+	for _, c := range cases {
+		minLovelace := service.MinLovelace(c.nativeTokenIDs)
+		if minLovelace != c.expected {
+			t.Errorf("wrong min lovelace for %+v, expected %d, got %d", c.nativeTokenIDs, c.expected, minLovelace)
+		}
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	promoStart := time.Date(2021, 5, 22, 21, 0, 0, 0, time.UTC)
+	rules := []fees.FeeRule{
+		fees.FeeRule{
+			Name: "processing",
+			Type: fees.FEE_TYPE_FLAT,
+			Amount: 1,
+		},
+		fees.FeeRule{
+			Name: "network",
+			Type: fees.FEE_TYPE_PERCENTAGE,
+			Rate: 0.01,
+		},
+	}
+	promoWindows := []fees.PromoWindow{
+		fees.PromoWindow{
+			Name: "launch",
+			Start: promoStart,
+			End: promoStart.Add(24 * time.Hour),
+		},
+	}
+	service, err := fees.New(rules, promoWindows, 1000000)
+	if err != nil {
+		t.Fatalf("failed to create fees service: %+v", err)
+	}
+
+	nativeTokenIDs := []string{policyID + ".Draculi"}
+	b, err := service.Calculate(80, service.MinLovelace(nativeTokenIDs), promoStart.Add(-1 * time.Hour))
+	if err != nil {
+		t.Fatalf("failed to calculate fees: %+v", err)
+	}
+	if b.FeesAmount() != 1.8 {
+		t.Errorf("expected fees of 1.8, got %f", b.FeesAmount())
+	}
+	if b.MinADADeposit != 2 {
+		t.Errorf("expected min-ada deposit of 2, got %f", b.MinADADeposit)
+	}
+	if b.Total != 83.8 {
+		t.Errorf("expected total of 83.8, got %f", b.Total)
+	}
+
+	// the breakdown survives being stored with an order
+	stored := fees.BreakdownFromOrderFees(b.Total, b.OrderFees())
+	if stored.Subtotal != b.Subtotal || stored.MinADADeposit != b.MinADADeposit || stored.FeesAmount() != b.FeesAmount() {
+		t.Errorf("breakdown changed when stored, %+v != %+v", stored, b)
+	}
+
+	b, err = service.Calculate(80, service.MinLovelace(nativeTokenIDs), promoStart)
+	if err != nil {
+		t.Fatalf("failed to calculate fees: %+v", err)
+	}
+	if b.FeesAmount() != 0 {
+		t.Errorf("expected fees to be waived, got %f", b.FeesAmount())
+	}
+	for _, f := range b.Fees {
+		if f.WaivedBy != "launch" {
+			t.Errorf("expected fee %s to be waived by launch, got %s", f.Name, f.WaivedBy)
+		}
+	}
+	if b.Total != 82 {
+		t.Errorf("expected total of 82, got %f", b.Total)
+	}
+}
+
+func TestNewRejectsFeeNames(t *testing.T) {
+	cases := [][]fees.FeeRule{
+		{{Name: "processing", Type: fees.FEE_TYPE_FLAT, Amount: 1}, {Name: "processing", Type: fees.FEE_TYPE_PERCENTAGE, Rate: 0.01}},
+		{{Name: fees.MinADADepositFeeName, Type: fees.FEE_TYPE_FLAT, Amount: 1}},
+		{{Type: fees.FEE_TYPE_FLAT, Amount: 1}},
+	}
+	for _, rules := range cases {
+		_, err := fees.New(rules, []fees.PromoWindow{}, 1000000)
+		if err == nil {
+			t.Errorf("expected fees %+v to be rejected", rules)
+		}
+	}
+}
+
+func TestMaxMinLovelace(t *testing.T) {
+	service, err := fees.New([]fees.FeeRule{}, []fees.PromoWindow{}, 1000000)
+	if err != nil {
+		t.Fatalf("failed to create fees service: %+v", err)
+	}
+
+	otherPolicyID := "a5e6bf0500378d4f0da4e8dde6becec7621cd8cbf5cbb9b87013d4cc"
+	possible := []string{policyID + ".A", policyID + ".BB", otherPolicyID + ".CCC", otherPolicyID + ".DDDD"}
+	// no draw of up to 2 of them needs more than the bound
+	for i := range possible {
+		for j := range possible {
+			drawn := []string{possible[i], possible[j]}
+			if service.MinLovelace(drawn) > service.MaxMinLovelace(possible, 2) {
+				t.Errorf("%+v needs more than the bound, %d > %d", drawn, service.MinLovelace(drawn), service.MaxMinLovelace(possible, 2))
+			}
+		}
+	}
+	if service.MaxMinLovelace(possible, 10) != service.MinLovelace(possible) {
+		t.Errorf("expected the bound for more units than tokens to be every token's min lovelace")
+	}
+	if service.MaxMinLovelace([]string{}, 0) != 1000000 {
+		t.Errorf("expected the bound with no tokens to be the min UTxO")
+	}
+}
@@ -0,0 +1,16 @@
+package listings
+
+import (
+	"context"
+	"time"
+)
+
+type Service interface {
+	// every listed product, sorted by product ID
+	GetListings(ctx context.Context) ([]Listing, error)
+	GetListing(ctx context.Context, productID string) (*Listing, error)
+	// how long listings are cached for
+	CacheTTL() time.Duration
+	// drops cached listings, e.g. after products changed
+	Invalidate()
+}
@@ -0,0 +1,304 @@
+package listings
+
+import (
+	"fmt"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+	"math/big"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+)
+
+const (
+	// used when products.listing-cache-ttl-seconds is not set
+	defaultCacheTTL = 15 * time.Second
+)
+
+var (
+	ErrListingNotFound = errors.New("product not found")
+)
+
+// the chance of a product on one draw of a slot
+type ProductOdds struct {
+	ProductID string `json:"product_id"`
+	// the pool the product is drawn from, empty for fixed products
+	Pool string `json:"pool,omitempty"`
+	// 1 for fixed products
+	Probability float64 `json:"probability"`
+}
+
+type SlotListing struct {
+	Type string `json:"type"`
+	// number of products the slot unpacks into
+	Count int `json:"count"`
+	Products []ProductOdds `json:"products"`
+}
+
+// what a bundle unpacks into, with the odds its next draws would be made with given current stock
+type BundleListing struct {
+	Name string `json:"name"`
+	Size int `json:"size"`
+	Slots []SlotListing `json:"slots"`
+}
+
+type Listing struct {
+	ProductID string `json:"product_id"`
+	// the running sale phase's price if it overrides the listed one
+	PriceUnitAmount float64 `json:"price_unit_amount"`
+	PriceCurrencyID string `json:"price_currency_id"`
+	MaxOrderSize int `json:"max_order_size"`
+	DateListed *time.Time `json:"date_listed"`
+	DateAvailable *time.Time `json:"date_available"`
+	// whether the availability date has passed
+	Available bool `json:"available"`
+	// whether the product can be ordered on its own now, see phases.Service.CheckPurchasable
+	Purchasable bool `json:"purchasable"`
+	// the running sale phase selling the product
+	Phase string `json:"phase,omitempty"`
+	NativeTokenID string `json:"native_token_id,omitempty"`
+	// unreserved units, for bundles at most the number that can be unpacked from the stock of their contents
+	Stock int64 `json:"stock"`
+	Bundle *BundleListing `json:"bundle,omitempty"`
+}
+
+// the parts of cardano.Service used to read stock
+type StockSource interface {
+	GetUnreservedStock(ctx context.Context) (map[string]*big.Int, error)
+}
+
+type ServiceImpl struct {
+	productsService products.Service
+	phasesService phases.Service
+	stockSource StockSource
+	cacheTTL time.Duration
+	// listings are loaded under the mutex so that concurrent requests share one stock query
+	mutex sync.Mutex
+	listings []Listing
+	expiresAt time.Time
+}
+
+// creates a new ServiceImpl, listings are cached for cacheTTL
+func New(productsService products.Service, phasesService phases.Service, stockSource StockSource, cacheTTL time.Duration) *ServiceImpl {
+	if cacheTTL <= 0 {
+		cacheTTL = defaultCacheTTL
+	}
+
+	return &ServiceImpl{
+		productsService: productsService,
+		phasesService: phasesService,
+		stockSource: stockSource,
+		cacheTTL: cacheTTL,
+	}
+}
+
+// creates a new ServiceImpl caching listings for products.listing-cache-ttl-seconds
+func NewFromConfig(cfg *config.Config, productsService products.Service, phasesService phases.Service, stockSource StockSource) *ServiceImpl {
+	return New(productsService, phasesService, stockSource, time.Duration(cfg.Products.ListingCacheTTLSeconds) * time.Second)
+}
+
+func (s *ServiceImpl) CacheTTL() time.Duration {
+	return s.cacheTTL
+}
+
+func (s *ServiceImpl) Invalidate() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.listings = nil
+}
+
+func (s *ServiceImpl) GetListings(ctx context.Context) ([]Listing, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.listings != nil && time.Now().Before(s.expiresAt) {
+		return s.listings, nil
+	}
+
+	listings, err := s.loadListings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.listings = listings
+	s.expiresAt = time.Now().Add(s.cacheTTL)
+	return listings, nil
+}
+
+func (s *ServiceImpl) GetListing(ctx context.Context, productID string) (*Listing, error) {
+	listings, err := s.GetListings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range listings {
+		if listings[i].ProductID == productID {
+			listing := listings[i]
+			return &listing, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrListingNotFound, productID)
+}
+
+func (s *ServiceImpl) loadListings(ctx context.Context) ([]Listing, error) {
+	productsByID, err := s.productsService.GetProducts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	unreserved, err := s.stockSource.GetUnreservedStock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unreserved stock: %v", err)
+	}
+
+	// the same stock the order's bundles are unpacked with, see cardano.NativeTokensFromOrder
+	stock := products.Stock{}
+	for productID, product := range productsByID {
+		if quantity, ok := unreserved[product.NativeTokenID]; ok && quantity.IsInt64() {
+			stock[productID] = quantity.Int64()
+		}
+	}
+
+	now := time.Now()
+	listings := []Listing{}
+	for _, product := range productsByID {
+		// not visible until it is listed
+		if product.DateListed != nil && product.DateListed.After(now) {
+			continue
+		}
+
+		listing := Listing{
+			ProductID: product.ProductID,
+			PriceUnitAmount: product.PriceUnitAmount,
+			PriceCurrencyID: product.PriceCurrencyID,
+			MaxOrderSize: product.MaxOrderSize,
+			DateListed: product.DateListed,
+			DateAvailable: product.DateAvailable,
+			Available: product.DateAvailable == nil || !product.DateAvailable.After(now),
+			NativeTokenID: product.NativeTokenID,
+			Stock: stock[product.ProductID],
+		}
+		phase, err := s.phasesService.CheckPurchasable(product, now)
+		if err == nil {
+			listing.Purchasable = true
+			listing.PriceUnitAmount = s.phasesService.Price(product, phase)
+			if phase != nil {
+				listing.Phase = phase.Name
+			}
+		}
+		bundle := s.productsService.GetCatalog().Bundle(product.ProductID)
+		if bundle != nil {
+			listing.Bundle, listing.Stock, err = s.bundleListing(bundle, stock)
+			if err != nil {
+				return nil, err
+			}
+		}
+		listings = append(listings, listing)
+	}
+
+	sort.Slice(listings, func(i, j int) bool {
+		return listings[i].ProductID < listings[j].ProductID
+	})
+	return listings, nil
+}
+
+// a bundle's contents with the odds of its next draws, and how many could be unpacked from stock
+func (s *ServiceImpl) bundleListing(bundle *products.Bundle, stock products.Stock) (*BundleListing, int64, error) {
+	catalog := s.productsService.GetCatalog()
+	bundleStock := int64(-1)
+
+	odds, err := s.productsService.BundleOdds(bundle.ProductID, stock)
+	if errors.Is(err, products.ErrOutOfStock) {
+		// sold out, show the catalog's odds
+		bundleStock = 0
+		odds, err = s.productsService.BundleOdds(bundle.ProductID, nil)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	listing := &BundleListing{
+		Name: bundle.Name,
+		Size: bundle.Size,
+		Slots: []SlotListing{},
+	}
+	next := 0
+	for _, slot := range bundle.Slots {
+		count := slot.Count
+		if count == 0 {
+			count = 1
+		}
+
+		slotListing := SlotListing{
+			Type: slot.Type,
+			Products: []ProductOdds{},
+		}
+		if slot.Type == products.SLOT_FIXED {
+			fixed := append([]string{}, slot.Products...)
+			for _, name := range slot.Pools {
+				fixed = append(fixed, catalog.Pools[name]...)
+			}
+			slotListing.Count = len(fixed)
+			for _, productID := range fixed {
+				slotListing.Products = append(slotListing.Products, ProductOdds{
+					ProductID: productID,
+					Probability: 1,
+				})
+				bundleStock = minStock(bundleStock, stock[productID])
+			}
+		} else {
+			slotListing.Count = count
+			slotListing.Products = drawOdds(odds[next])
+			next += 1
+			// every draw of the slot can come from any of its products left
+			var available int64
+			for _, p := range slotListing.Products {
+				available += stock[p.ProductID]
+			}
+			bundleStock = minStock(bundleStock, available / int64(count))
+		}
+		listing.Slots = append(listing.Slots, slotListing)
+	}
+
+	if bundleStock < 0 {
+		bundleStock = 0
+	}
+	return listing, bundleStock, nil
+}
+
+func minStock(a int64, b int64) int64 {
+	if b < 0 {
+		b = 0
+	}
+	if a < 0 || b < a {
+		return b
+	}
+	return a
+}
+
+// the chance of each product on one draw with odds
+func drawOdds(odds novellia_database.DrawOdds) []ProductOdds {
+	total := 0
+	for _, pool := range odds.Pools {
+		total += pool.Weight
+	}
+
+	productOdds := []ProductOdds{}
+	for _, pool := range odds.Pools {
+		if total <= 0 || len(pool.Products) == 0 {
+			continue
+		}
+		for _, productID := range pool.Products {
+			productOdds = append(productOdds, ProductOdds{
+				ProductID: productID,
+				Pool: pool.Pool,
+				Probability: float64(pool.Weight) / float64(total) / float64(len(pool.Products)),
+			})
+		}
+	}
+	return productOdds
+}
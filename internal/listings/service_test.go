@@ -0,0 +1,144 @@
+package listings_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/listings"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+)
+
+const (
+	catalogPath = "../../config/catalog.yaml"
+	boosterProductID = "PROD-01F4NAF8MANXDT26MGA5E0QXNJ"
+	starterDeckProductID = "PROD-01F4NAFJCAG5JDEGMR0XQARBW2"
+	unlistedProductID = "PROD-UNLISTED"
+)
+
+// serves products from memory instead of the database
+type testProducts struct {
+	*products.ServiceImpl
+	products map[string]novellia_database.Product
+}
+
+func (p *testProducts) GetProducts(ctx context.Context) (map[string]novellia_database.Product, error) {
+	return p.products, nil
+}
+
+type testStock struct {
+	stock map[string]*big.Int
+	queries int
+}
+
+func (s *testStock) GetUnreservedStock(ctx context.Context) (map[string]*big.Int, error) {
+	s.queries += 1
+	return s.stock, nil
+}
+
+func TestGetListings(t *testing.T) {
+	ctx := context.Background()
+
+	catalog, err := products.LoadCatalog(catalogPath)
+	if err != nil {
+		t.Fatalf("failed to load catalog: %v", err)
+	}
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	productsService := &testProducts{
+		ServiceImpl: products.New(nil, catalog, 0),
+		products: map[string]novellia_database.Product{
+			boosterProductID: novellia_database.Product{ProductID: boosterProductID, PriceUnitAmount: 3, PriceCurrencyID: "ada", MaxOrderSize: 10, DateListed: &past, DateAvailable: &future},
+			starterDeckProductID: novellia_database.Product{ProductID: starterDeckProductID, PriceUnitAmount: 10, PriceCurrencyID: "ada", MaxOrderSize: 2},
+			unlistedProductID: novellia_database.Product{ProductID: unlistedProductID, PriceUnitAmount: 1, PriceCurrencyID: "ada", DateListed: &future},
+		},
+	}
+	// the rares are sold out, every other card has 10 units
+	stock := &testStock{stock: map[string]*big.Int{}}
+	for name, pool := range catalog.Pools {
+		for _, productID := range pool {
+			productsService.products[productID] = novellia_database.Product{ProductID: productID, NativeTokenID: "TOKEN-" + productID}
+			if name == "occulta-novellia-rare" {
+				stock.stock["TOKEN-" + productID] = big.NewInt(0)
+			} else {
+				stock.stock["TOKEN-" + productID] = big.NewInt(10)
+			}
+		}
+	}
+
+	// the starter deck is on sale for 8 during the running phase, the booster is not sold
+	schedule := &phases.Schedule{
+		Phases: []phases.Phase{
+			phases.Phase{
+				Name: "pre-order",
+				StartTime: past.Format(time.RFC3339),
+				Products: []string{starterDeckProductID},
+				Prices: map[string]float64{starterDeckProductID: 8},
+			},
+		},
+	}
+	err = schedule.Validate()
+	if err != nil {
+		t.Fatalf("invalid schedule: %v", err)
+	}
+
+	s := listings.New(productsService, phases.New(schedule), stock, time.Minute)
+	productListings, err := s.GetListings(ctx)
+	if err != nil {
+		t.Fatalf("failed to get listings: %v", err)
+	}
+	for _, listing := range productListings {
+		if listing.ProductID == unlistedProductID {
+			t.Errorf("expected products that are not listed yet to be hidden")
+		}
+	}
+
+	booster, err := s.GetListing(ctx, boosterProductID)
+	if err != nil {
+		t.Fatalf("failed to get booster listing: %v", err)
+	}
+	if booster.Available || booster.Purchasable || booster.PriceUnitAmount != 3 || booster.Bundle == nil || len(booster.Bundle.Slots) != 1 {
+		t.Fatalf("unexpected booster listing %+v", booster)
+	}
+	// 11 kinda and not that rare cards with 10 units each, 3 per booster
+	if booster.Stock != 110 / 3 {
+		t.Errorf("expected %d boosters in stock, got %d", 110 / 3, booster.Stock)
+	}
+	total := 0.0
+	for _, p := range booster.Bundle.Slots[0].Products {
+		if p.Pool == "occulta-novellia-rare" {
+			t.Errorf("expected sold out rares to be left out of the odds, got %+v", p)
+		}
+		total += p.Probability
+	}
+	if math.Abs(total - 1) > 1e-9 {
+		t.Errorf("expected the odds to add up to 1, got %f", total)
+	}
+
+	// the guaranteed rare is sold out, so no starter decks can be unpacked
+	starterDeck, err := s.GetListing(ctx, starterDeckProductID)
+	if err != nil {
+		t.Fatalf("failed to get starter deck listing: %v", err)
+	}
+	if starterDeck.Stock != 0 || !starterDeck.Purchasable || starterDeck.Phase != "pre-order" || starterDeck.PriceUnitAmount != 8 || len(starterDeck.Bundle.Slots) != 2 || starterDeck.Bundle.Slots[1].Count != 11 {
+		t.Errorf("unexpected starter deck listing %+v", starterDeck)
+	}
+
+	card, err := s.GetListing(ctx, catalog.Pools["occulta-novellia-kinda-rare"][0])
+	if err != nil || card.Stock != 10 || card.Bundle != nil {
+		t.Errorf("unexpected card listing %+v: %v", card, err)
+	}
+
+	_, err = s.GetListing(ctx, unlistedProductID)
+	if !errors.Is(err, listings.ErrListingNotFound) {
+		t.Errorf("expected ErrListingNotFound, got %v", err)
+	}
+	if stock.queries != 1 {
+		t.Errorf("expected listings to be cached, stock was queried %d times", stock.queries)
+	}
+}
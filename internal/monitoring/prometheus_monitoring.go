@@ -77,6 +77,121 @@ var (
 		Name: "validate_stock_failed_metric",
 		Help: "The total number of times there wasn't enough stock to reserve an order",
 	})
+	reconciliationDiscrepanciesMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name: "reconciliation_discrepancies",
+		Help: "The number of discrepancies of each type found by the last reconciliation against NowPayments",
+	}, []string{"type"})
+	watchReconciliationStatusMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name: "watch_reconciliation_status",
+		Help: "Health status indicator for WatchReconciliation goroutine",
+	})
+	paymentRefundRequiredMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "payment_refund_required",
+		Help: "The total number of times an orphaned payment received funds and has to be refunded",
+	})
+	watchPaymentCompensationsStatusMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name: "watch_payment_compensations_status",
+		Help: "Health status indicator for WatchPaymentCompensations goroutine",
+	})
+	orderEventsListenerStatusMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name: "order_events_listener_status",
+		Help: "Health status indicator for the order events LISTEN connection",
+	})
+	orderEventSubscribersMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name: "order_event_subscribers",
+		Help: "The number of open order event streams and long polls",
+	})
+	webhookDeliveredMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "webhook_delivered",
+		Help: "The total number of outbound webhooks delivered",
+	})
+	webhookFailedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "webhook_failed",
+		Help: "The total number of failed outbound webhook attempts",
+	})
+	webhookDeadLetteredMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "webhook_dead_lettered",
+		Help: "The total number of outbound webhooks moved to the dead-letter table",
+	})
+	watchWebhookDeliveriesStatusMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name: "watch_webhook_deliveries_status",
+		Help: "Health status indicator for WatchWebhookDeliveries goroutine",
+	})
+	notificationSentMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "notification_sent",
+		Help: "The total number of customer notifications sent",
+	})
+	notificationFailedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "notification_failed",
+		Help: "The total number of customer notifications that ran out of attempts",
+	})
+	watchNotificationsStatusMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name: "watch_notifications_status",
+		Help: "Health status indicator for WatchNotifications goroutine",
+	})
+	bundlePoolOutOfStockMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "bundle_pool_out_of_stock",
+		Help: "The total number of bundle draws where a pool had no products in stock",
+	})
+	productCacheHitMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "product_cache_hit",
+		Help: "The total number of product reads served from the cache",
+	})
+	productCacheMissMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "product_cache_miss",
+		Help: "The total number of product reads that found the cache expired or invalidated",
+	})
+	productCacheRefreshMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "product_cache_refresh",
+		Help: "The total number of times products were loaded into the cache",
+	})
+	productCacheRefreshFailedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "product_cache_refresh_failed",
+		Help: "The total number of failed product loads",
+	})
+	productChangesListenerStatusMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name: "product_changes_listener_status",
+		Help: "Health status indicator for the product changes LISTEN connection",
+	})
+	waitlistJoinedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "waitlist_joined",
+		Help: "The total number of customers added to the waitlist of a sold-out product",
+	})
+	waitlistReservedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "waitlist_reserved",
+		Help: "The total number of waitlist entries stock was reserved for",
+	})
+	waitlistReservationExpiredMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name: "waitlist_reservation_expired",
+		Help: "The total number of waitlist reservations released without an order",
+	})
+	watchWaitlistStatusMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name: "watch_waitlist_status",
+		Help: "Health status indicator for WatchWaitlist goroutine",
+	})
 	/*
 	walletStockHistogramMetric = promauto.NewHistogram(prometheus.HistogramOpts{
 		Namespace: namespace,
@@ -197,3 +312,95 @@ func TickSubmittedToCardano() {
 func TickValidateStockFailed() {
 	validateStockFailedMetric.Inc()
 }
+
+func SetReconciliationDiscrepancies(discrepancyType string, count float64) {
+	reconciliationDiscrepanciesMetric.WithLabelValues(discrepancyType).Set(count)
+}
+
+func SetWatchReconciliationStatus(status float64) {
+	watchReconciliationStatusMetric.Set(status)
+}
+
+func TickPaymentRefundRequired() {
+	paymentRefundRequiredMetric.Inc()
+}
+
+func SetWatchPaymentCompensationsStatus(status float64) {
+	watchPaymentCompensationsStatusMetric.Set(status)
+}
+
+func SetOrderEventsListenerStatus(status float64) {
+	orderEventsListenerStatusMetric.Set(status)
+}
+
+func AddOrderEventSubscribers(delta float64) {
+	orderEventSubscribersMetric.Add(delta)
+}
+
+func TickWebhookDelivered() {
+	webhookDeliveredMetric.Inc()
+}
+
+func TickWebhookFailed() {
+	webhookFailedMetric.Inc()
+}
+
+func TickWebhookDeadLettered() {
+	webhookDeadLetteredMetric.Inc()
+}
+
+func SetWatchWebhookDeliveriesStatus(status float64) {
+	watchWebhookDeliveriesStatusMetric.Set(status)
+}
+
+func TickNotificationSent() {
+	notificationSentMetric.Inc()
+}
+
+func TickNotificationFailed() {
+	notificationFailedMetric.Inc()
+}
+
+func SetWatchNotificationsStatus(status float64) {
+	watchNotificationsStatusMetric.Set(status)
+}
+
+func TickBundlePoolOutOfStock() {
+	bundlePoolOutOfStockMetric.Inc()
+}
+
+func TickProductCacheHit() {
+	productCacheHitMetric.Inc()
+}
+
+func TickProductCacheMiss() {
+	productCacheMissMetric.Inc()
+}
+
+func TickProductCacheRefresh() {
+	productCacheRefreshMetric.Inc()
+}
+
+func TickProductCacheRefreshFailed() {
+	productCacheRefreshFailedMetric.Inc()
+}
+
+func SetProductChangesListenerStatus(status float64) {
+	productChangesListenerStatusMetric.Set(status)
+}
+
+func TickWaitlistJoined() {
+	waitlistJoinedMetric.Inc()
+}
+
+func TickWaitlistReserved() {
+	waitlistReservedMetric.Inc()
+}
+
+func AddWaitlistReservationsExpired(count float64) {
+	waitlistReservationExpiredMetric.Add(count)
+}
+
+func SetWatchWaitlistStatus(status float64) {
+	watchWaitlistStatusMetric.Set(status)
+}
@@ -0,0 +1,19 @@
+package notifications
+
+import (
+	"context"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+)
+
+type Service interface {
+	// renders and queues a notification on each channel the order's customer gave a contact for
+	Notify(ctx context.Context, eventType string, data EventData) error
+	// renders and queues a notification on each channel of contact, nil notifies no one
+	NotifyContact(ctx context.Context, contact *novellia_database.OrderContact, eventType string, data EventData) error
+	// renders the notifications Notify would queue, for the caller to write alongside its own changes
+	Notifications(ctx context.Context, eventType string, data EventData) ([]novellia_database.Notification, error)
+	// sends notifications that are due, retrying failures with exponential backoff
+	SendDue(ctx context.Context) error
+	WatchNotifications(ctx context.Context)
+}
@@ -0,0 +1,452 @@
+package notifications
+
+import (
+	"fmt"
+	"time"
+	"io"
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+	"text/template"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders/statemachine"
+	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
+)
+
+// each has a template named <event>.tmpl in the templates path, defining "subject" and "body"
+const (
+	EVENT_PAYMENT_RECEIVED = "payment_received"
+	// the order's tokens were sent on Cardano
+	EVENT_TOKENS_SENT = "tokens_sent"
+	// an operator recorded that the order's refund was made, not sent when a refund is only required
+	EVENT_REFUND_ISSUED = "refund_issued"
+	// stock was reserved for a waitlist entry
+	EVENT_BACK_IN_STOCK = "back_in_stock"
+)
+
+const (
+	CHANNEL_EMAIL = "email"
+	CHANNEL_DISCORD = "discord"
+)
+
+const (
+	defaultMaxAttempts = 8
+	defaultRetryBaseDelay = 1 * time.Minute
+	defaultTimeout = 10 * time.Second
+	maxRetryDelay = 6 * time.Hour
+	// notifications sent per claim
+	sendBatchSize = 20
+	checkNotificationsInterval = 5 * time.Second
+	// responses are only read this far for error messages
+	maxErrorBodyBytes = 512
+	// Discord rejects longer message content
+	maxDiscordContentLength = 2000
+)
+
+var (
+	ErrInvalidContact = errors.New("invalid contact")
+	eventTypes = []string{
+		EVENT_PAYMENT_RECEIVED,
+		EVENT_TOKENS_SENT,
+		EVENT_REFUND_ISSUED,
+		EVENT_BACK_IN_STOCK,
+	}
+	discordWebhookPrefixes = []string{
+		"https://discord.com/api/webhooks/",
+		"https://discordapp.com/api/webhooks/",
+	}
+)
+
+// what an event's template is rendered with
+type EventData struct {
+	OrderID string
+	// status the order moved to, if the event came from a transition
+	// transition reasons are written for operators and are not shown to customers
+	Status string
+	// Cardano transaction for tokens_sent
+	TxID string
+	// the reservation for back_in_stock, which has no order yet
+	WaitlistEntryID string
+	ProductID string
+	Quantity int64
+	ReservedUntil time.Time
+}
+
+type templateData struct {
+	EventData
+	// link to TxID on the explorer, empty without one
+	ExplorerURL string
+}
+
+type SMTPConfig struct {
+	// host:port
+	Addr string
+	Username string
+	Password string
+	From string
+}
+
+// the parts of novellia_database.Service used to queue and send notifications
+type Store interface {
+	GenerateULID(prefix string) string
+	QueryOrderContact(ctx context.Context, orderID string) (*novellia_database.OrderContact, error)
+	InsertNotifications(ctx context.Context, notifications []novellia_database.Notification) error
+	ClaimNotifications(ctx context.Context, lease time.Duration, limit int) ([]novellia_database.Notification, error)
+	UpdateNotificationSent(ctx context.Context, notificationID string, attempts int) error
+	UpdateNotificationRetry(ctx context.Context, notificationID string, attempts int, lastError string, delay time.Duration) error
+	UpdateNotificationFailed(ctx context.Context, notificationID string, attempts int, lastError string) error
+}
+
+type ServiceImpl struct {
+	store Store
+	// event type -> template defining "subject" and "body"
+	templates map[string]*template.Template
+	// transaction IDs are appended to this
+	explorerTxURL string
+	smtp SMTPConfig
+	client *http.Client
+	maxAttempts int
+	retryBaseDelay time.Duration
+}
+
+// creates a new ServiceImpl with templates loaded from templatesPath, zero values of maxAttempts, retryBaseDelay and timeout use defaults
+func New(store Store, templatesPath string, explorerTxURL string, smtpConfig SMTPConfig, maxAttempts int, retryBaseDelay time.Duration, timeout time.Duration) (*ServiceImpl, error) {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	if retryBaseDelay <= 0 {
+		retryBaseDelay = defaultRetryBaseDelay
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if smtpConfig.Addr != "" && smtpConfig.From == "" {
+		return nil, fmt.Errorf("SMTP requires a from address")
+	}
+
+	s := ServiceImpl{
+		store: store,
+		templates: make(map[string]*template.Template),
+		explorerTxURL: explorerTxURL,
+		smtp: smtpConfig,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		maxAttempts: maxAttempts,
+		retryBaseDelay: retryBaseDelay,
+	}
+	for _, eventType := range eventTypes {
+		path := filepath.Join(templatesPath, fmt.Sprintf("%s.tmpl", eventType))
+		t, err := template.ParseFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load notification template: %v", err)
+		}
+		if t.Lookup("subject") == nil || t.Lookup("body") == nil {
+			return nil, fmt.Errorf("notification template %s must define subject and body", path)
+		}
+		s.templates[eventType] = t
+	}
+
+	return &s, nil
+}
+
+// creates a new ServiceImpl from notifications in the config
+func NewFromConfig(cfg *config.Config, store Store) (*ServiceImpl, error) {
+	smtpConfig := SMTPConfig{
+		Username: cfg.Notifications.SMTP.Username,
+		Password: cfg.Notifications.SMTP.Password,
+		From: cfg.Notifications.SMTP.From,
+	}
+	if cfg.Notifications.SMTP.Host != "" {
+		smtpConfig.Addr = fmt.Sprintf("%s:%d", cfg.Notifications.SMTP.Host, cfg.Notifications.SMTP.Port)
+	}
+
+	return New(
+		store,
+		cfg.Notifications.TemplatesPath,
+		cfg.Notifications.ExplorerTxURL,
+		smtpConfig,
+		cfg.Notifications.MaxAttempts,
+		time.Duration(cfg.Notifications.RetryBaseDelaySeconds) * time.Second,
+		time.Duration(cfg.Notifications.TimeoutSeconds) * time.Second,
+	)
+}
+
+// checks the contact given with an order, nil is valid
+func ValidateContact(contact *novellia_database.OrderContact) error {
+	if contact == nil {
+		return nil
+	}
+	if contact.Email != "" {
+		address, err := mail.ParseAddress(contact.Email)
+		if err != nil || address.Address != contact.Email {
+			return fmt.Errorf("%w: email %q is not an address", ErrInvalidContact, contact.Email)
+		}
+	}
+	if contact.DiscordWebhookURL != "" {
+		valid := false
+		for _, prefix := range discordWebhookPrefixes {
+			if strings.HasPrefix(contact.DiscordWebhookURL, prefix) {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%w: discord_webhook_url must start with %s", ErrInvalidContact, discordWebhookPrefixes[0])
+		}
+	}
+	return nil
+}
+
+// the event a customer is notified of when their order moves between statuses, empty if none is
+func EventTypeForTransition(from string, to string) string {
+	switch {
+	case from == to:
+		return ""
+	case to == statemachine.STATE_PAID:
+		return EVENT_PAYMENT_RECEIVED
+	default:
+		return ""
+	}
+}
+
+func (s *ServiceImpl) render(eventType string, data EventData) (string, string, error) {
+	t, ok := s.templates[eventType]
+	if !ok {
+		return "", "", fmt.Errorf("unknown notification event %s", eventType)
+	}
+
+	values := templateData{
+		EventData: data,
+	}
+	if data.TxID != "" && s.explorerTxURL != "" {
+		values.ExplorerURL = s.explorerTxURL + data.TxID
+	}
+
+	var subject bytes.Buffer
+	err := t.ExecuteTemplate(&subject, "subject", values)
+	if err != nil {
+		return "", "", err
+	}
+	var body bytes.Buffer
+	err = t.ExecuteTemplate(&body, "body", values)
+	if err != nil {
+		return "", "", err
+	}
+	// subjects become a header, so they are kept to one line
+	return strings.Join(strings.Fields(subject.String()), " "), body.String(), nil
+}
+
+func (s *ServiceImpl) Notify(ctx context.Context, eventType string, data EventData) error {
+	contact, err := s.store.QueryOrderContact(ctx, data.OrderID)
+	if err != nil {
+		return err
+	}
+	return s.NotifyContact(ctx, contact, eventType, data)
+}
+
+// what a notification is about, for errors and logs
+func subjectID(orderID string, waitlistEntryID string) string {
+	if orderID == "" {
+		return fmt.Sprintf("waitlist entry %s", waitlistEntryID)
+	}
+	return fmt.Sprintf("order %s", orderID)
+}
+
+func (s *ServiceImpl) NotifyContact(ctx context.Context, contact *novellia_database.OrderContact, eventType string, data EventData) error {
+	notifications, err := s.contactNotifications(contact, eventType, data)
+	if err != nil {
+		return err
+	}
+
+	err = s.store.InsertNotifications(ctx, notifications)
+	if err != nil {
+		return fmt.Errorf("failed to queue %s notifications for %s: %v", eventType, subjectID(data.OrderID, data.WaitlistEntryID), err)
+	}
+	return nil
+}
+
+func (s *ServiceImpl) Notifications(ctx context.Context, eventType string, data EventData) ([]novellia_database.Notification, error) {
+	contact, err := s.store.QueryOrderContact(ctx, data.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	return s.contactNotifications(contact, eventType, data)
+}
+
+// renders a notification for each channel of contact without queuing them
+func (s *ServiceImpl) contactNotifications(contact *novellia_database.OrderContact, eventType string, data EventData) ([]novellia_database.Notification, error) {
+	if contact == nil {
+		return nil, nil
+	}
+
+	subject, body, err := s.render(eventType, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render %s notification for %s: %v", eventType, subjectID(data.OrderID, data.WaitlistEntryID), err)
+	}
+
+	notifications := []novellia_database.Notification{}
+	if contact.Email != "" && s.smtp.Addr != "" {
+		notifications = append(notifications, novellia_database.Notification{
+			NotificationID: s.store.GenerateULID("NOTIFICATION"),
+			OrderID: data.OrderID,
+			WaitlistEntryID: data.WaitlistEntryID,
+			Channel: CHANNEL_EMAIL,
+			Recipient: contact.Email,
+			EventType: eventType,
+			Subject: subject,
+			Body: body,
+		})
+	}
+	if contact.DiscordWebhookURL != "" {
+		notifications = append(notifications, novellia_database.Notification{
+			NotificationID: s.store.GenerateULID("NOTIFICATION"),
+			OrderID: data.OrderID,
+			WaitlistEntryID: data.WaitlistEntryID,
+			Channel: CHANNEL_DISCORD,
+			Recipient: contact.DiscordWebhookURL,
+			EventType: eventType,
+			Subject: subject,
+			Body: body,
+		})
+	}
+	return notifications, nil
+}
+
+// how long to wait after a number of failed attempts
+func (s *ServiceImpl) retryDelay(attempts int) time.Duration {
+	delay := s.retryBaseDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i += 1 {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func (s *ServiceImpl) sendEmail(n novellia_database.Notification) error {
+	if s.smtp.Addr == "" {
+		return fmt.Errorf("SMTP is not configured")
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", s.smtp.From)
+	fmt.Fprintf(&message, "To: %s\r\n", n.Recipient)
+	fmt.Fprintf(&message, "Subject: %s\r\n", n.Subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%s@order-fulfillment>\r\n", n.NotificationID)
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(strings.ReplaceAll(n.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if s.smtp.Username != "" {
+		host := s.smtp.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.smtp.Username, s.smtp.Password, host)
+	}
+	return smtp.SendMail(s.smtp.Addr, auth, s.smtp.From, []string{n.Recipient}, message.Bytes())
+}
+
+func (s *ServiceImpl) sendDiscord(ctx context.Context, n novellia_database.Notification) error {
+	content := fmt.Sprintf("**%s**\n%s", n.Subject, n.Body)
+	if len(content) > maxDiscordContentLength {
+		content = content[:maxDiscordContentLength]
+	}
+	body, err := json.Marshal(map[string]string{
+		"content": content,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.Recipient, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		return fmt.Errorf("discord responded %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// sends a notification once, recording the outcome
+func (s *ServiceImpl) send(ctx context.Context, n novellia_database.Notification) error {
+	attempts := n.Attempts + 1
+
+	var err error
+	switch n.Channel {
+	case CHANNEL_EMAIL:
+		err = s.sendEmail(n)
+	case CHANNEL_DISCORD:
+		err = s.sendDiscord(ctx, n)
+	default:
+		err = fmt.Errorf("unknown channel %s", n.Channel)
+	}
+	if err == nil {
+		prometheus_monitoring.TickNotificationSent()
+		return s.store.UpdateNotificationSent(ctx, n.NotificationID, attempts)
+	}
+
+	fmt.Printf("Notification %s (%s for %s) by %s failed, attempt %d: %+v\n", n.NotificationID, n.EventType, subjectID(n.OrderID, n.WaitlistEntryID), n.Channel, attempts, err)
+	if attempts >= s.maxAttempts {
+		prometheus_monitoring.TickNotificationFailed()
+		return s.store.UpdateNotificationFailed(ctx, n.NotificationID, attempts, err.Error())
+	}
+	return s.store.UpdateNotificationRetry(ctx, n.NotificationID, attempts, err.Error(), s.retryDelay(attempts))
+}
+
+func (s *ServiceImpl) SendDue(ctx context.Context) error {
+	// leased long enough for every claimed notification to time out before another instance retries them
+	lease := time.Duration(sendBatchSize) * s.client.Timeout + time.Minute
+	notifications, err := s.store.ClaimNotifications(ctx, lease, sendBatchSize)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, n := range notifications {
+		err = s.send(ctx, n)
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (s *ServiceImpl) WatchNotifications(ctx context.Context) {
+	go func() {
+		for {
+			time.Sleep(checkNotificationsInterval)
+
+			err := s.SendDue(ctx)
+			if err != nil {
+				fmt.Printf("WatchNotifications error: %+v\n", err)
+				prometheus_monitoring.SetWatchNotificationsStatus(0)
+				continue
+			}
+			prometheus_monitoring.SetWatchNotificationsStatus(1)
+		}
+	}()
+}
@@ -0,0 +1,218 @@
+package notifications_test
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"io/ioutil"
+	"encoding/json"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/notifications"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/smtp_sink"
+)
+
+const (
+	templatesPath = "../../templates/notifications"
+	explorerTxURL = "https://cardanoscan.io/transaction/"
+)
+
+// keeps notifications in memory, every pending notification is due
+type testStore struct {
+	ids int
+	contacts map[string]*novellia_database.OrderContact
+	notifications map[string]*novellia_database.Notification
+	statuses map[string]string
+	delays map[string]time.Duration
+}
+
+func newTestStore() *testStore {
+	return &testStore{
+		contacts: make(map[string]*novellia_database.OrderContact),
+		notifications: make(map[string]*novellia_database.Notification),
+		statuses: make(map[string]string),
+		delays: make(map[string]time.Duration),
+	}
+}
+
+func (s *testStore) GenerateULID(prefix string) string {
+	s.ids += 1
+	return fmt.Sprintf("%s-%d", prefix, s.ids)
+}
+
+func (s *testStore) QueryOrderContact(ctx context.Context, orderID string) (*novellia_database.OrderContact, error) {
+	return s.contacts[orderID], nil
+}
+
+func (s *testStore) InsertNotifications(ctx context.Context, notifications []novellia_database.Notification) error {
+	for i := range notifications {
+		n := notifications[i]
+		s.notifications[n.NotificationID] = &n
+		s.statuses[n.NotificationID] = "PENDING"
+	}
+	return nil
+}
+
+func (s *testStore) ClaimNotifications(ctx context.Context, lease time.Duration, limit int) ([]novellia_database.Notification, error) {
+	claimed := []novellia_database.Notification{}
+	for id, n := range s.notifications {
+		if s.statuses[id] == "PENDING" && len(claimed) < limit {
+			claimed = append(claimed, *n)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *testStore) UpdateNotificationSent(ctx context.Context, notificationID string, attempts int) error {
+	s.statuses[notificationID] = "SENT"
+	s.notifications[notificationID].Attempts = attempts
+	return nil
+}
+
+func (s *testStore) UpdateNotificationRetry(ctx context.Context, notificationID string, attempts int, lastError string, delay time.Duration) error {
+	s.notifications[notificationID].Attempts = attempts
+	s.delays[notificationID] = delay
+	return nil
+}
+
+func (s *testStore) UpdateNotificationFailed(ctx context.Context, notificationID string, attempts int, lastError string) error {
+	s.statuses[notificationID] = "FAILED"
+	s.notifications[notificationID].Attempts = attempts
+	return nil
+}
+
+func TestValidateContact(t *testing.T) {
+	tests := []struct {
+		contact *novellia_database.OrderContact
+		valid bool
+	}{
+		{nil, true},
+		{&novellia_database.OrderContact{}, true},
+		{&novellia_database.OrderContact{Email: "customer@example.com"}, true},
+		{&novellia_database.OrderContact{Email: "Customer <customer@example.com>"}, false},
+		{&novellia_database.OrderContact{Email: "customer@example.com\r\nBcc: other@example.com"}, false},
+		{&novellia_database.OrderContact{DiscordWebhookURL: "https://discord.com/api/webhooks/1/token"}, true},
+		{&novellia_database.OrderContact{DiscordWebhookURL: "https://example.com/api/webhooks/1/token"}, false},
+	}
+
+	for _, test := range tests {
+		err := notifications.ValidateContact(test.contact)
+		if test.valid && err != nil {
+			t.Errorf("%+v: expected valid, got %v", test.contact, err)
+		}
+		if !test.valid && !errors.Is(err, notifications.ErrInvalidContact) {
+			t.Errorf("%+v: expected ErrInvalidContact, got %v", test.contact, err)
+		}
+	}
+}
+
+func TestSendDue(t *testing.T) {
+	ctx := context.Background()
+
+	sink := smtp_sink.New()
+	smtpAddr, err := sink.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start SMTP sink: %v", err)
+	}
+	defer sink.Close()
+
+	discordMessages := make(chan string, 10)
+	discord := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/failing" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var message map[string]string
+		json.Unmarshal(body, &message)
+		discordMessages <- message["content"]
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer discord.Close()
+
+	store := newTestStore()
+	store.contacts["ORDER-1"] = &novellia_database.OrderContact{
+		Email: "customer@example.com",
+		DiscordWebhookURL: discord.URL + "/discord",
+	}
+	store.contacts["ORDER-2"] = &novellia_database.OrderContact{
+		DiscordWebhookURL: discord.URL + "/failing",
+	}
+	s, err := notifications.New(store, templatesPath, explorerTxURL, notifications.SMTPConfig{
+		Addr: smtpAddr,
+		From: "orders@novellia.io",
+	}, 2, time.Minute, time.Second)
+	if err != nil {
+		t.Fatalf("failed to create notifications service: %v", err)
+	}
+
+	err = s.Notify(ctx, notifications.EVENT_TOKENS_SENT, notifications.EventData{OrderID: "ORDER-1", TxID: "abc123"})
+	if err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	err = s.Notify(ctx, notifications.EVENT_REFUND_ISSUED, notifications.EventData{OrderID: "ORDER-2", Status: "REFUND"})
+	if err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	// no contact was given with this order
+	err = s.Notify(ctx, notifications.EVENT_PAYMENT_RECEIVED, notifications.EventData{OrderID: "ORDER-3", Status: "PAID"})
+	if err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	if len(store.notifications) != 3 {
+		t.Fatalf("expected 3 notifications, got %d", len(store.notifications))
+	}
+
+	err = s.SendDue(ctx)
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	messages := sink.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(messages))
+	}
+	email := messages[0]
+	if len(email.To) != 1 || email.To[0] != "customer@example.com" || email.From != "orders@novellia.io" {
+		t.Errorf("unexpected email envelope from %s to %v", email.From, email.To)
+	}
+	if email.Header("Subject") != "Tokens sent for order ORDER-1" {
+		t.Errorf("unexpected email subject %q", email.Header("Subject"))
+	}
+	if !strings.Contains(email.Body(), explorerTxURL + "abc123") {
+		t.Errorf("expected an explorer link in the email, got %q", email.Body())
+	}
+
+	content := <-discordMessages
+	if !strings.HasPrefix(content, "**Tokens sent for order ORDER-1**") || !strings.Contains(content, explorerTxURL + "abc123") {
+		t.Errorf("unexpected Discord message %q", content)
+	}
+
+	// the failing webhook is retried after the base delay, then gives up
+	var failingID string
+	for id, n := range store.notifications {
+		if n.OrderID == "ORDER-2" {
+			failingID = id
+		} else if store.statuses[id] != "SENT" {
+			t.Errorf("expected %s by %s to be sent, got %s", id, n.Channel, store.statuses[id])
+		}
+	}
+	if !strings.Contains(store.notifications[failingID].Body, "A refund has been issued for order ORDER-2") {
+		t.Errorf("unexpected refund notification %q", store.notifications[failingID].Body)
+	}
+	if store.statuses[failingID] != "PENDING" || store.notifications[failingID].Attempts != 1 || store.delays[failingID] != time.Minute {
+		t.Fatalf("expected a retry, got %s after %d attempts with delay %v", store.statuses[failingID], store.notifications[failingID].Attempts, store.delays[failingID])
+	}
+	err = s.SendDue(ctx)
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if store.statuses[failingID] != "FAILED" {
+		t.Errorf("expected the notification to fail, got %s", store.statuses[failingID])
+	}
+}
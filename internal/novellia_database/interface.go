@@ -6,20 +6,75 @@ import (
 
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
 	"math/big"
 )
 
 type Service interface {
-	InsertOrder(ctx context.Context, order ordf.Order, payment now_payments.CreatePaymentResponse) error
+	InsertPendingOrder(ctx context.Context, order ordf.Order, quoteID string, orderFees []fees.Fee, redemption *PromotionRedemption, tokens map[string]*big.Int, transition StatusTransition, contact *OrderContact, pulls []OrderPull, eligibility *OrderEligibility, customer *OrderCustomer) error
+	AttachOrderPayment(ctx context.Context, transition StatusTransition, payment now_payments.CreatePaymentResponse) error
+	UpdateOrderStatus(ctx context.Context, transition StatusTransition) error
+	InsertPaymentCompensation(ctx context.Context, transition StatusTransition, compensation PaymentCompensation) error
+	QueryPaymentCompensations(ctx context.Context, status string) ([]PaymentCompensation, error)
+	UpdatePaymentCompensation(ctx context.Context, transition StatusTransition, status string, detail string) error
+	// the payment is nil for orders without an active payment
 	QueryOrder(ctx context.Context, orderID string) (*ordf.Order, *now_payments.GetPaymentStatusResponse, *time.Time, error)
-	UpdateOrder(ctx context.Context, order ordf.Order, payment now_payments.GetPaymentStatusResponse) error
+	QueryOrderItems(ctx context.Context, orderID string) ([]ordf.OrderItems, error)
+	QueryOrderPayments(ctx context.Context, orderID string) ([]PaymentAttempt, error)
+	InsertOrderPayment(ctx context.Context, orderID string, payment now_payments.CreatePaymentResponse) error
+	UpdateOrder(ctx context.Context, order ordf.Order, payment now_payments.GetPaymentStatusResponse, transition *StatusTransition) error
+	QueryOrderStatusHistory(ctx context.Context, orderID string) ([]StatusTransition, error)
+	QueryOrderStatus(ctx context.Context, orderID string) (string, string, error)
+	UpdateOrderDeliveryAddress(ctx context.Context, transition StatusTransition, customer OrderCustomer) error
+	InsertAuditLog(ctx context.Context, entry AuditLogEntry) error
+	SearchOrders(ctx context.Context, search OrderSearch) ([]OrderSummary, error)
+	NotifyOrderEvent(ctx context.Context, payload string) error
+	ListenOrderEvents(ctx context.Context, handler func(payload string)) error
+	InsertWebhookDeliveries(ctx context.Context, deliveries []WebhookDelivery) error
+	ClaimWebhookDeliveries(ctx context.Context, lease time.Duration, limit int) ([]WebhookDelivery, error)
+	UpdateWebhookDelivered(ctx context.Context, deliveryID string, attempts int) error
+	UpdateWebhookRetry(ctx context.Context, deliveryID string, attempts int, lastError string, delay time.Duration) error
+	DeadLetterWebhookDelivery(ctx context.Context, deliveryID string, attempts int, lastError string) error
+	QueryWebhookDeadLetters(ctx context.Context) ([]WebhookDeadLetter, error)
+	ReplayWebhookDeadLetter(ctx context.Context, deliveryID string) (bool, error)
+	QueryOrderContact(ctx context.Context, orderID string) (*OrderContact, error)
+	InsertNotifications(ctx context.Context, notifications []Notification) error
+	ClaimNotifications(ctx context.Context, lease time.Duration, limit int) ([]Notification, error)
+	UpdateNotificationSent(ctx context.Context, notificationID string, attempts int) error
+	UpdateNotificationRetry(ctx context.Context, notificationID string, attempts int, lastError string, delay time.Duration) error
+	UpdateNotificationFailed(ctx context.Context, notificationID string, attempts int, lastError string) error
+	QueryActiveSaleSeed(ctx context.Context) (*SaleSeed, error)
+	QuerySaleSeeds(ctx context.Context) ([]SaleSeed, error)
+	InsertSaleSeed(ctx context.Context, seed SaleSeed, end bool) (bool, error)
+	RevealSaleSeed(ctx context.Context, saleSeedID string) (bool, error)
+	QueryOrderPulls(ctx context.Context, orderID string) ([]OrderPull, error)
+	ReplaceAllowlist(ctx context.Context, allowlistID string, addresses []string) error
+	QueryAllowlisted(ctx context.Context, allowlistID string, addresses []string) (bool, error)
+	QueryEligibilityUnits(ctx context.Context, salePhase string, address string) (int64, error)
+	QueryCustomerUnits(ctx context.Context, deliveryAddress string, stakeAddress string, limit PurchaseLimit) (int64, error)
+	InsertWaitlistEntry(ctx context.Context, entry WaitlistEntry) (bool, error)
+	QueryWaitlistEntry(ctx context.Context, waitlistEntryID string) (*WaitlistEntry, error)
+	QueryWaitingWaitlistEntries(ctx context.Context) ([]WaitlistEntry, error)
+	QueryWaitingNativeTokens(ctx context.Context) (map[string]*big.Int, error)
+	UpdateWaitlistEntryReserved(ctx context.Context, waitlistEntryID string, reservedUntil time.Time) (bool, error)
+	UpdateWaitlistEntriesExpired(ctx context.Context) (int64, error)
+	WithWaitlistLock(ctx context.Context, fn func(ctx context.Context) error) (bool, error)
+	WithOrderFulfillmentLock(ctx context.Context, orderID string, fn func(ctx context.Context) error) (bool, error)
 	QueryOrdersReadyForCheck(ctx context.Context, interval time.Duration, requiredStatus string) ([]string, error)
 	QueryProducts(ctx context.Context) ([]Product, error)
+	ListenProductChanges(ctx context.Context, handler func(payload string)) error
 	GenerateULID(prefix string) string
-	InsertCardanoTransaction(ctx context.Context, orderID string, txid string) error
+	FillOrder(ctx context.Context, order ordf.Order, payment now_payments.GetPaymentStatusResponse, transition *StatusTransition, txid string, deliveries []WebhookDelivery, notifications []Notification) error
 	QueryOrderNativeTokens(ctx context.Context, orderID string) (map[string]*big.Int, error)
-	InsertOrderNativeTokens(ctx context.Context, orderID string, tokens map[string]*big.Int) error
 	QueryCardanoTransactions(ctx context.Context, orderID string) ([]string, error)
 	QueryReservedNativeTokens(ctx context.Context) (map[string]*big.Int, error)
+	InsertPriceQuote(ctx context.Context, quoteID string, quote []byte, expiresAt time.Time) error
+	QueryPriceQuote(ctx context.Context, quoteID string) ([]byte, error)
+	QueryOrderFees(ctx context.Context, orderID string) ([]fees.Fee, error)
+	InsertPromotionCode(ctx context.Context, code PromotionCode) error
+	QueryPromotionCodes(ctx context.Context, code string) ([]PromotionCode, error)
+	DisablePromotionCode(ctx context.Context, code string) (bool, error)
+	QueryPromotionCodeUses(ctx context.Context, code string, deliveryAddress string) (int, int, error)
+	QueryReconciliationPayments(ctx context.Context, from time.Time, to time.Time) ([]ReconciliationPayment, error)
 	Close()
 }
@@ -7,7 +7,11 @@ import (
 	"context"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
+	"sort"
 	"math/big"
+	"errors"
+	"encoding/json"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -18,6 +22,7 @@ import (
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/constants"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
 )
 
 const (
@@ -36,6 +41,83 @@ const (
 	queryCustomerOrderNativeTokens = "queryCustomerOrderNativeTokens"
 	queryCardanoTransactions = "queryCardanoTransactions"
 	queryReservedNativeTokens = "queryReservedNativeTokens"
+	insertPriceQuote = "insertPriceQuote"
+	queryPriceQuote = "queryPriceQuote"
+	updatePriceQuoteRedeemed = "updatePriceQuoteRedeemed"
+	insertCustomerOrderFee = "insertCustomerOrderFee"
+	queryCustomerOrderFees = "queryCustomerOrderFees"
+	insertPromotionCode = "insertPromotionCode"
+	queryPromotionCodes = "queryPromotionCodes"
+	updatePromotionCodeDisabled = "updatePromotionCodeDisabled"
+	queryPromotionCodeUses = "queryPromotionCodeUses"
+	insertPromotionRedemption = "insertPromotionRedemption"
+	lockPromotionCode = "lockPromotionCode"
+	updateNowPaymentsPaymentInactive = "updateNowPaymentsPaymentInactive"
+	updateCustomerOrderPaymentAddress = "updateCustomerOrderPaymentAddress"
+	queryReconciliationPayments = "queryReconciliationPayments"
+	insertPaymentCompensation = "insertPaymentCompensation"
+	queryPaymentCompensations = "queryPaymentCompensations"
+	updatePaymentCompensation = "updatePaymentCompensation"
+	insertOrderStatusHistory = "insertOrderStatusHistory"
+	queryOrderStatusHistory = "queryOrderStatusHistory"
+	queryCustomerOrderStatus = "queryCustomerOrderStatus"
+	updateCustomerOrderDeliveryAddress = "updateCustomerOrderDeliveryAddress"
+	insertAuditLog = "insertAuditLog"
+	queryCustomerOrderSearch = "queryCustomerOrderSearch"
+	notifyOrderEvent = "notifyOrderEvent"
+	listenOrderEvents = "listenOrderEvents"
+	unlistenOrderEvents = "unlistenOrderEvents"
+	listenProductChanges = "listenProductChanges"
+	unlistenProductChanges = "unlistenProductChanges"
+	insertWebhookDelivery = "insertWebhookDelivery"
+	claimWebhookDeliveries = "claimWebhookDeliveries"
+	updateWebhookDeliveryDelivered = "updateWebhookDeliveryDelivered"
+	updateWebhookDeliveryRetry = "updateWebhookDeliveryRetry"
+	updateWebhookDeliveryDead = "updateWebhookDeliveryDead"
+	insertWebhookDeadLetter = "insertWebhookDeadLetter"
+	queryWebhookDeadLetters = "queryWebhookDeadLetters"
+	deleteWebhookDeadLetter = "deleteWebhookDeadLetter"
+	updateWebhookDeliveryReplay = "updateWebhookDeliveryReplay"
+	insertCustomerOrderContact = "insertCustomerOrderContact"
+	queryCustomerOrderContact = "queryCustomerOrderContact"
+	insertNotification = "insertNotification"
+	claimNotifications = "claimNotifications"
+	updateNotificationSent = "updateNotificationSent"
+	updateNotificationRetry = "updateNotificationRetry"
+	updateNotificationFailed = "updateNotificationFailed"
+	insertSaleSeed = "insertSaleSeed"
+	updateSaleSeedEnded = "updateSaleSeedEnded"
+	updateSaleSeedRevealed = "updateSaleSeedRevealed"
+	querySaleSeeds = "querySaleSeeds"
+	queryActiveSaleSeed = "queryActiveSaleSeed"
+	insertCustomerOrderPull = "insertCustomerOrderPull"
+	queryCustomerOrderPulls = "queryCustomerOrderPulls"
+	deleteAllowlistAddresses = "deleteAllowlistAddresses"
+	insertAllowlistAddress = "insertAllowlistAddress"
+	queryAllowlistAddress = "queryAllowlistAddress"
+	insertCustomerOrderEligibility = "insertCustomerOrderEligibility"
+	queryCustomerOrderEligibilityUnits = "queryCustomerOrderEligibilityUnits"
+	updateCustomerOrderStakeAddress = "updateCustomerOrderStakeAddress"
+	lockCustomer = "lockCustomer"
+	queryCustomerUnits = "queryCustomerUnits"
+	insertWaitlistEntry = "insertWaitlistEntry"
+	queryWaitlistEntry = "queryWaitlistEntry"
+	queryWaitingWaitlistEntries = "queryWaitingWaitlistEntries"
+	queryWaitingNativeTokens = "queryWaitingNativeTokens"
+	updateWaitlistEntryReserved = "updateWaitlistEntryReserved"
+	updateWaitlistEntriesExpired = "updateWaitlistEntriesExpired"
+	updateWaitlistEntryClaimed = "updateWaitlistEntryClaimed"
+	updateWaitlistEntryReleased = "updateWaitlistEntryReleased"
+	tryLockWaitlist = "tryLockWaitlist"
+	tryLockOrderFulfillment = "tryLockOrderFulfillment"
+)
+
+var (
+	ErrPromotionCodeUnavailable = errors.New("promotion code is disabled or has reached its usage limit")
+	ErrPurchaseCapReached = errors.New("address has reached the sale phase's purchase cap")
+	ErrPurchaseLimitReached = errors.New("customer has reached a purchase limit")
+	ErrWaitlistReservationUnavailable = errors.New("waitlist reservation is not held for this order")
+	ErrQuoteRedeemed = errors.New("quote has already been redeemed")
 )
 
 type Product struct {
@@ -48,6 +130,264 @@ type Product struct {
 	NativeTokenID string
 }
 
+type PromotionCode struct {
+	Code string `json:"code"`
+	DiscountType string `json:"discount_type"`
+	DiscountValue float64 `json:"discount_value"`
+	// 0 means unlimited
+	MaxUses int `json:"max_uses"`
+	MaxUsesPerAddress int `json:"max_uses_per_address"`
+	ValidFrom *time.Time `json:"valid_from"`
+	ValidUntil *time.Time `json:"valid_until"`
+	// empty means every product
+	ProductIDs []string `json:"product_ids"`
+	Disabled bool `json:"disabled"`
+}
+
+type PromotionRedemption struct {
+	Code string
+	DiscountAmount float64
+}
+
+// a NowPayments payment made for an order, an order has one active payment at a time
+type PaymentAttempt struct {
+	now_payments.GetPaymentStatusResponse
+	Active bool
+}
+
+// a change of order status as recorded in order_status_history
+type StatusTransition struct {
+	OrderID string `json:"order_id"`
+	// empty when the order was created
+	From string `json:"from"`
+	To string `json:"to"`
+	Reason string `json:"reason"`
+	Actor string `json:"actor"`
+	// authenticated identity that made the transition, empty for automated flows
+	ActorID string `json:"actor_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// a mutating request to an authenticated route
+type AuditLogEntry struct {
+	ActorID string
+	ActorRole string
+	AuthMethod string
+	RequestMethod string
+	RequestPath string
+	StatusCode int
+}
+
+// a payment created on NowPayments that could not be attached to its order
+type PaymentCompensation struct {
+	OrderID string
+	// empty if the payment is unknown
+	PaymentID string
+	PayAddress string
+	Status string
+	Detail string
+	CreatedAt time.Time
+}
+
+// a payment as recorded, along with the status of its order
+type ReconciliationPayment struct {
+	PaymentID string
+	OrderID string
+	PaymentStatus string
+	PayAmount float64
+	ActuallyPaid float64
+	OutcomeAmount float64
+	OutcomeCurrency string
+	Active bool
+	OrderStatus string
+}
+
+// filters for SearchOrders, empty fields are not filtered on
+type OrderSearch struct {
+	OrderStatus string
+	// status of the active payment
+	PaymentStatus string
+	DeliveryAddress string
+	ProductID string
+	// created at or after, see ULIDLowerBound
+	CreatedFromID string
+	// created before
+	CreatedToID string
+	// latest status change at or after
+	UpdatedFrom *time.Time
+	// latest status change before
+	UpdatedTo *time.Time
+	// only orders with lower IDs, i.e. created earlier
+	Cursor string
+	Limit int
+}
+
+// an order as listed by SearchOrders
+type OrderSummary struct {
+	OrderID string `json:"order_id"`
+	OrderStatus string `json:"order_status"`
+	// of the active payment, empty if the order has none
+	PaymentStatus string `json:"payment_status"`
+	DeliveryAddress string `json:"delivery_address"`
+	PriceCurrencyID string `json:"price_currency_id"`
+	PriceAmount float64 `json:"price_amount"`
+	ProductIDs []string `json:"product_ids"`
+	CreatedAt time.Time `json:"created_at"`
+	// latest status change
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// an outbound webhook to send to one endpoint
+type WebhookDelivery struct {
+	DeliveryID string
+	EndpointName string
+	EventType string
+	OrderID string
+	// JSON body, signed with the endpoint secret when sent
+	Payload string
+	// failed attempts so far
+	Attempts int
+}
+
+// a webhook delivery that ran out of attempts
+type WebhookDeadLetter struct {
+	DeliveryID string `json:"webhook_delivery_id"`
+	EndpointName string `json:"endpoint_name"`
+	EventType string `json:"event_type"`
+	OrderID string `json:"order_id"`
+	Payload string `json:"payload"`
+	Attempts int `json:"attempts"`
+	LastError string `json:"last_error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// how a customer wants to hear about their order, either may be empty
+type OrderContact struct {
+	Email string `json:"email,omitempty"`
+	DiscordWebhookURL string `json:"discord_webhook_url,omitempty"`
+}
+
+// a rendered customer notification to send on one channel
+type Notification struct {
+	NotificationID string
+	// one of OrderID and WaitlistEntryID is set
+	OrderID string
+	WaitlistEntryID string
+	// email or discord
+	Channel string
+	// email address or Discord webhook URL
+	Recipient string
+	EventType string
+	Subject string
+	Body string
+	// failed attempts so far
+	Attempts int
+}
+
+// a commit-reveal seed that bundle pulls are derived from while its sale runs
+type SaleSeed struct {
+	SaleSeedID string `json:"sale_seed_id"`
+	// hex SHA-256 of the seed bytes
+	SeedHash string `json:"seed_hash"`
+	// hash of the bundle catalog pulls are drawn from, committed with the seed, see products.Catalog.Hash
+	CatalogHash string `json:"catalog_hash"`
+	// hex, secret until revealed
+	Seed string `json:"seed,omitempty"`
+	Active bool `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	EndedAt *time.Time `json:"ended_at"`
+	RevealedAt *time.Time `json:"revealed_at"`
+}
+
+// what one unit of a bundle in an order unpacked into
+type OrderPull struct {
+	// position of the unit among the order's items, counting each unit of an item's quantity
+	ItemIndex int `json:"item_index"`
+	// the bundle product
+	ProductID string `json:"product_id"`
+	SaleSeedID string `json:"sale_seed_id"`
+	UnpackedProductIDs []string `json:"unpacked_product_ids"`
+	// one per random draw, in the order they were made
+	Odds []DrawOdds `json:"odds"`
+}
+
+// the candidates one random draw of a bundle slot was made from, after removing products that were out of stock
+type DrawOdds struct {
+	// index of the slot in the catalog bundle
+	Slot int `json:"slot"`
+	// a weighted slot picks one of these by weight, a guaranteed slot has one pool
+	Pools []PoolOdds `json:"pools"`
+	ProductID string `json:"product_id"`
+}
+
+type PoolOdds struct {
+	Pool string `json:"pool"`
+	Weight int `json:"weight"`
+	// in stock products in the pool, drawn uniformly
+	Products []string `json:"products"`
+}
+
+// the address an order counts against in its sale phase's per-address cap, see eligibility.Service
+type OrderEligibility struct {
+	SalePhase string `json:"sale_phase"`
+	// every address that qualified for the phase, the order counts against each of their caps
+	Addresses []string `json:"addresses"`
+	Units int64 `json:"units"`
+	// 0 means no cap
+	MaxUnits int64 `json:"max_units"`
+}
+
+// a cap on the units one customer orders, checked when an order is inserted
+type PurchaseLimit struct {
+	// describes the limit in errors
+	Name string
+	// empty means every product
+	ProductID string
+	MaxUnits int64
+	// units of the order being inserted that count against the limit
+	Units int64
+	// bounds on customer_order_id, i.e. on when orders were placed, empty means unbounded
+	FromOrderID string
+	ToOrderID string
+}
+
+// who an order counts against in per-customer purchase limits
+type OrderCustomer struct {
+	DeliveryAddress string
+	// stake address of the delivery address, empty if it has none
+	StakeAddress string
+	Limits []PurchaseLimit
+	// the waitlist reservation the order claims, empty if none
+	WaitlistEntryID string
+}
+
+const (
+	WAITLIST_STATUS_WAITING = "WAITING"
+	// stock is held for the customer until ReservedUntil
+	WAITLIST_STATUS_RESERVED = "RESERVED"
+	// an order was placed with the reservation
+	WAITLIST_STATUS_CLAIMED = "CLAIMED"
+	WAITLIST_STATUS_EXPIRED = "EXPIRED"
+)
+
+// a customer waiting for a sold-out product, see internal/waitlist
+type WaitlistEntry struct {
+	WaitlistEntryID string `json:"waitlist_entry_id"`
+	ProductID string `json:"product_id"`
+	NativeTokenID string `json:"native_token_id"`
+	DeliveryAddress string `json:"delivery_address"`
+	Quantity int64 `json:"quantity"`
+	Contact OrderContact `json:"-"`
+	// one of WAITLIST_STATUS_*
+	Status string `json:"status"`
+	ReservedUntil *time.Time `json:"reserved_until,omitempty"`
+	// the order that claimed the reservation
+	OrderID string `json:"order_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// entries waiting for the product ahead of this one
+	Ahead int64 `json:"ahead"`
+}
+
 type ServiceImpl struct {
 	queriesPath string
 	pool *pgxpool.Pool
@@ -98,6 +438,75 @@ func (s *ServiceImpl) loadQueries(ctx context.Context) error {
 		queryCustomerOrderNativeTokens: "query_customer_order_native_tokens.sql",
 		queryCardanoTransactions: "query_cardano_transactions.sql",
 		queryReservedNativeTokens: "query_reserved_native_tokens.sql",
+		insertPriceQuote: "insert_price_quote.sql",
+		queryPriceQuote: "query_price_quote.sql",
+		updatePriceQuoteRedeemed: "update_price_quote_redeemed.sql",
+		insertCustomerOrderFee: "insert_customer_order_fee.sql",
+		queryCustomerOrderFees: "query_customer_order_fees.sql",
+		insertPromotionCode: "insert_promotion_code.sql",
+		queryPromotionCodes: "query_promotion_codes.sql",
+		updatePromotionCodeDisabled: "update_promotion_code_disabled.sql",
+		queryPromotionCodeUses: "query_promotion_code_uses.sql",
+		insertPromotionRedemption: "insert_promotion_redemption.sql",
+		lockPromotionCode: "lock_promotion_code.sql",
+		updateNowPaymentsPaymentInactive: "update_now_payments_payment_inactive.sql",
+		updateCustomerOrderPaymentAddress: "update_customer_order_payment_address.sql",
+		queryReconciliationPayments: "query_reconciliation_payments.sql",
+		insertPaymentCompensation: "insert_payment_compensation.sql",
+		queryPaymentCompensations: "query_payment_compensations.sql",
+		updatePaymentCompensation: "update_payment_compensation.sql",
+		insertOrderStatusHistory: "insert_order_status_history.sql",
+		queryOrderStatusHistory: "query_order_status_history.sql",
+		queryCustomerOrderStatus: "query_customer_order_status.sql",
+		updateCustomerOrderDeliveryAddress: "update_customer_order_delivery_address.sql",
+		insertAuditLog: "insert_audit_log.sql",
+		queryCustomerOrderSearch: "query_customer_order_search.sql",
+		notifyOrderEvent: "notify_order_event.sql",
+		listenOrderEvents: "listen_order_events.sql",
+		unlistenOrderEvents: "unlisten_order_events.sql",
+		listenProductChanges: "listen_product_changes.sql",
+		unlistenProductChanges: "unlisten_product_changes.sql",
+		insertWebhookDelivery: "insert_webhook_delivery.sql",
+		claimWebhookDeliveries: "claim_webhook_deliveries.sql",
+		updateWebhookDeliveryDelivered: "update_webhook_delivery_delivered.sql",
+		updateWebhookDeliveryRetry: "update_webhook_delivery_retry.sql",
+		updateWebhookDeliveryDead: "update_webhook_delivery_dead.sql",
+		insertWebhookDeadLetter: "insert_webhook_dead_letter.sql",
+		queryWebhookDeadLetters: "query_webhook_dead_letters.sql",
+		deleteWebhookDeadLetter: "delete_webhook_dead_letter.sql",
+		updateWebhookDeliveryReplay: "update_webhook_delivery_replay.sql",
+		insertCustomerOrderContact: "insert_customer_order_contact.sql",
+		queryCustomerOrderContact: "query_customer_order_contact.sql",
+		insertNotification: "insert_notification.sql",
+		claimNotifications: "claim_notifications.sql",
+		updateNotificationSent: "update_notification_sent.sql",
+		updateNotificationRetry: "update_notification_retry.sql",
+		updateNotificationFailed: "update_notification_failed.sql",
+		insertSaleSeed: "insert_sale_seed.sql",
+		updateSaleSeedEnded: "update_sale_seed_ended.sql",
+		updateSaleSeedRevealed: "update_sale_seed_revealed.sql",
+		querySaleSeeds: "query_sale_seeds.sql",
+		queryActiveSaleSeed: "query_active_sale_seed.sql",
+		insertCustomerOrderPull: "insert_customer_order_pull.sql",
+		queryCustomerOrderPulls: "query_customer_order_pulls.sql",
+		deleteAllowlistAddresses: "delete_allowlist_addresses.sql",
+		insertAllowlistAddress: "insert_allowlist_address.sql",
+		queryAllowlistAddress: "query_allowlist_address.sql",
+		insertCustomerOrderEligibility: "insert_customer_order_eligibility.sql",
+		queryCustomerOrderEligibilityUnits: "query_customer_order_eligibility_units.sql",
+		updateCustomerOrderStakeAddress: "update_customer_order_stake_address.sql",
+		lockCustomer: "lock_customer.sql",
+		queryCustomerUnits: "query_customer_units.sql",
+		insertWaitlistEntry: "insert_waitlist_entry.sql",
+		queryWaitlistEntry: "query_waitlist_entry.sql",
+		queryWaitingWaitlistEntries: "query_waiting_waitlist_entries.sql",
+		queryWaitingNativeTokens: "query_waiting_native_tokens.sql",
+		updateWaitlistEntryReserved: "update_waitlist_entry_reserved.sql",
+		updateWaitlistEntriesExpired: "update_waitlist_entries_expired.sql",
+		updateWaitlistEntryClaimed: "update_waitlist_entry_claimed.sql",
+		updateWaitlistEntryReleased: "update_waitlist_entry_released.sql",
+		tryLockWaitlist: "try_lock_waitlist.sql",
+		tryLockOrderFulfillment: "try_lock_order_fulfillment.sql",
 	}
 	
 	queries := make(map[string]string)
@@ -136,14 +545,28 @@ func (s *ServiceImpl) GenerateULID(prefix string) string {
 	return fmt.Sprintf("%s-%s", prefix, u.String())
 }
 
-// inserts an order
-func (s *ServiceImpl) InsertOrder(ctx context.Context, order ordf.Order, payment now_payments.CreatePaymentResponse) error {
-	tx, err := s.pool.Begin(ctx)
+// the lowest prefixed ULID generated at or after t, for range queries on IDs
+func ULIDLowerBound(prefix string, t time.Time) string {
+	// ULIDs start at the Unix epoch
+	if t.Before(time.Unix(0, 0)) {
+		t = time.Unix(0, 0)
+	}
+	u := ulid.MustNew(ulid.Timestamp(t), nil)
+	return fmt.Sprintf("%s-%s", prefix, u.String())
+}
+
+// the time a prefixed ULID was generated
+func ULIDTime(id string) (time.Time, error) {
+	i := strings.LastIndex(id, "-")
+	u, err := ulid.ParseStrict(id[i + 1:])
 	if err != nil {
-		return err
+		return time.Time{}, fmt.Errorf("invalid ULID %s: %v", id, err)
 	}
+	return ulid.Time(u.Time()).UTC(), nil
+}
 
-	batch := &pgx.Batch{}
+// queues inserting an order with its items and fees, returning the number of results to read
+func (s *ServiceImpl) queueInsertOrder(batch *pgx.Batch, order ordf.Order, orderFees []fees.Fee) int {
 	batch.Queue(s.queries[insertCustomerOrder], 
 		order.OrderId,
 		order.OrderStatus,
@@ -154,6 +577,43 @@ func (s *ServiceImpl) InsertOrder(ctx context.Context, order ordf.Order, payment
 		order.Payment.PriceCurrencyId,
 		order.Payment.PriceAmount,
 	)
+	for _, v := range order.Items {
+		batch.Queue(s.queries[insertCustomerOrderItem],
+			order.OrderId,
+			v.ProductId,
+			v.Quantity,
+		)
+	}
+	for _, f := range orderFees {
+		batch.Queue(s.queries[insertCustomerOrderFee],
+			order.OrderId,
+			f.Name,
+			f.Type,
+			f.Amount,
+			f.WaivedBy,
+		)
+	}
+	return 1 + len(order.Items) + len(orderFees)
+}
+
+// queues a status change along with the history entry for it
+func (s *ServiceImpl) queueStatusTransition(batch *pgx.Batch, transition StatusTransition) {
+	batch.Queue(s.queries[updateCustomerOrder],
+		transition.OrderID,
+		transition.To,
+		time.Now().Format(constants.ISO8601DateFormat),
+	)
+	batch.Queue(s.queries[insertOrderStatusHistory],
+		transition.OrderID,
+		transition.From,
+		transition.To,
+		transition.Reason,
+		transition.Actor,
+		transition.ActorID,
+	)
+}
+
+func (s *ServiceImpl) queueInsertPayment(batch *pgx.Batch, orderID string, payment now_payments.CreatePaymentResponse) {
 	batch.Queue(s.queries[insertNowPaymentsPayment],
 		payment.PaymentID,
 		payment.PaymentStatus,
@@ -162,75 +622,289 @@ func (s *ServiceImpl) InsertOrder(ctx context.Context, order ordf.Order, payment
 		payment.PriceCurrency,
 		payment.PayAmount,
 		payment.PayCurrency,
-		payment.OrderID,
+		orderID,
 		payment.OrderDescription,
 		payment.PurchaseID,
 		payment.CreatedAt,
 		payment.UpdatedAt,
 		payment.IPNCallbackURL,
 	)
-	for _, v := range order.Items {
-		batch.Queue(s.queries[insertCustomerOrderItem],
-			order.OrderId,
-			v.ProductId,
-			v.Quantity,
-		)
-	}
+}
 
-	br := tx.SendBatch(ctx, batch)
-	for i := 0; i < 2 + len(order.Items); i += 1 {
+// reads queued results, then the redemption if any, which affects no rows if the code is unavailable
+func (s *ServiceImpl) execInsertOrderBatch(br pgx.BatchResults, queued int, redemption *PromotionRedemption) error {
+	for i := 0; i < queued; i += 1 {
 		_, err := br.Exec()
 		if err != nil {
-			tx.Rollback(ctx)
 			return err
 		}
 	}
-
-	err = br.Close()
+	if redemption == nil {
+		return nil
+	}
+	tag, err := br.Exec()
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() != 1 {
+		return fmt.Errorf("%w: %s", ErrPromotionCodeUnavailable, redemption.Code)
+	}
+	return nil
+}
 
-	err = tx.Commit(ctx)
+// locks every address the order is capped by until tx ends, then checks the customer's limits
+// orders that could exceed the same limit wait for each other, so limits hold across concurrent orders
+func (s *ServiceImpl) checkCustomerLimits(ctx context.Context, tx pgx.Tx, eligibility *OrderEligibility, customer *OrderCustomer) error {
+	keys := []string{}
+	if eligibility != nil && eligibility.MaxUnits > 0 {
+		keys = append(keys, eligibility.Addresses...)
+	}
+	if customer != nil && len(customer.Limits) > 0 {
+		keys = append(keys, customer.DeliveryAddress)
+		if customer.StakeAddress != "" {
+			keys = append(keys, customer.StakeAddress)
+		}
+	}
+	// always locked in the same order to avoid deadlocks
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, err := tx.Exec(ctx, s.queries[lockCustomer], key)
+		if err != nil {
+			return fmt.Errorf("failed to lock customer %s: %v", key, err)
+		}
+	}
+	if customer == nil {
+		return nil
+	}
+
+	for _, limit := range customer.Limits {
+		units, err := s.queryCustomerUnits(ctx, tx, customer.DeliveryAddress, customer.StakeAddress, limit)
+		if err != nil {
+			return err
+		}
+		if units + limit.Units > limit.MaxUnits {
+			return fmt.Errorf("%w: %s has ordered %d of %d units allowed by %s", ErrPurchaseLimitReached, customer.DeliveryAddress, units, limit.MaxUnits, limit.Name)
+		}
+	}
+	return nil
+}
+
+// a pool or transaction
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+func (s *ServiceImpl) queryCustomerUnits(ctx context.Context, q queryRower, deliveryAddress string, stakeAddress string, limit PurchaseLimit) (int64, error) {
+	var units int64
+	err := q.QueryRow(ctx, s.queries[queryCustomerUnits], deliveryAddress, stakeAddress, limit.ProductID, limit.FromOrderID, limit.ToOrderID).Scan(&units)
+	if err != nil {
+		return 0, fmt.Errorf("query customer units failed: %v", err)
+	}
+	return units, nil
+}
+
+// one insert was queued per address
+func execInsertEligibility(br pgx.BatchResults, eligibility *OrderEligibility) error {
+	for _, address := range eligibility.Addresses {
+		tag, err := br.Exec()
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() != 1 {
+			return fmt.Errorf("%w: %s in %s", ErrPurchaseCapReached, address, eligibility.SalePhase)
+		}
+	}
+	return nil
+}
+
+func execRedeemQuote(br pgx.BatchResults, quoteID string) error {
+	tag, err := br.Exec()
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() != 1 {
+		return fmt.Errorf("%w: %s", ErrQuoteRedeemed, quoteID)
+	}
+	return nil
+}
 
+func execClaimWaitlistEntry(br pgx.BatchResults, waitlistEntryID string) error {
+	tag, err := br.Exec()
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() != 1 {
+		return fmt.Errorf("%w: %s has expired or was made for another delivery address", ErrWaitlistReservationUnavailable, waitlistEntryID)
+	}
 	return nil
 }
 
-func (s *ServiceImpl) UpdateOrder(ctx context.Context, order ordf.Order, payment now_payments.GetPaymentStatusResponse) error {
+// locks the redeemed code until tx ends, so orders redeeming it wait for each other and its usage limits hold
+func (s *ServiceImpl) lockPromotionCode(ctx context.Context, tx pgx.Tx, redemption *PromotionRedemption) error {
+	if redemption == nil {
+		return nil
+	}
+	_, err := tx.Exec(ctx, s.queries[lockPromotionCode], redemption.Code)
+	return err
+}
+
+func (s *ServiceImpl) queueInsertRedemption(batch *pgx.Batch, order ordf.Order, redemption *PromotionRedemption) {
+	if redemption == nil {
+		return
+	}
+	batch.Queue(s.queries[insertPromotionRedemption],
+		redemption.Code,
+		order.OrderId,
+		order.Customer.DeliveryAddress,
+		redemption.DiscountAmount,
+	)
+}
+
+// inserts an order before its payment is created, reserving its native tokens and recording the pulls they came from, contact may be nil
+// the quote is redeemed in the same transaction, so a quote that was already redeemed fails the order
+func (s *ServiceImpl) InsertPendingOrder(ctx context.Context, order ordf.Order, quoteID string, orderFees []fees.Fee, redemption *PromotionRedemption, tokens map[string]*big.Int, transition StatusTransition, contact *OrderContact, pulls []OrderPull, eligibility *OrderEligibility, customer *OrderCustomer) error {
+	pullOdds := make([]string, len(pulls))
+	for i, pull := range pulls {
+		odds := pull.Odds
+		if odds == nil {
+			odds = []DrawOdds{}
+		}
+		oddsJSON, err := json.Marshal(odds)
+		if err != nil {
+			return fmt.Errorf("failed to encode pull odds: %v", err)
+		}
+		pullOdds[i] = string(oddsJSON)
+	}
+
 	tx, err := s.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 
-	timeNow := time.Now().Format(constants.ISO8601DateFormat)
+	err = s.checkCustomerLimits(ctx, tx, eligibility, customer)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	err = s.lockPromotionCode(ctx, tx, redemption)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
 
 	batch := &pgx.Batch{}
-	batch.Queue(s.queries[updateCustomerOrder],
+	queued := s.queueInsertOrder(batch, order, orderFees)
+	if customer != nil && customer.StakeAddress != "" {
+		batch.Queue(s.queries[updateCustomerOrderStakeAddress], order.OrderId, customer.StakeAddress)
+		queued += 1
+	}
+	batch.Queue(s.queries[insertOrderStatusHistory],
 		order.OrderId,
-		order.OrderStatus,
-		// update "checked last"
-		timeNow,
+		transition.From,
+		transition.To,
+		transition.Reason,
+		transition.Actor,
+		transition.ActorID,
 	)
+	for native_token_id, quantity := range tokens {
+		batch.Queue(s.queries[insertCustomerOrderNativeTokens], 
+			order.OrderId,
+			native_token_id,
+			quantity.Int64(),
+		)
+	}
+	if contact != nil {
+		batch.Queue(s.queries[insertCustomerOrderContact],
+			order.OrderId,
+			contact.Email,
+			contact.DiscordWebhookURL,
+		)
+		queued += 1
+	}
+	for i, pull := range pulls {
+		batch.Queue(s.queries[insertCustomerOrderPull],
+			order.OrderId,
+			pull.ItemIndex,
+			pull.ProductID,
+			pull.SaleSeedID,
+			pull.UnpackedProductIDs,
+			pullOdds[i],
+		)
+		queued += 1
+	}
+	s.queueInsertRedemption(batch, order, redemption)
+	if eligibility != nil {
+		for _, address := range eligibility.Addresses {
+			batch.Queue(s.queries[insertCustomerOrderEligibility],
+				order.OrderId,
+				eligibility.SalePhase,
+				address,
+				eligibility.Units,
+				eligibility.MaxUnits,
+			)
+		}
+	}
+	if quoteID != "" {
+		batch.Queue(s.queries[updatePriceQuoteRedeemed], quoteID, order.OrderId)
+	}
+	waitlistEntryID := ""
+	if customer != nil {
+		waitlistEntryID = customer.WaitlistEntryID
+	}
+	if waitlistEntryID != "" {
+		batch.Queue(s.queries[updateWaitlistEntryClaimed], waitlistEntryID, order.OrderId, order.Customer.DeliveryAddress)
+	}
 
-	if payment.UpdatedAt == "" {
-		payment.UpdatedAt = timeNow
+	br := tx.SendBatch(ctx, batch)
+	err = s.execInsertOrderBatch(br, queued + 1 + len(tokens), redemption)
+	if err == nil && eligibility != nil {
+		err = execInsertEligibility(br, eligibility)
 	}
-	batch.Queue(s.queries[updateNowPaymentsPayment],
-		order.OrderId,
-		payment.PaymentStatus,
-		payment.ActuallyPaid,
-		payment.UpdatedAt,
-		payment.OutcomeAmount,
-		payment.OutcomeCurrency,
+	if err == nil && quoteID != "" {
+		err = execRedeemQuote(br, quoteID)
+	}
+	if err == nil && waitlistEntryID != "" {
+		err = execClaimWaitlistEntry(br, waitlistEntryID)
+	}
+	if err != nil {
+		br.Close()
+		tx.Rollback(ctx)
+		return err
+	}
+
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// attaches the first payment to a pending order and makes the transition
+func (s *ServiceImpl) AttachOrderPayment(ctx context.Context, transition StatusTransition, payment now_payments.CreatePaymentResponse) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	s.queueInsertPayment(batch, transition.OrderID, payment)
+	batch.Queue(s.queries[updateCustomerOrderPaymentAddress],
+		transition.OrderID,
+		payment.PayAddress,
 	)
+	s.queueStatusTransition(batch, transition)
 
 	br := tx.SendBatch(ctx, batch)
-	for i := 0; i < 2; i += 1 {
+	for i := 0; i < 4; i += 1 {
 		_, err := br.Exec()
 		if err != nil {
+			br.Close()
 			tx.Rollback(ctx)
 			return err
 		}
@@ -249,196 +923,1338 @@ func (s *ServiceImpl) UpdateOrder(ctx context.Context, order ordf.Order, payment
 	return nil
 }
 
-// queries for an order
-func (s *ServiceImpl) QueryOrder(ctx context.Context, orderID string) (*ordf.Order, *now_payments.GetPaymentStatusResponse, *time.Time, error) {
-	var order ordf.Order
-	var checkedLast pgtype.Timestamptz
-	err := s.pool.QueryRow(ctx, s.queries[queryCustomerOrder], orderID).Scan(
-		&order.OrderId,
-		&order.OrderStatus,
-		&order.Description,
-		&order.Customer.DeliveryAddress,
-		&order.Payment.PaymentAddress,
-		&order.Payment.PriceCurrencyId,
-		&order.Payment.PriceAmount,
-		&checkedLast,
-	)
+// makes a transition without touching the order's payment, a failed order releases any waitlist reservation it claimed
+func (s *ServiceImpl) UpdateOrderStatus(ctx context.Context, transition StatusTransition) error {
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
 
-	rows, err := s.pool.Query(ctx, s.queries[queryCustomerOrderItems], orderID)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-	defer rows.Close()
+	batch := &pgx.Batch{}
+	s.queueStatusTransition(batch, transition)
+	batch.Queue(s.queries[updateWaitlistEntryReleased], transition.OrderID)
 
-	for rows.Next() {
-		var i ordf.OrderItems
-		err = rows.Scan(
-			&i.ProductId,
-			&i.Quantity,
-		)
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < 3; i += 1 {
+		_, err := br.Exec()
 		if err != nil {
-			return nil, nil, nil, err
+			br.Close()
+			tx.Rollback(ctx)
+			return err
 		}
-
-		order.Items = append(order.Items, i)
 	}
 
-	// TODO: handle case of multiple payments, e.g. if the first one expired
-	var payment now_payments.GetPaymentStatusResponse
+	err = br.Close()
+	if err != nil {
+		return err
+	}
 
-	var createdAt pgtype.Timestamptz
-	var updatedAt pgtype.Timestamptz
-	err = s.pool.QueryRow(ctx, s.queries[queryNowPaymentsPayment], orderID).Scan(
-		&payment.PaymentID,
-		&payment.PaymentStatus,
-		&payment.PayAddress,
-		&payment.PriceAmount,
-		&payment.PriceCurrency,
-		&payment.PayAmount,
-		&payment.PayCurrency,
-		&payment.OrderID,
-		&payment.OrderDescription,
-		&payment.PurchaseID,
-		&createdAt,
-		&updatedAt,
-	)
+	err = tx.Commit(ctx)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
-	payment.CreatedAt = createdAt.Time.UTC().Format(constants.ISO8601DateFormat)
-	payment.UpdatedAt = updatedAt.Time.UTC().Format(constants.ISO8601DateFormat)
 
-	return &order, &payment, &checkedLast.Time, nil
+	return nil
 }
 
-func (s *ServiceImpl ) QueryOrdersReadyForCheck(ctx context.Context, interval time.Duration, requiredStatus string) ([]string, error) {
-	minCheckedLast := time.Now().Add(-1 * interval).Format(constants.ISO8601DateFormat)
-	rows, err := s.pool.Query(ctx, s.queries[queryOrdersReadyForCheck], minCheckedLast, requiredStatus)
+// makes a transition and queues a compensation for the order's payment
+func (s *ServiceImpl) InsertPaymentCompensation(ctx context.Context, transition StatusTransition, compensation PaymentCompensation) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	s.queueStatusTransition(batch, transition)
+	batch.Queue(s.queries[insertPaymentCompensation],
+		compensation.OrderID,
+		compensation.PaymentID,
+		compensation.PayAddress,
+		compensation.Status,
+		compensation.Detail,
+	)
+
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < 3; i += 1 {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *ServiceImpl) QueryPaymentCompensations(ctx context.Context, status string) ([]PaymentCompensation, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryPaymentCompensations], status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	compensations := []PaymentCompensation{}
+	for rows.Next() {
+		var c PaymentCompensation
+		err = rows.Scan(
+			&c.OrderID,
+			&c.PaymentID,
+			&c.PayAddress,
+			&c.Status,
+			&c.Detail,
+			&c.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("query payment compensations failed: %v", err)
+		}
+		compensations = append(compensations, c)
+	}
+
+	return compensations, nil
+}
+
+// resolves an order's compensation along with the transition that ends the order
+func (s *ServiceImpl) UpdatePaymentCompensation(ctx context.Context, transition StatusTransition, status string, detail string) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	batch.Queue(s.queries[updatePaymentCompensation], transition.OrderID, status, detail)
+	s.queueStatusTransition(batch, transition)
+
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < 3; i += 1 {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// updates checked_last and the order's payment, along with its status if transition is not nil
+// as with UpdateOrderStatus, a failed order releases any waitlist reservation it claimed
+func (s *ServiceImpl) UpdateOrder(ctx context.Context, order ordf.Order, payment now_payments.GetPaymentStatusResponse, transition *StatusTransition) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	queued := s.queueUpdateOrder(batch, order, payment, transition)
+
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < queued; i += 1 {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// queues updating an order with its payment and transition, returning the number of results to read
+func (s *ServiceImpl) queueUpdateOrder(batch *pgx.Batch, order ordf.Order, payment now_payments.GetPaymentStatusResponse, transition *StatusTransition) int {
+	timeNow := time.Now().Format(constants.ISO8601DateFormat)
+
+	batch.Queue(s.queries[updateCustomerOrder],
+		order.OrderId,
+		order.OrderStatus,
+		// update "checked last"
+		timeNow,
+	)
+
+	if payment.UpdatedAt == "" {
+		payment.UpdatedAt = timeNow
+	}
+	batch.Queue(s.queries[updateNowPaymentsPayment],
+		payment.PaymentID.String(),
+		payment.PaymentStatus,
+		payment.ActuallyPaid,
+		payment.UpdatedAt,
+		payment.OutcomeAmount,
+		payment.OutcomeCurrency,
+	)
+
+	queued := 2
+	if transition != nil {
+		batch.Queue(s.queries[insertOrderStatusHistory],
+			transition.OrderID,
+			transition.From,
+			transition.To,
+			transition.Reason,
+			transition.Actor,
+			transition.ActorID,
+		)
+		batch.Queue(s.queries[updateWaitlistEntryReleased], transition.OrderID)
+		queued += 2
+	}
+	return queued
+}
+
+// records that an order was submitted to Cardano in txid, making its transition and queuing the deliveries and notifications that announce it
+// all or nothing is written, so the customer only hears of a fill that was recorded
+func (s *ServiceImpl) FillOrder(ctx context.Context, order ordf.Order, payment now_payments.GetPaymentStatusResponse, transition *StatusTransition, txid string, deliveries []WebhookDelivery, notifications []Notification) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	queued := s.queueUpdateOrder(batch, order, payment, transition)
+	batch.Queue(s.queries[insertCardanoTransaction], order.OrderId, txid)
+	s.queueInsertWebhookDeliveries(batch, deliveries)
+	s.queueInsertNotifications(batch, notifications)
+	queued += 1 + len(deliveries) + len(notifications)
+
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < queued; i += 1 {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// queries for an order
+func (s *ServiceImpl) QueryOrder(ctx context.Context, orderID string) (*ordf.Order, *now_payments.GetPaymentStatusResponse, *time.Time, error) {
+	var order ordf.Order
+	var checkedLast pgtype.Timestamptz
+	err := s.pool.QueryRow(ctx, s.queries[queryCustomerOrder], orderID).Scan(
+		&order.OrderId,
+		&order.OrderStatus,
+		&order.Description,
+		&order.Customer.DeliveryAddress,
+		&order.Payment.PaymentAddress,
+		&order.Payment.PriceCurrencyId,
+		&order.Payment.PriceAmount,
+		&checkedLast,
+	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	order.Items, err = s.QueryOrderItems(ctx, orderID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// return the active payment, earlier attempts are in QueryOrderPayments
+	// orders are written before their payment is created, so the payment is nil until one is attached
+	payments, err := s.QueryOrderPayments(ctx, orderID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var payment *now_payments.GetPaymentStatusResponse
+	for i := range payments {
+		if payments[i].Active {
+			payment = &payments[i].GetPaymentStatusResponse
+		}
+	}
+
+	return &order, payment, &checkedLast.Time, nil
+}
+
+func (s *ServiceImpl) QueryOrderItems(ctx context.Context, orderID string) ([]ordf.OrderItems, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryCustomerOrderItems], orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ordf.OrderItems{}
+	for rows.Next() {
+		var i ordf.OrderItems
+		err = rows.Scan(
+			&i.ProductId,
+			&i.Quantity,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, i)
+	}
+
+	return items, nil
+}
+
+// queries every payment attempt for an order, oldest first
+func (s *ServiceImpl) QueryOrderPayments(ctx context.Context, orderID string) ([]PaymentAttempt, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryNowPaymentsPayment], orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []PaymentAttempt{}
+	for rows.Next() {
+		var payment PaymentAttempt
+		var createdAt pgtype.Timestamptz
+		var updatedAt pgtype.Timestamptz
+		err = rows.Scan(
+			&payment.PaymentID,
+			&payment.PaymentStatus,
+			&payment.PayAddress,
+			&payment.PriceAmount,
+			&payment.PriceCurrency,
+			&payment.PayAmount,
+			&payment.ActuallyPaid,
+			&payment.PayCurrency,
+			&payment.OrderID,
+			&payment.OrderDescription,
+			&payment.PurchaseID,
+			&createdAt,
+			&updatedAt,
+			&payment.Active,
+		)
+		if err != nil {
+			return nil, err
+		}
+		payment.CreatedAt = createdAt.Time.UTC().Format(constants.ISO8601DateFormat)
+		payment.UpdatedAt = updatedAt.Time.UTC().Format(constants.ISO8601DateFormat)
+
+		payments = append(payments, payment)
+	}
+
+	return payments, nil
+}
+
+// adds a new active payment attempt to an order, deactivating the previous ones
+func (s *ServiceImpl) InsertOrderPayment(ctx context.Context, orderID string, payment now_payments.CreatePaymentResponse) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	batch.Queue(s.queries[updateNowPaymentsPaymentInactive], orderID)
+	s.queueInsertPayment(batch, orderID, payment)
+	batch.Queue(s.queries[updateCustomerOrderPaymentAddress],
+		orderID,
+		payment.PayAddress,
+	)
+
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < 3; i += 1 {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+
+func (s *ServiceImpl ) QueryOrdersReadyForCheck(ctx context.Context, interval time.Duration, requiredStatus string) ([]string, error) {
+	minCheckedLast := time.Now().Add(-1 * interval).Format(constants.ISO8601DateFormat)
+	rows, err := s.pool.Query(ctx, s.queries[queryOrdersReadyForCheck], minCheckedLast, requiredStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orderIDs := []string{}
+	for rows.Next() {
+		var orderID string
+		err = rows.Scan(
+			&orderID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		orderIDs = append(orderIDs, orderID)
+	}
+
+	return orderIDs, nil
+}
+
+func (s *ServiceImpl) QueryProducts(ctx context.Context) ([]Product, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryProducts])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := []Product{}
+	for rows.Next() {
+		var p Product
+		var dateListed pgtype.Timestamptz
+		var dateAvailable pgtype.Timestamptz
+
+		err = rows.Scan(
+			&p.ProductID,
+			&p.PriceUnitAmount,
+			&p.PriceCurrencyID,
+			&p.MaxOrderSize,
+			&dateListed,
+			&dateAvailable,
+			&p.NativeTokenID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("query products failed: %v", err)
+		}
+
+		// convert dates to time.Time
+		p.DateListed = nil
+		if dateListed.Status == pgtype.Present {
+			p.DateListed = &dateListed.Time
+		}
+		p.DateAvailable = nil
+		if dateAvailable.Status == pgtype.Present {
+			p.DateAvailable = &dateAvailable.Time
+		}
+
+		products = append(products, p)
+	}
+
+	return products, nil
+}
+
+func (s *ServiceImpl) Close() {
+	s.pool.Close()
+}
+
+func (s *ServiceImpl) QueryOrderNativeTokens(ctx context.Context, orderID string) (map[string]*big.Int, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryCustomerOrderNativeTokens], orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	t := map[string]*big.Int{}
+	for rows.Next() {
+		var nativeTokenID string
+		var quantity int64
+
+		err = rows.Scan(
+			&nativeTokenID,
+			&quantity,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("query order native tokens failed: %v", err)
+		}
+
+		t[nativeTokenID] = big.NewInt(quantity)
+	}
+
+	return t, err
+}
+
+func (s *ServiceImpl) QueryCardanoTransactions(ctx context.Context, orderID string) ([]string, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryCardanoTransactions], orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txids := []string{}
+	for rows.Next() {
+		var txid string
+
+		err = rows.Scan(
+			&txid,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("query Cardano transactions failed: %v", err)
+		}
+
+		txids = append(txids, txid)
+	}
+
+	return txids, err
+}
+
+func (s *ServiceImpl) QueryReservedNativeTokens(ctx context.Context) (map[string]*big.Int, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryReservedNativeTokens])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	t := map[string]*big.Int{}
+	for rows.Next() {
+		var nativeTokenID string
+		var quantity int64
+
+		err = rows.Scan(
+			&nativeTokenID,
+			&quantity,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("query reserved native tokens failed: %v", err)
+		}
+
+		t[nativeTokenID] = big.NewInt(quantity)
+	}
+
+	return t, err
+}
+
+// inserts a quote, stored as JSON so that it can be re-verified when redeemed
+func (s *ServiceImpl) InsertPriceQuote(ctx context.Context, quoteID string, quote []byte, expiresAt time.Time) error {
+	_, err := s.pool.Exec(ctx, s.queries[insertPriceQuote], quoteID, string(quote), expiresAt.Format(constants.ISO8601DateFormat))
+	if err != nil {
+		return fmt.Errorf("insert price quote failed: %v", err)
+	}
+	return nil
+}
+
+func (s *ServiceImpl) QueryPriceQuote(ctx context.Context, quoteID string) ([]byte, error) {
+	var quote string
+	err := s.pool.QueryRow(ctx, s.queries[queryPriceQuote], quoteID).Scan(
+		&quote,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(quote), nil
+}
+
+func (s *ServiceImpl) QueryOrderFees(ctx context.Context, orderID string) ([]fees.Fee, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryCustomerOrderFees], orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orderFees := []fees.Fee{}
+	for rows.Next() {
+		var f fees.Fee
+
+		err = rows.Scan(
+			&f.Name,
+			&f.Type,
+			&f.Amount,
+			&f.WaivedBy,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("query order fees failed: %v", err)
+		}
+
+		orderFees = append(orderFees, f)
+	}
+
+	return orderFees, err
+}
+
+func (s *ServiceImpl) InsertPromotionCode(ctx context.Context, code PromotionCode) error {
+	_, err := s.pool.Exec(ctx, s.queries[insertPromotionCode],
+		code.Code,
+		code.DiscountType,
+		code.DiscountValue,
+		code.MaxUses,
+		code.MaxUsesPerAddress,
+		code.ValidFrom,
+		code.ValidUntil,
+		code.ProductIDs,
+	)
+	if err != nil {
+		return fmt.Errorf("insert promotion code failed: %v", err)
+	}
+	return nil
+}
+
+// queries promotion codes, all of them if code is empty
+func (s *ServiceImpl) QueryPromotionCodes(ctx context.Context, code string) ([]PromotionCode, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryPromotionCodes], code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []PromotionCode{}
+	for rows.Next() {
+		var c PromotionCode
+		var validFrom pgtype.Timestamptz
+		var validUntil pgtype.Timestamptz
+
+		err = rows.Scan(
+			&c.Code,
+			&c.DiscountType,
+			&c.DiscountValue,
+			&c.MaxUses,
+			&c.MaxUsesPerAddress,
+			&validFrom,
+			&validUntil,
+			&c.ProductIDs,
+			&c.Disabled,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("query promotion codes failed: %v", err)
+		}
+
+		// convert dates to time.Time
+		c.ValidFrom = nil
+		if validFrom.Status == pgtype.Present {
+			c.ValidFrom = &validFrom.Time
+		}
+		c.ValidUntil = nil
+		if validUntil.Status == pgtype.Present {
+			c.ValidUntil = &validUntil.Time
+		}
+
+		codes = append(codes, c)
+	}
+
+	return codes, nil
+}
+
+// disables a promotion code, returning false if it does not exist
+func (s *ServiceImpl) DisablePromotionCode(ctx context.Context, code string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, s.queries[updatePromotionCodeDisabled], code)
+	if err != nil {
+		return false, fmt.Errorf("disable promotion code failed: %v", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// counts redemptions of a code by orders that have not failed, in total and for a delivery address
+func (s *ServiceImpl) QueryPromotionCodeUses(ctx context.Context, code string, deliveryAddress string) (int, int, error) {
+	var uses int
+	var addressUses int
+	err := s.pool.QueryRow(ctx, s.queries[queryPromotionCodeUses], code, deliveryAddress).Scan(
+		&uses,
+		&addressUses,
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uses, addressUses, nil
+}
+
+// queries payments created in [from, to) along with the status of their orders
+func (s *ServiceImpl) QueryReconciliationPayments(ctx context.Context, from time.Time, to time.Time) ([]ReconciliationPayment, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryReconciliationPayments],
+		from.Format(constants.ISO8601DateFormat),
+		to.Format(constants.ISO8601DateFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []ReconciliationPayment{}
+	for rows.Next() {
+		var p ReconciliationPayment
+		err = rows.Scan(
+			&p.PaymentID,
+			&p.OrderID,
+			&p.PaymentStatus,
+			&p.PayAmount,
+			&p.ActuallyPaid,
+			&p.OutcomeAmount,
+			&p.OutcomeCurrency,
+			&p.Active,
+			&p.OrderStatus,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("query reconciliation payments failed: %v", err)
+		}
+		payments = append(payments, p)
+	}
+
+	return payments, nil
+}
+
+func (s *ServiceImpl) QueryOrderStatusHistory(ctx context.Context, orderID string) ([]StatusTransition, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryOrderStatusHistory], orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []StatusTransition{}
+	for rows.Next() {
+		var t StatusTransition
+		err = rows.Scan(
+			&t.OrderID,
+			&t.From,
+			&t.To,
+			&t.Reason,
+			&t.Actor,
+			&t.ActorID,
+			&t.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("query order status history failed: %v", err)
+		}
+		history = append(history, t)
+	}
+
+	return history, nil
+}
+
+// queries an order's status and delivery address, which unlike QueryOrder works for orders without a payment
+func (s *ServiceImpl) QueryOrderStatus(ctx context.Context, orderID string) (string, string, error) {
+	var orderStatus string
+	var deliveryAddress string
+	err := s.pool.QueryRow(ctx, s.queries[queryCustomerOrderStatus], orderID).Scan(
+		&orderStatus,
+		&deliveryAddress,
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	return orderStatus, deliveryAddress, nil
+}
+
+// moves an order to customer's delivery and stake address, checking customer's limits under the locks CreateOrder takes
+// the order already counts against the new address once moved, so customer's limits carry no units of their own
+func (s *ServiceImpl) UpdateOrderDeliveryAddress(ctx context.Context, transition StatusTransition, customer OrderCustomer) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, s.queries[updateCustomerOrderDeliveryAddress], transition.OrderID, customer.DeliveryAddress, customer.StakeAddress)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	err = s.checkCustomerLimits(ctx, tx, nil, &customer)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	s.queueStatusTransition(batch, transition)
+
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < 2; i += 1 {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *ServiceImpl) InsertAuditLog(ctx context.Context, entry AuditLogEntry) error {
+	_, err := s.pool.Exec(ctx, s.queries[insertAuditLog],
+		entry.ActorID,
+		entry.ActorRole,
+		entry.AuthMethod,
+		entry.RequestMethod,
+		entry.RequestPath,
+		entry.StatusCode,
+	)
+	return err
+}
+
+// queries orders matching a search, newest first
+func (s *ServiceImpl) SearchOrders(ctx context.Context, search OrderSearch) ([]OrderSummary, error) {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(constants.ISO8601DateFormat)
+	}
+
+	rows, err := s.pool.Query(ctx, s.queries[queryCustomerOrderSearch],
+		search.Cursor,
+		search.OrderStatus,
+		search.PaymentStatus,
+		search.DeliveryAddress,
+		search.ProductID,
+		search.CreatedFromID,
+		search.CreatedToID,
+		formatTime(search.UpdatedFrom),
+		formatTime(search.UpdatedTo),
+		search.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []OrderSummary{}
+	for rows.Next() {
+		var o OrderSummary
+		var updatedAt pgtype.Timestamptz
+		err = rows.Scan(
+			&o.OrderID,
+			&o.OrderStatus,
+			&o.PaymentStatus,
+			&o.DeliveryAddress,
+			&o.PriceCurrencyID,
+			&o.PriceAmount,
+			&o.ProductIDs,
+			&updatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("search orders failed: %v", err)
+		}
+		o.CreatedAt, err = ULIDTime(o.OrderID)
+		if err != nil {
+			return nil, err
+		}
+		o.UpdatedAt = updatedAt.Time
+		orders = append(orders, o)
+	}
+
+	return orders, nil
+}
+
+// notifies every instance listening for order events
+func (s *ServiceImpl) NotifyOrderEvent(ctx context.Context, payload string) error {
+	_, err := s.pool.Exec(ctx, s.queries[notifyOrderEvent], payload)
+	return err
+}
+
+// holds a connection listening for order events, calling handler with each payload until ctx is done or the connection fails
+func (s *ServiceImpl) ListenOrderEvents(ctx context.Context, handler func(payload string)) error {
+	return s.listen(ctx, listenOrderEvents, unlistenOrderEvents, handler)
+}
+
+// holds a connection listening for changes to novellia.product, calling handler with the statement type until ctx is done or the connection fails
+func (s *ServiceImpl) ListenProductChanges(ctx context.Context, handler func(payload string)) error {
+	return s.listen(ctx, listenProductChanges, unlistenProductChanges, handler)
+}
+
+func (s *ServiceImpl) listen(ctx context.Context, listenQuery string, unlistenQuery string, handler func(payload string)) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	pgConn := conn.Conn()
+	defer func() {
+		// connections closed by a failed wait are dropped by the pool, others stop listening before being reused
+		if !pgConn.IsClosed() {
+			pgConn.Exec(context.Background(), s.queries[unlistenQuery])
+		}
+		conn.Release()
+	}()
+
+	_, err = pgConn.Exec(ctx, s.queries[listenQuery])
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := pgConn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		handler(notification.Payload)
+	}
+}
+
+func (s *ServiceImpl) queueInsertWebhookDeliveries(batch *pgx.Batch, deliveries []WebhookDelivery) {
+	for _, d := range deliveries {
+		batch.Queue(s.queries[insertWebhookDelivery],
+			d.DeliveryID,
+			d.EndpointName,
+			d.EventType,
+			d.OrderID,
+			d.Payload,
+		)
+	}
+}
+
+// queues webhook deliveries, all or none are written
+func (s *ServiceImpl) InsertWebhookDeliveries(ctx context.Context, deliveries []WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	s.queueInsertWebhookDeliveries(batch, deliveries)
+
+	br := tx.SendBatch(ctx, batch)
+	for range deliveries {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// leases up to limit pending deliveries that are due, they become due again after lease unless updated
+func (s *ServiceImpl) ClaimWebhookDeliveries(ctx context.Context, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.pool.Query(ctx, s.queries[claimWebhookDeliveries], lease.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		err = rows.Scan(
+			&d.DeliveryID,
+			&d.EndpointName,
+			&d.EventType,
+			&d.OrderID,
+			&d.Payload,
+			&d.Attempts,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("claim webhook deliveries failed: %v", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
+
+func (s *ServiceImpl) UpdateWebhookDelivered(ctx context.Context, deliveryID string, attempts int) error {
+	_, err := s.pool.Exec(ctx, s.queries[updateWebhookDeliveryDelivered], deliveryID, attempts)
+	return err
+}
+
+// schedules another attempt after delay
+func (s *ServiceImpl) UpdateWebhookRetry(ctx context.Context, deliveryID string, attempts int, lastError string, delay time.Duration) error {
+	_, err := s.pool.Exec(ctx, s.queries[updateWebhookDeliveryRetry], deliveryID, attempts, lastError, delay.Seconds())
+	return err
+}
+
+// stops retrying a delivery, moving it to the dead-letter table
+func (s *ServiceImpl) DeadLetterWebhookDelivery(ctx context.Context, deliveryID string, attempts int, lastError string) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	batch.Queue(s.queries[updateWebhookDeliveryDead], deliveryID, attempts, lastError)
+	batch.Queue(s.queries[insertWebhookDeadLetter], deliveryID, attempts, lastError)
+
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < 2; i += 1 {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *ServiceImpl) QueryWebhookDeadLetters(ctx context.Context) ([]WebhookDeadLetter, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryWebhookDeadLetters])
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	orderIDs := []string{}
+	deadLetters := []WebhookDeadLetter{}
 	for rows.Next() {
-		var orderID string
+		var d WebhookDeadLetter
 		err = rows.Scan(
-			&orderID,
+			&d.DeliveryID,
+			&d.EndpointName,
+			&d.EventType,
+			&d.OrderID,
+			&d.Payload,
+			&d.Attempts,
+			&d.LastError,
+			&d.CreatedAt,
 		)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("query webhook dead letters failed: %v", err)
 		}
+		deadLetters = append(deadLetters, d)
+	}
 
-		orderIDs = append(orderIDs, orderID)
+	return deadLetters, nil
+}
+
+// moves a dead letter back to pending with its attempts reset, returning false if there is no such dead letter
+func (s *ServiceImpl) ReplayWebhookDeadLetter(ctx context.Context, deliveryID string) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
 	}
 
-	return orderIDs, nil
+	tag, err := tx.Exec(ctx, s.queries[deleteWebhookDeadLetter], deliveryID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return false, err
+	}
+	if tag.RowsAffected() != 1 {
+		tx.Rollback(ctx)
+		return false, nil
+	}
+	_, err = tx.Exec(ctx, s.queries[updateWebhookDeliveryReplay], deliveryID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return false, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (s *ServiceImpl) QueryProducts(ctx context.Context) ([]Product, error) {
-	rows, err := s.pool.Query(ctx, s.queries[queryProducts])
+// gets the contact given with an order, nil if none was
+func (s *ServiceImpl) QueryOrderContact(ctx context.Context, orderID string) (*OrderContact, error) {
+	var contact OrderContact
+	err := s.pool.QueryRow(ctx, s.queries[queryCustomerOrderContact], orderID).Scan(
+		&contact.Email,
+		&contact.DiscordWebhookURL,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query order contact failed: %v", err)
+	}
+
+	return &contact, nil
+}
+
+func (s *ServiceImpl) queueInsertNotifications(batch *pgx.Batch, notifications []Notification) {
+	for _, n := range notifications {
+		batch.Queue(s.queries[insertNotification],
+			n.NotificationID,
+			n.OrderID,
+			n.WaitlistEntryID,
+			n.Channel,
+			n.Recipient,
+			n.EventType,
+			n.Subject,
+			n.Body,
+		)
+	}
+}
+
+// queues notifications, all or none are written
+func (s *ServiceImpl) InsertNotifications(ctx context.Context, notifications []Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	s.queueInsertNotifications(batch, notifications)
+
+	br := tx.SendBatch(ctx, batch)
+	for range notifications {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// leases up to limit pending notifications that are due, they become due again after lease unless updated
+func (s *ServiceImpl) ClaimNotifications(ctx context.Context, lease time.Duration, limit int) ([]Notification, error) {
+	rows, err := s.pool.Query(ctx, s.queries[claimNotifications], lease.Seconds(), limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	products := []Product{}
+	notifications := []Notification{}
 	for rows.Next() {
-		var p Product
-		var dateListed pgtype.Timestamptz
-		var dateAvailable pgtype.Timestamptz
-
+		var n Notification
 		err = rows.Scan(
-			&p.ProductID,
-			&p.PriceUnitAmount,
-			&p.PriceCurrencyID,
-			&p.MaxOrderSize,
-			&dateListed,
-			&dateAvailable,
-			&p.NativeTokenID,
+			&n.NotificationID,
+			&n.OrderID,
+			&n.WaitlistEntryID,
+			&n.Channel,
+			&n.Recipient,
+			&n.EventType,
+			&n.Subject,
+			&n.Body,
+			&n.Attempts,
 		)
 		if err != nil {
-			return nil, fmt.Errorf("query products failed: %v", err)
+			return nil, fmt.Errorf("claim notifications failed: %v", err)
 		}
+		notifications = append(notifications, n)
+	}
 
-		// convert dates to time.Time
-		p.DateListed = nil
-		if dateListed.Status == pgtype.Present {
-			p.DateListed = &dateListed.Time
-		}
-		p.DateAvailable = nil
-		if dateAvailable.Status == pgtype.Present {
-			p.DateAvailable = &dateAvailable.Time
-		}
+	return notifications, nil
+}
 
-		products = append(products, p)
-	}
+func (s *ServiceImpl) UpdateNotificationSent(ctx context.Context, notificationID string, attempts int) error {
+	_, err := s.pool.Exec(ctx, s.queries[updateNotificationSent], notificationID, attempts)
+	return err
+}
 
-	return products, nil
+// schedules another attempt after delay
+func (s *ServiceImpl) UpdateNotificationRetry(ctx context.Context, notificationID string, attempts int, lastError string, delay time.Duration) error {
+	_, err := s.pool.Exec(ctx, s.queries[updateNotificationRetry], notificationID, attempts, lastError, delay.Seconds())
+	return err
+}
+
+// stops retrying a notification
+func (s *ServiceImpl) UpdateNotificationFailed(ctx context.Context, notificationID string, attempts int, lastError string) error {
+	_, err := s.pool.Exec(ctx, s.queries[updateNotificationFailed], notificationID, attempts, lastError)
+	return err
 }
 
-func (s *ServiceImpl) InsertCardanoTransaction(ctx context.Context, orderID string, txid string) error {
-	_, err := s.pool.Exec(ctx, s.queries[insertCardanoTransaction], orderID, txid)
+func scanSaleSeed(row pgx.Row) (*SaleSeed, error) {
+	var seed SaleSeed
+	var endedAt pgtype.Timestamptz
+	var revealedAt pgtype.Timestamptz
+	err := row.Scan(
+		&seed.SaleSeedID,
+		&seed.SeedHash,
+		&seed.CatalogHash,
+		&seed.Seed,
+		&seed.Active,
+		&seed.CreatedAt,
+		&endedAt,
+		&revealedAt,
+	)
 	if err != nil {
-		return fmt.Errorf("insert cardano transaction failed: %v", err)
+		return nil, err
 	}
-	return nil
+
+	if endedAt.Status == pgtype.Present {
+		seed.EndedAt = &endedAt.Time
+	}
+	if revealedAt.Status == pgtype.Present {
+		seed.RevealedAt = &revealedAt.Time
+	}
+	return &seed, nil
 }
 
-func (s *ServiceImpl) Close() {
-	s.pool.Close()
+// gets the seed of the running sale, nil if there is none
+func (s *ServiceImpl) QueryActiveSaleSeed(ctx context.Context) (*SaleSeed, error) {
+	seed, err := scanSaleSeed(s.pool.QueryRow(ctx, s.queries[queryActiveSaleSeed]))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query active sale seed failed: %v", err)
+	}
+	return seed, nil
 }
 
-func (s *ServiceImpl) QueryOrderNativeTokens(ctx context.Context, orderID string) (map[string]*big.Int, error) {
-	rows, err := s.pool.Query(ctx, s.queries[queryCustomerOrderNativeTokens], orderID)
+// every seed newest first, including the secret ones
+func (s *ServiceImpl) QuerySaleSeeds(ctx context.Context) ([]SaleSeed, error) {
+	rows, err := s.pool.Query(ctx, s.queries[querySaleSeeds])
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	t := map[string]*big.Int{}
+	seeds := []SaleSeed{}
 	for rows.Next() {
-		var nativeTokenID string
-		var quantity int64
+		seed, err := scanSaleSeed(rows)
+		if err != nil {
+			return nil, fmt.Errorf("query sale seeds failed: %v", err)
+		}
+		seeds = append(seeds, *seed)
+	}
+
+	return seeds, nil
+}
+
+// starts a sale with seed, ending the running one if end is set
+// returns false if end is not set and another sale is running
+func (s *ServiceImpl) InsertSaleSeed(ctx context.Context, seed SaleSeed, end bool) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if end {
+		_, err = tx.Exec(ctx, s.queries[updateSaleSeedEnded])
+		if err != nil {
+			tx.Rollback(ctx)
+			return false, err
+		}
+	}
+	tag, err := tx.Exec(ctx, s.queries[insertSaleSeed], seed.SaleSeedID, seed.SeedHash, seed.Seed, seed.CatalogHash)
+	if err != nil {
+		tx.Rollback(ctx)
+		return false, err
+	}
+	if tag.RowsAffected() != 1 {
+		tx.Rollback(ctx)
+		return false, nil
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// publishes the seed of an ended sale, returning false if there is no such ended sale
+func (s *ServiceImpl) RevealSaleSeed(ctx context.Context, saleSeedID string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, s.queries[updateSaleSeedRevealed], saleSeedID)
+	if err != nil {
+		return false, fmt.Errorf("reveal sale seed failed: %v", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s *ServiceImpl) QueryOrderPulls(ctx context.Context, orderID string) ([]OrderPull, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryCustomerOrderPulls], orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	pulls := []OrderPull{}
+	for rows.Next() {
+		var p OrderPull
+		var odds string
 		err = rows.Scan(
-			&nativeTokenID,
-			&quantity,
+			&p.ItemIndex,
+			&p.ProductID,
+			&p.SaleSeedID,
+			&p.UnpackedProductIDs,
+			&odds,
 		)
 		if err != nil {
-			return nil, fmt.Errorf("query order native tokens failed: %v", err)
+			return nil, fmt.Errorf("query order pulls failed: %v", err)
 		}
-
-		t[nativeTokenID] = big.NewInt(quantity)
+		err = json.Unmarshal([]byte(odds), &p.Odds)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode pull odds: %v", err)
+		}
+		pulls = append(pulls, p)
 	}
 
-	return t, err
+	return pulls, nil
 }
 
-func (s *ServiceImpl) InsertOrderNativeTokens(ctx context.Context, orderID string, tokens map[string]*big.Int) error {
+// replaces the addresses of an allowlist
+func (s *ServiceImpl) ReplaceAllowlist(ctx context.Context, allowlistID string, addresses []string) error {
 	tx, err := s.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 
 	batch := &pgx.Batch{}
-	for native_token_id, quantity := range tokens {
-		batch.Queue(s.queries[insertCustomerOrderNativeTokens], 
-			orderID,
-			native_token_id,
-			quantity.Int64(),
-		)
+	batch.Queue(s.queries[deleteAllowlistAddresses], allowlistID)
+	for _, address := range addresses {
+		batch.Queue(s.queries[insertAllowlistAddress], allowlistID, address)
 	}
 
 	br := tx.SendBatch(ctx, batch)
-	for i := 0; i < len(tokens); i++ {
-		_, err := br.Exec()
+	for i := 0; i < batch.Len(); i += 1 {
+		_, err = br.Exec()
 		if err != nil {
+			br.Close()
 			tx.Rollback(ctx)
-			return err
+			return fmt.Errorf("replace allowlist %s failed: %v", allowlistID, err)
 		}
 	}
 
@@ -447,40 +2263,113 @@ func (s *ServiceImpl) InsertOrderNativeTokens(ctx context.Context, orderID strin
 		return err
 	}
 
-	err = tx.Commit(ctx)
+	return tx.Commit(ctx)
+}
+
+// whether any of addresses is on the allowlist
+func (s *ServiceImpl) QueryAllowlisted(ctx context.Context, allowlistID string, addresses []string) (bool, error) {
+	var allowlisted bool
+	err := s.pool.QueryRow(ctx, s.queries[queryAllowlistAddress], allowlistID, addresses).Scan(&allowlisted)
 	if err != nil {
-		return err
+		return false, err
 	}
+	return allowlisted, nil
+}
 
-	return nil
+// units counted against address in a sale phase by orders that have not failed
+func (s *ServiceImpl) QueryEligibilityUnits(ctx context.Context, salePhase string, address string) (int64, error) {
+	var units int64
+	err := s.pool.QueryRow(ctx, s.queries[queryCustomerOrderEligibilityUnits], salePhase, address).Scan(&units)
+	if err != nil {
+		return 0, err
+	}
+	return units, nil
 }
 
-func (s *ServiceImpl) QueryCardanoTransactions(ctx context.Context, orderID string) ([]string, error) {
-	rows, err := s.pool.Query(ctx, s.queries[queryCardanoTransactions], orderID)
+// units ordered by a delivery address or stake address that count against limit, in orders that have not failed
+func (s *ServiceImpl) QueryCustomerUnits(ctx context.Context, deliveryAddress string, stakeAddress string, limit PurchaseLimit) (int64, error) {
+	return s.queryCustomerUnits(ctx, s.pool, deliveryAddress, stakeAddress, limit)
+}
+
+// queues a customer for a product, returns false if the delivery address is already waiting for it
+func (s *ServiceImpl) InsertWaitlistEntry(ctx context.Context, entry WaitlistEntry) (bool, error) {
+	tag, err := s.pool.Exec(ctx, s.queries[insertWaitlistEntry],
+		entry.WaitlistEntryID,
+		entry.ProductID,
+		entry.NativeTokenID,
+		entry.DeliveryAddress,
+		entry.Quantity,
+		entry.Contact.Email,
+		entry.Contact.DiscordWebhookURL,
+	)
+	if err != nil {
+		return false, fmt.Errorf("insert waitlist entry failed: %v", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func scanWaitlistEntry(row pgx.Row) (*WaitlistEntry, error) {
+	var entry WaitlistEntry
+	var reservedUntil pgtype.Timestamptz
+	err := row.Scan(
+		&entry.WaitlistEntryID,
+		&entry.ProductID,
+		&entry.NativeTokenID,
+		&entry.DeliveryAddress,
+		&entry.Quantity,
+		&entry.Contact.Email,
+		&entry.Contact.DiscordWebhookURL,
+		&entry.Status,
+		&reservedUntil,
+		&entry.OrderID,
+		&entry.CreatedAt,
+		&entry.Ahead,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if reservedUntil.Status == pgtype.Present {
+		entry.ReservedUntil = &reservedUntil.Time
+	}
+	return &entry, nil
+}
+
+// returns nil if the entry does not exist
+func (s *ServiceImpl) QueryWaitlistEntry(ctx context.Context, waitlistEntryID string) (*WaitlistEntry, error) {
+	entry, err := scanWaitlistEntry(s.pool.QueryRow(ctx, s.queries[queryWaitlistEntry], waitlistEntryID))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query waitlist entry failed: %v", err)
+	}
+	return entry, nil
+}
+
+// entries without a reservation, oldest first
+func (s *ServiceImpl) QueryWaitingWaitlistEntries(ctx context.Context) ([]WaitlistEntry, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryWaitingWaitlistEntries])
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	txids := []string{}
+	entries := []WaitlistEntry{}
 	for rows.Next() {
-		var txid string
-
-		err = rows.Scan(
-			&txid,
-		)
+		entry, err := scanWaitlistEntry(rows)
 		if err != nil {
-			return nil, fmt.Errorf("query Cardano transactions failed: %v", err)
+			return nil, fmt.Errorf("query waiting waitlist entries failed: %v", err)
 		}
-
-		txids = append(txids, txid)
+		entries = append(entries, *entry)
 	}
 
-	return txids, err
+	return entries, nil
 }
 
-func (s *ServiceImpl) QueryReservedNativeTokens(ctx context.Context) (map[string]*big.Int, error) {
-	rows, err := s.pool.Query(ctx, s.queries[queryReservedNativeTokens])
+// quantity of each native token that entries without a reservation are waiting for
+func (s *ServiceImpl) QueryWaitingNativeTokens(ctx context.Context) (map[string]*big.Int, error) {
+	rows, err := s.pool.Query(ctx, s.queries[queryWaitingNativeTokens])
 	if err != nil {
 		return nil, err
 	}
@@ -496,11 +2385,79 @@ func (s *ServiceImpl) QueryReservedNativeTokens(ctx context.Context) (map[string
 			&quantity,
 		)
 		if err != nil {
-			return nil, fmt.Errorf("query reserved native tokens failed: %v", err)
+			return nil, fmt.Errorf("query waiting native tokens failed: %v", err)
 		}
 
 		t[nativeTokenID] = big.NewInt(quantity)
 	}
 
-	return t, err
+	return t, nil
+}
+
+// holds stock for a waiting entry until reservedUntil, returns false if the entry was not waiting
+func (s *ServiceImpl) UpdateWaitlistEntryReserved(ctx context.Context, waitlistEntryID string, reservedUntil time.Time) (bool, error) {
+	tag, err := s.pool.Exec(ctx, s.queries[updateWaitlistEntryReserved], waitlistEntryID, reservedUntil)
+	if err != nil {
+		return false, fmt.Errorf("update waitlist entry reserved failed: %v", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// expires reservations that were not claimed in time, returning how many were
+func (s *ServiceImpl) UpdateWaitlistEntriesExpired(ctx context.Context) (int64, error) {
+	tag, err := s.pool.Exec(ctx, s.queries[updateWaitlistEntriesExpired])
+	if err != nil {
+		return 0, fmt.Errorf("update waitlist entries expired failed: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// runs fn unless another instance is running it, returning false if fn was skipped
+// fn is not run in the transaction holding the lock, which is released when fn returns
+func (s *ServiceImpl) WithWaitlistLock(ctx context.Context, fn func(ctx context.Context) error) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	err = tx.QueryRow(ctx, s.queries[tryLockWaitlist]).Scan(&locked)
+	if err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+
+	err = fn(ctx)
+	if err != nil {
+		return true, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// runs fn unless another caller on any instance is fulfilling the order, returning false if fn was skipped
+// fn is not run in the transaction holding the lock, which is released when fn returns
+func (s *ServiceImpl) WithOrderFulfillmentLock(ctx context.Context, orderID string, fn func(ctx context.Context) error) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	err = tx.QueryRow(ctx, s.queries[tryLockOrderFulfillment], orderID).Scan(&locked)
+	if err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+
+	err = fn(ctx)
+	if err != nil {
+		return true, err
+	}
+	return true, tx.Commit(ctx)
 }
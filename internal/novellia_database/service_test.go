@@ -6,10 +6,14 @@ import (
 	"context"
 	"testing"
 	"math/big"
+	"sync"
+	"errors"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders/statemachine"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
 )
 
@@ -42,7 +46,7 @@ func setupTest(ctx context.Context) (novellia_database.Service, error) {
 	return novelliaDatabaseService, nil
 }
 
-func TestInsertOrder(t *testing.T) {
+func TestInsertPendingOrder(t *testing.T) {
 	ctx := context.Background()
 
 	service, err := setupTest(ctx)
@@ -64,12 +68,15 @@ func TestInsertOrder(t *testing.T) {
 		Payment: ordf.OrderPayment{
 			PriceCurrencyId: "ada",
 			PriceAmount: 60,
-			PaymentAddress: "addr1q8hax2z9wav0prwhmls59g2dz5aja7jnsz9kyqr7sa8rp0ew08lffp5n2kzt72ez93m5zev2v4fm9sawnrqnvllmyhmst2jnww",
-			PaymentStatus: "WAITING",
 		},
 		Description: "Test Order",
 		OrderId: "ORDER-ABC",
-		OrderStatus: "AWAITING_PAYMENT",
+		OrderStatus: orders.ORDER_STATUS_PENDING,
+	}
+
+	tokens := map[string]*big.Int{
+		"0xRektangularStudios.Draculi": big.NewInt(2),
+		"0xRektangularStudios.IscaraTheTenThousandGuns": big.NewInt(4),
 	}
 
 	payment := now_payments.CreatePaymentResponse{
@@ -78,7 +85,7 @@ func TestInsertOrder(t *testing.T) {
 		PayAddress: "addr1q8hax2z9wav0prwhmls59g2dz5aja7jnsz9kyqr7sa8rp0ew08lffp5n2kzt72ez93m5zev2v4fm9sawnrqnvllmyhmst2jnww",
 		PriceAmount: 60,
 		PriceCurrency: "ada",
-		PayAmount: 60,
+		PayAmount: "60",
 		PayCurrency: "ada",
 		OrderID: "ORDER-ABC",
 		OrderDescription: "Test Order",
@@ -89,9 +96,48 @@ func TestInsertOrder(t *testing.T) {
 		PurchaseID: "5831731753",
 	}
 
-	err = service.InsertOrder(ctx, order, payment)
+	orderFees := []fees.Fee{
+		fees.Fee{
+			Name: "processing",
+			Type: fees.FEE_TYPE_FLAT,
+			Amount: 1,
+		},
+		fees.Fee{
+			Name: fees.MinADADepositFeeName,
+			Type: fees.FEE_TYPE_DEPOSIT,
+			Amount: 2,
+		},
+	}
+
+	err = service.InsertPendingOrder(ctx, order, "", orderFees, nil, tokens, novellia_database.StatusTransition{
+		OrderID: order.OrderId,
+		To: orders.ORDER_STATUS_PENDING,
+		Reason: "order created",
+		Actor: statemachine.ACTOR_CUSTOMER,
+	}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("insert pending order failed: %+v", err)
+	}
+
+	err = service.AttachOrderPayment(ctx, novellia_database.StatusTransition{
+		OrderID: order.OrderId,
+		From: orders.ORDER_STATUS_PENDING,
+		To: orders.ORDER_STATUS_AWAITING_PAYMENT,
+		Reason: "payment created",
+		Actor: statemachine.ACTOR_CUSTOMER,
+	}, payment)
+	if err != nil {
+		t.Fatalf("attach order payment failed: %+v", err)
+	}
+
+	inserted, err := service.QueryOrderNativeTokens(ctx, order.OrderId)
 	if err != nil {
-		t.Errorf("insert order failed: %+v", err)
+		t.Fatalf("query order native tokens failed: %+v", err)
+	}
+	for nativeTokenID, quantity := range tokens {
+		if inserted[nativeTokenID] == nil || inserted[nativeTokenID].Cmp(quantity) != 0 {
+			t.Errorf("expected %s of %s, got %v", quantity, nativeTokenID, inserted[nativeTokenID])
+		}
 	}
 }
 
@@ -159,7 +205,7 @@ func TestUpdateOrder(t *testing.T) {
 	}
 	defer service.Close()
 
-	err = service.UpdateOrder(ctx, order, payment)
+	err = service.UpdateOrder(ctx, order, payment, nil)
 	if err != nil {
 		t.Errorf("update order failed: %+v", err)
 	}
@@ -215,7 +261,7 @@ func TestQueryOrderNativeTokens(t *testing.T) {
 	t.Errorf("%+v", tokens)
 }
 
-func TestInsertOrderNativeTokens(t *testing.T) {
+func TestQueryCardanoTransactions(t *testing.T) {
 	ctx := context.Background()
 
 	service, err := setupTest(ctx)
@@ -224,18 +270,15 @@ func TestInsertOrderNativeTokens(t *testing.T) {
 	}
 	defer service.Close()
 
-	orderID := "ORDER-ABC"
-	tokens := map[string]*big.Int{
-		"0xRektangularStudios.Draculi": big.NewInt(2),
-		"0xRektangularStudios.IscaraTheTenThousandGuns": big.NewInt(4),
-	}
-	err = service.InsertOrderNativeTokens(ctx, orderID, tokens)
+	orderID := "ORDER-01F68KR9PRJBGPPRGRJEPNP85J"
+	txids, err := service.QueryCardanoTransactions(ctx, orderID)
 	if err != nil {
-		t.Errorf("insert order native tokens failed: %+v", err)
+		t.Errorf("query Cardano transactions failed: %+v", err)
 	}
+	t.Errorf("txids: %+v", txids)
 }
 
-func TestQueryCardanoTransactions(t *testing.T) {
+func TestQueryReservedNativeTokens(t *testing.T) {
 	ctx := context.Background()
 
 	service, err := setupTest(ctx)
@@ -244,26 +287,437 @@ func TestQueryCardanoTransactions(t *testing.T) {
 	}
 	defer service.Close()
 
-	orderID := "ORDER-01F68KR9PRJBGPPRGRJEPNP85J"
-	txids, err := service.QueryCardanoTransactions(ctx, orderID)
+	reservedTokens, err := service.QueryReservedNativeTokens(ctx)
 	if err != nil {
-		t.Errorf("query Cardano transactions failed: %+v", err)
+		t.Errorf("query reserved native tokens failed: %+v", err)
 	}
-	t.Errorf("txids: %+v", txids)
+	t.Errorf("reserved tokens: %+v", reservedTokens)
 }
 
-func TestQueryReservedNativeTokens(t *testing.T) {
+func TestPendingOrder(t *testing.T) {
 	ctx := context.Background()
 
 	service, err := setupTest(ctx)
 	if err != nil {
-		t.Errorf("failed to setup test: %+v", err)
+		t.Fatalf("failed to setup test: %+v", err)
 	}
 	defer service.Close()
 
-	reservedTokens, err := service.QueryReservedNativeTokens(ctx)
+	order := ordf.Order{
+		Items: []ordf.OrderItems{
+			ordf.OrderItems{
+				ProductId: "PROD-01F4MK45QJS4WZ1VBZW1A1THD7",
+				Quantity: 1,
+			},
+		},
+		Customer: ordf.OrderCustomer{
+			DeliveryAddress: "addr1q8hax2z9wav0prwhmls59g2dz5aja7jnsz9kyqr7sa8rp0ew08lffp5n2kzt72ez93m5zev2v4fm9sawnrqnvllmyhmst2jnww",
+		},
+		Payment: ordf.OrderPayment{
+			PriceCurrencyId: "ada",
+			PriceAmount: 20,
+		},
+		Description: "Test Order",
+		OrderId: service.GenerateULID("ORDER"),
+		OrderStatus: orders.ORDER_STATUS_PENDING,
+	}
+	tokens := map[string]*big.Int{
+		"0xRektangularStudios.Draculi": big.NewInt(1),
+	}
+	err = service.InsertPendingOrder(ctx, order, "", nil, nil, tokens, novellia_database.StatusTransition{
+		OrderID: order.OrderId,
+		To: orders.ORDER_STATUS_PENDING,
+		Reason: "test",
+		Actor: "customer",
+	}, &novellia_database.OrderContact{
+		Email: "customer@example.com",
+	}, nil, nil, nil)
 	if err != nil {
-		t.Errorf("query reserved native tokens failed: %+v", err)
+		t.Fatalf("insert pending order failed: %+v", err)
+	}
+
+	contact, err := service.QueryOrderContact(ctx, order.OrderId)
+	if err != nil {
+		t.Fatalf("query order contact failed: %+v", err)
+	}
+	if contact == nil || contact.Email != "customer@example.com" || contact.DiscordWebhookURL != "" {
+		t.Fatalf("unexpected order contact: %+v", contact)
+	}
+
+	pendingOrder, pendingPayment, _, err := service.QueryOrder(ctx, order.OrderId)
+	if err != nil {
+		t.Fatalf("query pending order failed: %+v", err)
+	}
+	if pendingOrder.OrderStatus != orders.ORDER_STATUS_PENDING || pendingPayment != nil {
+		t.Errorf("pending order should have no payment: %+v, %+v", pendingOrder, pendingPayment)
+	}
+
+	payment := now_payments.CreatePaymentResponse{
+		PaymentID: fmt.Sprintf("%d", time.Now().Unix()),
+		PaymentStatus: "waiting",
+		PayAddress: "addr1q8hax2z9wav0prwhmls59g2dz5aja7jnsz9kyqr7sa8rp0ew08lffp5n2kzt72ez93m5zev2v4fm9sawnrqnvllmyhmst2jnww",
+		PriceAmount: 20,
+		PriceCurrency: "ada",
+		PayAmount: "20",
+		PayCurrency: "ada",
+		OrderID: order.OrderId,
+		OrderDescription: "Test Order",
+		CreatedAt: "2021-05-11T02:00:03.859Z",
+		UpdatedAt: "2021-05-11T02:00:03.859Z",
+	}
+	err = service.AttachOrderPayment(ctx, novellia_database.StatusTransition{
+		OrderID: order.OrderId,
+		From: orders.ORDER_STATUS_PENDING,
+		To: orders.ORDER_STATUS_AWAITING_PAYMENT,
+		Reason: "test",
+		Actor: "customer",
+	}, payment)
+	if err != nil {
+		t.Fatalf("attach order payment failed: %+v", err)
+	}
+
+	queriedOrder, queriedPayment, _, err := service.QueryOrder(ctx, order.OrderId)
+	if err != nil {
+		t.Fatalf("query order failed: %+v", err)
+	}
+	if queriedOrder.OrderStatus != orders.ORDER_STATUS_AWAITING_PAYMENT || queriedPayment.PaymentID.String() != payment.PaymentID {
+		t.Errorf("payment not attached: %+v, %+v", queriedOrder, queriedPayment)
+	}
+
+	history, err := service.QueryOrderStatusHistory(ctx, order.OrderId)
+	if err != nil {
+		t.Fatalf("query order status history failed: %+v", err)
+	}
+	if len(history) != 2 || history[1].To != orders.ORDER_STATUS_AWAITING_PAYMENT {
+		t.Errorf("unexpected history: %+v", history)
+	}
+}
+
+func TestULIDLowerBound(t *testing.T) {
+	createdAt := time.Date(2021, 5, 22, 21, 0, 0, 0, time.UTC)
+	lower := novellia_database.ULIDLowerBound("ORDER", createdAt)
+
+	parsed, err := novellia_database.ULIDTime(lower)
+	if err != nil {
+		t.Fatalf("failed to parse ULID bound: %+v", err)
+	}
+	if !parsed.Equal(createdAt) {
+		t.Errorf("expected %v, got %v", createdAt, parsed)
+	}
+
+	before := novellia_database.ULIDLowerBound("ORDER", createdAt.Add(-time.Millisecond))
+	after := novellia_database.ULIDLowerBound("ORDER", createdAt.Add(time.Millisecond))
+	if !(before < lower && lower < after) {
+		t.Errorf("ULID bounds do not sort by time: %s, %s, %s", before, lower, after)
+	}
+}
+
+func TestSearchOrders(t *testing.T) {
+	ctx := context.Background()
+	service, err := setupTest(ctx)
+	if err != nil {
+		t.Fatalf("failed to setup test: %+v", err)
+	}
+	defer service.Close()
+
+	startedAt := time.Now().Add(-time.Second)
+	deliveryAddress := fmt.Sprintf("addr_test_search_%d", time.Now().UnixNano())
+	orderIDs := []string{}
+	for i := 0; i < 3; i += 1 {
+		order := ordf.Order{
+			Items: []ordf.OrderItems{
+				ordf.OrderItems{
+					ProductId: "PROD-01F4MK45QJS4WZ1VBZW1A1THD7",
+					Quantity: 1,
+				},
+			},
+			Customer: ordf.OrderCustomer{
+				DeliveryAddress: deliveryAddress,
+			},
+			Payment: ordf.OrderPayment{
+				PriceCurrencyId: "ada",
+				PriceAmount: 20,
+			},
+			Description: "Test Order",
+			OrderId: service.GenerateULID("ORDER"),
+			OrderStatus: orders.ORDER_STATUS_PENDING,
+		}
+		err = service.InsertPendingOrder(ctx, order, "", nil, nil, map[string]*big.Int{}, novellia_database.StatusTransition{
+			OrderID: order.OrderId,
+			To: orders.ORDER_STATUS_PENDING,
+			Reason: "test",
+			Actor: "customer",
+		}, nil, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("insert pending order failed: %+v", err)
+		}
+		orderIDs = append(orderIDs, order.OrderId)
+	}
+
+	search := novellia_database.OrderSearch{
+		OrderStatus: orders.ORDER_STATUS_PENDING,
+		DeliveryAddress: deliveryAddress,
+		ProductID: "PROD-01F4MK45QJS4WZ1VBZW1A1THD7",
+		CreatedFromID: novellia_database.ULIDLowerBound("ORDER", startedAt),
+		Limit: 2,
+	}
+	page, err := service.SearchOrders(ctx, search)
+	if err != nil {
+		t.Fatalf("search orders failed: %+v", err)
+	}
+	// newest first
+	if len(page) != 2 || page[0].OrderID != orderIDs[2] || page[1].OrderID != orderIDs[1] {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+
+	search.Cursor = page[1].OrderID
+	page, err = service.SearchOrders(ctx, search)
+	if err != nil {
+		t.Fatalf("search orders failed: %+v", err)
+	}
+	if len(page) != 1 || page[0].OrderID != orderIDs[0] || len(page[0].ProductIDs) != 1 {
+		t.Errorf("unexpected second page: %+v", page)
+	}
+}
+
+func TestCustomerLimits(t *testing.T) {
+	ctx := context.Background()
+	service, err := setupTest(ctx)
+	if err != nil {
+		t.Fatalf("failed to setup test: %+v", err)
+	}
+	defer service.Close()
+
+	// each order is delivered to a different address with the same stake address, at most 3 units between them
+	suffix := time.Now().UnixNano()
+	stakeAddress := fmt.Sprintf("stake_test_limits_%d", suffix)
+	limit := novellia_database.PurchaseLimit{
+		Name: "test limit",
+		ProductID: "PROD-01F4MK45QJS4WZ1VBZW1A1THD7",
+		MaxUnits: 3,
+		Units: 1,
+		FromOrderID: novellia_database.ULIDLowerBound("ORDER", time.Now().Add(-time.Second)),
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i += 1 {
+		order := ordf.Order{
+			Items: []ordf.OrderItems{
+				ordf.OrderItems{
+					ProductId: limit.ProductID,
+					Quantity: 1,
+				},
+			},
+			Customer: ordf.OrderCustomer{
+				DeliveryAddress: fmt.Sprintf("addr_test_limits_%d_%d", suffix, i),
+			},
+			Payment: ordf.OrderPayment{
+				PriceCurrencyId: "ada",
+				PriceAmount: 20,
+			},
+			Description: "Test Order",
+			OrderId: service.GenerateULID("ORDER"),
+			OrderStatus: orders.ORDER_STATUS_PENDING,
+		}
+		customer := &novellia_database.OrderCustomer{
+			DeliveryAddress: order.Customer.DeliveryAddress,
+			StakeAddress: stakeAddress,
+			Limits: []novellia_database.PurchaseLimit{limit},
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- service.InsertPendingOrder(ctx, order, "", nil, nil, map[string]*big.Int{}, novellia_database.StatusTransition{
+				OrderID: order.OrderId,
+				To: orders.ORDER_STATUS_PENDING,
+				Reason: "test",
+				Actor: "customer",
+			}, nil, nil, nil, customer)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	inserted := 0
+	for err := range errs {
+		if err == nil {
+			inserted += 1
+		} else if !errors.Is(err, novellia_database.ErrPurchaseLimitReached) {
+			t.Errorf("insert pending order failed: %+v", err)
+		}
+	}
+	if inserted != 3 {
+		t.Errorf("expected 3 concurrent orders within the limit, got %d", inserted)
+	}
+
+	units, err := service.QueryCustomerUnits(ctx, "addr_test_limits_other", stakeAddress, limit)
+	if err != nil || units != 3 {
+		t.Errorf("expected 3 units counted by stake address, got %d: %v", units, err)
+	}
+
+	// an order moved to an address with the same stake address counts against its limit
+	order := ordf.Order{
+		Items: []ordf.OrderItems{
+			ordf.OrderItems{
+				ProductId: limit.ProductID,
+				Quantity: 1,
+			},
+		},
+		Customer: ordf.OrderCustomer{
+			DeliveryAddress: fmt.Sprintf("addr_test_limits_%d_moved", suffix),
+		},
+		Payment: ordf.OrderPayment{
+			PriceCurrencyId: "ada",
+			PriceAmount: 20,
+		},
+		Description: "Test Order",
+		OrderId: service.GenerateULID("ORDER"),
+		OrderStatus: orders.ORDER_STATUS_PENDING,
+	}
+	err = service.InsertPendingOrder(ctx, order, "", nil, nil, map[string]*big.Int{}, novellia_database.StatusTransition{
+		OrderID: order.OrderId,
+		To: orders.ORDER_STATUS_PENDING,
+		Reason: "test",
+		Actor: "customer",
+	}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("insert pending order failed: %+v", err)
+	}
+	moved := limit
+	moved.Units = 0
+	transition := novellia_database.StatusTransition{
+		OrderID: order.OrderId,
+		From: orders.ORDER_STATUS_PENDING,
+		To: orders.ORDER_STATUS_PENDING,
+		Reason: "test",
+		Actor: "admin",
+	}
+	err = service.UpdateOrderDeliveryAddress(ctx, transition, novellia_database.OrderCustomer{
+		DeliveryAddress: fmt.Sprintf("addr_test_limits_%d_5", suffix),
+		StakeAddress: stakeAddress,
+		Limits: []novellia_database.PurchaseLimit{moved},
+	})
+	if !errors.Is(err, novellia_database.ErrPurchaseLimitReached) {
+		t.Errorf("expected moving the order onto a full stake address to be refused, got %v", err)
+	}
+	otherStakeAddress := stakeAddress + "_other"
+	err = service.UpdateOrderDeliveryAddress(ctx, transition, novellia_database.OrderCustomer{
+		DeliveryAddress: fmt.Sprintf("addr_test_limits_%d_6", suffix),
+		StakeAddress: otherStakeAddress,
+		Limits: []novellia_database.PurchaseLimit{moved},
+	})
+	if err != nil {
+		t.Errorf("update order delivery address failed: %+v", err)
+	}
+	units, err = service.QueryCustomerUnits(ctx, "addr_test_limits_other", otherStakeAddress, limit)
+	if err != nil || units != 1 {
+		t.Errorf("expected the moved order to count by its new stake address, got %d: %v", units, err)
+	}
+}
+
+func TestWaitlistReservation(t *testing.T) {
+	ctx := context.Background()
+	service, err := setupTest(ctx)
+	if err != nil {
+		t.Fatalf("failed to setup test: %+v", err)
+	}
+	defer service.Close()
+
+	suffix := time.Now().UnixNano()
+	entry := novellia_database.WaitlistEntry{
+		WaitlistEntryID: service.GenerateULID("WAITLIST"),
+		ProductID: "PROD-01F4MK45QJS4WZ1VBZW1A1THD7",
+		NativeTokenID: fmt.Sprintf("policy.waitlist%d", suffix),
+		DeliveryAddress: fmt.Sprintf("addr_test_waitlist_%d", suffix),
+		Quantity: 2,
+	}
+	inserted, err := service.InsertWaitlistEntry(ctx, entry)
+	if err != nil || !inserted {
+		t.Fatalf("insert waitlist entry failed: %v", err)
+	}
+	duplicate := entry
+	duplicate.WaitlistEntryID = service.GenerateULID("WAITLIST")
+	inserted, err = service.InsertWaitlistEntry(ctx, duplicate)
+	if err != nil || inserted {
+		t.Errorf("expected one active entry per product and delivery address: %v", err)
+	}
+	waiting, err := service.QueryWaitingNativeTokens(ctx)
+	if err != nil || waiting[entry.NativeTokenID] == nil || waiting[entry.NativeTokenID].Int64() != 2 {
+		t.Errorf("expected the entry to wait for 2 tokens, got %v: %v", waiting[entry.NativeTokenID], err)
+	}
+
+	reserved, err := service.UpdateWaitlistEntryReserved(ctx, entry.WaitlistEntryID, time.Now().Add(time.Hour))
+	if err != nil || !reserved {
+		t.Fatalf("update waitlist entry reserved failed: %v", err)
+	}
+	tokens, err := service.QueryReservedNativeTokens(ctx)
+	if err != nil || tokens[entry.NativeTokenID] == nil || tokens[entry.NativeTokenID].Int64() != 2 {
+		t.Errorf("expected the reservation to hold 2 tokens, got %v: %v", tokens[entry.NativeTokenID], err)
+	}
+
+	// the order takes over the reservation, only once
+	order := ordf.Order{
+		Items: []ordf.OrderItems{
+			ordf.OrderItems{
+				ProductId: entry.ProductID,
+				Quantity: 2,
+			},
+		},
+		Customer: ordf.OrderCustomer{
+			DeliveryAddress: entry.DeliveryAddress,
+		},
+		Payment: ordf.OrderPayment{
+			PriceCurrencyId: "ada",
+			PriceAmount: 20,
+		},
+		Description: "Test Order",
+		OrderStatus: orders.ORDER_STATUS_PENDING,
+	}
+	customer := &novellia_database.OrderCustomer{
+		DeliveryAddress: entry.DeliveryAddress,
+		WaitlistEntryID: entry.WaitlistEntryID,
+	}
+	for i, expected := range []error{nil, novellia_database.ErrWaitlistReservationUnavailable} {
+		order.OrderId = service.GenerateULID("ORDER")
+		err = service.InsertPendingOrder(ctx, order, "", nil, nil, map[string]*big.Int{entry.NativeTokenID: big.NewInt(2)}, novellia_database.StatusTransition{
+			OrderID: order.OrderId,
+			To: orders.ORDER_STATUS_PENDING,
+			Reason: "test",
+			Actor: "customer",
+		}, nil, nil, nil, customer)
+		if !errors.Is(err, expected) {
+			t.Errorf("order %d: expected %v, got %v", i, expected, err)
+		}
+	}
+
+	claimed, err := service.QueryWaitlistEntry(ctx, entry.WaitlistEntryID)
+	if err != nil || claimed.Status != novellia_database.WAITLIST_STATUS_CLAIMED || claimed.OrderID == "" {
+		t.Errorf("expected the entry to be claimed, got %+v: %v", claimed, err)
+	}
+	tokens, err = service.QueryReservedNativeTokens(ctx)
+	if err != nil || tokens[entry.NativeTokenID].Int64() != 2 {
+		t.Errorf("expected the order alone to hold 2 tokens, got %v: %v", tokens[entry.NativeTokenID], err)
+	}
+
+	// the order failing hands the reservation back to the entry
+	err = service.UpdateOrderStatus(ctx, novellia_database.StatusTransition{
+		OrderID: claimed.OrderID,
+		From: orders.ORDER_STATUS_PENDING,
+		To: orders.ORDER_STATUS_FAILED,
+		Reason: "test",
+		Actor: "customer",
+	})
+	if err != nil {
+		t.Fatalf("failed to fail order: %v", err)
+	}
+	released, err := service.QueryWaitlistEntry(ctx, entry.WaitlistEntryID)
+	if err != nil || released.Status != novellia_database.WAITLIST_STATUS_RESERVED || released.OrderID != "" {
+		t.Errorf("expected the entry to be reserved again, got %+v: %v", released, err)
+	}
+	tokens, err = service.QueryReservedNativeTokens(ctx)
+	if err != nil || tokens[entry.NativeTokenID].Int64() != 2 {
+		t.Errorf("expected the reservation alone to hold 2 tokens, got %v: %v", tokens[entry.NativeTokenID], err)
 	}
-	t.Errorf("reserved tokens: %+v", reservedTokens)
 }
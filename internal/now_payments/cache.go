@@ -0,0 +1,46 @@
+package now_payments
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	value float64
+	expiresAt time.Time
+}
+
+// caches values that NowPayments only changes occasionally, e.g. minimum amounts
+type cache struct {
+	ttl time.Duration
+	mutex sync.RWMutex
+	entries map[string]cacheEntry
+}
+
+func newCache(ttl time.Duration) *cache {
+	return &cache {
+		ttl: ttl,
+		entries: map[string]cacheEntry{},
+	}
+}
+
+func (c *cache) get(key string) (float64, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return 0, false
+	}
+	return entry.value, true
+}
+
+func (c *cache) set(key string, value float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[key] = cacheEntry{
+		value: value,
+		expiresAt: time.Now().Add(c.ttl),
+	}
+}
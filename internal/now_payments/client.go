@@ -0,0 +1,182 @@
+package now_payments
+
+import (
+	"fmt"
+	"context"
+	"net/http"
+	"encoding/json"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// NowPayments tokens expire after 5 minutes, refresh them a little early
+	tokenTTL = 4 * time.Minute
+)
+
+var (
+	ErrRateLimited = errors.New("NowPayments rate limit exceeded")
+	ErrInvalidAmount = errors.New("NowPayments rejected the amount")
+	ErrMinAmount = errors.New("amount is below the NowPayments minimum")
+)
+
+// an error response from the NowPayments API
+type APIError struct {
+	StatusCode int
+	Code string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("NowPayments API error %d: %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+// maps API errors onto the typed errors, so callers can use errors.Is
+func (e *APIError) Unwrap() error {
+	message := strings.ToLower(e.Message)
+	switch {
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.Code == "AMOUNT_MINIMAL_ERROR" || strings.Contains(message, "too small"):
+		return ErrMinAmount
+	case e.StatusCode == http.StatusBadRequest && strings.Contains(message, "amount"):
+		return ErrInvalidAmount
+	default:
+		return nil
+	}
+}
+
+type authRequest struct {
+	Email string `json:"email"`
+	Password string `json:"password"`
+}
+
+type authResponse struct {
+	Token string `json:"token"`
+}
+
+// gets a JWT for routes that need one, tokens are valid for 5 minutes
+func (s *ServiceImpl) authToken(ctx context.Context) (string, error) {
+	s.authMutex.Lock()
+	defer s.authMutex.Unlock()
+
+	if s.token != "" && time.Now().Before(s.tokenExpiresAt) {
+		return s.token, nil
+	}
+	if s.email == "" || s.password == "" {
+		return "", fmt.Errorf("NowPayments email and password are required for this request")
+	}
+
+	body, err := json.Marshal(authRequest{
+		Email: s.email,
+		Password: s.password,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// "/auth"
+	var respBody authResponse
+	err = s.do(ctx, http.MethodPost, "auth", body, http.StatusOK, &respBody)
+	if err != nil {
+		return "", fmt.Errorf("auth failed: %w", err)
+	}
+
+	s.token = respBody.Token
+	s.tokenExpiresAt = time.Now().Add(tokenTTL)
+	return s.token, nil
+}
+
+// whether a failed request should be retried
+// requests that create things are only retried if NowPayments cannot have acted on them
+func retryable(method string, statusCode int, err error) bool {
+	idempotent := method == http.MethodGet
+	if err != nil {
+		return idempotent
+	}
+	if statusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return idempotent && statusCode >= 500
+}
+
+// delay before a retry, honouring Retry-After if NowPayments sent one
+func (s *ServiceImpl) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return s.retryBaseDelay * time.Duration(1 << uint(attempt))
+}
+
+// sends a request to the NowPayments API, retrying with exponential backoff, and decodes the response into out
+func (s *ServiceImpl) do(ctx context.Context, method string, route string, body []byte, expectedStatus int, out interface{}) error {
+	return s.doWithHeaders(ctx, method, route, http.Header{}, body, expectedStatus, out)
+}
+
+// same as do, with extra headers e.g. for routes that need a JWT
+func (s *ServiceImpl) doWithHeaders(ctx context.Context, method string, route string, headers http.Header, body []byte, expectedStatus int, out interface{}) error {
+	u, err := s.fromBaseURL(route)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt += 1 {
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for key, values := range headers {
+			req.Header[key] = values
+		}
+		req.Header.Set("x-api-key", s.apiKey)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		var bodyBytes []byte
+		resp, err := s.client.Do(req)
+		if err == nil {
+			bodyBytes, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		if err == nil && statusCode == expectedStatus {
+			return json.Unmarshal(bodyBytes, out)
+		}
+
+		var requestErr error
+		if err != nil {
+			requestErr = err
+		} else {
+			apiErr := &APIError{}
+			// error bodies are not always JSON, keep the raw body in that case
+			if json.Unmarshal(bodyBytes, apiErr) != nil {
+				apiErr.Message = string(bodyBytes)
+			}
+			apiErr.StatusCode = statusCode
+			requestErr = apiErr
+		}
+
+		if attempt >= s.maxRetries || !retryable(method, statusCode, err) || ctx.Err() != nil {
+			return requestErr
+		}
+
+		delay := s.backoff(attempt, resp)
+		fmt.Printf("NowPayments %s %s failed, retrying in %s: %v\n", method, route, delay, requestErr)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
@@ -9,5 +9,11 @@ type Service interface {
 	Status(ctx context.Context) (string, error)
 	CreatePayment(ctx context.Context, createPaymentRequest CreatePaymentRequest) (*CreatePaymentResponse, error)
 	GetPaymentStatus(ctx context.Context, paymentID string) (*GetPaymentStatusResponse, error)
+	// lists payments created in a date range, one page at a time
+	ListPayments(ctx context.Context, listPaymentsRequest ListPaymentsRequest) (*ListPaymentsResponse, error)
+	// minimum payment in currencyFrom that NowPayments accepts for currencyTo, cached
+	GetMinimumAmount(ctx context.Context, currencyFrom string, currencyTo string) (float64, error)
+	// amount in currencyTo that amount in currencyFrom converts to, cached
+	GetEstimatedPrice(ctx context.Context, amount float64, currencyFrom string, currencyTo string) (float64, error)
 	IPNWebhookValidate(r *http.Request) (*GetPaymentStatusResponse, error)
 }
@@ -6,8 +6,10 @@ import (
 	"net/http"
 	"encoding/json"
 	"net/url"
-	"bytes"
 	"io/ioutil"
+	"time"
+	"strconv"
+	"sync"
 	"crypto/hmac"
 	"crypto/sha512"
 	"encoding/hex"
@@ -15,6 +17,13 @@ import (
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
 )
 
+const (
+	defaultTimeout = 10 * time.Second
+	defaultMaxRetries = 3
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultCacheTTL = 60 * time.Second
+)
+
 const (
 	baseURL = "https://api.nowpayments.io/v1/"
 	sandboxBaseURL = "https://api.sandbox.nowpayments.io/v1/"
@@ -26,6 +35,16 @@ type ServiceImpl struct {
 	ipnSecretKey string
 	isSandbox bool
 	ipnCallbackURL string
+	baseURL string
+	client *http.Client
+	maxRetries int
+	retryBaseDelay time.Duration
+	cache *cache
+	email string
+	password string
+	authMutex sync.Mutex
+	token string
+	tokenExpiresAt time.Time
 }
 
 // creates a new ServiceImpl
@@ -35,11 +54,38 @@ func New(apiKey string, ipnSecretKey string, isSandbox bool) (*ServiceImpl, erro
 		return nil, fmt.Errorf("failed to get config from env: %v", err)
 	}
 
+	timeout := defaultTimeout
+	if config.NowPayments.TimeoutSeconds > 0 {
+		timeout = time.Duration(config.NowPayments.TimeoutSeconds) * time.Second
+	}
+	maxRetries := defaultMaxRetries
+	if config.NowPayments.MaxRetries > 0 {
+		maxRetries = config.NowPayments.MaxRetries
+	}
+	retryBaseDelay := defaultRetryBaseDelay
+	if config.NowPayments.RetryBaseDelayMilliseconds > 0 {
+		retryBaseDelay = time.Duration(config.NowPayments.RetryBaseDelayMilliseconds) * time.Millisecond
+	}
+
+	cacheTTL := defaultCacheTTL
+	if config.NowPayments.CacheTTLSeconds > 0 {
+		cacheTTL = time.Duration(config.NowPayments.CacheTTLSeconds) * time.Second
+	}
+
 	return &ServiceImpl {
 		apiKey: apiKey,
 		ipnSecretKey: ipnSecretKey,
 		isSandbox: isSandbox,
 		ipnCallbackURL: config.NowPayments.IPNCallbackURL,
+		baseURL: config.NowPayments.BaseURL,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		maxRetries: maxRetries,
+		retryBaseDelay: retryBaseDelay,
+		cache: newCache(cacheTTL),
+		email: config.NowPayments.Email,
+		password: config.NowPayments.Password,
 	}, nil
 }
 
@@ -62,7 +108,7 @@ type CreatePaymentResponse struct {
 	PaymentID string `json:"payment_id"`
 	PaymentStatus string `json:"payment_status"`
 	PayAddress string `json:"pay_address"`
-	PriceAmount int `json:"price_amount"`
+	PriceAmount float64 `json:"price_amount"`
 	PriceCurrency string `json:"price_currency"`
 	PayAmount string `json:"pay_amount"`
 	PayCurrency string `json:"pay_currency"`
@@ -79,7 +125,7 @@ type GetPaymentStatusResponse struct {
 	PaymentID json.Number `json:"payment_id"`
 	PaymentStatus string `json:"payment_status"`
 	PayAddress string `json:"pay_address"`
-	PriceAmount int `json:"price_amount"`
+	PriceAmount float64 `json:"price_amount"`
 	PriceCurrency string `json:"price_currency"`
 	PayAmount float64 `json:"pay_amount"`
 	ActuallyPaid float64 `json:"actually_paid"`
@@ -94,6 +140,36 @@ type GetPaymentStatusResponse struct {
 	Case string `json:"case,omitempty"`
 }
 
+type ListPaymentsRequest struct {
+	DateFrom time.Time
+	DateTo time.Time
+	// at most 500
+	Limit int
+	// pages start at 0
+	Page int
+}
+
+type ListPaymentsResponse struct {
+	Data []GetPaymentStatusResponse `json:"data"`
+	Limit int `json:"limit"`
+	Page int `json:"page"`
+	PagesCount int `json:"pagesCount"`
+	Total int `json:"total"`
+}
+
+type GetMinimumAmountResponse struct {
+	CurrencyFrom string `json:"currency_from"`
+	CurrencyTo string `json:"currency_to"`
+	MinAmount json.Number `json:"min_amount"`
+}
+
+type GetEstimatedPriceResponse struct {
+	CurrencyFrom string `json:"currency_from"`
+	AmountFrom json.Number `json:"amount_from"`
+	CurrencyTo string `json:"currency_to"`
+	EstimatedAmount json.Number `json:"estimated_amount"`
+}
+
 type GetPaymentStatusResponseStringOnly struct {
 	PaymentID json.Number `json:"payment_id"`
 	PaymentStatus string `json:"payment_status"`
@@ -120,7 +196,9 @@ func (s *ServiceImpl) fromBaseURL(route string) (*url.URL, error) {
 	}
 
 	var base *url.URL
-	if s.isSandbox {
+	if s.baseURL != "" {
+		base, err = url.Parse(s.baseURL)
+	} else if s.isSandbox {
 		base, err = url.Parse(sandboxBaseURL)
 	} else {
 		base, err= url.Parse(baseURL)
@@ -134,23 +212,8 @@ func (s *ServiceImpl) fromBaseURL(route string) (*url.URL, error) {
 
 func (s *ServiceImpl) Status(ctx context.Context) (string, error) {
 	// "/status"
-	u, err := s.fromBaseURL("status")
-	if err != nil {
-		return "", err
-	}
-
-	resp, err := http.Get(u.String())
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
 	var respBody GetStatusResponse
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	err = json.Unmarshal(bodyBytes, &respBody)
+	err := s.do(ctx, http.MethodGet, "status", nil, http.StatusOK, &respBody)
 	if err != nil {
 		return "", err
 	}
@@ -159,12 +222,8 @@ func (s *ServiceImpl) Status(ctx context.Context) (string, error) {
 }
 
 func (s *ServiceImpl) CreatePayment(ctx context.Context, createPaymentRequest CreatePaymentRequest) (*CreatePaymentResponse, error) {
-	config, err := config.GetConfig()
-	if err != nil {
-		return nil, err
-	}
 	// automagically set "success" for Sandbox testint
-	if config.NowPayments.IsSandbox {
+	if s.isSandbox {
 		fmt.Printf("Creating payment with success case (sandbox)\n")
 		createPaymentRequest.Case = "success"
 	}
@@ -174,83 +233,114 @@ func (s *ServiceImpl) CreatePayment(ctx context.Context, createPaymentRequest Cr
 		createPaymentRequest.IPNCallbackURL = s.ipnCallbackURL
 	}
 
-	// "/payment"
-	u, err := s.fromBaseURL("payment")
-	if err != nil {
-		return nil, err
-	}
-
 	body, err := json.Marshal(createPaymentRequest)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", u.String(), bytes.NewBuffer(body))
+	// "/payment"
+	var respBody CreatePaymentResponse
+	err = s.do(ctx, http.MethodPost, "payment", body, http.StatusCreated, &respBody)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("create payment failed: %w", err)
 	}
-	req.Header.Set("x-api-key", s.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-	fmt.Printf("request: %+v", req)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+
+	return &respBody, nil
+}
+
+func (s *ServiceImpl) GetPaymentStatus(ctx context.Context, paymentID string) (*GetPaymentStatusResponse, error) {
+	// "/payment/<your_payment_id>"
+	var respBody GetPaymentStatusResponse
+	err := s.do(ctx, http.MethodGet, fmt.Sprintf("payment/%s", paymentID), nil, http.StatusOK, &respBody)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("get payment status failed: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 201 {
-		return nil, fmt.Errorf("create payment failed: %+v", resp)
-	}
+	return &respBody, nil
+}
 
-	var respBody CreatePaymentResponse
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+func (s *ServiceImpl) ListPayments(ctx context.Context, listPaymentsRequest ListPaymentsRequest) (*ListPaymentsResponse, error) {
+	token, err := s.authToken(ctx)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(bodyBytes, &respBody)
+
+	// "/payment/?limit=<limit>&page=<page>&sortBy=created_at&orderBy=asc&dateFrom=<date_from>&dateTo=<date_to>"
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(listPaymentsRequest.Limit))
+	query.Set("page", strconv.Itoa(listPaymentsRequest.Page))
+	query.Set("sortBy", "created_at")
+	query.Set("orderBy", "asc")
+	query.Set("dateFrom", listPaymentsRequest.DateFrom.UTC().Format(time.RFC3339))
+	query.Set("dateTo", listPaymentsRequest.DateTo.UTC().Format(time.RFC3339))
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer " + token)
+
+	var respBody ListPaymentsResponse
+	err = s.doWithHeaders(ctx, http.MethodGet, "payment/?" + query.Encode(), headers, nil, http.StatusOK, &respBody)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("list payments failed: %w", err)
 	}
 
 	return &respBody, nil
 }
 
-func (s *ServiceImpl) GetPaymentStatus(ctx context.Context, paymentID string) (*GetPaymentStatusResponse, error) {
-	// "/payment/<your_payment_id>"
-	u, err := s.fromBaseURL(fmt.Sprintf("payment/%s", paymentID))
-	if err != nil {
-		return nil,err
+func (s *ServiceImpl) GetMinimumAmount(ctx context.Context, currencyFrom string, currencyTo string) (float64, error) {
+	key := fmt.Sprintf("min-amount/%s/%s", currencyFrom, currencyTo)
+	if minAmount, ok := s.cache.get(key); ok {
+		return minAmount, nil
 	}
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	// "/min-amount?currency_from=<currency_from>&currency_to=<currency_to>"
+	query := url.Values{}
+	query.Set("currency_from", currencyFrom)
+	query.Set("currency_to", currencyTo)
+	var respBody GetMinimumAmountResponse
+	err := s.do(ctx, http.MethodGet, "min-amount?" + query.Encode(), nil, http.StatusOK, &respBody)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("get minimum amount failed: %w", err)
 	}
-	req.Header.Set("x-api-key", s.apiKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	minAmount, err := respBody.MinAmount.Float64()
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("get minimum amount failed, invalid min_amount: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("get payment status failed: %+v", resp)
+	s.cache.set(key, minAmount)
+	return minAmount, nil
+}
+
+func (s *ServiceImpl) GetEstimatedPrice(ctx context.Context, amount float64, currencyFrom string, currencyTo string) (float64, error) {
+	if amount <= 0 {
+		return 0, fmt.Errorf("%w: cannot estimate %f", ErrInvalidAmount, amount)
+	}
+	// same currency needs no conversion
+	if currencyFrom == currencyTo {
+		return amount, nil
 	}
 
-	var respBody GetPaymentStatusResponse
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	// estimates are cached as a rate so that different amounts share them
+	key := fmt.Sprintf("estimate/%s/%s", currencyFrom, currencyTo)
+	if rate, ok := s.cache.get(key); ok {
+		return amount * rate, nil
+	}
+
+	// "/estimate?amount=<amount>&currency_from=<currency_from>&currency_to=<currency_to>"
+	query := url.Values{}
+	query.Set("amount", strconv.FormatFloat(amount, 'f', -1, 64))
+	query.Set("currency_from", currencyFrom)
+	query.Set("currency_to", currencyTo)
+	var respBody GetEstimatedPriceResponse
+	err := s.do(ctx, http.MethodGet, "estimate?" + query.Encode(), nil, http.StatusOK, &respBody)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("get estimated price failed: %w", err)
 	}
-	err = json.Unmarshal(bodyBytes, &respBody)
+	estimatedAmount, err := respBody.EstimatedAmount.Float64()
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("get estimated price failed, invalid estimated_amount: %v", err)
 	}
 
-	return &respBody, nil
+	s.cache.set(key, estimatedAmount / amount)
+	return estimatedAmount, nil
 }
 
 func jsonRemarshal(bytes []byte) ([]byte, error) {
@@ -303,6 +393,20 @@ func jsonRemarshal(bytes []byte) ([]byte, error) {
 }
 
 
+// computes the X-Nowpayments-Sig header for an IPN callback body
+func SignIPN(ipnSecretKey string, body []byte) (string, error) {
+	// remarshal callback JSON to be sorted alphabetically
+	sortedJSON, err := jsonRemarshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	// hash body
+	h := hmac.New(sha512.New, []byte(ipnSecretKey))
+	h.Write(sortedJSON)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func (s *ServiceImpl) IPNWebhookValidate(r *http.Request) (*GetPaymentStatusResponse, error) {
 	// remarshal callback JSON to be sorted alphabetically
 	//fmt.Printf("\n\nrequest: %+v,", r)
@@ -313,16 +417,11 @@ func (s *ServiceImpl) IPNWebhookValidate(r *http.Request) (*GetPaymentStatusResp
 	//fmt.Printf("Received webhook: %+v, %s", r, string(bodyBytes))
 
 	//fmt.Printf("\n\nincoming body bytes: %s", string(bodyBytes))
-	sortedJSON, err := jsonRemarshal(bodyBytes)
+	sha, err := SignIPN(s.ipnSecretKey, bodyBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	// hash body
-	h := hmac.New(sha512.New, []byte(s.ipnSecretKey))
-	h.Write(sortedJSON)
-	sha := hex.EncodeToString(h.Sum(nil))
-
 	// verify signature
 	sigValues := r.Header.Values("X-Nowpayments-Sig")
 	if len(sigValues) == 0 {
@@ -2,79 +2,123 @@ package now_payments_test
 
 import (
 	"bytes"
+	"errors"
 	"net/http"
 	"fmt"
 	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
 	now_payments "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments_emulator"
 )
 
 const (
-	sandboxAPIKey = "X"
-	sandboxIPNSecretKey = "X"
-	demoIPNWebhookURL = "https://api-demo.rektangularstudios.com/order-fulfillment/ipn"
+	emulatorAPIKey = "emulator-api-key"
+	emulatorIPNSecretKey = "emulator-ipn-secret-key"
+	ipnWebhookURL = "http://127.0.0.1:1/order-fulfillment/v0/ipn"
 )
 
-func TestStatus(t *testing.T) {
-	ctx := context.Background()
-	service, err := now_payments.New(sandboxAPIKey, sandboxIPNSecretKey, true)
+// starts an emulator and returns a NowPayments client configured to use it
+func setupTest(t *testing.T) *now_payments.ServiceImpl {
+	emulator := now_payments_emulator.New(emulatorAPIKey, emulatorIPNSecretKey)
+	baseURL, err := emulator.Start("127.0.0.1:0")
 	if err != nil {
-		t.Errorf("failed to create NowPayments service")
+		t.Fatalf("failed to start emulator: %+v", err)
 	}
+	t.Cleanup(func() {
+		emulator.Close()
+	})
 
-	status, err := service.Status(ctx)
+	configYAML := fmt.Sprintf(`
+monitoring:
+  status-url: http://127.0.0.1/order-fulfillment/v0/status
+now-payments:
+  ipn-callback-url: %s
+  base-url: %s
+  retry-base-delay-ms: 1
+  email: emulator@example.com
+  password: emulator-password
+`, ipnWebhookURL, baseURL)
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err = ioutil.WriteFile(configPath, []byte(configYAML), 0600)
 	if err != nil {
-		t.Errorf("failed to get status: %+v", err)
+		t.Fatalf("failed to write config: %+v", err)
 	}
-	if status != "OK" {
-		t.Errorf("API not OK: %+v", err)
+	err = config.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("failed to load config: %+v", err)
 	}
-}
+	t.Cleanup(func() {
+		os.Unsetenv("config")
+	})
 
-func TestCreatePayment(t *testing.T) {
-	ctx := context.Background()
-	service, err := now_payments.New(sandboxAPIKey, sandboxIPNSecretKey, true)
+	service, err := now_payments.New(emulatorAPIKey, emulatorIPNSecretKey, false)
 	if err != nil {
-		t.Errorf("failed to create NowPayments service")
+		t.Fatalf("failed to create NowPayments service: %+v", err)
 	}
+	return service
+}
 
-	req := now_payments.CreatePaymentRequest{
+func createPayment(ctx context.Context, service *now_payments.ServiceImpl) (*now_payments.CreatePaymentResponse, error) {
+	return service.CreatePayment(ctx, now_payments.CreatePaymentRequest{
 		PriceAmount : 10,
 		PriceCurrency: "ada",
 		PayCurrency: "ada",
-		IPNCallbackURL: demoIPNWebhookURL,
+		IPNCallbackURL: ipnWebhookURL,
 		OrderID: "ORDER-123",
 		OrderDescription: "Test Order",
-		Case: "success",
+	})
+}
+
+func TestStatus(t *testing.T) {
+	ctx := context.Background()
+	service := setupTest(t)
+
+	status, err := service.Status(ctx)
+	if err != nil {
+		t.Errorf("failed to get status: %+v", err)
+	}
+	if status != "OK" {
+		t.Errorf("API not OK: %+v", err)
 	}
-	resp, err := service.CreatePayment(ctx, req)
+}
+
+func TestCreatePayment(t *testing.T) {
+	ctx := context.Background()
+	service := setupTest(t)
+
+	resp, err := createPayment(ctx, service)
 	if err != nil {
-		t.Errorf("failed to create payment: %+v", err)
+		t.Fatalf("failed to create payment: %+v", err)
+	}
+	if resp.PaymentID == "" || resp.PaymentStatus != "waiting" {
+		t.Errorf("unexpected CreatePayment resp: %+v", resp)
 	}
-	
-	fmt.Printf("\nCreatePayment resp: %+v\n", resp)
 }
 
 func TestGetPaymentStatus(t *testing.T) {
 	ctx := context.Background()
-	service, err := now_payments.New(sandboxAPIKey, sandboxIPNSecretKey, true)
+	service := setupTest(t)
+
+	created, err := createPayment(ctx, service)
 	if err != nil {
-		t.Errorf("failed to create NowPayments service")
+		t.Fatalf("failed to create payment: %+v", err)
 	}
 
-	resp, err := service.GetPaymentStatus(ctx, "6199378400")
+	resp, err := service.GetPaymentStatus(ctx, created.PaymentID)
 	if err != nil {
-		t.Errorf("failed to get payment status: %+v", err)
+		t.Fatalf("failed to get payment status: %+v", err)
+	}
+	if resp.PaymentStatus != "waiting" || resp.OrderID != "ORDER-123" {
+		t.Errorf("unexpected GetPaymentStatus resp: %+v", resp)
 	}
-
-	fmt.Printf("\nGetPaymentStatus resp: %+v\n", resp)
 }
 
-func TestIPNWebhookValidateWithoutCase(t *testing.T) {
-	service, err := now_payments.New(sandboxAPIKey, sandboxIPNSecretKey, true)
-	if err != nil {
-		t.Errorf("failed to create NowPayments service")
-	}
+func TestIPNWebhookValidate(t *testing.T) {
+	service := setupTest(t)
 
 	jsonBody := `
 	{
@@ -95,18 +139,55 @@ func TestIPNWebhookValidateWithoutCase(t *testing.T) {
 		"outcome_currency":"ada"
  }
 	`
-	sigHeader := "bdae844b7cae55306d5bae9ed52f86ca96e667ee4e22180a7aa7b3ac4fadb2ed437da53ff62556ef6cfb7c4749271b2acb407f92659643ae69c0395d94cc7529"
+	sigHeader, err := now_payments.SignIPN(emulatorIPNSecretKey, []byte(jsonBody))
+	if err != nil {
+		t.Fatalf("failed to sign IPN: %+v", err)
+	}
 
-	r, err := http.NewRequest("POST", demoIPNWebhookURL, bytes.NewBuffer([]byte(jsonBody)))
+	r, err := http.NewRequest("POST", ipnWebhookURL, bytes.NewBuffer([]byte(jsonBody)))
 	if err != nil {
-		t.Errorf("failed to create IPN webhook validation request: %+v", err)
+		t.Fatalf("failed to create IPN webhook validation request: %+v", err)
 	}
 	r.Header.Add("X-Nowpayments-Sig", sigHeader)
 
 	resp, err := service.IPNWebhookValidate(r)
 	if err != nil {
-		t.Errorf("failed IPN Webhook validate: %+v", err)
+		t.Fatalf("failed IPN Webhook validate: %+v", err)
+	}
+	if resp.PaymentStatus != "confirming" || resp.OrderID != "ORDER-66" {
+		t.Errorf("unexpected IPNWebhookValidate resp: %+v", resp)
 	}
 
-	fmt.Printf("\nIPNWebhookValidate resp: %+v\n", resp)
+	// a tampered body no longer matches the signature
+	r, err = http.NewRequest("POST", ipnWebhookURL, bytes.NewBuffer(bytes.Replace([]byte(jsonBody), []byte("confirming"), []byte("finished"), 1)))
+	if err != nil {
+		t.Fatalf("failed to create IPN webhook validation request: %+v", err)
+	}
+	r.Header.Add("X-Nowpayments-Sig", sigHeader)
+
+	_, err = service.IPNWebhookValidate(r)
+	if err == nil {
+		t.Errorf("expected tampered IPN to fail validation")
+	}
+}
+
+func TestAPIErrorIs(t *testing.T) {
+	cases := []struct {
+		err *now_payments.APIError
+		expected error
+	}{
+		{&now_payments.APIError{StatusCode: 429}, now_payments.ErrRateLimited},
+		{&now_payments.APIError{StatusCode: 400, Code: "AMOUNT_MINIMAL_ERROR", Message: "amountTo is too small"}, now_payments.ErrMinAmount},
+		{&now_payments.APIError{StatusCode: 400, Code: "INVALID_REQUEST_PARAMS", Message: "price_amount must be a number"}, now_payments.ErrInvalidAmount},
+	}
+	for _, c := range cases {
+		if !errors.Is(fmt.Errorf("wrapped: %w", c.err), c.expected) {
+			t.Errorf("expected %+v to be %v", c.err, c.expected)
+		}
+	}
+
+	err := &now_payments.APIError{StatusCode: 500, Message: "internal error"}
+	if errors.Is(err, now_payments.ErrRateLimited) || errors.Is(err, now_payments.ErrMinAmount) || errors.Is(err, now_payments.ErrInvalidAmount) {
+		t.Errorf("expected %+v to be untyped", err)
+	}
 }
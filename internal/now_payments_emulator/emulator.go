@@ -0,0 +1,557 @@
+package now_payments_emulator
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"encoding/json"
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
+)
+
+const (
+	apiPrefix = "/v1/"
+	emulatorPrefix = "/emulator/"
+	defaultMinAmount = 1
+	// NowPayments payment IDs are 10 digit numbers
+	firstPaymentID = 5000000000
+)
+
+// a state an emulated payment moves to some time after it was created
+type Step struct {
+	Status string
+	After time.Duration
+	// fraction of pay_amount actually paid once in this state
+	PaidFraction float64
+}
+
+// a scripted API failure, returned instead of handling a request
+type failure struct {
+	statusCode int
+	body string
+}
+
+// an HTTP-compatible stand-in for the NowPayments API
+type Emulator struct {
+	apiKey string
+	ipnSecretKey string
+	client *http.Client
+
+	mutex sync.Mutex
+	nextPaymentID int64
+	payments map[string]*now_payments.GetPaymentStatusResponse
+	ipnCallbackURLs map[string]string
+	script []Step
+	failures []failure
+	minAmounts map[string]float64
+	rates map[string]float64
+	tokens map[string]bool
+
+	server *http.Server
+	// IPN callbacks are sent in the background, this tracks them so tests can wait
+	ipnWaitGroup sync.WaitGroup
+}
+
+// creates a new Emulator, requests must carry apiKey and IPN callbacks are signed with ipnSecretKey
+func New(apiKey string, ipnSecretKey string) *Emulator {
+	return &Emulator {
+		apiKey: apiKey,
+		ipnSecretKey: ipnSecretKey,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		nextPaymentID: firstPaymentID,
+		payments: map[string]*now_payments.GetPaymentStatusResponse{},
+		ipnCallbackURLs: map[string]string{},
+		script: []Step{},
+		failures: []failure{},
+		minAmounts: map[string]float64{},
+		rates: map[string]float64{},
+		tokens: map[string]bool{},
+	}
+}
+
+// sets the states new payments move through, each is entered After the payment was created
+func (e *Emulator) SetScript(script []Step) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.script = script
+}
+
+// makes the next API request fail with a status code and body
+func (e *Emulator) FailNext(statusCode int, body string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.failures = append(e.failures, failure{
+		statusCode: statusCode,
+		body: body,
+	})
+}
+
+// sets the minimum payment amount for a currency, the default is 1
+func (e *Emulator) SetMinAmount(currency string, amount float64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.minAmounts[strings.ToLower(currency)] = amount
+}
+
+// sets the rate used for estimates, amounts in from are multiplied by rate to get amounts in to
+func (e *Emulator) SetRate(from string, to string, rate float64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.rates[strings.ToLower(from) + "/" + strings.ToLower(to)] = rate
+}
+
+// gets a copy of a payment as NowPayments would return it
+func (e *Emulator) Payment(paymentID string) (*now_payments.GetPaymentStatusResponse, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	p, ok := e.payments[paymentID]
+	if !ok {
+		return nil, false
+	}
+	payment := *p
+	return &payment, true
+}
+
+// moves a payment to a new state and sends an IPN callback for it
+func (e *Emulator) SetPaymentStatus(paymentID string, status string, actuallyPaid float64) error {
+	e.mutex.Lock()
+	p, ok := e.payments[paymentID]
+	if !ok {
+		e.mutex.Unlock()
+		return fmt.Errorf("payment not found: %s", paymentID)
+	}
+	p.PaymentStatus = status
+	p.ActuallyPaid = actuallyPaid
+	p.UpdatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	if status == "finished" {
+		p.OutcomeAmount = math.Round(actuallyPaid * 0.995 * 1000000) / 1000000
+		p.OutcomeCurrency = p.PayCurrency
+	}
+	payment := *p
+	ipnCallbackURL := e.ipnCallbackURLs[paymentID]
+	e.mutex.Unlock()
+
+	if ipnCallbackURL != "" {
+		e.ipnWaitGroup.Add(1)
+		go func() {
+			defer e.ipnWaitGroup.Done()
+			err := e.sendIPN(ipnCallbackURL, payment)
+			if err != nil {
+				fmt.Printf("NowPayments emulator failed to send IPN for payment %s: %v\n", paymentID, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// waits for IPN callbacks that are in flight
+func (e *Emulator) WaitForIPN() {
+	e.ipnWaitGroup.Wait()
+}
+
+func (e *Emulator) sendIPN(ipnCallbackURL string, payment now_payments.GetPaymentStatusResponse) error {
+	body, err := json.Marshal(payment)
+	if err != nil {
+		return err
+	}
+	sig, err := now_payments.SignIPN(e.ipnSecretKey, body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ipnCallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Nowpayments-Sig", sig)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("IPN callback returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// runs the script for a new payment
+func (e *Emulator) runScript(paymentID string, payAmount float64, script []Step) {
+	for _, step := range script {
+		step := step
+		time.AfterFunc(step.After, func() {
+			err := e.SetPaymentStatus(paymentID, step.Status, payAmount * step.PaidFraction)
+			if err != nil {
+				fmt.Printf("NowPayments emulator failed to run script for payment %s: %v\n", paymentID, err)
+			}
+		})
+	}
+}
+
+// starts serving on addr, e.g. "127.0.0.1:0", and returns the base URL to configure the NowPayments client with
+func (e *Emulator) Start(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	e.server = &http.Server{
+		Handler: e,
+	}
+	go func() {
+		err := e.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Printf("NowPayments emulator stopped: %v\n", err)
+		}
+	}()
+
+	return fmt.Sprintf("http://%s%s", listener.Addr().String(), apiPrefix), nil
+}
+
+// stops serving
+func (e *Emulator) Close() error {
+	if e.server == nil {
+		return nil
+	}
+	return e.server.Close()
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writes an error in the format NowPayments uses
+func writeError(w http.ResponseWriter, statusCode int, code string, message string) {
+	writeJSON(w, statusCode, map[string]interface{}{
+		"status": false,
+		"statusCode": statusCode,
+		"code": code,
+		"message": message,
+	})
+}
+
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// scripting routes used by the mock server, these are not part of the NowPayments API
+	if strings.HasPrefix(r.URL.Path, emulatorPrefix) {
+		e.serveEmulator(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	route := strings.TrimPrefix(r.URL.Path, apiPrefix)
+
+	e.mutex.Lock()
+	if len(e.failures) > 0 {
+		f := e.failures[0]
+		e.failures = e.failures[1:]
+		e.mutex.Unlock()
+		w.WriteHeader(f.statusCode)
+		w.Write([]byte(f.body))
+		return
+	}
+	e.mutex.Unlock()
+
+	// the real API allows /status without a key, the client always sends it
+	if route != "status" && r.Header.Get("x-api-key") != e.apiKey {
+		writeError(w, http.StatusForbidden, "INVALID_API_KEY", "Invalid api key")
+		return
+	}
+
+	switch {
+	case route == "status" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, now_payments.GetStatusResponse{
+			Message: "OK",
+		})
+	case route == "auth" && r.Method == http.MethodPost:
+		e.auth(w, r)
+	case route == "payment" && r.Method == http.MethodPost:
+		e.createPayment(w, r)
+	case (route == "payment" || route == "payment/") && r.Method == http.MethodGet:
+		e.listPayments(w, r)
+	case strings.HasPrefix(route, "payment/") && r.Method == http.MethodGet:
+		e.getPayment(w, strings.TrimPrefix(route, "payment/"))
+	case route == "min-amount" && r.Method == http.MethodGet:
+		e.getMinAmount(w, r)
+	case route == "estimate" && r.Method == http.MethodGet:
+		e.getEstimate(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (e *Emulator) minAmount(currency string) float64 {
+	if amount, ok := e.minAmounts[strings.ToLower(currency)]; ok {
+		return amount
+	}
+	return defaultMinAmount
+}
+
+func (e *Emulator) rate(from string, to string) (float64, bool) {
+	from = strings.ToLower(from)
+	to = strings.ToLower(to)
+	if from == to {
+		return 1, true
+	}
+	rate, ok := e.rates[from + "/" + to]
+	return rate, ok
+}
+
+func (e *Emulator) createPayment(w http.ResponseWriter, r *http.Request) {
+	var req now_payments.CreatePaymentRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", err.Error())
+		return
+	}
+	if req.PriceAmount <= 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", "price_amount must be greater than 0")
+		return
+	}
+
+	e.mutex.Lock()
+	rate, ok := e.rate(req.PriceCurrency, req.PayCurrency)
+	if !ok {
+		e.mutex.Unlock()
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", fmt.Sprintf("no rate from %s to %s", req.PriceCurrency, req.PayCurrency))
+		return
+	}
+	payAmount := math.Round(req.PriceAmount * rate * 1000000) / 1000000
+	if payAmount < e.minAmount(req.PayCurrency) {
+		e.mutex.Unlock()
+		writeError(w, http.StatusBadRequest, "AMOUNT_MINIMAL_ERROR", "amountTo is too small")
+		return
+	}
+
+	paymentID := strconv.FormatInt(e.nextPaymentID, 10)
+	e.nextPaymentID += 1
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	payment := now_payments.GetPaymentStatusResponse{
+		PaymentID: json.Number(paymentID),
+		PaymentStatus: "waiting",
+		PayAddress: fmt.Sprintf("emulated_%s_address_%s", strings.ToLower(req.PayCurrency), paymentID),
+		PriceAmount: req.PriceAmount,
+		PriceCurrency: req.PriceCurrency,
+		PayAmount: payAmount,
+		PayCurrency: req.PayCurrency,
+		OrderID: req.OrderID,
+		OrderDescription: req.OrderDescription,
+		PurchaseID: strconv.FormatInt(e.nextPaymentID * 7, 10),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	e.payments[paymentID] = &payment
+	e.ipnCallbackURLs[paymentID] = req.IPNCallbackURL
+	script := e.script
+	e.mutex.Unlock()
+
+	e.runScript(paymentID, payAmount, script)
+
+	writeJSON(w, http.StatusCreated, now_payments.CreatePaymentResponse{
+		PaymentID: paymentID,
+		PaymentStatus: payment.PaymentStatus,
+		PayAddress: payment.PayAddress,
+		PriceAmount: payment.PriceAmount,
+		PriceCurrency: payment.PriceCurrency,
+		PayAmount: strconv.FormatFloat(payAmount, 'f', -1, 64),
+		PayCurrency: payment.PayCurrency,
+		OrderID: payment.OrderID,
+		OrderDescription: payment.OrderDescription,
+		IPNCallbackURL: req.IPNCallbackURL,
+		CreatedAt: payment.CreatedAt,
+		UpdatedAt: payment.UpdatedAt,
+		PurchaseID: payment.PurchaseID,
+	})
+}
+
+// any email and password are accepted
+func (e *Emulator) auth(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Email == "" || req.Password == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", "email and password are required")
+		return
+	}
+
+	e.mutex.Lock()
+	token := fmt.Sprintf("emulator-token-%d", len(e.tokens))
+	e.tokens[token] = true
+	e.mutex.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"token": token,
+	})
+}
+
+func (e *Emulator) listPayments(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	authorized := e.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	e.mutex.Unlock()
+	if !authorized {
+		writeError(w, http.StatusUnauthorized, "AUTH_REQUIRED", "Authorization header is empty (Bearer JWTtoken is required)")
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 0 {
+		page = 0
+	}
+	var dateFrom, dateTo time.Time
+	if query.Get("dateFrom") != "" {
+		dateFrom, err = time.Parse(time.RFC3339, query.Get("dateFrom"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", "dateFrom is invalid")
+			return
+		}
+	}
+	if query.Get("dateTo") != "" {
+		dateTo, err = time.Parse(time.RFC3339, query.Get("dateTo"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", "dateTo is invalid")
+			return
+		}
+	}
+
+	// payment IDs are sequential, so sorting by them sorts by created_at
+	e.mutex.Lock()
+	payments := []now_payments.GetPaymentStatusResponse{}
+	for id := int64(firstPaymentID); id < e.nextPaymentID; id += 1 {
+		p, ok := e.payments[strconv.FormatInt(id, 10)]
+		if !ok {
+			continue
+		}
+		createdAt, err := time.Parse(time.RFC3339Nano, p.CreatedAt)
+		if err != nil {
+			continue
+		}
+		if (!dateFrom.IsZero() && createdAt.Before(dateFrom)) || (!dateTo.IsZero() && !createdAt.Before(dateTo)) {
+			continue
+		}
+		payments = append(payments, *p)
+	}
+	e.mutex.Unlock()
+
+	start := page * limit
+	if start > len(payments) {
+		start = len(payments)
+	}
+	end := start + limit
+	if end > len(payments) {
+		end = len(payments)
+	}
+
+	writeJSON(w, http.StatusOK, now_payments.ListPaymentsResponse{
+		Data: payments[start:end],
+		Limit: limit,
+		Page: page,
+		PagesCount: (len(payments) + limit - 1) / limit,
+		Total: len(payments),
+	})
+}
+
+func (e *Emulator) getPayment(w http.ResponseWriter, paymentID string) {
+	payment, ok := e.Payment(paymentID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "PAYMENT_NOT_FOUND", fmt.Sprintf("payment %s not found", paymentID))
+		return
+	}
+	writeJSON(w, http.StatusOK, payment)
+}
+
+func (e *Emulator) getMinAmount(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("currency_from")
+	to := r.URL.Query().Get("currency_to")
+	if from == "" || to == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", "currency_from and currency_to are required")
+		return
+	}
+
+	e.mutex.Lock()
+	minAmount := e.minAmount(to)
+	rate, ok := e.rate(from, to)
+	e.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", fmt.Sprintf("no rate from %s to %s", from, to))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"currency_from": from,
+		"currency_to": to,
+		// minimum is in currency_from
+		"min_amount": math.Round(minAmount / rate * 1000000) / 1000000,
+	})
+}
+
+func (e *Emulator) getEstimate(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("currency_from")
+	to := r.URL.Query().Get("currency_to")
+	amount, err := strconv.ParseFloat(r.URL.Query().Get("amount"), 64)
+	if err != nil || from == "" || to == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", "amount, currency_from and currency_to are required")
+		return
+	}
+
+	e.mutex.Lock()
+	rate, ok := e.rate(from, to)
+	e.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", fmt.Sprintf("no rate from %s to %s", from, to))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"currency_from": from,
+		"amount_from": amount,
+		"currency_to": to,
+		"estimated_amount": math.Round(amount * rate * 1000000) / 1000000,
+	})
+}
+
+// POST /emulator/payments/{payment_id}/status with {"payment_status": ..., "actually_paid": ...}
+func (e *Emulator) serveEmulator(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, emulatorPrefix), "/")
+	if len(parts) != 3 || parts[0] != "payments" || parts[2] != "status" || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req struct {
+		PaymentStatus string `json:"payment_status"`
+		ActuallyPaid float64 `json:"actually_paid"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST_PARAMS", err.Error())
+		return
+	}
+
+	err = e.SetPaymentStatus(parts[1], req.PaymentStatus, req.ActuallyPaid)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "PAYMENT_NOT_FOUND", err.Error())
+		return
+	}
+	payment, _ := e.Payment(parts[1])
+	writeJSON(w, http.StatusOK, payment)
+}
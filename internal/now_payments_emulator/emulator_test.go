@@ -0,0 +1,252 @@
+package now_payments_emulator_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments_emulator"
+)
+
+const (
+	apiKey = "emulator-api-key"
+	ipnSecretKey = "emulator-ipn-secret-key"
+)
+
+// starts an emulator and a NowPayments client configured to use it
+func setupTest(t *testing.T, ipnCallbackURL string) (*now_payments_emulator.Emulator, *now_payments.ServiceImpl) {
+	emulator := now_payments_emulator.New(apiKey, ipnSecretKey)
+	baseURL, err := emulator.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start emulator: %+v", err)
+	}
+	t.Cleanup(func() {
+		emulator.Close()
+	})
+
+	// config requires an IPN callback URL, nothing listens here
+	if ipnCallbackURL == "" {
+		ipnCallbackURL = "http://127.0.0.1:1/ipn"
+	}
+	configYAML := fmt.Sprintf(`
+monitoring:
+  status-url: http://127.0.0.1/order-fulfillment/v0/status
+now-payments:
+  ipn-callback-url: %s
+  base-url: %s
+  retry-base-delay-ms: 1
+  email: emulator@example.com
+  password: emulator-password
+`, ipnCallbackURL, baseURL)
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err = ioutil.WriteFile(configPath, []byte(configYAML), 0600)
+	if err != nil {
+		t.Fatalf("failed to write config: %+v", err)
+	}
+	err = config.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("failed to load config: %+v", err)
+	}
+	t.Cleanup(func() {
+		os.Unsetenv("config")
+	})
+
+	service, err := now_payments.New(apiKey, ipnSecretKey, false)
+	if err != nil {
+		t.Fatalf("failed to create NowPayments service: %+v", err)
+	}
+
+	return emulator, service
+}
+
+func createPayment(ctx context.Context, service *now_payments.ServiceImpl, amount float64) (*now_payments.CreatePaymentResponse, error) {
+	return service.CreatePayment(ctx, now_payments.CreatePaymentRequest{
+		PriceAmount: amount,
+		PriceCurrency: "ada",
+		PayCurrency: "ada",
+		OrderID: "ORDER-123",
+		OrderDescription: "Test Order",
+	})
+}
+
+func TestPayment(t *testing.T) {
+	ctx := context.Background()
+	_, service := setupTest(t, "")
+
+	status, err := service.Status(ctx)
+	if err != nil || status != "OK" {
+		t.Fatalf("expected status OK, got %s (%+v)", status, err)
+	}
+
+	created, err := createPayment(ctx, service, 22.5)
+	if err != nil {
+		t.Fatalf("failed to create payment: %+v", err)
+	}
+
+	payment, err := service.GetPaymentStatus(ctx, created.PaymentID)
+	if err != nil {
+		t.Fatalf("failed to get payment status: %+v", err)
+	}
+	if payment.PaymentStatus != "waiting" || payment.PriceAmount != 22.5 || payment.PayAddress != created.PayAddress {
+		t.Errorf("payment does not match created payment: %+v != %+v", payment, created)
+	}
+
+	_, err = createPayment(ctx, service, 0.5)
+	if !errors.Is(err, now_payments.ErrMinAmount) {
+		t.Errorf("expected ErrMinAmount, got %+v", err)
+	}
+}
+
+func TestMinimumAmountAndEstimate(t *testing.T) {
+	ctx := context.Background()
+	emulator, service := setupTest(t, "")
+
+	emulator.SetMinAmount("ada", 5)
+	emulator.SetRate("usd", "ada", 0.5)
+
+	minAmount, err := service.GetMinimumAmount(ctx, "ada", "ada")
+	if err != nil || minAmount != 5 {
+		t.Errorf("expected min amount 5, got %f (%+v)", minAmount, err)
+	}
+
+	// cached until the TTL passes
+	emulator.SetMinAmount("ada", 10)
+	minAmount, err = service.GetMinimumAmount(ctx, "ada", "ada")
+	if err != nil || minAmount != 5 {
+		t.Errorf("expected cached min amount 5, got %f (%+v)", minAmount, err)
+	}
+
+	estimate, err := service.GetEstimatedPrice(ctx, 100, "usd", "ada")
+	if err != nil || estimate != 50 {
+		t.Errorf("expected estimate 50, got %f (%+v)", estimate, err)
+	}
+	estimate, err = service.GetEstimatedPrice(ctx, 30, "usd", "ada")
+	if err != nil || estimate != 15 {
+		t.Errorf("expected cached rate estimate 15, got %f (%+v)", estimate, err)
+	}
+}
+
+func TestListPayments(t *testing.T) {
+	ctx := context.Background()
+	_, service := setupTest(t, "")
+
+	from := time.Now().Add(-time.Minute)
+	for i := 0; i < 3; i++ {
+		_, err := createPayment(ctx, service, 10)
+		if err != nil {
+			t.Fatalf("failed to create payment: %+v", err)
+		}
+	}
+
+	request := now_payments.ListPaymentsRequest{
+		DateFrom: from,
+		DateTo: time.Now().Add(time.Minute),
+		Limit: 2,
+	}
+	first, err := service.ListPayments(ctx, request)
+	if err != nil {
+		t.Fatalf("failed to list payments: %+v", err)
+	}
+	if len(first.Data) != 2 || first.PagesCount != 2 || first.Total != 3 {
+		t.Errorf("unexpected first page: %+v", first)
+	}
+
+	request.Page = 1
+	second, err := service.ListPayments(ctx, request)
+	if err != nil {
+		t.Fatalf("failed to list payments: %+v", err)
+	}
+	if len(second.Data) != 1 || second.Data[0].PaymentID == first.Data[0].PaymentID {
+		t.Errorf("unexpected second page: %+v", second)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	emulator, service := setupTest(t, "")
+
+	created, err := createPayment(ctx, service, 10)
+	if err != nil {
+		t.Fatalf("failed to create payment: %+v", err)
+	}
+
+	// reads are retried on 5xx and 429
+	emulator.FailNext(http.StatusServiceUnavailable, "")
+	emulator.FailNext(http.StatusTooManyRequests, "")
+	_, err = service.GetPaymentStatus(ctx, created.PaymentID)
+	if err != nil {
+		t.Errorf("expected GetPaymentStatus to be retried, got %+v", err)
+	}
+
+	// creating a payment is not retried on 5xx, NowPayments may have created it
+	emulator.FailNext(http.StatusInternalServerError, "")
+	_, err = createPayment(ctx, service, 10)
+	if err == nil {
+		t.Errorf("expected CreatePayment not to be retried")
+	}
+
+	// but is retried on 429
+	emulator.FailNext(http.StatusTooManyRequests, "")
+	_, err = createPayment(ctx, service, 10)
+	if err != nil {
+		t.Errorf("expected CreatePayment to be retried, got %+v", err)
+	}
+
+	// and gives up eventually
+	for i := 0; i < 4; i += 1 {
+		emulator.FailNext(http.StatusTooManyRequests, "")
+	}
+	_, err = service.GetPaymentStatus(ctx, created.PaymentID)
+	if !errors.Is(err, now_payments.ErrRateLimited) {
+		t.Errorf("expected ErrRateLimited, got %+v", err)
+	}
+}
+
+func TestIPN(t *testing.T) {
+	ctx := context.Background()
+
+	received := make(chan *now_payments.GetPaymentStatusResponse, 1)
+	var service *now_payments.ServiceImpl
+	ipnServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payment, err := service.IPNWebhookValidate(r)
+		if err != nil {
+			t.Errorf("failed to validate IPN: %+v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- payment
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ipnServer.Close()
+
+	emulator, service := setupTest(t, ipnServer.URL)
+
+	created, err := createPayment(ctx, service, 12.345678)
+	if err != nil {
+		t.Fatalf("failed to create payment: %+v", err)
+	}
+
+	err = emulator.SetPaymentStatus(created.PaymentID, "finished", 12.345678)
+	if err != nil {
+		t.Fatalf("failed to set payment status: %+v", err)
+	}
+	emulator.WaitForIPN()
+
+	select {
+	case payment := <-received:
+		if payment.PaymentStatus != "finished" || payment.ActuallyPaid != 12.345678 {
+			t.Errorf("unexpected IPN payment: %+v", payment)
+		}
+	default:
+		t.Errorf("expected an IPN callback")
+	}
+}
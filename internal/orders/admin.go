@@ -0,0 +1,267 @@
+package orders
+
+import (
+	"fmt"
+	"context"
+	"errors"
+	"strings"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/notifications"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders/statemachine"
+	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
+)
+
+// actions for POST /admin/orders/{order_id}/{action}
+const (
+	ADMIN_ACTION_PAID = "paid"
+	ADMIN_ACTION_FAIL = "fail"
+	ADMIN_ACTION_RETRY_FULFILLMENT = "retry-fulfillment"
+	ADMIN_ACTION_DELIVERY_ADDRESS = "delivery-address"
+	ADMIN_ACTION_CANCEL = "cancel"
+	ADMIN_ACTION_REFUNDED = "refunded"
+)
+
+var (
+	ErrReasonRequired = errors.New("a reason is required")
+	ErrInvalidDeliveryAddress = errors.New("invalid delivery address")
+)
+
+// an operator's intervention on an order, see POST /admin/orders/{order_id}/{action}
+type AdminOrderAction struct {
+	// recorded in the order's status history
+	Reason string `json:"reason"`
+	// only for changing the delivery address
+	DeliveryAddress string `json:"delivery_address,omitempty"`
+	// the authenticated operator, recorded in the order's status history
+	ActorID string `json:"-"`
+}
+
+// looks up an order's status for an intervention, checking that a reason was given
+func (s *ServiceImpl) adminOrderStatus(ctx context.Context, orderID string, action AdminOrderAction) (string, string, error) {
+	if strings.TrimSpace(action.Reason) == "" {
+		return "", "", ErrReasonRequired
+	}
+	orderStatus, deliveryAddress, err := s.novelliaDatabaseService.QueryOrderStatus(ctx, orderID)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s (%v)", ErrOrderNotFound, orderID, err)
+	}
+	return orderStatus, deliveryAddress, nil
+}
+
+// validates a transition made by an operator, recording who made it
+func (s *ServiceImpl) newAdminTransition(orderID string, from string, to string, paymentStatus string, reason string, action AdminOrderAction) (novellia_database.StatusTransition, error) {
+	transition, err := s.newTransition(orderID, from, to, paymentStatus, reason, statemachine.ACTOR_ADMIN)
+	if err != nil {
+		return transition, err
+	}
+	transition.ActorID = action.ActorID
+	return transition, nil
+}
+
+// records an intervention's transition and publishes it
+func (s *ServiceImpl) updateOrderStatus(ctx context.Context, transition novellia_database.StatusTransition) error {
+	err := s.novelliaDatabaseService.UpdateOrderStatus(ctx, transition)
+	if err != nil {
+		return err
+	}
+	s.publishTransition(ctx, &transition)
+	return nil
+}
+
+// marks an order paid, for payments confirmed outside of NowPayments
+func (s *ServiceImpl) MarkOrderPaid(ctx context.Context, orderID string, action AdminOrderAction) error {
+	// shares stock reservations with CreateOrder
+	s.createOrderMutex.Lock()
+	defer s.createOrderMutex.Unlock()
+
+	orderStatus, _, err := s.adminOrderStatus(ctx, orderID, action)
+	if err != nil {
+		return err
+	}
+	transition, err := s.newAdminTransition(orderID, orderStatus, ORDER_STATUS_PAID, "", action.Reason, action)
+	if err != nil {
+		return err
+	}
+
+	// failed orders released their stock, take it again
+	if orderStatus == ORDER_STATUS_FAILED {
+		nativeTokens, err := s.novelliaDatabaseService.QueryOrderNativeTokens(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		err = s.ValidateStockAvailable(ctx, nativeTokens)
+		if err != nil {
+			prometheus_monitoring.TickValidateStockFailed()
+			return fmt.Errorf("failed to validate stock available %+v", err)
+		}
+	}
+
+	return s.updateOrderStatus(ctx, transition)
+}
+
+// fails an order, releasing its stock
+func (s *ServiceImpl) FailOrder(ctx context.Context, orderID string, action AdminOrderAction) error {
+	orderStatus, _, err := s.adminOrderStatus(ctx, orderID, action)
+	if err != nil {
+		return err
+	}
+	transition, err := s.newAdminTransition(orderID, orderStatus, ORDER_STATUS_FAILED, "", action.Reason, action)
+	if err != nil {
+		return err
+	}
+
+	return s.updateOrderStatus(ctx, transition)
+}
+
+// submits a paid order to Cardano now instead of waiting for WatchOrdersForFulfillment
+// refused with ErrFulfillmentInProgress while the watcher is fulfilling the order
+func (s *ServiceImpl) RetryFulfillment(ctx context.Context, orderID string, action AdminOrderAction) error {
+	orderStatus, _, err := s.adminOrderStatus(ctx, orderID, action)
+	if err != nil {
+		return err
+	}
+	if orderStatus != ORDER_STATUS_PAID {
+		return fmt.Errorf("%w: order %s is %s, only %s orders are fulfilled", statemachine.ErrInvalidTransition, orderID, orderStatus, ORDER_STATUS_PAID)
+	}
+
+	// record the intervention, the fill is recorded by CheckAndUpdateOrderFulfillment
+	transition, err := s.newAdminTransition(orderID, orderStatus, orderStatus, "", fmt.Sprintf("fulfillment retried: %s", action.Reason), action)
+	if err != nil {
+		return err
+	}
+	err = s.updateOrderStatus(ctx, transition)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.CheckAndUpdateOrderFulfillment(ctx, orderID)
+	return err
+}
+
+// changes where an unfilled order is delivered
+func (s *ServiceImpl) ChangeDeliveryAddress(ctx context.Context, orderID string, action AdminOrderAction) error {
+	orderStatus, deliveryAddress, err := s.adminOrderStatus(ctx, orderID, action)
+	if err != nil {
+		return err
+	}
+	if orderStatus == ORDER_STATUS_FILLED || orderStatus == ORDER_STATUS_PARTIALLY_FILLED || orderStatus == ORDER_STATUS_REFUND {
+		return fmt.Errorf("%w: order %s is %s, its delivery address cannot change", statemachine.ErrInvalidTransition, orderID, orderStatus)
+	}
+	err = s.cardanoService.ValidateAddress(action.DeliveryAddress)
+	if err != nil {
+		return fmt.Errorf("%w: %s, %v", ErrInvalidDeliveryAddress, action.DeliveryAddress, err)
+	}
+
+	customer, err := s.movedOrderCustomer(ctx, orderID, action.DeliveryAddress)
+	if err != nil {
+		return err
+	}
+
+	reason := fmt.Sprintf("delivery address changed from %s to %s: %s", deliveryAddress, action.DeliveryAddress, action.Reason)
+	transition, err := s.newAdminTransition(orderID, orderStatus, orderStatus, "", reason, action)
+	if err != nil {
+		return err
+	}
+
+	// the order counts against the new address's limits from now on
+	err = s.novelliaDatabaseService.UpdateOrderDeliveryAddress(ctx, transition, *customer)
+	if err != nil {
+		return err
+	}
+	s.publishTransition(ctx, &transition)
+	return nil
+}
+
+// cancels an order, queuing a refund for anything paid towards it
+func (s *ServiceImpl) CancelOrder(ctx context.Context, orderID string, action AdminOrderAction) error {
+	orderStatus, _, err := s.adminOrderStatus(ctx, orderID, action)
+	if err != nil {
+		return err
+	}
+	payments, err := s.novelliaDatabaseService.QueryOrderPayments(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	var paid *novellia_database.PaymentAttempt
+	actuallyPaid := 0.0
+	for i := range payments {
+		actuallyPaid += payments[i].ActuallyPaid
+		if payments[i].ActuallyPaid > 0 {
+			paid = &payments[i]
+		}
+	}
+
+	// nothing to refund
+	if paid == nil {
+		transition, err := s.newAdminTransition(orderID, orderStatus, ORDER_STATUS_FAILED, "", fmt.Sprintf("cancelled: %s", action.Reason), action)
+		if err != nil {
+			return err
+		}
+		return s.updateOrderStatus(ctx, transition)
+	}
+
+	transition, err := s.newAdminTransition(orderID, orderStatus, ORDER_STATUS_REFUND, paid.PaymentStatus, fmt.Sprintf("cancelled with refund: %s", action.Reason), action)
+	if err != nil {
+		return err
+	}
+	err = s.novelliaDatabaseService.InsertPaymentCompensation(ctx, transition, novellia_database.PaymentCompensation{
+		OrderID: orderID,
+		PaymentID: paid.PaymentID.String(),
+		PayAddress: paid.PayAddress,
+		Status: COMPENSATION_STATUS_REFUND_REQUIRED,
+		Detail: fmt.Sprintf("cancelled by admin, actually paid %f %s across %d payments", actuallyPaid, paid.PayCurrency, len(payments)),
+	})
+	if err != nil {
+		return err
+	}
+	s.publishTransition(ctx, &transition)
+	prometheus_monitoring.TickPaymentRefundRequired()
+	return nil
+}
+
+// records that the refund of an order was made from the NowPayments dashboard, and only then tells the customer
+func (s *ServiceImpl) RecordRefund(ctx context.Context, orderID string, action AdminOrderAction) error {
+	orderStatus, _, err := s.adminOrderStatus(ctx, orderID, action)
+	if err != nil {
+		return err
+	}
+	if orderStatus != ORDER_STATUS_REFUND {
+		return fmt.Errorf("%w: order %s is %s, only %s orders are refunded", statemachine.ErrInvalidTransition, orderID, orderStatus, ORDER_STATUS_REFUND)
+	}
+	compensations, err := s.novelliaDatabaseService.QueryPaymentCompensations(ctx, COMPENSATION_STATUS_REFUND_REQUIRED)
+	if err != nil {
+		return err
+	}
+	required := false
+	for _, compensation := range compensations {
+		if compensation.OrderID == orderID {
+			required = true
+		}
+	}
+	if !required {
+		return fmt.Errorf("%w: order %s has no refund waiting to be made", statemachine.ErrInvalidTransition, orderID)
+	}
+
+	transition, err := s.newAdminTransition(orderID, orderStatus, orderStatus, "", fmt.Sprintf("refund made: %s", action.Reason), action)
+	if err != nil {
+		return err
+	}
+	err = s.novelliaDatabaseService.UpdatePaymentCompensation(ctx, transition, COMPENSATION_STATUS_REFUNDED, fmt.Sprintf("refunded by admin: %s", action.Reason))
+	if err != nil {
+		return err
+	}
+	s.publishTransition(ctx, &transition)
+
+	if s.notificationsService != nil {
+		err = s.notificationsService.Notify(ctx, notifications.EVENT_REFUND_ISSUED, notifications.EventData{
+			OrderID: orderID,
+			Status: orderStatus,
+		})
+		if err != nil {
+			fmt.Printf("RecordRefund error: %+v\n", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package orders_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/notifications"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders/statemachine"
+)
+
+const (
+	// a ULID, its time picks the sale phase the order was placed in
+	adminOrderID = "ORDER-01F5NY7WJ93YFC7Q00B2EWDPJ3"
+	newDeliveryAddress = "addr1qx2fxv2umyhttkxyxp8x0dlpdt3k6cwng5pxj3jhsydzer3n0d3vllmyqwsx5wktcd8cc3sq835lu7drv2xwl2wywfgse35a3x"
+)
+
+func TestAdminOrderActions(t *testing.T) {
+	ctx := context.Background()
+	action := orders.AdminOrderAction{
+		Reason: "confirmed by support",
+		ActorID: "operator@example.com",
+	}
+
+	cases := []struct {
+		name string
+		orderStatus string
+		run func(s *orders.ServiceImpl) error
+		expectedErr error
+		expectedStatus string
+	}{
+		{
+			name: "paid",
+			orderStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+			run: func(s *orders.ServiceImpl) error { return s.MarkOrderPaid(ctx, adminOrderID, action) },
+			expectedStatus: orders.ORDER_STATUS_PAID,
+		},
+		{
+			name: "paid without a reason",
+			orderStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+			run: func(s *orders.ServiceImpl) error { return s.MarkOrderPaid(ctx, adminOrderID, orders.AdminOrderAction{Reason: " "}) },
+			expectedErr: orders.ErrReasonRequired,
+			expectedStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+		},
+		{
+			name: "unknown order",
+			orderStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+			run: func(s *orders.ServiceImpl) error { return s.FailOrder(ctx, "ORDER-UNKNOWN", action) },
+			expectedErr: orders.ErrOrderNotFound,
+			expectedStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+		},
+		{
+			name: "fail",
+			orderStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+			run: func(s *orders.ServiceImpl) error { return s.FailOrder(ctx, adminOrderID, action) },
+			expectedStatus: orders.ORDER_STATUS_FAILED,
+		},
+		{
+			name: "fail a paid order",
+			orderStatus: orders.ORDER_STATUS_PAID,
+			run: func(s *orders.ServiceImpl) error { return s.FailOrder(ctx, adminOrderID, action) },
+			expectedErr: statemachine.ErrInvalidTransition,
+			expectedStatus: orders.ORDER_STATUS_PAID,
+		},
+		{
+			name: "retry fulfillment of an unpaid order",
+			orderStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+			run: func(s *orders.ServiceImpl) error { return s.RetryFulfillment(ctx, adminOrderID, action) },
+			expectedErr: statemachine.ErrInvalidTransition,
+			expectedStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+		},
+		{
+			name: "change delivery address to an invalid address",
+			orderStatus: orders.ORDER_STATUS_PAID,
+			run: func(s *orders.ServiceImpl) error {
+				a := action
+				a.DeliveryAddress = "not-an-address"
+				return s.ChangeDeliveryAddress(ctx, adminOrderID, a)
+			},
+			expectedErr: orders.ErrInvalidDeliveryAddress,
+			expectedStatus: orders.ORDER_STATUS_PAID,
+		},
+		{
+			name: "change delivery address of a filled order",
+			orderStatus: orders.ORDER_STATUS_FILLED,
+			run: func(s *orders.ServiceImpl) error {
+				a := action
+				a.DeliveryAddress = newDeliveryAddress
+				return s.ChangeDeliveryAddress(ctx, adminOrderID, a)
+			},
+			expectedErr: statemachine.ErrInvalidTransition,
+			expectedStatus: orders.ORDER_STATUS_FILLED,
+		},
+		{
+			name: "cancel without payment",
+			orderStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+			run: func(s *orders.ServiceImpl) error { return s.CancelOrder(ctx, adminOrderID, action) },
+			expectedStatus: orders.ORDER_STATUS_FAILED,
+		},
+		{
+			name: "record a refund that was not required",
+			orderStatus: orders.ORDER_STATUS_FAILED,
+			run: func(s *orders.ServiceImpl) error { return s.RecordRefund(ctx, adminOrderID, action) },
+			expectedErr: statemachine.ErrInvalidTransition,
+			expectedStatus: orders.ORDER_STATUS_FAILED,
+		},
+	}
+	for _, c := range cases {
+		store := newTestStore()
+		store.addOrder(adminOrderID, c.orderStatus, 10, nil)
+		s := newTestService(store, newTestPayments(), nil)
+
+		err := c.run(s)
+		if c.expectedErr == nil && err != nil {
+			t.Errorf("%s: failed: %+v", c.name, err)
+		}
+		if c.expectedErr != nil && !errors.Is(err, c.expectedErr) {
+			t.Errorf("%s: expected %v, got %+v", c.name, c.expectedErr, err)
+		}
+		if store.orders[adminOrderID].OrderStatus != c.expectedStatus {
+			t.Errorf("%s: expected order to be %s, got %s", c.name, c.expectedStatus, store.orders[adminOrderID].OrderStatus)
+		}
+
+		// every intervention is recorded against the operator who made it
+		if err != nil {
+			if len(store.history) != 0 {
+				t.Errorf("%s: expected nothing to be recorded, got %+v", c.name, store.history)
+			}
+			continue
+		}
+		if len(store.history) != 1 || store.history[0].Actor != statemachine.ACTOR_ADMIN || store.history[0].ActorID != action.ActorID {
+			t.Errorf("%s: expected a transition by %s, got %+v", c.name, action.ActorID, store.history)
+		}
+	}
+}
+
+func TestAdminChangeDeliveryAddress(t *testing.T) {
+	ctx := context.Background()
+
+	store := newTestStore()
+	store.addOrder(adminOrderID, orders.ORDER_STATUS_PAID, 10, nil)
+	s := newTestService(store, newTestPayments(), nil)
+
+	err := s.ChangeDeliveryAddress(ctx, adminOrderID, orders.AdminOrderAction{
+		Reason: "customer lost their wallet",
+		DeliveryAddress: newDeliveryAddress,
+	})
+	if err != nil {
+		t.Fatalf("failed to change delivery address: %+v", err)
+	}
+	if store.orders[adminOrderID].Customer.DeliveryAddress != newDeliveryAddress {
+		t.Errorf("expected delivery address %s, got %s", newDeliveryAddress, store.orders[adminOrderID].Customer.DeliveryAddress)
+	}
+}
+
+func TestAdminRetryFulfillmentInProgress(t *testing.T) {
+	ctx := context.Background()
+
+	store := newTestStore()
+	store.addOrder(adminOrderID, orders.ORDER_STATUS_PAID, 10, nil)
+	store.fulfilling = true
+	s := newTestService(store, newTestPayments(), nil)
+
+	err := s.RetryFulfillment(ctx, adminOrderID, orders.AdminOrderAction{Reason: "stuck"})
+	if !errors.Is(err, orders.ErrFulfillmentInProgress) {
+		t.Errorf("expected %v, got %+v", orders.ErrFulfillmentInProgress, err)
+	}
+	if store.orders[adminOrderID].OrderStatus != orders.ORDER_STATUS_PAID {
+		t.Errorf("expected order to stay %s, got %s", orders.ORDER_STATUS_PAID, store.orders[adminOrderID].OrderStatus)
+	}
+}
+
+func TestAdminCancelAndRefund(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	action := orders.AdminOrderAction{
+		Reason: "customer asked to cancel",
+		ActorID: "operator@example.com",
+	}
+
+	store := newTestStore()
+	store.addOrder(adminOrderID, orders.ORDER_STATUS_AWAITING_PAYMENT, 10, nil,
+		testPayment("1", "expired", 4, now.Add(-time.Hour)),
+		testPayment("2", "waiting", 0, now),
+	)
+	n := &testNotifications{}
+	s := newTestService(store, newTestPayments(), n)
+
+	// the refund is made from the NowPayments dashboard, the customer is only told once it is recorded
+	err := s.CancelOrder(ctx, adminOrderID, action)
+	if err != nil {
+		t.Fatalf("failed to cancel order: %+v", err)
+	}
+	if store.orders[adminOrderID].OrderStatus != orders.ORDER_STATUS_REFUND {
+		t.Errorf("expected order to be %s, got %s", orders.ORDER_STATUS_REFUND, store.orders[adminOrderID].OrderStatus)
+	}
+	if len(store.compensations) != 1 || store.compensations[0].PaymentID != "1" || store.compensations[0].Status != orders.COMPENSATION_STATUS_REFUND_REQUIRED {
+		t.Fatalf("expected a refund of payment 1 to be required, got %+v", store.compensations)
+	}
+	for _, event := range n.events {
+		if event == notifications.EVENT_REFUND_ISSUED + " " + adminOrderID {
+			t.Errorf("expected no refund notice before the refund is recorded")
+		}
+	}
+
+	err = s.RecordRefund(ctx, adminOrderID, action)
+	if err != nil {
+		t.Fatalf("failed to record refund: %+v", err)
+	}
+	if store.compensations[0].Status != orders.COMPENSATION_STATUS_REFUNDED {
+		t.Errorf("expected compensation to be %s, got %s", orders.COMPENSATION_STATUS_REFUNDED, store.compensations[0].Status)
+	}
+	if len(n.events) == 0 || n.events[len(n.events) - 1] != notifications.EVENT_REFUND_ISSUED + " " + adminOrderID {
+		t.Errorf("expected a refund notice, got %+v", n.events)
+	}
+
+	// recording it again would notify the customer twice
+	err = s.RecordRefund(ctx, adminOrderID, action)
+	if !errors.Is(err, statemachine.ErrInvalidTransition) {
+		t.Errorf("expected %v, got %+v", statemachine.ErrInvalidTransition, err)
+	}
+}
@@ -0,0 +1,215 @@
+package orders
+
+import (
+	"fmt"
+	"context"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders/statemachine"
+	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
+)
+
+const (
+	// waiting for the payment to expire or receive funds
+	COMPENSATION_STATUS_QUEUED = "QUEUED"
+	// the payment ended without receiving funds
+	COMPENSATION_STATUS_CANCELLED = "CANCELLED"
+	// the payment received funds, which have to be refunded through NowPayments
+	COMPENSATION_STATUS_REFUND_REQUIRED = "REFUND_REQUIRED"
+	// an operator made the refund from the NowPayments dashboard, see RecordRefund
+	COMPENSATION_STATUS_REFUNDED = "REFUNDED"
+	// the order was left pending, NowPayments has to be checked for a payment with its order_id
+	COMPENSATION_STATUS_REVIEW_REQUIRED = "REVIEW_REQUIRED"
+)
+
+const (
+	checkPaymentCompensationsInterval = 5 * time.Minute
+	checkPaymentCompensationsRateLimit = 100 * time.Millisecond // 0.1 seconds per API call
+	// longer than CreateOrder takes, pending orders older than this were abandoned mid-creation
+	pendingOrderTimeout = 10 * time.Minute
+)
+
+// pending orders are orphaned with their payment, orders that already have an active payment only record the compensation
+func (s *ServiceImpl) orphanTransition(orderID string, orderStatus string, paymentStatus string, detail string, actor string) (novellia_database.StatusTransition, error) {
+	to := orderStatus
+	if orderStatus == ORDER_STATUS_PENDING {
+		to = ORDER_STATUS_ORPHANED
+	}
+	return s.newTransition(orderID, orderStatus, to, paymentStatus, detail, actor)
+}
+
+// records a payment that could not be attached to its order, keeping it in memory if the database is unavailable
+// orderStatus is the status of the order when the payment was created
+func (s *ServiceImpl) orphanPayment(ctx context.Context, orderID string, orderStatus string, payment *now_payments.CreatePaymentResponse, cause error) {
+	prometheus_monitoring.TickPaymentCreatedWithoutOrder()
+	compensation := novellia_database.PaymentCompensation{
+		OrderID: orderID,
+		PaymentID: payment.PaymentID,
+		PayAddress: payment.PayAddress,
+		Status: COMPENSATION_STATUS_QUEUED,
+		Detail: fmt.Sprintf("failed to attach payment: %v", cause),
+	}
+	transition, err := s.orphanTransition(orderID, orderStatus, payment.PaymentStatus, compensation.Detail, statemachine.ACTOR_CUSTOMER)
+	if err == nil {
+		err = s.novelliaDatabaseService.InsertPaymentCompensation(ctx, transition, compensation)
+	}
+	if err == nil {
+		s.publishTransition(ctx, &transition)
+	} else {
+		fmt.Printf("orphanPayment error (order %s, payment %s, address %s): %+v\n", orderID, payment.PaymentID, payment.PayAddress, err)
+		s.unrecordedCompensationsMutex.Lock()
+		s.unrecordedCompensations = append(s.unrecordedCompensations, compensation)
+		s.unrecordedCompensationsMutex.Unlock()
+	}
+}
+
+// retries recording compensations that orphanPayment could not
+func (s *ServiceImpl) recordCompensations(ctx context.Context) error {
+	s.unrecordedCompensationsMutex.Lock()
+	defer s.unrecordedCompensationsMutex.Unlock()
+
+	remaining := []novellia_database.PaymentCompensation{}
+	var lastErr error
+	for _, compensation := range s.unrecordedCompensations {
+		orderStatus, _, err := s.novelliaDatabaseService.QueryOrderStatus(ctx, compensation.OrderID)
+		var transition novellia_database.StatusTransition
+		if err == nil {
+			transition, err = s.orphanTransition(compensation.OrderID, orderStatus, "", compensation.Detail, statemachine.ACTOR_SYSTEM)
+		}
+		if err == nil {
+			err = s.novelliaDatabaseService.InsertPaymentCompensation(ctx, transition, compensation)
+		}
+		if err != nil {
+			lastErr = err
+			remaining = append(remaining, compensation)
+			continue
+		}
+		s.publishTransition(ctx, &transition)
+	}
+	s.unrecordedCompensations = remaining
+	return lastErr
+}
+
+// orphans orders abandoned while pending, their payment may or may not exist
+func (s *ServiceImpl) orphanPendingOrders(ctx context.Context) error {
+	orderIDs, err := s.novelliaDatabaseService.QueryOrdersReadyForCheck(ctx, pendingOrderTimeout, ORDER_STATUS_PENDING)
+	if err != nil {
+		return err
+	}
+
+	for _, orderID := range orderIDs {
+		prometheus_monitoring.TickPaymentCreatedWithoutOrder()
+		detail := fmt.Sprintf("order was left %s, check NowPayments for a payment with this order_id", ORDER_STATUS_PENDING)
+		transition, err := s.newTransition(orderID, ORDER_STATUS_PENDING, ORDER_STATUS_ORPHANED, "", detail, statemachine.ACTOR_SYSTEM)
+		if err != nil {
+			return err
+		}
+		err = s.novelliaDatabaseService.InsertPaymentCompensation(ctx, transition, novellia_database.PaymentCompensation{
+			OrderID: orderID,
+			Status: COMPENSATION_STATUS_REVIEW_REQUIRED,
+			Detail: detail,
+		})
+		if err != nil {
+			return err
+		}
+		s.publishTransition(ctx, &transition)
+	}
+	return nil
+}
+
+// cancels or requests a refund for a queued compensation once its payment settles
+func (s *ServiceImpl) compensatePayment(ctx context.Context, compensation novellia_database.PaymentCompensation) error {
+	payment, err := s.nowPaymentsService.GetPaymentStatus(ctx, compensation.PaymentID)
+	if err != nil {
+		return err
+	}
+	paymentStatus, err := s.mapNowPaymentsStatus(payment.PaymentStatus)
+	if err != nil {
+		return err
+	}
+
+	status := ""
+	orderStatus := ""
+	switch {
+	case payment.ActuallyPaid > 0 || paymentStatus == PAYMENT_STATUS_FINISHED:
+		// NowPayments has no refund API, refunds are made from its dashboard
+		status = COMPENSATION_STATUS_REFUND_REQUIRED
+		orderStatus = ORDER_STATUS_REFUND
+		prometheus_monitoring.TickPaymentRefundRequired()
+	case paymentStatus == PAYMENT_STATUS_EXPIRED || paymentStatus == PAYMENT_STATUS_FAILED || paymentStatus == PAYMENT_STATUS_REFUNDED:
+		status = COMPENSATION_STATUS_CANCELLED
+		orderStatus = ORDER_STATUS_FAILED
+	default:
+		// NowPayments cannot cancel a payment, wait for it to expire
+		return nil
+	}
+
+	detail := fmt.Sprintf("payment %s, actually paid %f %s", paymentStatus, payment.ActuallyPaid, payment.PayCurrency)
+	currentStatus, _, err := s.novelliaDatabaseService.QueryOrderStatus(ctx, compensation.OrderID)
+	if err != nil {
+		return err
+	}
+	// an operator already resolved the order, only record the outcome
+	if currentStatus != ORDER_STATUS_ORPHANED {
+		orderStatus = currentStatus
+	}
+	transition, err := s.newTransition(compensation.OrderID, currentStatus, orderStatus, payment.PaymentStatus, fmt.Sprintf("compensation %s, %s", status, detail), statemachine.ACTOR_SYSTEM)
+	if err != nil {
+		return err
+	}
+	err = s.novelliaDatabaseService.UpdatePaymentCompensation(ctx, transition, status, detail)
+	if err != nil {
+		return err
+	}
+	s.publishTransition(ctx, &transition)
+	fmt.Printf("compensatePayment, order %s payment %s is %s: %s\n", compensation.OrderID, compensation.PaymentID, status, detail)
+	return nil
+}
+
+// records, orphans and settles compensations once, see WatchPaymentCompensations
+func (s *ServiceImpl) CompensatePayments(ctx context.Context) error {
+	err := s.recordCompensations(ctx)
+	if err != nil {
+		return fmt.Errorf("record compensations: %w", err)
+	}
+
+	err = s.orphanPendingOrders(ctx)
+	if err != nil {
+		return fmt.Errorf("orphan pending orders: %w", err)
+	}
+
+	compensations, err := s.novelliaDatabaseService.QueryPaymentCompensations(ctx, COMPENSATION_STATUS_QUEUED)
+	if err != nil {
+		return fmt.Errorf("query compensations: %w", err)
+	}
+
+	for _, compensation := range compensations {
+		err := s.compensatePayment(ctx, compensation)
+		if err != nil {
+			return fmt.Errorf("compensate order %s: %w", compensation.OrderID, err)
+		}
+		time.Sleep(checkPaymentCompensationsRateLimit)
+	}
+	return nil
+}
+
+func (s *ServiceImpl) WatchPaymentCompensations(ctx context.Context) {
+	go func() {
+		for {
+			time.Sleep(checkPaymentCompensationsInterval)
+			fmt.Printf("WatchPaymentCompensations, running iteration\n")
+
+			err := s.CompensatePayments(ctx)
+			if err != nil {
+				fmt.Printf("WatchPaymentCompensations error: %+v\n", err)
+				prometheus_monitoring.SetWatchPaymentCompensationsStatus(0)
+				continue
+			}
+
+			prometheus_monitoring.SetWatchPaymentCompensationsStatus(1)
+			fmt.Printf("WatchPaymentCompensations, completed iteration\n")
+		}
+	}()
+}
@@ -0,0 +1,124 @@
+package orders_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders/statemachine"
+)
+
+func TestCompensatePayments(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	store := newTestStore()
+	// abandoned while pending, NowPayments has to be checked by hand
+	store.addOrder("ORDER-PENDING", orders.ORDER_STATUS_PENDING, 10, nil)
+	// orphaned with a payment that expired without funds
+	store.addOrder("ORDER-EXPIRED", orders.ORDER_STATUS_ORPHANED, 10, nil)
+	// orphaned with a payment that received funds
+	store.addOrder("ORDER-PAID", orders.ORDER_STATUS_ORPHANED, 10, nil)
+	// orphaned with a payment that can still receive funds
+	store.addOrder("ORDER-WAITING", orders.ORDER_STATUS_ORPHANED, 10, nil)
+	// a re-issued payment that could not be attached, the order keeps its expired payment
+	store.addOrder("ORDER-REISSUED", orders.ORDER_STATUS_AWAITING_PAYMENT, 10, nil)
+	store.compensations = []novellia_database.PaymentCompensation{
+		{OrderID: "ORDER-EXPIRED", PaymentID: "1", Status: orders.COMPENSATION_STATUS_QUEUED},
+		{OrderID: "ORDER-PAID", PaymentID: "2", Status: orders.COMPENSATION_STATUS_QUEUED},
+		{OrderID: "ORDER-WAITING", PaymentID: "3", Status: orders.COMPENSATION_STATUS_QUEUED},
+		{OrderID: "ORDER-REISSUED", PaymentID: "4", Status: orders.COMPENSATION_STATUS_QUEUED},
+	}
+	payments := newTestPayments(
+		testPayment("1", "expired", 0, now),
+		testPayment("2", "partially_paid", 4, now),
+		testPayment("3", "waiting", 0, now),
+		testPayment("4", "expired", 0, now),
+	)
+	s := newTestService(store, payments, nil)
+
+	err := s.CompensatePayments(ctx)
+	if err != nil {
+		t.Fatalf("failed to compensate payments: %+v", err)
+	}
+
+	expected := map[string]struct {
+		orderStatus string
+		compensationStatus string
+	}{
+		"ORDER-PENDING": {orders.ORDER_STATUS_ORPHANED, orders.COMPENSATION_STATUS_REVIEW_REQUIRED},
+		"ORDER-EXPIRED": {orders.ORDER_STATUS_FAILED, orders.COMPENSATION_STATUS_CANCELLED},
+		"ORDER-PAID": {orders.ORDER_STATUS_REFUND, orders.COMPENSATION_STATUS_REFUND_REQUIRED},
+		"ORDER-WAITING": {orders.ORDER_STATUS_ORPHANED, orders.COMPENSATION_STATUS_QUEUED},
+		"ORDER-REISSUED": {orders.ORDER_STATUS_AWAITING_PAYMENT, orders.COMPENSATION_STATUS_CANCELLED},
+	}
+	for orderID, e := range expected {
+		if store.orders[orderID].OrderStatus != e.orderStatus {
+			t.Errorf("%s: expected order to be %s, got %s", orderID, e.orderStatus, store.orders[orderID].OrderStatus)
+		}
+		found := false
+		for _, c := range store.compensations {
+			if c.OrderID == orderID {
+				found = true
+				if c.Status != e.compensationStatus {
+					t.Errorf("%s: expected compensation to be %s, got %s", orderID, e.compensationStatus, c.Status)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected a compensation", orderID)
+		}
+	}
+
+	for _, transition := range store.history {
+		if transition.Actor != statemachine.ACTOR_SYSTEM {
+			t.Errorf("expected compensations to be made by %s, got %+v", statemachine.ACTOR_SYSTEM, transition)
+		}
+	}
+}
+
+func TestCompensatePaymentsUnrecorded(t *testing.T) {
+	ctx := context.Background()
+	expired := testPayment("1", "expired", 0, time.Now().Add(-10 * time.Minute))
+
+	store := newTestStore()
+	store.addOrder("ORDER-1", orders.ORDER_STATUS_AWAITING_PAYMENT, 100, nil, expired)
+	store.insertOrderPaymentErr = errors.New("connection reset")
+	store.insertCompensationErr = errors.New("connection reset")
+	payments := newTestPayments(expired)
+	s := newTestService(store, payments, nil)
+
+	// neither the payment nor its compensation can be recorded
+	_, err := s.ReissuePayment(ctx, "ORDER-1")
+	if err == nil {
+		t.Fatalf("expected the payment not to be attached")
+	}
+	if len(store.compensations) != 0 {
+		t.Fatalf("expected no compensation to be recorded, got %+v", store.compensations)
+	}
+
+	// recorded on the next iteration, then settled once the payment expires
+	err = s.CompensatePayments(ctx)
+	if err != nil {
+		t.Fatalf("failed to compensate payments: %+v", err)
+	}
+	if len(store.compensations) != 1 || store.compensations[0].PaymentID != "9001" || store.compensations[0].Status != orders.COMPENSATION_STATUS_QUEUED {
+		t.Fatalf("expected a queued compensation for payment 9001, got %+v", store.compensations)
+	}
+
+	payments.payments["9001"] = testPayment("9001", "finished", 98, time.Now())
+	err = s.CompensatePayments(ctx)
+	if err != nil {
+		t.Fatalf("failed to compensate payments: %+v", err)
+	}
+	// the order is not orphaned, so only the outcome is recorded
+	if store.compensations[0].Status != orders.COMPENSATION_STATUS_REFUND_REQUIRED {
+		t.Errorf("expected compensation to be %s, got %s", orders.COMPENSATION_STATUS_REFUND_REQUIRED, store.compensations[0].Status)
+	}
+	if store.orders["ORDER-1"].OrderStatus != orders.ORDER_STATUS_AWAITING_PAYMENT {
+		t.Errorf("expected order to stay %s, got %s", orders.ORDER_STATUS_AWAITING_PAYMENT, store.orders["ORDER-1"].OrderStatus)
+	}
+}
@@ -0,0 +1,80 @@
+package orders
+
+import (
+	"fmt"
+	"time"
+	"context"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/events"
+)
+
+const (
+	defaultLongPollTimeout = 30 * time.Second
+	maxLongPollTimeout = 60 * time.Second
+)
+
+// an order's status when subscribing, followed by its events until Close is called
+type OrderSubscription struct {
+	Status string
+	Events <-chan events.OrderEvent
+	// whether the order can still change
+	Final bool
+	Close func()
+}
+
+func (s *ServiceImpl) SubscribeOrder(ctx context.Context, orderID string) (*OrderSubscription, error) {
+	// subscribe before reading the status so that no change in between is missed
+	ch, unsubscribe := s.eventsService.Subscribe(orderID)
+	orderStatus, _, err := s.novelliaDatabaseService.QueryOrderStatus(ctx, orderID)
+	if err != nil {
+		unsubscribe()
+		return nil, fmt.Errorf("%w: %s (%v)", ErrOrderNotFound, orderID, err)
+	}
+
+	return &OrderSubscription{
+		Status: orderStatus,
+		Events: ch,
+		Final: s.IsFinalStatus(orderStatus),
+		Close: unsubscribe,
+	}, nil
+}
+
+// checks that an order in this status will not change again
+func (s *ServiceImpl) IsFinalStatus(orderStatus string) bool {
+	return s.stateMachine.IsTerminal(orderStatus)
+}
+
+func (s *ServiceImpl) WaitForOrderUpdate(ctx context.Context, orderID string, lastStatus string, timeout time.Duration) (*OrderDetails, error) {
+	if timeout <= 0 {
+		timeout = defaultLongPollTimeout
+	}
+	if timeout > maxLongPollTimeout {
+		timeout = maxLongPollTimeout
+	}
+
+	subscription, err := s.SubscribeOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer subscription.Close()
+
+	if subscription.Status == lastStatus && !subscription.Final {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+	wait:
+		for {
+			select {
+			case event := <-subscription.Events:
+				if event.To != lastStatus {
+					break wait
+				}
+			case <-timer.C:
+				break wait
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	return s.GetOrder(ctx, orderID)
+}
@@ -2,19 +2,43 @@ package orders
 
 import (
 	"context"
+	"time"
 	"math/big"
 
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
 )
 
 type Service interface {
-	ValidateOrder(ctx context.Context, order ordf.Order) error
+	ValidateOrder(ctx context.Context, request OrderRequest) (*PaymentEstimate, error)
 	ValidateStockAvailable(ctx context.Context, tokens map[string]*big.Int) error
-	CreateOrder(ctx context.Context, order ordf.Order) (string, error)
-	GetOrder(ctx context.Context, orderID string) (*ordf.Order, error)
+	QuoteOrder(ctx context.Context, request OrderRequest) (*QuoteDetails, error)
+	CreateOrder(ctx context.Context, request OrderRequest) (string, error)
+	GetOrder(ctx context.Context, orderID string) (*OrderDetails, error)
 	CheckAndUpdateOrderPayment(ctx context.Context, orderID string) (*ordf.Order, error)
+	// issues a new payment for the amount still owed once the active one has expired
+	ReissuePayment(ctx context.Context, orderID string) (*OrderDetails, error)
+	// every status an order went through, oldest first
+	GetOrderHistory(ctx context.Context, orderID string) ([]novellia_database.StatusTransition, error)
+	// subscribes to an order's status changes, see events.Service
+	SubscribeOrder(ctx context.Context, orderID string) (*OrderSubscription, error)
+	IsFinalStatus(orderStatus string) bool
+	// returns an order once its status differs from lastStatus, or after timeout (30s by default, at most 60s)
+	WaitForOrderUpdate(ctx context.Context, orderID string, lastStatus string, timeout time.Duration) (*OrderDetails, error)
+	// lists orders matching a search, newest first, see OrderSearchResult.NextCursor for more
+	SearchOrders(ctx context.Context, search OrderSearchRequest) (*OrderSearchResult, error)
+	// operator interventions, each requires a reason which is recorded in the order's history
+	MarkOrderPaid(ctx context.Context, orderID string, action AdminOrderAction) error
+	FailOrder(ctx context.Context, orderID string, action AdminOrderAction) error
+	RetryFulfillment(ctx context.Context, orderID string, action AdminOrderAction) error
+	ChangeDeliveryAddress(ctx context.Context, orderID string, action AdminOrderAction) error
+	CancelOrder(ctx context.Context, orderID string, action AdminOrderAction) error
+	RecordRefund(ctx context.Context, orderID string, action AdminOrderAction) error
 	IPNUpdateOrder(ctx context.Context, payment now_payments.GetPaymentStatusResponse) error
 	WatchOrdersForPayment(ctx context.Context)
 	WatchOrdersForFulfillment(ctx context.Context)
+	// cancels or flags for refund payments that could not be attached to their order
+	CompensatePayments(ctx context.Context) error
+	WatchPaymentCompensations(ctx context.Context)
 }
@@ -0,0 +1,117 @@
+package orders
+
+import (
+	"context"
+	"fmt"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano/address"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+)
+
+// what a validated order counts against, checked again when it is inserted
+type orderLimits struct {
+	eligibility *novellia_database.OrderEligibility
+	customer *novellia_database.OrderCustomer
+}
+
+func purchaseLimitName(limit phases.PurchaseLimit) string {
+	name := "the sale"
+	if limit.Phase != "" {
+		name = limit.Phase
+	}
+	if limit.ProductID != "" {
+		return fmt.Sprintf("%s limit of %s", name, limit.ProductID)
+	}
+	return fmt.Sprintf("%s limit", name)
+}
+
+// the per-customer limits an order of units by product counts against in phase, checked against the customer's orders so far
+// MaxOrderSize only limits one order, these are counted across orders by delivery address and its stake address
+func (s *ServiceImpl) customerLimits(ctx context.Context, deliveryAddress string, phase *phases.Phase, units map[string]int64) (*novellia_database.OrderCustomer, error) {
+	customer, err := s.orderCustomer(deliveryAddress, phase, units)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, limit := range customer.Limits {
+		ordered, err := s.novelliaDatabaseService.QueryCustomerUnits(ctx, deliveryAddress, customer.StakeAddress, limit)
+		if err != nil {
+			return nil, err
+		}
+		if ordered + limit.Units > limit.MaxUnits {
+			return nil, fmt.Errorf("%w: %s has ordered %d of %d units allowed by %s", novellia_database.ErrPurchaseLimitReached, deliveryAddress, ordered, limit.MaxUnits, limit.Name)
+		}
+	}
+	return customer, nil
+}
+
+// the customer an existing order counts against once delivered to deliveryAddress, with the limits of the phase it was placed in
+// the order counts itself once moved, so its limits carry no units, see novellia_database.UpdateOrderDeliveryAddress
+func (s *ServiceImpl) movedOrderCustomer(ctx context.Context, orderID string, deliveryAddress string) (*novellia_database.OrderCustomer, error) {
+	items, err := s.novelliaDatabaseService.QueryOrderItems(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	createdAt, err := novellia_database.ULIDTime(orderID)
+	if err != nil {
+		return nil, err
+	}
+	units := map[string]int64{}
+	for _, item := range items {
+		units[item.ProductId] += int64(item.Quantity)
+	}
+
+	customer, err := s.orderCustomer(deliveryAddress, s.phasesService.PhaseAt(createdAt), units)
+	if err != nil {
+		return nil, err
+	}
+	for i := range customer.Limits {
+		customer.Limits[i].Units = 0
+	}
+	return customer, nil
+}
+
+// the limits an order of units by product counts against in phase, before counting the customer's other orders
+func (s *ServiceImpl) orderCustomer(deliveryAddress string, phase *phases.Phase, units map[string]int64) (*novellia_database.OrderCustomer, error) {
+	// Byron and enterprise addresses have no stake address, so they are only limited by delivery address
+	stakeAddress, err := address.StakeAddress(deliveryAddress)
+	if err != nil {
+		stakeAddress = ""
+	}
+	customer := &novellia_database.OrderCustomer{
+		DeliveryAddress: deliveryAddress,
+		StakeAddress: stakeAddress,
+		Limits: []novellia_database.PurchaseLimit{},
+	}
+
+	for _, limit := range s.phasesService.PurchaseLimits(phase) {
+		orderUnits := units[limit.ProductID]
+		if limit.ProductID == "" {
+			for _, u := range units {
+				orderUnits += u
+			}
+		}
+		if orderUnits == 0 {
+			continue
+		}
+
+		purchaseLimit := novellia_database.PurchaseLimit{
+			Name: purchaseLimitName(limit),
+			ProductID: limit.ProductID,
+			MaxUnits: limit.MaxUnits,
+			Units: orderUnits,
+		}
+		if limit.Start != nil {
+			purchaseLimit.FromOrderID = novellia_database.ULIDLowerBound(orderIDPrefix, *limit.Start)
+		}
+		if limit.End != nil {
+			purchaseLimit.ToOrderID = novellia_database.ULIDLowerBound(orderIDPrefix, *limit.End)
+		}
+		if orderUnits > limit.MaxUnits {
+			return nil, fmt.Errorf("%w: cannot order %d units, %s is %d", novellia_database.ErrPurchaseLimitReached, orderUnits, purchaseLimit.Name, limit.MaxUnits)
+		}
+		customer.Limits = append(customer.Limits, purchaseLimit)
+	}
+	return customer, nil
+}
@@ -0,0 +1,96 @@
+package orders
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"errors"
+	"strings"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+)
+
+const (
+	// order IDs are ULIDs with this prefix, so they sort by creation time
+	orderIDPrefix = "ORDER"
+	defaultSearchLimit = 50
+	maxSearchLimit = 200
+)
+
+var (
+	ErrInvalidSearch = errors.New("invalid order search")
+)
+
+// filters for GET /orders, empty fields are not filtered on
+type OrderSearchRequest struct {
+	OrderStatus string
+	// NowPayments status of the active payment, e.g. "finished"
+	PaymentStatus string
+	DeliveryAddress string
+	ProductID string
+	// [CreatedFrom, CreatedTo)
+	CreatedFrom *time.Time
+	CreatedTo *time.Time
+	// [UpdatedFrom, UpdatedTo), by the latest status change
+	UpdatedFrom *time.Time
+	UpdatedTo *time.Time
+	// NextCursor from the previous page
+	Cursor string
+	// defaults to 50, at most 200
+	Limit int
+}
+
+// a page of orders, newest first
+type OrderSearchResult struct {
+	Orders []novellia_database.OrderSummary `json:"orders"`
+	// pass as cursor for the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+func (s *ServiceImpl) SearchOrders(ctx context.Context, search OrderSearchRequest) (*OrderSearchResult, error) {
+	limit := search.Limit
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+	if limit < 0 || limit > maxSearchLimit {
+		return nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidSearch, maxSearchLimit)
+	}
+	if search.Cursor != "" {
+		_, err := novellia_database.ULIDTime(search.Cursor)
+		if err != nil || !strings.HasPrefix(search.Cursor, orderIDPrefix + "-") {
+			return nil, fmt.Errorf("%w: malformed cursor %s", ErrInvalidSearch, search.Cursor)
+		}
+	}
+
+	dbSearch := novellia_database.OrderSearch{
+		OrderStatus: strings.ToUpper(search.OrderStatus),
+		PaymentStatus: strings.ToLower(search.PaymentStatus),
+		DeliveryAddress: search.DeliveryAddress,
+		ProductID: search.ProductID,
+		UpdatedFrom: search.UpdatedFrom,
+		UpdatedTo: search.UpdatedTo,
+		Cursor: search.Cursor,
+		// one extra to tell whether there is another page
+		Limit: limit + 1,
+	}
+	if search.CreatedFrom != nil {
+		dbSearch.CreatedFromID = novellia_database.ULIDLowerBound(orderIDPrefix, *search.CreatedFrom)
+	}
+	if search.CreatedTo != nil {
+		dbSearch.CreatedToID = novellia_database.ULIDLowerBound(orderIDPrefix, *search.CreatedTo)
+	}
+
+	summaries, err := s.novelliaDatabaseService.SearchOrders(ctx, dbSearch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search orders: %v", err)
+	}
+
+	result := OrderSearchResult{
+		Orders: summaries,
+	}
+	if len(summaries) > limit {
+		result.Orders = summaries[:limit]
+		result.NextCursor = summaries[limit - 1].OrderID
+	}
+	return &result, nil
+}
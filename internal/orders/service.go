@@ -4,25 +4,42 @@ import (
 	"fmt"
 	"context"
 	"time"
+	"math"
 	"math/big"
 	"sync"
+	"strings"
+	"errors"
 
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/events"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/webhooks"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/notifications"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fairness"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/eligibility"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/waitlist"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
 	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/constants"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/quotes"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/promotions"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders/statemachine"
 )
 
+// transitions between these are declared in statemachine
 const (
-	ORDER_STATUS_AWAITING_PAYMENT = "AWAITING_PAYMENT"
-	ORDER_STATUS_PAID = "PAID"
-	ORDER_STATUS_FILLED = "FILLED"
-	ORDER_STATUS_PARTIALLY_FILLED = "PARTIALLY_FILLED"
-	ORDER_STATUS_REFUND = "REFUND"
-	ORDER_STATUS_FAILED = "FAILED"
+	ORDER_STATUS_PENDING = statemachine.STATE_PENDING
+	ORDER_STATUS_ORPHANED = statemachine.STATE_ORPHANED
+	ORDER_STATUS_AWAITING_PAYMENT = statemachine.STATE_AWAITING_PAYMENT
+	ORDER_STATUS_PAID = statemachine.STATE_PAID
+	ORDER_STATUS_FILLED = statemachine.STATE_FILLED
+	ORDER_STATUS_PARTIALLY_FILLED = statemachine.STATE_PARTIALLY_FILLED
+	ORDER_STATUS_REFUND = statemachine.STATE_REFUND
+	ORDER_STATUS_FAILED = statemachine.STATE_FAILED
 )
 
 const (
@@ -42,14 +59,89 @@ const (
 	checkOrdersForPaymentRateLimit = 100 * time.Millisecond // 0.1 seconds per API call
 	checkOrdersForFulfillmentInterval = 1 * time.Minute
 	checkOrdersForFulfillmentRateLimit = 60 * time.Second // 3 * Cardano blocktime
+	// stock stays reserved for this long after a payment expires so that the customer can request a new one
+	paymentReissueWindow = 1 * time.Hour
+	maxPaymentAttempts = 3
 )
 
+var (
+	ErrPaymentNotReissuable = errors.New("payment cannot be re-issued")
+	ErrOrderNotFound = errors.New("order not found")
+	ErrStockUnavailable = errors.New("not enough unreserved stock, join the waitlist to be notified when it is back")
+	ErrFulfillmentInProgress = errors.New("order is being fulfilled")
+)
+
+// an order as submitted by a customer, extending the SDK order with fields it does not have yet
+type OrderRequest struct {
+	ordf.Order
+	// quote to take the price from, see POST /quotes
+	QuoteID string `json:"quote_id"`
+	// optional promotion code, see POST /admin/promotions
+	DiscountCode string `json:"discount_code"`
+	// optional, where the customer is notified as the order progresses
+	Contact *novellia_database.OrderContact `json:"contact,omitempty"`
+	// optional, proves a wallet other than the delivery address is eligible for the running sale phase
+	EligibilityProof *eligibility.WalletProof `json:"eligibility_proof,omitempty"`
+	// optional, the waitlist reservation holding stock for the order, see POST /waitlist
+	WaitlistEntryID string `json:"waitlist_entry_id,omitempty"`
+}
+
+// an order as returned to a customer, extending the SDK order with fields it does not have yet
+type OrderDetails struct {
+	ordf.Order
+	Fees *fees.Breakdown `json:"fees"`
+	// every payment attempt, the last one is active
+	Payments []PaymentAttempt `json:"payments"`
+	// sum of actually_paid across payment attempts
+	ActuallyPaid float64 `json:"actually_paid"`
+}
+
+// what NowPayments is expected to ask the customer for
+type PaymentEstimate struct {
+	PriceAmount float64 `json:"price_amount"`
+	PriceCurrency string `json:"price_currency"`
+	PayCurrency string `json:"pay_currency"`
+	// smallest price_amount NowPayments accepts
+	MinAmount float64 `json:"min_amount"`
+	EstimatedPayAmount float64 `json:"estimated_pay_amount"`
+}
+
+// a quote as returned to a customer, extended with the payment it will lead to
+type QuoteDetails struct {
+	quotes.Quote
+	PaymentEstimate *PaymentEstimate `json:"payment_estimate"`
+}
+
+type PaymentAttempt struct {
+	PaymentID string `json:"payment_id"`
+	PaymentStatus string `json:"payment_status"`
+	PayAddress string `json:"pay_address"`
+	PayAmount float64 `json:"pay_amount"`
+	ActuallyPaid float64 `json:"actually_paid"`
+	Active bool `json:"active"`
+	CreatedAt string `json:"created_at"`
+}
+
 type ServiceImpl struct {
 	novelliaDatabaseService novellia_database.Service
 	nowPaymentsService now_payments.Service
 	productsService products.Service
 	cardanoService cardano.Service
+	quotesService quotes.Service
+	feesService fees.Service
+	promotionsService promotions.Service
+	eventsService events.Service
+	webhooksService webhooks.Service
+	notificationsService notifications.Service
+	fairnessService fairness.Service
+	phasesService phases.Service
+	eligibilityService eligibility.Service
+	waitlistService waitlist.Service
+	stateMachine *statemachine.Machine
 	createOrderMutex sync.Mutex
+	// orphaned payments that could not be recorded yet, retried by WatchPaymentCompensations
+	unrecordedCompensations []novellia_database.PaymentCompensation
+	unrecordedCompensationsMutex sync.Mutex
 }
 
 // creates a new ServiceImpl
@@ -58,12 +150,33 @@ func New(
 	nowPaymentsService now_payments.Service,
 	productsService products.Service,
 	cardanoService cardano.Service,
+	quotesService quotes.Service,
+	feesService fees.Service,
+	promotionsService promotions.Service,
+	eventsService events.Service,
+	webhooksService webhooks.Service,
+	notificationsService notifications.Service,
+	fairnessService fairness.Service,
+	phasesService phases.Service,
+	eligibilityService eligibility.Service,
+	waitlistService waitlist.Service,
 ) *ServiceImpl {
 	return &ServiceImpl {
 		novelliaDatabaseService: novelliaDatabaseService,
 		nowPaymentsService: nowPaymentsService,
 		productsService: productsService,
 		cardanoService: cardanoService,
+		quotesService: quotesService,
+		feesService: feesService,
+		promotionsService: promotionsService,
+		eventsService: eventsService,
+		webhooksService: webhooksService,
+		notificationsService: notificationsService,
+		fairnessService: fairnessService,
+		phasesService: phasesService,
+		eligibilityService: eligibilityService,
+		waitlistService: waitlistService,
+		stateMachine: statemachine.New(),
 	}
 }
 
@@ -92,198 +205,390 @@ func (s *ServiceImpl) mapNowPaymentsStatus(nowPaymentsStatus string) (string, er
 	}
 }
 
-func (s *ServiceImpl) ValidateOrder(ctx context.Context, order ordf.Order) error {
+// checks that NowPayments will accept a payment and estimates what the customer will pay
+func (s *ServiceImpl) estimatePayment(ctx context.Context, amount float64, priceCurrency string) (*PaymentEstimate, error) {
+	// payments are made in the listed currency, see CreateOrder
+	payCurrency := priceCurrency
+
+	minAmount, err := s.nowPaymentsService.GetMinimumAmount(ctx, priceCurrency, payCurrency)
+	if err != nil {
+		return nil, err
+	}
+	if amount < minAmount {
+		return nil, fmt.Errorf("%w: order payment of %f %s is below the minimum of %f", now_payments.ErrMinAmount, amount, priceCurrency, minAmount)
+	}
+
+	estimatedPayAmount, err := s.nowPaymentsService.GetEstimatedPrice(ctx, amount, priceCurrency, payCurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PaymentEstimate{
+		PriceAmount: amount,
+		PriceCurrency: priceCurrency,
+		PayCurrency: payCurrency,
+		MinAmount: minAmount,
+		EstimatedPayAmount: estimatedPayAmount,
+	}, nil
+}
+
+// validates everything about an order except for its price, which is checked against a quote
+// the returned estimate excludes the min-ada deposit, so it is a lower bound of what the customer will pay
+func (s *ServiceImpl) ValidateOrder(ctx context.Context, request OrderRequest) (*PaymentEstimate, error) {
+	paymentEstimate, _, err := s.validateOrder(ctx, request)
+	return paymentEstimate, err
+}
+
+// validates an order, also returning the caps and limits it counts against
+func (s *ServiceImpl) validateOrder(ctx context.Context, request OrderRequest) (*PaymentEstimate, *orderLimits, error) {
+	order := request.Order
+	err := notifications.ValidateContact(request.Contact)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	products, err := s.productsService.GetProducts(ctx)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	var totalCost float64 = 0
+	// every item is checked against the same instant, so an order never straddles two phases
+	now := time.Now()
+	var phase *phases.Phase
+	var units int64
+	productUnits := map[string]int64{}
+	lineAmounts := map[string]float64{}
 	for _, v := range order.Items {
 		if _, ok := products[v.ProductId]; !ok {
-			return fmt.Errorf("product ID does not exist: %s", v.ProductId)
+			return nil, nil, fmt.Errorf("product ID does not exist: %s", v.ProductId)
 		}
 		p := products[v.ProductId]
 
-
-		// prevent purchasing some products
-		// TODO: fix the date issue with unavailable products
-		if p.ProductID == "PROD-01F5YTNB4BSBKPGRKHVHEM9F0F" {
-			return fmt.Errorf("collector's kit should be delisted. this should never be hit")
-		}
-		if p.ProductID == "PROD-01F4MK4ZCVTKAAZF1QZAPWMPFP" {
-			return fmt.Errorf("cannot order Glacial Draculi directly")
-		}
-		if p.ProductID == "PROD-01F4MK4ZNC8FMVR2ANHDW9E1N4" {
-			return fmt.Errorf("cannot order Cryptic Cat directly")
-		}
-		if p.ProductID == "PROD-01F4MK4ZYC6P9EGG4W0DNFQTWS" {
-			return fmt.Errorf("cannot order Ghost Rotakin directly")
-		}
-
-		// TODO: fix this
-		// check that product has been listed and is available
-		/*
-		if p.DateListed != nil && p.DateListed.After(time.Now()) {
-			return fmt.Errorf("tried to order product that is not listed yet: %s is available on %s", p.ProductID, p.DateListed.String())
-		}
-		if p.DateAvailable != nil && p.DateAvailable.After(time.Now()) {
-			return fmt.Errorf("tried to order product that is not available yet: %s is available on %s", p.ProductID, p.DateAvailable.String())
+		// check that product has been listed, is available and is sold in the running phase
+		phase, err = s.phasesService.CheckPurchasable(p, now)
+		if err != nil {
+			return nil, nil, err
 		}
-		*/
+		priceUnitAmount := s.phasesService.Price(p, phase)
 
 		if v.Quantity <= 0 {
-			return fmt.Errorf("product quantity must be greater than 0, %d", v.Quantity)
+			return nil, nil, fmt.Errorf("product quantity must be greater than 0, %d", v.Quantity)
 		}
 		if v.Quantity > int32(p.MaxOrderSize) {
-			return fmt.Errorf("cannot order more than %d of product %s. tried to order %d", p.MaxOrderSize, p.ProductID, v.Quantity)
+			return nil, nil, fmt.Errorf("cannot order more than %d of product %s. tried to order %d", p.MaxOrderSize, p.ProductID, v.Quantity)
 		}
 		// this is a restriction checked on the DB, not the order
-		if p.PriceUnitAmount <= 0 {
-			return fmt.Errorf("price unit amount cannot be negative, %v", p.PriceUnitAmount)
+		if priceUnitAmount <= 0 {
+			return nil, nil, fmt.Errorf("price unit amount cannot be negative, %v", priceUnitAmount)
 		}
 
-		// verify payment values
-		totalCost += float64(v.Quantity) * p.PriceUnitAmount
 		if p.PriceCurrencyID != order.Payment.PriceCurrencyId {
-			return fmt.Errorf("order currency_id does not match listed currency_id: %s, %s (listing) != %s (order)", p.ProductID, p.PriceCurrencyID, order.Payment.PriceCurrencyId)
+			return nil, nil, fmt.Errorf("order currency_id does not match listed currency_id: %s, %s (listing) != %s (order)", p.ProductID, p.PriceCurrencyID, order.Payment.PriceCurrencyId)
 		}
-	}
-
-	if totalCost != float64(order.Payment.PriceAmount) {
-		return fmt.Errorf("total order value does not match listed total value (including integrated min-ada deposit + processing fee): %f (listing) != %f (order)", totalCost, order.Payment.PriceAmount)
-	}
-	if totalCost <= float64(constants.MinADA + constants.OrderFee) {
-		return fmt.Errorf("total order value must be greater than min-ada + processing fee")
+		lineAmounts[p.ProductID] += float64(v.Quantity) * priceUnitAmount
+		units += int64(v.Quantity)
+		productUnits[p.ProductID] += int64(v.Quantity)
 	}
 
 	// validate Cardano address
 	err = s.cardanoService.ValidateAddress(order.Customer.DeliveryAddress)
 	if err != nil {
-		return fmt.Errorf("got invalid customer address: %s, %+v", order.Customer.DeliveryAddress, err)
+		return nil, nil, fmt.Errorf("got invalid customer address: %s, %+v", order.Customer.DeliveryAddress, err)
+	}
+
+	// check that the customer may order in the running phase and stays within its cap
+	orderEligibility, err := s.eligibilityService.CheckEligible(ctx, phase, order.Customer.DeliveryAddress, units, request.EligibilityProof)
+	if err != nil {
+		return nil, nil, err
+	}
+	customer, err := s.customerLimits(ctx, order.Customer.DeliveryAddress, phase, productUnits)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// verify currency_id
 	if order.Payment.PriceCurrencyId != "ada" {
-		return fmt.Errorf("received unaccepted payment currency_id, only ADA is accepted at this time: %s", order.Payment.PriceCurrencyId)
+		return nil, nil, fmt.Errorf("received unaccepted payment currency_id, only ADA is accepted at this time: %s", order.Payment.PriceCurrencyId)
 	}
 
-	return nil
-}
+	var subtotal float64 = 0
+	for _, amount := range lineAmounts {
+		subtotal += amount
+	}
 
-func (s *ServiceImpl) ValidateStockAvailable(ctx context.Context, tokens map[string]*big.Int) error {
-	reservedTokens, err := s.novelliaDatabaseService.QueryReservedNativeTokens(ctx)
+	// check that the discount code can be used by this customer
+	if request.DiscountCode != "" {
+		discount, err := s.promotionsService.Apply(ctx, request.DiscountCode, order.Customer.DeliveryAddress, lineAmounts)
+		if err != nil {
+			return nil, nil, err
+		}
+		subtotal -= discount.Amount
+	}
+
+	// reject orders NowPayments would refuse before they are quoted
+	paymentEstimate, err := s.estimatePayment(ctx, subtotal, order.Payment.PriceCurrencyId)
 	if err != nil {
-		fmt.Printf("failed to query reserved native tokens: %+v\n", err)
-		return err
+		return nil, nil, err
 	}
+	return paymentEstimate, &orderLimits{
+		eligibility: orderEligibility,
+		customer: customer,
+	}, nil
+}
 
-	availableTokens, err := s.cardanoService.GetStock([]string{s.cardanoService.HotWalletAddress()})
+func (s *ServiceImpl) ValidateStockAvailable(ctx context.Context, tokens map[string]*big.Int) error {
+	return s.validateStockAvailable(ctx, tokens, nil, nil)
+}
+
+// held is stock reserved for the order itself, e.g. by its waitlist entry, which counts as available
+// waiting is stock waitlist entries are in line for, which does not
+func (s *ServiceImpl) validateStockAvailable(ctx context.Context, tokens map[string]*big.Int, held map[string]*big.Int, waiting map[string]*big.Int) error {
+	unreservedTokens, err := s.cardanoService.GetUnreservedStock(ctx)
 	if err != nil {
-		fmt.Printf("failed to query available (wallet) native tokens: %+v\n", err)
+		fmt.Printf("failed to get unreserved native tokens: %+v\n", err)
 		return err
 	}
 
 	for nativeTokenID, requiredQuantity := range tokens {
-		var amountReserved *big.Int
-		if _, ok := reservedTokens[nativeTokenID]; !ok {
-			amountReserved = big.NewInt(0)
-		} else {
-			amountReserved = reservedTokens[nativeTokenID]
+		adjustedStockAvailable, ok := unreservedTokens[nativeTokenID]
+		if !ok {
+			return fmt.Errorf("%w: %s has no tokens available in wallet, wanted %d", ErrStockUnavailable, nativeTokenID, requiredQuantity)
 		}
-
-		if _, ok := availableTokens[nativeTokenID]; !ok {
-			return fmt.Errorf("%s has no tokens available in wallet, wanted %d", nativeTokenID, requiredQuantity)
+		if h, ok := held[nativeTokenID]; ok {
+			adjustedStockAvailable = big.NewInt(0).Add(adjustedStockAvailable, h)
 		}
-
-		// available - reserved - min-leftover in hot wallet
-		adjustedStockAvailable := big.NewInt(0).Sub(availableTokens[nativeTokenID], amountReserved)
-		adjustedStockAvailable = big.NewInt(0).Sub(adjustedStockAvailable, big.NewInt(constants.MinUnreservedStockPerNativeToken))
-		// if stock leftover is negative, clip to 0
-		if adjustedStockAvailable.Cmp(big.NewInt(0)) == -1 {
-			adjustedStockAvailable = big.NewInt(0)
+		if w, ok := waiting[nativeTokenID]; ok {
+			adjustedStockAvailable = big.NewInt(0).Sub(adjustedStockAvailable, w)
 		}
 
 		// throw an error if required > adjusted_available
 		if requiredQuantity.Cmp(adjustedStockAvailable) == 1 {
-			return fmt.Errorf("%s not enough unreserved tokens available, wanted %d > %d", nativeTokenID, requiredQuantity, adjustedStockAvailable)
+			return fmt.Errorf("%w: %s not enough unreserved tokens available, wanted %d > %d", ErrStockUnavailable, nativeTokenID, requiredQuantity, adjustedStockAvailable)
 		}
 	}
 
 	return nil
 }
 
-func (s *ServiceImpl) CreateOrder(ctx context.Context, order ordf.Order) (string, error) {
+// the stock held for the order by its waitlist entry, nil without one
+func (s *ServiceImpl) waitlistHeld(ctx context.Context, request OrderRequest, limits *orderLimits) (map[string]*big.Int, error) {
+	if request.WaitlistEntryID == "" {
+		return nil, nil
+	}
+	entry, err := s.waitlistService.CheckReservation(ctx, request.WaitlistEntryID, request.Order.Customer.DeliveryAddress)
+	if err != nil {
+		return nil, err
+	}
+	ordered := false
+	for _, item := range request.Order.Items {
+		if item.ProductId == entry.ProductID {
+			ordered = true
+		}
+	}
+	if !ordered {
+		return nil, fmt.Errorf("%w: %s holds %s, which the order does not include", novellia_database.ErrWaitlistReservationUnavailable, entry.WaitlistEntryID, entry.ProductID)
+	}
+
+	// the order claims the entry when it is inserted
+	limits.customer.WaitlistEntryID = entry.WaitlistEntryID
+	return map[string]*big.Int{
+		entry.NativeTokenID: big.NewInt(entry.Quantity),
+	}, nil
+}
+
+// validates an order and prices it, the returned quote can be passed to CreateOrder
+func (s *ServiceImpl) QuoteOrder(ctx context.Context, request OrderRequest) (*QuoteDetails, error) {
+	_, err := s.ValidateOrder(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate order: %w", err)
+	}
+
+	order := request.Order
+	quote, err := s.quotesService.CreateQuote(ctx, order.Items, order.Payment.PriceCurrencyId, request.DiscountCode, order.Customer.DeliveryAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// estimate the exact payment now that the deposit is known
+	paymentEstimate, err := s.estimatePayment(ctx, quote.PaymentAmount, quote.PriceCurrencyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QuoteDetails{
+		Quote: *quote,
+		PaymentEstimate: paymentEstimate,
+	}, nil
+}
+
+func (s *ServiceImpl) CreateOrder(ctx context.Context, request OrderRequest) (string, error) {
 	// this is not thread-safe
 	s.createOrderMutex.Lock()
 	defer s.createOrderMutex.Unlock()
 
-	// set default order status
-	order.OrderStatus = ORDER_STATUS_AWAITING_PAYMENT
+	order := request.Order
+	order.OrderStatus = ""
 
-	err := s.ValidateOrder(ctx, order)
+	_, limits, err := s.validateOrder(ctx, request)
 	if err != nil {
-		return "", fmt.Errorf("failed to validate order: %+v", err)
+		return "", fmt.Errorf("failed to validate order: %w", err)
 	}
 
-	nativeTokens, err := s.cardanoService.NativeTokensFromOrder(ctx, &order)
+	// take the price from the quote instead of trusting the client
+	if request.QuoteID == "" {
+		return "", fmt.Errorf("failed to create order, quote_id is required")
+	}
+	quote, err := s.quotesService.GetQuote(ctx, request.QuoteID)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to get quote: %w", err)
+	}
+	if !quote.MatchesItems(order.Items) || quote.PriceCurrencyID != order.Payment.PriceCurrencyId {
+		return "", fmt.Errorf("order items do not match quote %s", quote.QuoteID)
 	}
-	err = s.ValidateStockAvailable(ctx, nativeTokens)
+	// the quote is only priced for the discount code it was made with
+	var redemption *novellia_database.PromotionRedemption
+	if quote.Discount != nil {
+		if !strings.EqualFold(quote.Discount.Code, strings.TrimSpace(request.DiscountCode)) {
+			return "", fmt.Errorf("order discount_code does not match quote %s", quote.QuoteID)
+		}
+		redemption = &novellia_database.PromotionRedemption{
+			Code: quote.Discount.Code,
+			DiscountAmount: quote.Discount.Amount,
+		}
+	} else if request.DiscountCode != "" {
+		return "", fmt.Errorf("order discount_code does not match quote %s", quote.QuoteID)
+	}
+	order.Payment.PriceAmount = float32(quote.Total)
+	_, err = s.estimatePayment(ctx, quote.PaymentAmount, quote.PriceCurrencyID)
 	if err != nil {
-		prometheus_monitoring.TickValidateStockFailed()
-		return "", fmt.Errorf("failed to validate stock available %+v", err)
+		return "", err
 	}
 
-	orderULID := s.novelliaDatabaseService.GenerateULID("ORDER")
+	// the order ID is part of each bundle's draw, so it is generated before unpacking
+	orderULID := s.novelliaDatabaseService.GenerateULID(orderIDPrefix)
 	order.OrderId = orderULID
 	if order.OrderId == "" {
 		return "", fmt.Errorf("failed to create order, got empty OrderId")
 	}
 
+	var seed *novellia_database.SaleSeed
+	if s.fairnessService != nil {
+		seed, err = s.fairnessService.ActiveSeed(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get sale seed: %v", err)
+		}
+	}
+	nativeTokens, pulls, err := s.cardanoService.NativeTokensFromOrder(ctx, &order, seed)
+	if err != nil {
+		return "", err
+	}
+	held, err := s.waitlistHeld(ctx, request, limits)
+	if err != nil {
+		return "", err
+	}
+	// stock freed since the waitlist was last served goes to waiting entries first, orders holding a reservation are already served
+	var waiting map[string]*big.Int
+	if held == nil {
+		waiting, err = s.novelliaDatabaseService.QueryWaitingNativeTokens(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = s.validateStockAvailable(ctx, nativeTokens, held, waiting)
+	if err != nil {
+		prometheus_monitoring.TickValidateStockFailed()
+		return "", fmt.Errorf("failed to validate stock available: %w", err)
+	}
+
+	// quotes cover any draw of the catalog they were made with, this only fails if the catalog changed since
+	nativeTokenIDs := []string{}
+	for nativeTokenID := range nativeTokens {
+		nativeTokenIDs = append(nativeTokenIDs, nativeTokenID)
+	}
+	minLovelace := s.feesService.MinLovelace(nativeTokenIDs)
+	if float64(minLovelace) > quote.MinADADeposit * 1000000 {
+		return "", fmt.Errorf("quoted min-ada deposit does not cover order, %f ADA < %d lovelace, request a new quote", quote.MinADADeposit, minLovelace)
+	}
+
 	// check that order does not already exist
 	_, _, _, err = s.novelliaDatabaseService.QueryOrder(ctx, order.OrderId)
 	if err == nil {
 		return "", fmt.Errorf("failed to create order, %s already exists", order.OrderId)
 	}
 
+	// the order is written before its payment is created so that no payment is ever untracked
+	created, err := s.transitionOrder(&order, ORDER_STATUS_PENDING, "", fmt.Sprintf("created from quote %s", quote.QuoteID), statemachine.ACTOR_CUSTOMER)
+	if err != nil {
+		return "", err
+	}
+	// reserves stock and redeems the quote, nothing exists on NowPayments yet so a failure here needs no compensation
+	err = s.novelliaDatabaseService.InsertPendingOrder(ctx, order, quote.QuoteID, quote.OrderFees(), redemption, nativeTokens, *created, request.Contact, pulls, limits.eligibility, limits.customer)
+	if err != nil {
+		return "", err
+	}
+	s.publishTransition(ctx, created)
+
 	createPaymentRequest := now_payments.CreatePaymentRequest{
-		// we record the actual amount paid X, but only require receipt of X - OrderFee on NowPayments
-		PriceAmount: float64(order.Payment.PriceAmount) - float64(constants.OrderFee),
+		PriceAmount: quote.PaymentAmount,
 		PriceCurrency: order.Payment.PriceCurrencyId,
 		PayCurrency: order.Payment.PriceCurrencyId,
 		OrderID: order.OrderId,
 		OrderDescription: order.Description,
 	}
 	createPaymentResponse, err := s.nowPaymentsService.CreatePayment(ctx, createPaymentRequest)
-	if err != nil {
-		return "", err
+	if err != nil && !paymentRejected(err) {
+		// the payment may still have been created, e.g. on a timeout or 5xx, so the order is left pending
+		// orphanPendingOrders then marks it for review against NowPayments' payments for this order_id
+		fmt.Printf("CreateOrder error (create payment for order %s, left %s): %+v\n", order.OrderId, ORDER_STATUS_PENDING, err)
+		return "", paymentError(err, createPaymentRequest.PriceAmount)
 	}
-
-	// add created payment information to order
-	order.Payment.PaymentAddress = createPaymentResponse.PayAddress
-	paymentStatus, err := s.mapNowPaymentsStatus(createPaymentResponse.PaymentStatus)
 	if err != nil {
-		return "", err
+		// NowPayments rejected the payment outright so none exists, release the reservation
+		failed, updateErr := s.newTransition(order.OrderId, ORDER_STATUS_PENDING, ORDER_STATUS_FAILED, "", fmt.Sprintf("failed to create payment: %v", err), statemachine.ACTOR_CUSTOMER)
+		if updateErr == nil {
+			updateErr = s.novelliaDatabaseService.UpdateOrderStatus(ctx, failed)
+		}
+		if updateErr != nil {
+			fmt.Printf("CreateOrder error (fail pending order %s): %+v\n", order.OrderId, updateErr)
+		} else {
+			s.publishTransition(ctx, &failed)
+		}
+		return "", paymentError(err, createPaymentRequest.PriceAmount)
 	}
-	order.Payment.PaymentStatus = paymentStatus
 
-	err = s.novelliaDatabaseService.InsertOrder(ctx, order, *createPaymentResponse)
-	if err != nil {
-		prometheus_monitoring.TickPaymentCreatedWithoutOrder()
-		return "", err
+	attached, err := s.transitionOrder(&order, ORDER_STATUS_AWAITING_PAYMENT, createPaymentResponse.PaymentStatus, fmt.Sprintf("payment %s created", createPaymentResponse.PaymentID), statemachine.ACTOR_CUSTOMER)
+	if err == nil {
+		err = s.novelliaDatabaseService.AttachOrderPayment(ctx, *attached, *createPaymentResponse)
 	}
-
-	err = s.novelliaDatabaseService.InsertOrderNativeTokens(ctx, order.OrderId, nativeTokens)
 	if err != nil {
-		return "", err
+		s.orphanPayment(ctx, order.OrderId, ORDER_STATUS_PENDING, createPaymentResponse, err)
+		return "", fmt.Errorf("failed to attach payment %s to order %s: %v", createPaymentResponse.PaymentID, order.OrderId, err)
 	}
+	s.publishTransition(ctx, attached)
 
 	prometheus_monitoring.TickCreatedOrder()
 	return order.OrderId, nil
 }
 
+// whether NowPayments definitely did not create the payment
+func paymentRejected(err error) bool {
+	return errors.Is(err, now_payments.ErrInvalidAmount) || errors.Is(err, now_payments.ErrMinAmount)
+}
+
+// explains NowPayments errors in terms of the order, keeping the typed error for the API to map
+func paymentError(err error, amount float64) error {
+	switch {
+	case errors.Is(err, now_payments.ErrMinAmount):
+		return fmt.Errorf("order payment of %f is too small to be accepted, add more items: %w", amount, err)
+	case errors.Is(err, now_payments.ErrInvalidAmount):
+		return fmt.Errorf("order payment of %f was rejected: %w", amount, err)
+	case errors.Is(err, now_payments.ErrRateLimited):
+		return fmt.Errorf("payment provider is busy, try again shortly: %w", err)
+	default:
+		return err
+	}
+}
+
 func (s *ServiceImpl) addPaymentToOrder(order *ordf.Order, payment *now_payments.GetPaymentStatusResponse) error {
 	order.Payment.PaymentAddress = payment.PayAddress
 	paymentStatus, err := s.mapNowPaymentsStatus(payment.PaymentStatus)
@@ -295,34 +600,208 @@ func (s *ServiceImpl) addPaymentToOrder(order *ordf.Order, payment *now_payments
 	return nil
 }
 
-func (s *ServiceImpl) updateOrderStatus(order *ordf.Order, payment *now_payments.GetPaymentStatusResponse) error {
+// builds a transition, checking it against the state machine
+func (s *ServiceImpl) newTransition(orderID string, from string, to string, paymentStatus string, reason string, actor string) (novellia_database.StatusTransition, error) {
+	err := s.stateMachine.Validate(statemachine.Transition{
+		From: from,
+		To: to,
+		Reason: reason,
+		Actor: actor,
+		PaymentStatus: paymentStatus,
+	})
+	if err != nil {
+		return novellia_database.StatusTransition{}, fmt.Errorf("order %s: %w", orderID, err)
+	}
+
+	return novellia_database.StatusTransition{
+		OrderID: orderID,
+		From: from,
+		To: to,
+		Reason: reason,
+		Actor: actor,
+	}, nil
+}
+
+// moves an order to a status, returning the transition to record with the update or nil if the status is unchanged
+// paymentStatus is the NowPayments status of the active payment
+func (s *ServiceImpl) transitionOrder(order *ordf.Order, to string, paymentStatus string, reason string, actor string) (*novellia_database.StatusTransition, error) {
+	if order.OrderStatus == to {
+		return nil, nil
+	}
+	transition, err := s.newTransition(order.OrderId, order.OrderStatus, to, paymentStatus, reason, actor)
+	if err != nil {
+		return nil, err
+	}
+	order.OrderStatus = to
+	return &transition, nil
+}
+
+// tells subscribers, webhook endpoints and the customer about a transition once it has been recorded, nil transitions are ignored
+func (s *ServiceImpl) publishTransition(ctx context.Context, transition *novellia_database.StatusTransition) {
+	if transition == nil {
+		return
+	}
+	if s.eventsService != nil {
+		createdAt := transition.CreatedAt
+		if createdAt.IsZero() {
+			createdAt = time.Now().UTC()
+		}
+		s.eventsService.Publish(ctx, events.OrderEvent{
+			OrderID: transition.OrderID,
+			From: transition.From,
+			To: transition.To,
+			Reason: transition.Reason,
+			CreatedAt: createdAt,
+		})
+	}
+
+	eventType := webhooks.EventTypeForTransition(transition.From, transition.To)
+	if s.webhooksService != nil && eventType != "" {
+		err := s.webhooksService.Enqueue(ctx, eventType, webhooks.EventData{
+			OrderID: transition.OrderID,
+			From: transition.From,
+			To: transition.To,
+			Reason: transition.Reason,
+		})
+		if err != nil {
+			fmt.Printf("publishTransition error: %+v\n", err)
+		}
+	}
+
+	notificationType := notifications.EventTypeForTransition(transition.From, transition.To)
+	if s.notificationsService != nil && notificationType != "" {
+		err := s.notificationsService.Notify(ctx, notificationType, notifications.EventData{
+			OrderID: transition.OrderID,
+			Status: transition.To,
+		})
+		if err != nil {
+			fmt.Printf("publishTransition error: %+v\n", err)
+		}
+	}
+}
+
+// status an awaiting order moves to for its active payment, along with the reason
+func (s *ServiceImpl) orderStatusForPayment(order *ordf.Order, payment *now_payments.GetPaymentStatusResponse) (string, string, error) {
+	paymentStatus, err := s.mapNowPaymentsStatus(payment.PaymentStatus)
+	if err != nil {
+		return "", "", err
+	}
+	if order.OrderStatus != ORDER_STATUS_AWAITING_PAYMENT {
+		return order.OrderStatus, "", nil
+	}
+	if paymentStatus == PAYMENT_STATUS_FINISHED {
+		return ORDER_STATUS_PAID, fmt.Sprintf("payment %s finished", payment.PaymentID), nil
+	}
+	// expired payments keep their reservation while they can be re-issued, see CheckAndUpdateOrderPayment
+	if paymentStatus == PAYMENT_STATUS_FAILED {
+		return ORDER_STATUS_FAILED, fmt.Sprintf("payment %s failed", payment.PaymentID), nil
+	}
+
+	return order.OrderStatus, "", nil
+}
+
+// amount still owed to NowPayments across every payment attempt on an order
+func (s *ServiceImpl) remainingPaymentAmount(ctx context.Context, order *ordf.Order, payments []novellia_database.PaymentAttempt) (float64, error) {
+	orderFees, err := s.novelliaDatabaseService.QueryOrderFees(ctx, order.OrderId)
+	if err != nil {
+		return 0, err
+	}
+	breakdown := fees.BreakdownFromOrderFees(float64(order.Payment.PriceAmount), orderFees)
+
+	// processing fees are not requested from NowPayments, see CreateOrder
+	remaining := breakdown.Total - breakdown.FeesAmount()
+	for _, p := range payments {
+		remaining -= p.ActuallyPaid
+	}
+	return math.Round(remaining * 1000000) / 1000000, nil
+}
+
+// parses payment times, which are RFC3339 from NowPayments and ISO8601DateFormat from the database
+func parsePaymentTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse(constants.ISO8601DateFormat, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse payment time: %s", value)
+	}
+	return t, nil
+}
+
+// checks that the active payment on an order has expired and a new one can be issued while its stock is reserved
+func (s *ServiceImpl) checkPaymentReissuable(order *ordf.Order, payment *now_payments.GetPaymentStatusResponse, attempts int) error {
+	if order.OrderStatus != ORDER_STATUS_AWAITING_PAYMENT {
+		return fmt.Errorf("%w: order %s is %s", ErrPaymentNotReissuable, order.OrderId, order.OrderStatus)
+	}
 	paymentStatus, err := s.mapNowPaymentsStatus(payment.PaymentStatus)
 	if err != nil {
 		return err
 	}
-	if paymentStatus == PAYMENT_STATUS_FINISHED && order.OrderStatus == ORDER_STATUS_AWAITING_PAYMENT {
-		order.OrderStatus = ORDER_STATUS_PAID
+	if paymentStatus != PAYMENT_STATUS_EXPIRED {
+		return fmt.Errorf("%w: payment %s is %s", ErrPaymentNotReissuable, payment.PaymentID, paymentStatus)
+	}
+	if attempts >= maxPaymentAttempts {
+		return fmt.Errorf("%w: order %s already has %d payment attempts", ErrPaymentNotReissuable, order.OrderId, attempts)
 	}
-	// TODO: handle reservations
-	if paymentStatus == PAYMENT_STATUS_EXPIRED || paymentStatus == PAYMENT_STATUS_FAILED {
-		order.OrderStatus = ORDER_STATUS_FAILED
+	expiredAt, err := parsePaymentTime(payment.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(expiredAt.Add(paymentReissueWindow)) {
+		return fmt.Errorf("%w: payment %s expired at %s", ErrPaymentNotReissuable, payment.PaymentID, payment.UpdatedAt)
 	}
 
 	return nil
 }
 
-func (s *ServiceImpl) GetOrder(ctx context.Context, orderID string) (*ordf.Order, error) {
+func (s *ServiceImpl) GetOrder(ctx context.Context, orderID string) (*OrderDetails, error) {
 	order, payment, _, err := s.novelliaDatabaseService.QueryOrder(ctx, orderID)
 	if err != nil {
 		return nil, err
 	}
 
-	err = s.addPaymentToOrder(order, payment)
+	// pending, orphaned and rejected orders have no payment attached
+	if payment != nil {
+		err = s.addPaymentToOrder(order, payment)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	orderFees, err := s.novelliaDatabaseService.QueryOrderFees(ctx, orderID)
 	if err != nil {
 		return nil, err
 	}
 
-	return order, nil
+	details := OrderDetails{
+		Order: *order,
+		Fees: fees.BreakdownFromOrderFees(float64(order.Payment.PriceAmount), orderFees),
+		Payments: []PaymentAttempt{},
+	}
+
+	payments, err := s.novelliaDatabaseService.QueryOrderPayments(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range payments {
+		paymentStatus, err := s.mapNowPaymentsStatus(p.PaymentStatus)
+		if err != nil {
+			return nil, err
+		}
+		details.Payments = append(details.Payments, PaymentAttempt{
+			PaymentID: p.PaymentID.String(),
+			PaymentStatus: paymentStatus,
+			PayAddress: p.PayAddress,
+			PayAmount: p.PayAmount,
+			ActuallyPaid: p.ActuallyPaid,
+			Active: p.Active,
+			CreatedAt: p.CreatedAt,
+		})
+		details.ActuallyPaid += p.ActuallyPaid
+	}
+
+	return &details, nil
 }
 
 func (s *ServiceImpl) CheckAndUpdateOrderPayment(ctx context.Context, orderID string) (*ordf.Order, error) {
@@ -332,6 +811,9 @@ func (s *ServiceImpl) CheckAndUpdateOrderPayment(ctx context.Context, orderID st
 	if err != nil {
 		return nil, err
 	}
+	if payment == nil {
+		return nil, fmt.Errorf("order %s has no active payment", orderID)
+	}
 
 	err = s.addPaymentToOrder(order, payment)
 	if err != nil {
@@ -339,7 +821,7 @@ func (s *ServiceImpl) CheckAndUpdateOrderPayment(ctx context.Context, orderID st
 	}
 
 	// update checked last
-	err = s.novelliaDatabaseService.UpdateOrder(ctx, *order, *payment)
+	err = s.novelliaDatabaseService.UpdateOrder(ctx, *order, *payment, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -355,28 +837,132 @@ func (s *ServiceImpl) CheckAndUpdateOrderPayment(ctx context.Context, orderID st
 			return nil, err
 		}
 
-		err = s.updateOrderStatus(order, refreshedPayment)
+		orderStatus, reason, err := s.orderStatusForPayment(order, refreshedPayment)
 		if err != nil {
 			return nil, err
 		}
 
-		err = s.novelliaDatabaseService.UpdateOrder(ctx, *order, *refreshedPayment)
+		// release the reservation once an expired payment can no longer be re-issued
+		if order.Payment.PaymentStatus == PAYMENT_STATUS_EXPIRED && order.OrderStatus == ORDER_STATUS_AWAITING_PAYMENT {
+			payments, err := s.novelliaDatabaseService.QueryOrderPayments(ctx, orderID)
+			if err != nil {
+				return nil, err
+			}
+			err = s.checkPaymentReissuable(order, refreshedPayment, len(payments))
+			if errors.Is(err, ErrPaymentNotReissuable) {
+				orderStatus = ORDER_STATUS_FAILED
+				reason = err.Error()
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		transition, err := s.transitionOrder(order, orderStatus, refreshedPayment.PaymentStatus, reason, statemachine.ACTOR_SYSTEM)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.novelliaDatabaseService.UpdateOrder(ctx, *order, *refreshedPayment, transition)
 		if err != nil {
 			return nil, err
 		}
+		s.publishTransition(ctx, transition)
 	}
 
 	return order, nil
 }
 
+func (s *ServiceImpl) ReissuePayment(ctx context.Context, orderID string) (*OrderDetails, error) {
+	// shares stock reservations with CreateOrder
+	s.createOrderMutex.Lock()
+	defer s.createOrderMutex.Unlock()
+
+	// make sure the active payment has really expired
+	order, err := s.CheckAndUpdateOrderPayment(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, payment, _, err := s.novelliaDatabaseService.QueryOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if payment == nil {
+		return nil, fmt.Errorf("order %s has no active payment", orderID)
+	}
+	payments, err := s.novelliaDatabaseService.QueryOrderPayments(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkPaymentReissuable(order, payment, len(payments))
+	if err != nil {
+		return nil, err
+	}
+
+	remaining, err := s.remainingPaymentAmount(ctx, order, payments)
+	if err != nil {
+		return nil, err
+	}
+	if remaining <= 0 {
+		return nil, fmt.Errorf("%w: order %s has been paid in full, awaiting confirmation", ErrPaymentNotReissuable, orderID)
+	}
+	_, err = s.estimatePayment(ctx, remaining, order.Payment.PriceCurrencyId)
+	if err != nil {
+		return nil, err
+	}
+
+	createPaymentRequest := now_payments.CreatePaymentRequest{
+		PriceAmount: remaining,
+		PriceCurrency: order.Payment.PriceCurrencyId,
+		PayCurrency: order.Payment.PriceCurrencyId,
+		OrderID: order.OrderId,
+		OrderDescription: order.Description,
+	}
+	createPaymentResponse, err := s.nowPaymentsService.CreatePayment(ctx, createPaymentRequest)
+	if err != nil {
+		return nil, paymentError(err, createPaymentRequest.PriceAmount)
+	}
+
+	err = s.novelliaDatabaseService.InsertOrderPayment(ctx, orderID, *createPaymentResponse)
+	if err != nil {
+		// the order keeps its expired payment, the new one is compensated once it settles
+		s.orphanPayment(ctx, orderID, order.OrderStatus, createPaymentResponse, err)
+		return nil, fmt.Errorf("failed to attach payment %s to order %s: %v", createPaymentResponse.PaymentID, orderID, err)
+	}
+
+	fmt.Printf("Re-issued payment %s for order %s\n", createPaymentResponse.PaymentID, orderID)
+	return s.GetOrder(ctx, orderID)
+}
+
+// submits a paid order to Cardano, only one caller on any instance fulfills an order at a time
 func (s *ServiceImpl) CheckAndUpdateOrderFulfillment(ctx context.Context, orderID string) (*ordf.Order, error) {
+	var order *ordf.Order
+	locked, err := s.novelliaDatabaseService.WithOrderFulfillmentLock(ctx, orderID, func(ctx context.Context) error {
+		var err error
+		order, err = s.fulfillOrder(ctx, orderID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, fmt.Errorf("%w: order %s", ErrFulfillmentInProgress, orderID)
+	}
+	return order, nil
+}
+
+// must hold the order's fulfillment lock, the order is queried after taking it so an order filled meanwhile is not submitted again
+func (s *ServiceImpl) fulfillOrder(ctx context.Context, orderID string) (*ordf.Order, error) {
 	// this function doesn't verify a check interval, the caller will have to do that
 
 	order, payment, _, err := s.novelliaDatabaseService.QueryOrder(ctx, orderID)
 	if err != nil {
-		fmt.Printf("Failed to query order: %+v (%s)\n", order.OrderId, err)
+		fmt.Printf("Failed to query order: %+v (%s)\n", orderID, err)
 		return nil, err
 	}
+	if payment == nil {
+		return nil, fmt.Errorf("order %s has no active payment", orderID)
+	}
 
 	err = s.addPaymentToOrder(order, payment)
 	if err != nil {
@@ -385,7 +971,7 @@ func (s *ServiceImpl) CheckAndUpdateOrderFulfillment(ctx context.Context, orderI
 	}
 
 	// update checked last
-	err = s.novelliaDatabaseService.UpdateOrder(ctx, *order, *payment)
+	err = s.novelliaDatabaseService.UpdateOrder(ctx, *order, *payment, nil)
 	if err != nil {
 		fmt.Printf("Failed to update order (updating checked last): %+v (%s), (order) %+v, (payment) %+v\n", order.OrderId, err, *order, *payment)
 		return nil, err
@@ -400,25 +986,40 @@ func (s *ServiceImpl) CheckAndUpdateOrderFulfillment(ctx context.Context, orderI
 		}
 
 		fmt.Printf("Filling order %s\n", order.OrderId)
-
-		order.OrderStatus = ORDER_STATUS_FILLED
-		err = s.updateOrderStatus(order, payment)
+		transition, err := s.transitionOrder(order, ORDER_STATUS_FILLED, payment.PaymentStatus, fmt.Sprintf("submitted to Cardano in %s", txid), statemachine.ACTOR_SYSTEM)
 		if err != nil {
 			fmt.Printf("Failed to update order: %+v (%s), (order) %+v, (payment) %+v\n", order.OrderId, err, *order, *payment)
 			return nil, err
 		}
 
-		err = s.novelliaDatabaseService.UpdateOrder(ctx, *order, *payment)
-		if err != nil {
-			fmt.Printf("Failed to update order: %+v (%s)\n", order.OrderId, err)
-			return nil, err
+		// the fill is announced in the same transaction that records it, so no one hears of a fill that was not saved
+		var deliveries []novellia_database.WebhookDelivery
+		if s.webhooksService != nil {
+			deliveries, err = s.webhooksService.Deliveries(webhooks.EVENT_ORDER_SUBMITTED, webhooks.EventData{
+				OrderID: order.OrderId,
+				TxID: txid,
+			})
+			if err != nil {
+				fmt.Printf("CheckAndUpdateOrderFulfillment error: %+v\n", err)
+			}
+		}
+		var fillNotifications []novellia_database.Notification
+		if s.notificationsService != nil {
+			fillNotifications, err = s.notificationsService.Notifications(ctx, notifications.EVENT_TOKENS_SENT, notifications.EventData{
+				OrderID: order.OrderId,
+				TxID: txid,
+			})
+			if err != nil {
+				fmt.Printf("CheckAndUpdateOrderFulfillment error: %+v\n", err)
+			}
 		}
 
-		err = s.novelliaDatabaseService.InsertCardanoTransaction(ctx, order.OrderId, txid)
+		err = s.novelliaDatabaseService.FillOrder(ctx, *order, *payment, transition, txid, deliveries, fillNotifications)
 		if err != nil {
-			fmt.Printf("Failed to insert Cardano transaction: %+v (%s)\n", order.OrderId, err)
+			fmt.Printf("Failed to fill order: %+v (%s)\n", order.OrderId, err)
 			return nil, err
 		}
+		s.publishTransition(ctx, transition)
 
 		fmt.Printf("Successfully fulfilled order %s\n", order.OrderId)
 	}
@@ -426,22 +1027,66 @@ func (s *ServiceImpl) CheckAndUpdateOrderFulfillment(ctx context.Context, orderI
 	return order, nil
 }
 
+// records an IPN against the payment attempt it is for, only the active attempt moves the order
+// a late IPN from an earlier attempt can still complete the order once the attempts together cover it
 func (s *ServiceImpl) IPNUpdateOrder(ctx context.Context, payment now_payments.GetPaymentStatusResponse) error {
 	order, _, _, err := s.novelliaDatabaseService.QueryOrder(ctx, payment.OrderID)
 	if err != nil {
 		return err
 	}
+	payments, err := s.novelliaDatabaseService.QueryOrderPayments(ctx, order.OrderId)
+	if err != nil {
+		return err
+	}
+	var attempt *novellia_database.PaymentAttempt
+	for i := range payments {
+		if payments[i].PaymentID.String() == payment.PaymentID.String() {
+			attempt = &payments[i]
+		}
+	}
+	if attempt == nil {
+		return fmt.Errorf("payment %s is not an attempt on order %s", payment.PaymentID, order.OrderId)
+	}
+	attempt.PaymentStatus = payment.PaymentStatus
+	attempt.ActuallyPaid = payment.ActuallyPaid
 
 	newPaymentStatus, err := s.mapNowPaymentsStatus(payment.PaymentStatus)
 	if err != nil {
 		return err
 	}
-	order.Payment.PaymentStatus = newPaymentStatus
 
-	err = s.novelliaDatabaseService.UpdateOrder(ctx, *order, payment)
+	orderStatus := order.OrderStatus
+	reason := ""
+	if attempt.Active {
+		err = s.addPaymentToOrder(order, &payment)
+		if err != nil {
+			return err
+		}
+		orderStatus, reason, err = s.orderStatusForPayment(order, &payment)
+		if err != nil {
+			return err
+		}
+	} else if order.OrderStatus == ORDER_STATUS_AWAITING_PAYMENT && newPaymentStatus == PAYMENT_STATUS_FINISHED {
+		remaining, err := s.remainingPaymentAmount(ctx, order, payments)
+		if err != nil {
+			return err
+		}
+		if remaining <= 0 {
+			orderStatus = ORDER_STATUS_PAID
+			reason = fmt.Sprintf("earlier payment %s finished, payments cover the order", payment.PaymentID)
+		}
+	}
+
+	transition, err := s.transitionOrder(order, orderStatus, payment.PaymentStatus, reason, statemachine.ACTOR_IPN)
+	if err != nil {
+		return err
+	}
+	// updates this attempt's row, the active payment is only changed by its own IPNs
+	err = s.novelliaDatabaseService.UpdateOrder(ctx, *order, payment, transition)
 	if err != nil {
 		return err
 	}
+	s.publishTransition(ctx, transition)
 
 	return nil
 }
@@ -498,6 +1143,10 @@ func (s *ServiceImpl) WatchOrdersForFulfillment(ctx context.Context) {
 			failedUpdate := false
 			for _, orderID := range orderIDs {
 				_, err := s.CheckAndUpdateOrderFulfillment(ctx, orderID)
+				if errors.Is(err, ErrFulfillmentInProgress) {
+					// an operator is retrying it
+					continue
+				}
 				if err != nil {
 					fmt.Printf("WatchOrdersForFulfillment error (query update order %s): %+v\n", orderID, err)
 					failedUpdate = true
@@ -517,3 +1166,16 @@ func (s *ServiceImpl) WatchOrdersForFulfillment(ctx context.Context) {
 	}()
 }
 
+
+func (s *ServiceImpl) GetOrderHistory(ctx context.Context, orderID string) ([]novellia_database.StatusTransition, error) {
+	history, err := s.novelliaDatabaseService.QueryOrderStatusHistory(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	// every order has at least the transition that created it
+	if len(history) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+
+	return history, nil
+}
@@ -3,12 +3,24 @@ package orders_test
 import (
 	"fmt"
 	"context"
+	"errors"
+	"encoding/json"
 	"testing"
+	"time"
 
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/quotes"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/promotions"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/events"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fairness"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/eligibility"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/notifications"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
 )
@@ -48,8 +60,24 @@ func setupTest(ctx context.Context) (novellia_database.Service, now_payments.Ser
 		return nil, nil, nil, nil, err
 	}
 
-	productsService := products.New(novelliaDatabaseService)
-	ordersService := orders.New(novelliaDatabaseService, nowPaymentsService, productsService)
+	productsService, err := products.NewFromConfig(config, novelliaDatabaseService)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	feesService, err := fees.NewFromConfig(config)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	cardanoService, err := cardano.New(novelliaDatabaseService, productsService, feesService)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	promotionsService := promotions.New(novelliaDatabaseService)
+	quotesService, err := quotes.New(novelliaDatabaseService, productsService, cardanoService, feesService, promotionsService, phases.New(nil), "test-signing-key", 10 * time.Minute)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	ordersService := orders.New(novelliaDatabaseService, nowPaymentsService, productsService, cardanoService, quotesService, feesService, promotionsService, events.New(novelliaDatabaseService), nil, nil, fairness.New(novelliaDatabaseService, productsService), phases.New(nil), eligibility.New(novelliaDatabaseService, cardanoService), nil)
 
 	return novelliaDatabaseService, nowPaymentsService, productsService, ordersService, nil
 }
@@ -90,7 +118,9 @@ func TestValidateOrder(t *testing.T) {
 		OrderStatus: "PAID",
 	}
 
-	err = ordersService.ValidateOrder(ctx, order)
+	_, err = ordersService.ValidateOrder(ctx, orders.OrderRequest{
+		Order: order,
+	})
 	if err != nil {
 		t.Errorf("validate order failed: %+v", err)
 	}
@@ -121,12 +151,24 @@ func TestCreateOrder(t *testing.T) {
 		},
 		Payment: ordf.OrderPayment{
 			PriceCurrencyId: "ada",
-			PriceAmount: 80,
 		},
 		Description: "Test Order",
 	}
 
-	orderID, err := ordersService.CreateOrder(ctx, order)
+	quote, err := ordersService.QuoteOrder(ctx, orders.OrderRequest{
+		Order: order,
+	})
+	if err != nil {
+		t.Fatalf("quote order failed: %+v", err)
+	}
+	if quote.Subtotal != 80 {
+		t.Errorf("expected quote subtotal of 80, got %f", quote.Subtotal)
+	}
+
+	orderID, err := ordersService.CreateOrder(ctx, orders.OrderRequest{
+		Order: order,
+		QuoteID: quote.QuoteID,
+	})
 	if err != nil {
 		t.Errorf("validate order failed: %+v", err)
 	}
@@ -190,3 +232,407 @@ func TestIPNUpdateOrder(t *testing.T) {
 		t.Errorf("IPN update order failed: %+v", err)
 	}
 }
+
+// keeps orders in memory, database methods the tests do not use panic through the nil Service
+type testStore struct {
+	novellia_database.Service
+	orders map[string]*ordf.Order
+	// the last payment of an order is active
+	payments map[string][]novellia_database.PaymentAttempt
+	fees map[string][]fees.Fee
+	compensations []novellia_database.PaymentCompensation
+	history []novellia_database.StatusTransition
+	// set to fail the next calls
+	insertOrderPaymentErr error
+	insertCompensationErr error
+	// set while another instance fulfills orders
+	fulfilling bool
+}
+
+func newTestStore() *testStore {
+	return &testStore{
+		orders: make(map[string]*ordf.Order),
+		payments: make(map[string][]novellia_database.PaymentAttempt),
+		fees: make(map[string][]fees.Fee),
+	}
+}
+
+func (s *testStore) addOrder(orderID string, orderStatus string, priceAmount float32, orderFees []fees.Fee, payments ...now_payments.GetPaymentStatusResponse) {
+	s.orders[orderID] = &ordf.Order{
+		OrderId: orderID,
+		OrderStatus: orderStatus,
+		Items: []ordf.OrderItems{{ProductId: "PROD-01F4MK45QJS4WZ1VBZW1A1THD7", Quantity: 1}},
+		Customer: ordf.OrderCustomer{
+			DeliveryAddress: "addr1q8hax2z9wav0prwhmls59g2dz5aja7jnsz9kyqr7sa8rp0ew08lffp5n2kzt72ez93m5zev2v4fm9sawnrqnvllmyhmst2jnww",
+		},
+		Payment: ordf.OrderPayment{
+			PriceCurrencyId: "ada",
+			PriceAmount: priceAmount,
+		},
+		Description: "Test Order",
+	}
+	s.fees[orderID] = orderFees
+	for i, p := range payments {
+		s.payments[orderID] = append(s.payments[orderID], novellia_database.PaymentAttempt{
+			GetPaymentStatusResponse: p,
+			Active: i == len(payments) - 1,
+		})
+	}
+}
+
+func (s *testStore) transition(transition novellia_database.StatusTransition) {
+	s.orders[transition.OrderID].OrderStatus = transition.To
+	s.history = append(s.history, transition)
+}
+
+func (s *testStore) QueryOrder(ctx context.Context, orderID string) (*ordf.Order, *now_payments.GetPaymentStatusResponse, *time.Time, error) {
+	order, ok := s.orders[orderID]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("no order %s", orderID)
+	}
+	o := *order
+	payments := s.payments[orderID]
+	if len(payments) == 0 {
+		return &o, nil, nil, nil
+	}
+	p := payments[len(payments) - 1].GetPaymentStatusResponse
+	return &o, &p, nil, nil
+}
+
+func (s *testStore) QueryOrderStatus(ctx context.Context, orderID string) (string, string, error) {
+	order, ok := s.orders[orderID]
+	if !ok {
+		return "", "", fmt.Errorf("no order %s", orderID)
+	}
+	return order.OrderStatus, order.Customer.DeliveryAddress, nil
+}
+
+func (s *testStore) QueryOrderItems(ctx context.Context, orderID string) ([]ordf.OrderItems, error) {
+	return s.orders[orderID].Items, nil
+}
+
+func (s *testStore) QueryOrderPayments(ctx context.Context, orderID string) ([]novellia_database.PaymentAttempt, error) {
+	return append([]novellia_database.PaymentAttempt{}, s.payments[orderID]...), nil
+}
+
+func (s *testStore) QueryOrderFees(ctx context.Context, orderID string) ([]fees.Fee, error) {
+	return s.fees[orderID], nil
+}
+
+func (s *testStore) UpdateOrder(ctx context.Context, order ordf.Order, payment now_payments.GetPaymentStatusResponse, transition *novellia_database.StatusTransition) error {
+	s.orders[order.OrderId] = &order
+	for i := range s.payments[order.OrderId] {
+		if s.payments[order.OrderId][i].PaymentID == payment.PaymentID {
+			s.payments[order.OrderId][i].GetPaymentStatusResponse = payment
+		}
+	}
+	if transition != nil {
+		s.history = append(s.history, *transition)
+	}
+	return nil
+}
+
+func (s *testStore) UpdateOrderStatus(ctx context.Context, transition novellia_database.StatusTransition) error {
+	s.transition(transition)
+	return nil
+}
+
+func (s *testStore) UpdateOrderDeliveryAddress(ctx context.Context, transition novellia_database.StatusTransition, customer novellia_database.OrderCustomer) error {
+	s.orders[transition.OrderID].Customer.DeliveryAddress = customer.DeliveryAddress
+	s.transition(transition)
+	return nil
+}
+
+func (s *testStore) InsertOrderPayment(ctx context.Context, orderID string, payment now_payments.CreatePaymentResponse) error {
+	if s.insertOrderPaymentErr != nil {
+		return s.insertOrderPaymentErr
+	}
+	for i := range s.payments[orderID] {
+		s.payments[orderID][i].Active = false
+	}
+	s.payments[orderID] = append(s.payments[orderID], novellia_database.PaymentAttempt{
+		GetPaymentStatusResponse: now_payments.GetPaymentStatusResponse{
+			PaymentID: json.Number(payment.PaymentID),
+			PaymentStatus: payment.PaymentStatus,
+			PayAddress: payment.PayAddress,
+			PriceAmount: payment.PriceAmount,
+		},
+		Active: true,
+	})
+	return nil
+}
+
+func (s *testStore) InsertPaymentCompensation(ctx context.Context, transition novellia_database.StatusTransition, compensation novellia_database.PaymentCompensation) error {
+	if s.insertCompensationErr != nil {
+		err := s.insertCompensationErr
+		s.insertCompensationErr = nil
+		return err
+	}
+	s.compensations = append(s.compensations, compensation)
+	s.transition(transition)
+	return nil
+}
+
+func (s *testStore) QueryPaymentCompensations(ctx context.Context, status string) ([]novellia_database.PaymentCompensation, error) {
+	compensations := []novellia_database.PaymentCompensation{}
+	for _, c := range s.compensations {
+		if c.Status == status {
+			compensations = append(compensations, c)
+		}
+	}
+	return compensations, nil
+}
+
+func (s *testStore) UpdatePaymentCompensation(ctx context.Context, transition novellia_database.StatusTransition, status string, detail string) error {
+	for i := range s.compensations {
+		if s.compensations[i].OrderID == transition.OrderID {
+			s.compensations[i].Status = status
+			s.compensations[i].Detail = detail
+		}
+	}
+	s.transition(transition)
+	return nil
+}
+
+// every order with the status is ready, whatever the interval
+func (s *testStore) QueryOrdersReadyForCheck(ctx context.Context, interval time.Duration, requiredStatus string) ([]string, error) {
+	orderIDs := []string{}
+	for orderID, order := range s.orders {
+		if order.OrderStatus == requiredStatus {
+			orderIDs = append(orderIDs, orderID)
+		}
+	}
+	return orderIDs, nil
+}
+
+func (s *testStore) WithOrderFulfillmentLock(ctx context.Context, orderID string, fn func(ctx context.Context) error) (bool, error) {
+	if s.fulfilling {
+		return false, nil
+	}
+	return true, fn(ctx)
+}
+
+// serves payments from memory, NowPayments methods the tests do not use panic through the nil Service
+type testPayments struct {
+	now_payments.Service
+	payments map[string]now_payments.GetPaymentStatusResponse
+	created []now_payments.CreatePaymentRequest
+	minAmount float64
+}
+
+func newTestPayments(payments ...now_payments.GetPaymentStatusResponse) *testPayments {
+	p := &testPayments{
+		payments: make(map[string]now_payments.GetPaymentStatusResponse),
+		minAmount: 1,
+	}
+	for _, payment := range payments {
+		p.payments[payment.PaymentID.String()] = payment
+	}
+	return p
+}
+
+func (p *testPayments) GetPaymentStatus(ctx context.Context, paymentID string) (*now_payments.GetPaymentStatusResponse, error) {
+	payment, ok := p.payments[paymentID]
+	if !ok {
+		return nil, fmt.Errorf("no payment %s", paymentID)
+	}
+	return &payment, nil
+}
+
+func (p *testPayments) GetMinimumAmount(ctx context.Context, currencyFrom string, currencyTo string) (float64, error) {
+	return p.minAmount, nil
+}
+
+func (p *testPayments) GetEstimatedPrice(ctx context.Context, amount float64, currencyFrom string, currencyTo string) (float64, error) {
+	return amount, nil
+}
+
+func (p *testPayments) CreatePayment(ctx context.Context, createPaymentRequest now_payments.CreatePaymentRequest) (*now_payments.CreatePaymentResponse, error) {
+	p.created = append(p.created, createPaymentRequest)
+	paymentID := fmt.Sprintf("%d", 9000 + len(p.created))
+	p.payments[paymentID] = now_payments.GetPaymentStatusResponse{
+		PaymentID: json.Number(paymentID),
+		PaymentStatus: "waiting",
+		PriceAmount: createPaymentRequest.PriceAmount,
+		OrderID: createPaymentRequest.OrderID,
+	}
+	return &now_payments.CreatePaymentResponse{
+		PaymentID: paymentID,
+		PaymentStatus: "waiting",
+		PayAddress: "addr_payment_" + paymentID,
+		PriceAmount: createPaymentRequest.PriceAmount,
+		PriceCurrency: createPaymentRequest.PriceCurrency,
+		OrderID: createPaymentRequest.OrderID,
+	}, nil
+}
+
+// records notifications instead of queuing them
+type testNotifications struct {
+	notifications.Service
+	events []string
+}
+
+func (n *testNotifications) Notify(ctx context.Context, eventType string, data notifications.EventData) error {
+	n.events = append(n.events, fmt.Sprintf("%s %s", eventType, data.OrderID))
+	return nil
+}
+
+// validates addresses the way cardano-cli would reject the obviously wrong ones
+type testCardano struct {
+	cardano.Service
+}
+
+func (c *testCardano) ValidateAddress(address string) error {
+	if len(address) < 4 || address[:4] != "addr" {
+		return fmt.Errorf("not a Shelley address: %s", address)
+	}
+	return nil
+}
+
+func newTestService(store *testStore, payments *testPayments, notificationsService notifications.Service) *orders.ServiceImpl {
+	return orders.New(store, payments, nil, &testCardano{}, nil, nil, nil, nil, nil, notificationsService, nil, phases.New(nil), nil, nil)
+}
+
+func testPayment(paymentID string, paymentStatus string, actuallyPaid float64, updatedAt time.Time) now_payments.GetPaymentStatusResponse {
+	return now_payments.GetPaymentStatusResponse{
+		PaymentID: json.Number(paymentID),
+		PaymentStatus: paymentStatus,
+		PayAddress: "addr_payment_" + paymentID,
+		PayCurrency: "ada",
+		ActuallyPaid: actuallyPaid,
+		UpdatedAt: updatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func TestReissuePayment(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	// 100 ADA total, of which the 2 ADA processing fee is not requested from NowPayments
+	orderFees := []fees.Fee{
+		{Name: "processing", Type: fees.FEE_TYPE_FLAT, Amount: 2},
+		{Name: fees.MinADADepositFeeName, Type: fees.FEE_TYPE_DEPOSIT, Amount: 1.5},
+	}
+
+	cases := []struct {
+		name string
+		payments []now_payments.GetPaymentStatusResponse
+		minAmount float64
+		expectedErr error
+		// status the order is left in
+		expectedStatus string
+		// amount of the re-issued payment, 0 if none is issued
+		expectedAmount float64
+	}{
+		{
+			name: "expired within the window",
+			payments: []now_payments.GetPaymentStatusResponse{testPayment("1", "expired", 0, now.Add(-10 * time.Minute))},
+			expectedStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+			expectedAmount: 98,
+		},
+		{
+			name: "partially paid across attempts",
+			payments: []now_payments.GetPaymentStatusResponse{
+				testPayment("1", "expired", 30, now.Add(-50 * time.Minute)),
+				testPayment("2", "expired", 20.5, now.Add(-10 * time.Minute)),
+			},
+			expectedStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+			expectedAmount: 47.5,
+		},
+		{
+			name: "still waiting",
+			payments: []now_payments.GetPaymentStatusResponse{testPayment("1", "waiting", 0, now)},
+			expectedErr: orders.ErrPaymentNotReissuable,
+			expectedStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+		},
+		{
+			name: "expired outside the window",
+			payments: []now_payments.GetPaymentStatusResponse{testPayment("1", "expired", 0, now.Add(-2 * time.Hour))},
+			expectedErr: orders.ErrPaymentNotReissuable,
+			expectedStatus: orders.ORDER_STATUS_FAILED,
+		},
+		{
+			name: "attempts exhausted",
+			payments: []now_payments.GetPaymentStatusResponse{
+				testPayment("1", "expired", 0, now.Add(-50 * time.Minute)),
+				testPayment("2", "expired", 0, now.Add(-30 * time.Minute)),
+				testPayment("3", "expired", 0, now.Add(-10 * time.Minute)),
+			},
+			expectedErr: orders.ErrPaymentNotReissuable,
+			expectedStatus: orders.ORDER_STATUS_FAILED,
+		},
+		{
+			name: "paid in full",
+			payments: []now_payments.GetPaymentStatusResponse{testPayment("1", "expired", 98, now.Add(-10 * time.Minute))},
+			expectedErr: orders.ErrPaymentNotReissuable,
+			expectedStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+		},
+		{
+			name: "remainder below the minimum",
+			payments: []now_payments.GetPaymentStatusResponse{testPayment("1", "expired", 90, now.Add(-10 * time.Minute))},
+			minAmount: 10,
+			expectedErr: now_payments.ErrMinAmount,
+			expectedStatus: orders.ORDER_STATUS_AWAITING_PAYMENT,
+		},
+	}
+	for _, c := range cases {
+		store := newTestStore()
+		store.addOrder("ORDER-1", orders.ORDER_STATUS_AWAITING_PAYMENT, 100, orderFees, c.payments...)
+		payments := newTestPayments(c.payments...)
+		if c.minAmount > 0 {
+			payments.minAmount = c.minAmount
+		}
+		s := newTestService(store, payments, nil)
+
+		details, err := s.ReissuePayment(ctx, "ORDER-1")
+		if c.expectedErr == nil && err != nil {
+			t.Errorf("%s: failed to reissue payment: %+v", c.name, err)
+		}
+		if c.expectedErr != nil && !errors.Is(err, c.expectedErr) {
+			t.Errorf("%s: expected %v, got %+v", c.name, c.expectedErr, err)
+		}
+		if store.orders["ORDER-1"].OrderStatus != c.expectedStatus {
+			t.Errorf("%s: expected order to be %s, got %s", c.name, c.expectedStatus, store.orders["ORDER-1"].OrderStatus)
+		}
+
+		if c.expectedAmount == 0 {
+			if len(payments.created) != 0 {
+				t.Errorf("%s: expected no payment, got %+v", c.name, payments.created)
+			}
+			continue
+		}
+		if len(payments.created) != 1 || payments.created[0].PriceAmount != c.expectedAmount {
+			t.Errorf("%s: expected a payment of %f, got %+v", c.name, c.expectedAmount, payments.created)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		active := details.Payments[len(details.Payments) - 1]
+		if len(details.Payments) != len(c.payments) + 1 || !active.Active || active.PaymentStatus != orders.PAYMENT_STATUS_WAITING {
+			t.Errorf("%s: expected the new payment to be active, got %+v", c.name, details.Payments)
+		}
+	}
+}
+
+func TestReissuePaymentNotAttached(t *testing.T) {
+	ctx := context.Background()
+	expired := testPayment("1", "expired", 0, time.Now().Add(-10 * time.Minute))
+
+	store := newTestStore()
+	store.addOrder("ORDER-1", orders.ORDER_STATUS_AWAITING_PAYMENT, 100, nil, expired)
+	store.insertOrderPaymentErr = errors.New("connection reset")
+	s := newTestService(store, newTestPayments(expired), nil)
+
+	_, err := s.ReissuePayment(ctx, "ORDER-1")
+	if err == nil {
+		t.Fatalf("expected the payment not to be attached")
+	}
+
+	// the order keeps its reservation and the new payment is queued for compensation
+	if store.orders["ORDER-1"].OrderStatus != orders.ORDER_STATUS_AWAITING_PAYMENT {
+		t.Errorf("expected order to stay %s, got %s", orders.ORDER_STATUS_AWAITING_PAYMENT, store.orders["ORDER-1"].OrderStatus)
+	}
+	if len(store.compensations) != 1 || store.compensations[0].PaymentID != "9001" || store.compensations[0].Status != orders.COMPENSATION_STATUS_QUEUED {
+		t.Errorf("expected a queued compensation for payment 9001, got %+v", store.compensations)
+	}
+}
@@ -0,0 +1,152 @@
+package statemachine
+
+import (
+	"fmt"
+	"errors"
+)
+
+const (
+	// stock is reserved but the payment is not attached yet
+	STATE_PENDING = "PENDING"
+	// a payment may exist that could not be attached, see payment_compensation
+	STATE_ORPHANED = "ORPHANED"
+	STATE_AWAITING_PAYMENT = "AWAITING_PAYMENT"
+	STATE_PAID = "PAID"
+	STATE_FILLED = "FILLED"
+	STATE_PARTIALLY_FILLED = "PARTIALLY_FILLED"
+	STATE_REFUND = "REFUND"
+	STATE_FAILED = "FAILED"
+)
+
+const (
+	// the order fulfillment watchers
+	ACTOR_SYSTEM = "system"
+	// NowPayments IPN callbacks
+	ACTOR_IPN = "ipn"
+	ACTOR_CUSTOMER = "customer"
+	// operators, through the admin API
+	ACTOR_ADMIN = "admin"
+)
+
+// NowPayments payment_status that completes a payment
+const paymentStatusFinished = "finished"
+
+var (
+	ErrInvalidTransition = errors.New("invalid order status transition")
+)
+
+// a change of order status and why it happened
+type Transition struct {
+	From string
+	To string
+	Reason string
+	Actor string
+	// NowPayments payment_status of the active payment, if known
+	PaymentStatus string
+}
+
+// returns an error if a transition is not allowed even though its states are
+type Guard func(t Transition) error
+
+type Machine struct {
+	// from -> to -> guard, a nil guard always allows
+	transitions map[string]map[string]Guard
+}
+
+// orders are only marked paid by NowPayments, operators can override this
+func paymentFinished(t Transition) error {
+	if t.PaymentStatus == paymentStatusFinished || t.Actor == ACTOR_ADMIN {
+		return nil
+	}
+	return fmt.Errorf("payment is %s", t.PaymentStatus)
+}
+
+func actorIs(actors ...string) Guard {
+	return func(t Transition) error {
+		for _, actor := range actors {
+			if t.Actor == actor {
+				return nil
+			}
+		}
+		return fmt.Errorf("actor %s may not make this transition", t.Actor)
+	}
+}
+
+// creates a Machine with the order lifecycle
+func New() *Machine {
+	return &Machine{
+		transitions: map[string]map[string]Guard{
+			// orders are created pending
+			"": {
+				STATE_PENDING: actorIs(ACTOR_CUSTOMER),
+			},
+			STATE_PENDING: {
+				STATE_AWAITING_PAYMENT: nil,
+				STATE_ORPHANED: nil,
+				STATE_FAILED: nil,
+			},
+			STATE_ORPHANED: {
+				STATE_REFUND: nil,
+				STATE_FAILED: nil,
+			},
+			STATE_AWAITING_PAYMENT: {
+				STATE_PAID: paymentFinished,
+				STATE_FAILED: nil,
+				STATE_REFUND: actorIs(ACTOR_ADMIN),
+			},
+			STATE_PAID: {
+				STATE_FILLED: nil,
+				STATE_PARTIALLY_FILLED: nil,
+				STATE_REFUND: actorIs(ACTOR_ADMIN),
+			},
+			STATE_PARTIALLY_FILLED: {
+				STATE_FILLED: nil,
+				STATE_REFUND: actorIs(ACTOR_ADMIN),
+			},
+			// payments that arrive after an order failed are checked by an operator
+			STATE_FAILED: {
+				STATE_PAID: actorIs(ACTOR_ADMIN),
+				STATE_REFUND: actorIs(ACTOR_ADMIN),
+			},
+			STATE_FILLED: {},
+			STATE_REFUND: {},
+		},
+	}
+}
+
+// checks that a transition is allowed, staying in the same state always is
+func (m *Machine) Validate(t Transition) error {
+	if t.From == t.To {
+		return nil
+	}
+	allowed, ok := m.transitions[t.From]
+	if !ok {
+		return fmt.Errorf("%w: unknown state %s", ErrInvalidTransition, t.From)
+	}
+	guard, ok := allowed[t.To]
+	if !ok {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, t.From, t.To)
+	}
+	if guard != nil {
+		err := guard(t)
+		if err != nil {
+			return fmt.Errorf("%w: %s -> %s, %v", ErrInvalidTransition, t.From, t.To, err)
+		}
+	}
+	return nil
+}
+
+// states reachable from a state
+func (m *Machine) Next(from string) []string {
+	next := []string{}
+	for to := range m.transitions[from] {
+		next = append(next, to)
+	}
+	return next
+}
+
+// checks that a state has no way out
+func (m *Machine) IsTerminal(state string) bool {
+	allowed, ok := m.transitions[state]
+	return ok && len(allowed) == 0
+}
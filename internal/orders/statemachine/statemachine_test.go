@@ -0,0 +1,44 @@
+package statemachine_test
+
+import (
+	"errors"
+	"testing"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders/statemachine"
+)
+
+func TestValidate(t *testing.T) {
+	machine := statemachine.New()
+
+	cases := []struct {
+		transition statemachine.Transition
+		allowed bool
+	}{
+		{statemachine.Transition{From: "", To: statemachine.STATE_PENDING, Actor: statemachine.ACTOR_CUSTOMER}, true},
+		{statemachine.Transition{From: statemachine.STATE_PENDING, To: statemachine.STATE_AWAITING_PAYMENT, Actor: statemachine.ACTOR_CUSTOMER}, true},
+		// paid only once NowPayments says so, unless an operator overrides it
+		{statemachine.Transition{From: statemachine.STATE_AWAITING_PAYMENT, To: statemachine.STATE_PAID, Actor: statemachine.ACTOR_SYSTEM, PaymentStatus: "finished"}, true},
+		{statemachine.Transition{From: statemachine.STATE_AWAITING_PAYMENT, To: statemachine.STATE_PAID, Actor: statemachine.ACTOR_SYSTEM, PaymentStatus: "confirming"}, false},
+		{statemachine.Transition{From: statemachine.STATE_AWAITING_PAYMENT, To: statemachine.STATE_PAID, Actor: statemachine.ACTOR_ADMIN}, true},
+		{statemachine.Transition{From: statemachine.STATE_FAILED, To: statemachine.STATE_PAID, Actor: statemachine.ACTOR_SYSTEM, PaymentStatus: "finished"}, false},
+		{statemachine.Transition{From: statemachine.STATE_FAILED, To: statemachine.STATE_PAID, Actor: statemachine.ACTOR_ADMIN}, true},
+		{statemachine.Transition{From: statemachine.STATE_PAID, To: statemachine.STATE_FILLED, Actor: statemachine.ACTOR_SYSTEM}, true},
+		// filled orders stay filled
+		{statemachine.Transition{From: statemachine.STATE_FILLED, To: statemachine.STATE_AWAITING_PAYMENT, Actor: statemachine.ACTOR_ADMIN}, false},
+		{statemachine.Transition{From: statemachine.STATE_FILLED, To: statemachine.STATE_FILLED, Actor: statemachine.ACTOR_SYSTEM}, true},
+		{statemachine.Transition{From: "SHIPPED", To: statemachine.STATE_FILLED, Actor: statemachine.ACTOR_SYSTEM}, false},
+	}
+	for _, c := range cases {
+		err := machine.Validate(c.transition)
+		if c.allowed && err != nil {
+			t.Errorf("expected %+v to be allowed, got %+v", c.transition, err)
+		}
+		if !c.allowed && !errors.Is(err, statemachine.ErrInvalidTransition) {
+			t.Errorf("expected %+v to be invalid, got %+v", c.transition, err)
+		}
+	}
+
+	if !machine.IsTerminal(statemachine.STATE_FILLED) || machine.IsTerminal(statemachine.STATE_PAID) {
+		t.Errorf("wrong terminal states")
+	}
+}
@@ -0,0 +1,22 @@
+package phases
+
+import (
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+)
+
+type Service interface {
+	// nil when no sale phases are configured
+	GetSchedule() *Schedule
+	// the schedule with the phases running at and after t
+	GetStatus(t time.Time) Status
+	// checks that a product can be ordered on its own at t, returning the phase it is sold in, nil when there is no schedule
+	CheckPurchasable(product novellia_database.Product, t time.Time) (*Phase, error)
+	// the unit price of a product during phase, which may be nil
+	Price(product novellia_database.Product, phase *Phase) float64
+	// the phase running at t, nil when none is or there is no schedule
+	PhaseAt(t time.Time) *Phase
+	// the per-customer limits an order placed in phase counts against, phase may be nil
+	PurchaseLimits(phase *Phase) []PurchaseLimit
+}
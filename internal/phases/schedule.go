@@ -0,0 +1,304 @@
+package phases
+
+import (
+	"fmt"
+	"os"
+	"encoding/hex"
+	"sort"
+	"time"
+	// the schedule's time zone must load in containers without zoneinfo
+	_ "time/tzdata"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// times without an offset are read in this zone, e.g. 2021-05-22T09:00:00
+	localTimeFormat = "2006-01-02T15:04:05"
+)
+
+// a window in which a set of products is sold
+type Phase struct {
+	Name string `yaml:"name" json:"name"`
+	// RFC3339, or without an offset in the schedule's time zone
+	StartTime string `yaml:"start" json:"-"`
+	// empty means the phase runs until the schedule is changed
+	EndTime string `yaml:"end" json:"-"`
+	Start time.Time `yaml:"-" json:"start"`
+	End *time.Time `yaml:"-" json:"end"`
+	// products sold in the phase, empty means every product
+	Products []string `yaml:"products" json:"products"`
+	// unit prices replacing the listed prices during the phase
+	Prices map[string]float64 `yaml:"prices" json:"prices"`
+	// products that can only be obtained from bundles during the phase
+	NotDirectlyPurchasable []string `yaml:"not-directly-purchasable" json:"not_directly_purchasable"`
+	// who may order during the phase, nil means anyone
+	Eligibility *Eligibility `yaml:"eligibility" json:"eligibility,omitempty"`
+	// counted over orders placed during the phase
+	CustomerLimits *CustomerLimits `yaml:"customer-limits" json:"customer_limits,omitempty"`
+}
+
+// caps on the units one customer, by delivery address or its stake address, orders across orders that have not failed
+type CustomerLimits struct {
+	// units of all products together, 0 means no cap
+	MaxUnits int64 `yaml:"max-units" json:"max_units"`
+	// units of each product
+	Products map[string]int64 `yaml:"products" json:"products,omitempty"`
+}
+
+func (l *CustomerLimits) validate(scope string) error {
+	if l.MaxUnits < 0 {
+		return fmt.Errorf("%s customer-limits max-units cannot be negative", scope)
+	}
+	for productID, maxUnits := range l.Products {
+		if maxUnits <= 0 {
+			return fmt.Errorf("%s customer-limits of %s must be positive", scope, productID)
+		}
+	}
+	return nil
+}
+
+// a wallet holding at least Quantity native tokens of PolicyID
+type Holding struct {
+	// hex, 28 bytes
+	PolicyID string `yaml:"policy-id" json:"policy_id"`
+	Quantity int64 `yaml:"quantity" json:"quantity"`
+}
+
+// phase-scoped rules checked by eligibility.Service
+// an address is eligible if it is on the allowlist or meets any holding, or always when neither is set
+type Eligibility struct {
+	// ID of an allowlist uploaded with PUT /admin/allowlists/{allowlist_id}
+	Allowlist string `yaml:"allowlist" json:"allowlist,omitempty"`
+	Holds []Holding `yaml:"holds" json:"holds,omitempty"`
+	// units an address may order across its orders in the phase, 0 means no cap
+	MaxUnitsPerAddress int64 `yaml:"max-units-per-address" json:"max_units_per_address"`
+}
+
+func (e *Eligibility) validate(phase string) error {
+	for _, holding := range e.Holds {
+		policyID, err := hex.DecodeString(holding.PolicyID)
+		if err != nil || len(policyID) != 28 {
+			return fmt.Errorf("sale phase %s holds invalid policy-id %q", phase, holding.PolicyID)
+		}
+		if holding.Quantity <= 0 {
+			return fmt.Errorf("sale phase %s must hold a positive quantity of %s", phase, holding.PolicyID)
+		}
+	}
+	if e.MaxUnitsPerAddress < 0 {
+		return fmt.Errorf("sale phase %s max-units-per-address cannot be negative", phase)
+	}
+	return nil
+}
+
+// sale phases, read from YAML so that a drop can be scheduled ahead of time
+type Schedule struct {
+	// IANA zone of times given without an offset, defaults to UTC
+	TimeZone string `yaml:"time-zone" json:"time_zone"`
+	// products that can only be obtained from bundles, whatever the phase
+	NotDirectlyPurchasable []string `yaml:"not-directly-purchasable" json:"not_directly_purchasable"`
+	// counted over every order, whatever the phase
+	CustomerLimits *CustomerLimits `yaml:"customer-limits" json:"customer_limits,omitempty"`
+	// sorted by start when loaded
+	Phases []Phase `yaml:"phases" json:"phases"`
+}
+
+// loads and validates a schedule YAML
+func LoadSchedule(path string) (*Schedule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var schedule Schedule
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&schedule)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sale phases %s: %v", path, err)
+	}
+
+	err = schedule.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func parseTime(value string, location *time.Location) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(localTimeFormat, value, location)
+}
+
+// parses phase times in the schedule's time zone, sorts phases by start and checks that they do not overlap
+func (s *Schedule) Validate() error {
+	location := time.UTC
+	if s.TimeZone != "" {
+		var err error
+		location, err = time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return fmt.Errorf("sale phases have unknown time-zone %s: %v", s.TimeZone, err)
+		}
+	}
+
+	if s.CustomerLimits != nil {
+		err := s.CustomerLimits.validate("sale phases")
+		if err != nil {
+			return err
+		}
+	}
+
+	names := map[string]bool{}
+	for i := range s.Phases {
+		phase := &s.Phases[i]
+		if phase.Name == "" {
+			return fmt.Errorf("sale phase %d has no name", i)
+		}
+		if names[phase.Name] {
+			return fmt.Errorf("duplicate sale phase %s", phase.Name)
+		}
+		names[phase.Name] = true
+
+		start, err := parseTime(phase.StartTime, location)
+		if err != nil {
+			return fmt.Errorf("sale phase %s has invalid start %q", phase.Name, phase.StartTime)
+		}
+		phase.Start = start
+		phase.End = nil
+		if phase.EndTime != "" {
+			end, err := parseTime(phase.EndTime, location)
+			if err != nil {
+				return fmt.Errorf("sale phase %s has invalid end %q", phase.Name, phase.EndTime)
+			}
+			if !end.After(start) {
+				return fmt.Errorf("sale phase %s must end after it starts", phase.Name)
+			}
+			phase.End = &end
+		}
+
+		for productID, price := range phase.Prices {
+			if price <= 0 {
+				return fmt.Errorf("sale phase %s price of %s must be positive", phase.Name, productID)
+			}
+		}
+		if phase.Eligibility != nil {
+			err = phase.Eligibility.validate(phase.Name)
+			if err != nil {
+				return err
+			}
+		}
+		if phase.CustomerLimits != nil {
+			err = phase.CustomerLimits.validate(fmt.Sprintf("sale phase %s", phase.Name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	sort.SliceStable(s.Phases, func(i, j int) bool {
+		return s.Phases[i].Start.Before(s.Phases[j].Start)
+	})
+	for i := 1; i < len(s.Phases); i++ {
+		previous := s.Phases[i - 1]
+		if previous.End == nil || previous.End.After(s.Phases[i].Start) {
+			return fmt.Errorf("sale phase %s overlaps %s", s.Phases[i].Name, previous.Name)
+		}
+	}
+	return nil
+}
+
+// the phase running at t, nil if none is or there is no schedule
+func (s *Schedule) PhaseAt(t time.Time) *Phase {
+	if s == nil {
+		return nil
+	}
+	for i := range s.Phases {
+		phase := &s.Phases[i]
+		if !t.Before(phase.Start) && (phase.End == nil || t.Before(*phase.End)) {
+			return phase
+		}
+	}
+	return nil
+}
+
+// the phase starting after t, nil if none does
+func (s *Schedule) NextPhase(t time.Time) *Phase {
+	if s == nil {
+		return nil
+	}
+	for i := range s.Phases {
+		if s.Phases[i].Start.After(t) {
+			return &s.Phases[i]
+		}
+	}
+	return nil
+}
+
+func contains(productIDs []string, productID string) bool {
+	for _, id := range productIDs {
+		if id == productID {
+			return true
+		}
+	}
+	return false
+}
+
+// a cap on the units one customer orders, counted over orders placed in [Start, End)
+type PurchaseLimit struct {
+	// the phase the limit is counted in, empty for every order
+	Phase string
+	// nil means unbounded
+	Start *time.Time
+	End *time.Time
+	// empty means every product
+	ProductID string
+	MaxUnits int64
+}
+
+func (l *CustomerLimits) purchaseLimits(phase *Phase) []PurchaseLimit {
+	limits := []PurchaseLimit{}
+	if l == nil {
+		return limits
+	}
+	limit := PurchaseLimit{}
+	if phase != nil {
+		start := phase.Start
+		limit.Phase = phase.Name
+		limit.Start = &start
+		limit.End = phase.End
+	}
+	if l.MaxUnits > 0 {
+		limit.MaxUnits = l.MaxUnits
+		limits = append(limits, limit)
+	}
+	for productID, maxUnits := range l.Products {
+		limit.ProductID = productID
+		limit.MaxUnits = maxUnits
+		limits = append(limits, limit)
+	}
+	return limits
+}
+
+// the schedule's customer limits and those of phase, if not nil
+func (s *Schedule) PurchaseLimits(phase *Phase) []PurchaseLimit {
+	if s == nil {
+		return []PurchaseLimit{}
+	}
+	limits := s.CustomerLimits.purchaseLimits(nil)
+	if phase != nil {
+		limits = append(limits, phase.CustomerLimits.purchaseLimits(phase)...)
+	}
+	return limits
+}
+
+// whether productID is sold in the phase
+func (p *Phase) Sells(productID string) bool {
+	if contains(p.NotDirectlyPurchasable, productID) {
+		return false
+	}
+	return len(p.Products) == 0 || contains(p.Products, productID)
+}
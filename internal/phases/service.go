@@ -0,0 +1,119 @@
+package phases
+
+import (
+	"fmt"
+	"errors"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+)
+
+var (
+	ErrNotPurchasable = errors.New("product cannot be purchased")
+)
+
+// a schedule with the phase running at a time and the one after it
+type Status struct {
+	Schedule
+	// empty when no phase is running
+	Current string `json:"current"`
+	Next string `json:"next"`
+}
+
+type ServiceImpl struct {
+	schedule *Schedule
+}
+
+// creates a new ServiceImpl, a nil schedule only enforces product listing and availability dates
+func New(schedule *Schedule) *ServiceImpl {
+	return &ServiceImpl{
+		schedule: schedule,
+	}
+}
+
+// creates a new ServiceImpl with the schedule in sales.phases-path, if set
+func NewFromConfig(cfg *config.Config) (*ServiceImpl, error) {
+	if cfg.Sales.PhasesPath == "" {
+		return New(nil), nil
+	}
+	schedule, err := LoadSchedule(cfg.Sales.PhasesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, phase := range schedule.Phases {
+		end := "until further notice"
+		if phase.End != nil {
+			end = fmt.Sprintf("until %s", phase.End.Format(time.RFC3339))
+		}
+		fmt.Printf("Scheduled sale phase %s from %s %s\n", phase.Name, phase.Start.Format(time.RFC3339), end)
+	}
+	return New(schedule), nil
+}
+
+func (s *ServiceImpl) GetSchedule() *Schedule {
+	return s.schedule
+}
+
+func (s *ServiceImpl) GetStatus(t time.Time) Status {
+	status := Status{}
+	if s.schedule == nil {
+		status.Phases = []Phase{}
+		return status
+	}
+
+	status.Schedule = *s.schedule
+	if phase := s.schedule.PhaseAt(t); phase != nil {
+		status.Current = phase.Name
+	}
+	if next := s.schedule.NextPhase(t); next != nil {
+		status.Next = next.Name
+	}
+	return status
+}
+
+func (s *ServiceImpl) CheckPurchasable(product novellia_database.Product, t time.Time) (*Phase, error) {
+	if s.schedule != nil && contains(s.schedule.NotDirectlyPurchasable, product.ProductID) {
+		return nil, fmt.Errorf("%w: %s can only be obtained from bundles", ErrNotPurchasable, product.ProductID)
+	}
+	if product.DateListed != nil && product.DateListed.After(t) {
+		return nil, fmt.Errorf("%w: %s is not listed until %s", ErrNotPurchasable, product.ProductID, product.DateListed.Format(time.RFC3339))
+	}
+	if product.DateAvailable != nil && product.DateAvailable.After(t) {
+		return nil, fmt.Errorf("%w: %s is not available until %s", ErrNotPurchasable, product.ProductID, product.DateAvailable.Format(time.RFC3339))
+	}
+	if s.schedule == nil || len(s.schedule.Phases) == 0 {
+		return nil, nil
+	}
+
+	phase := s.schedule.PhaseAt(t)
+	if phase == nil {
+		next := s.schedule.NextPhase(t)
+		if next != nil {
+			return nil, fmt.Errorf("%w: no sale is running, %s starts at %s", ErrNotPurchasable, next.Name, next.Start.Format(time.RFC3339))
+		}
+		return nil, fmt.Errorf("%w: no sale is running", ErrNotPurchasable)
+	}
+	if !phase.Sells(product.ProductID) {
+		return nil, fmt.Errorf("%w: %s is not sold during %s", ErrNotPurchasable, product.ProductID, phase.Name)
+	}
+	return phase, nil
+}
+
+func (s *ServiceImpl) Price(product novellia_database.Product, phase *Phase) float64 {
+	if phase != nil {
+		if price, ok := phase.Prices[product.ProductID]; ok {
+			return price
+		}
+	}
+	return product.PriceUnitAmount
+}
+
+func (s *ServiceImpl) PhaseAt(t time.Time) *Phase {
+	return s.schedule.PhaseAt(t)
+}
+
+func (s *ServiceImpl) PurchaseLimits(phase *Phase) []PurchaseLimit {
+	return s.schedule.PurchaseLimits(phase)
+}
@@ -0,0 +1,174 @@
+package phases_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+)
+
+const (
+	phasesPath = "../../config/sale_phases.yaml"
+	boosterProductID = "PROD-01F4NAF8MANXDT26MGA5E0QXNJ"
+	starterDeckProductID = "PROD-01F4NAFJCAG5JDEGMR0XQARBW2"
+	rareProductID = "PROD-01F4MK4ZCVTKAAZF1QZAPWMPFP"
+	cardProductID = "PROD-01F4MK45QJS4WZ1VBZW1A1THD7"
+)
+
+func TestLoadSchedule(t *testing.T) {
+	schedule, err := phases.LoadSchedule(phasesPath)
+	if err != nil {
+		t.Fatalf("failed to load sale phases: %v", err)
+	}
+	if len(schedule.Phases) != 2 || schedule.Phases[0].Name != "pre-order" {
+		t.Fatalf("unexpected phases %+v", schedule.Phases)
+	}
+	// 9am in Los Angeles is 4pm UTC in daylight saving time
+	expectedStart := time.Date(2021, 5, 22, 16, 0, 0, 0, time.UTC)
+	if !schedule.Phases[0].Start.Equal(expectedStart) {
+		t.Errorf("expected pre-order to start at %s, got %s", expectedStart, schedule.Phases[0].Start)
+	}
+	if schedule.Phases[1].End != nil {
+		t.Errorf("expected general sale to run until further notice, got %s", schedule.Phases[1].End)
+	}
+
+	invalid := map[string]phases.Schedule{
+		"unknown time zone": phases.Schedule{
+			TimeZone: "Mars/Olympus_Mons",
+			Phases: []phases.Phase{phases.Phase{Name: "a", StartTime: "2021-05-22T09:00:00"}},
+		},
+		"end before start": phases.Schedule{
+			Phases: []phases.Phase{phases.Phase{Name: "a", StartTime: "2021-05-22T09:00:00", EndTime: "2021-05-22T08:00:00"}},
+		},
+		"overlap": phases.Schedule{
+			Phases: []phases.Phase{
+				phases.Phase{Name: "a", StartTime: "2021-05-22T09:00:00", EndTime: "2021-05-22T14:00:00"},
+				phases.Phase{Name: "b", StartTime: "2021-05-22T13:00:00"},
+			},
+		},
+		"phase without end before another": phases.Schedule{
+			Phases: []phases.Phase{
+				phases.Phase{Name: "a", StartTime: "2021-05-22T09:00:00"},
+				phases.Phase{Name: "b", StartTime: "2021-05-23T09:00:00"},
+			},
+		},
+		"negative price": phases.Schedule{
+			Phases: []phases.Phase{phases.Phase{Name: "a", StartTime: "2021-05-22T09:00:00", Prices: map[string]float64{boosterProductID: -1}}},
+		},
+	}
+	for name, schedule := range invalid {
+		err := schedule.Validate()
+		if err == nil {
+			t.Errorf("expected %s to be invalid", name)
+		}
+	}
+}
+
+func TestCheckPurchasable(t *testing.T) {
+	schedule, err := phases.LoadSchedule(phasesPath)
+	if err != nil {
+		t.Fatalf("failed to load sale phases: %v", err)
+	}
+	schedule.Phases[0].Prices = map[string]float64{boosterProductID: 2.5}
+	s := phases.New(schedule)
+
+	booster := novellia_database.Product{ProductID: boosterProductID, PriceUnitAmount: 3}
+	card := novellia_database.Product{ProductID: cardProductID, PriceUnitAmount: 1}
+	rare := novellia_database.Product{ProductID: rareProductID, PriceUnitAmount: 1}
+	beforeSale := time.Date(2021, 5, 22, 15, 59, 0, 0, time.UTC)
+	preOrder := time.Date(2021, 5, 22, 16, 0, 0, 0, time.UTC)
+	general := time.Date(2021, 5, 22, 21, 0, 0, 0, time.UTC)
+
+	_, err = s.CheckPurchasable(booster, beforeSale)
+	if !errors.Is(err, phases.ErrNotPurchasable) {
+		t.Errorf("expected nothing to be sold before the first phase, got %v", err)
+	}
+	status := s.GetStatus(beforeSale)
+	if status.Current != "" || status.Next != "pre-order" {
+		t.Errorf("unexpected status before the sale %+v", status)
+	}
+
+	phase, err := s.CheckPurchasable(booster, preOrder)
+	if err != nil || phase == nil || phase.Name != "pre-order" {
+		t.Fatalf("expected booster to be sold in pre-order, got %v: %v", phase, err)
+	}
+	if price := s.Price(booster, phase); price != 2.5 {
+		t.Errorf("expected pre-order price of 2.5, got %f", price)
+	}
+	_, err = s.CheckPurchasable(card, preOrder)
+	if !errors.Is(err, phases.ErrNotPurchasable) {
+		t.Errorf("expected card not to be sold in pre-order, got %v", err)
+	}
+
+	phase, err = s.CheckPurchasable(card, general)
+	if err != nil || phase.Name != "general" {
+		t.Errorf("expected card to be sold in general sale, got %v: %v", phase, err)
+	}
+	if price := s.Price(booster, phase); price != 3 {
+		t.Errorf("expected listed price of 3 in general sale, got %f", price)
+	}
+	_, err = s.CheckPurchasable(rare, general)
+	if !errors.Is(err, phases.ErrNotPurchasable) {
+		t.Errorf("expected rare not to be directly purchasable, got %v", err)
+	}
+
+	// listing and availability dates hold without a schedule
+	unscheduled := phases.New(nil)
+	later := general.Add(time.Hour)
+	card.DateAvailable = &later
+	_, err = unscheduled.CheckPurchasable(card, general)
+	if !errors.Is(err, phases.ErrNotPurchasable) {
+		t.Errorf("expected card not to be available yet, got %v", err)
+	}
+	phase, err = unscheduled.CheckPurchasable(card, later)
+	if err != nil || phase != nil {
+		t.Errorf("expected card to be available without a phase, got %v: %v", phase, err)
+	}
+}
+
+func TestPurchaseLimits(t *testing.T) {
+	schedule, err := phases.LoadSchedule(phasesPath)
+	if err != nil {
+		t.Fatalf("failed to load sale phases: %v", err)
+	}
+	s := phases.New(schedule)
+
+	limits := s.PurchaseLimits(&schedule.Phases[0])
+	if len(limits) != 2 {
+		t.Fatalf("expected a starter deck and a pre-order limit, got %+v", limits)
+	}
+	for _, limit := range limits {
+		switch limit.ProductID {
+		case starterDeckProductID:
+			if limit.Phase != "" || limit.Start != nil || limit.MaxUnits != 4 {
+				t.Errorf("unexpected starter deck limit %+v", limit)
+			}
+		case "":
+			if limit.Phase != "pre-order" || !limit.Start.Equal(schedule.Phases[0].Start) || !limit.End.Equal(*schedule.Phases[0].End) || limit.MaxUnits != 10 {
+				t.Errorf("unexpected pre-order limit %+v", limit)
+			}
+		default:
+			t.Errorf("unexpected limit %+v", limit)
+		}
+	}
+
+	if limits := s.PurchaseLimits(&schedule.Phases[1]); len(limits) != 1 {
+		t.Errorf("expected only the starter deck limit in general sale, got %+v", limits)
+	}
+	if limits := phases.New(nil).PurchaseLimits(nil); len(limits) != 0 {
+		t.Errorf("expected no limits without a schedule, got %+v", limits)
+	}
+
+	invalid := phases.Schedule{
+		Phases: []phases.Phase{phases.Phase{
+			Name: "a",
+			StartTime: "2021-05-22T09:00:00",
+			CustomerLimits: &phases.CustomerLimits{Products: map[string]int64{boosterProductID: 0}},
+		}},
+	}
+	if invalid.Validate() == nil {
+		t.Errorf("expected a product limit of 0 to be invalid")
+	}
+}
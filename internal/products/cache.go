@@ -0,0 +1,116 @@
+package products
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
+)
+
+const (
+	defaultCacheTTL = 5 * time.Minute
+	listenRetryDelay = 5 * time.Second
+)
+
+// the parts of novellia_database.Service used to read products
+type Store interface {
+	QueryProducts(ctx context.Context) ([]novellia_database.Product, error)
+	ListenProductChanges(ctx context.Context, handler func(payload string)) error
+}
+
+// the state of the product cache
+type CacheStatus struct {
+	Products int `json:"products"`
+	LoadedAt *time.Time `json:"loaded_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// returns cached products, loading them when the cache has expired or been invalidated
+// products are loaded under the mutex so that concurrent misses share one query
+// the map returned is never modified, a refresh replaces it
+func (s *ServiceImpl) GetProducts(ctx context.Context) (map[string]novellia_database.Product, error) {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+
+	if s.products != nil && time.Now().Before(s.expiresAt) {
+		prometheus_monitoring.TickProductCacheHit()
+		return s.products, nil
+	}
+	prometheus_monitoring.TickProductCacheMiss()
+
+	products, err := s.store.QueryProducts(ctx)
+	if err != nil {
+		prometheus_monitoring.TickProductCacheRefreshFailed()
+		// products loaded before are better than failing every order while the database is unreachable
+		if s.products != nil {
+			fmt.Printf("Failed to refresh products, serving cached products loaded at %s: %+v\n", s.loadedAt.Format(time.RFC3339), err)
+			return s.products, nil
+		}
+		return nil, err
+	}
+
+	m := make(map[string]novellia_database.Product)
+	for _, v := range products {
+		m[v.ProductID] = v
+	}
+	s.products = m
+	s.loadedAt = time.Now()
+	s.expiresAt = s.loadedAt.Add(s.cacheTTL)
+	prometheus_monitoring.TickProductCacheRefresh()
+
+	return s.products, nil
+}
+
+// expires the product cache, cached products are kept to be served if the next load fails
+// a load in progress finishes first, so products it read before a change are not served afterwards
+func (s *ServiceImpl) InvalidateProducts() {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+
+	s.expiresAt = time.Time{}
+}
+
+func (s *ServiceImpl) GetCacheStatus() CacheStatus {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+
+	status := CacheStatus{
+		Products: len(s.products),
+	}
+	if s.products != nil {
+		loadedAt := s.loadedAt
+		status.LoadedAt = &loadedAt
+		expiresAt := s.expiresAt
+		status.ExpiresAt = &expiresAt
+	}
+	return status
+}
+
+func (s *ServiceImpl) handleProductChange(payload string) {
+	fmt.Printf("Product table changed (%s), invalidating product cache\n", payload)
+	s.InvalidateProducts()
+}
+
+// invalidates the product cache whenever novellia.product changes, through Postgres LISTEN/NOTIFY
+func (s *ServiceImpl) WatchProductChanges(ctx context.Context) {
+	if s.store == nil {
+		return
+	}
+
+	go func() {
+		for {
+			// changes made while the listener was down were not notified
+			s.InvalidateProducts()
+			prometheus_monitoring.SetProductChangesListenerStatus(1)
+			err := s.store.ListenProductChanges(ctx, s.handleProductChange)
+			prometheus_monitoring.SetProductChangesListenerStatus(0)
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("Listen error (product changes), reconnecting: %+v\n", err)
+			time.Sleep(listenRetryDelay)
+		}
+	}()
+}
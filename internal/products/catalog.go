@@ -0,0 +1,247 @@
+package products
+
+import (
+	"fmt"
+	"os"
+	"encoding/hex"
+	"encoding/json"
+	"crypto/sha256"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// how a bundle slot is filled when the bundle is unpacked
+const (
+	// every product in products and in each of pools
+	SLOT_FIXED = "fixed"
+	// count draws, each from a pool picked by weight and then a uniformly random product in it
+	SLOT_WEIGHTED = "weighted"
+	// count uniformly random products from pool
+	SLOT_GUARANTEED = "guaranteed"
+)
+
+// what a random draw does when one of its pools has no products in stock
+const (
+	// draw from the slot's other pools, renormalizing their weights
+	OUT_OF_STOCK_REDISTRIBUTE = "redistribute"
+	// fail the unpack, and with it the order
+	OUT_OF_STOCK_FAIL = "fail"
+)
+
+// a pool picked with probability weight / sum of the slot's weights
+type PoolWeight struct {
+	Pool string `yaml:"pool" json:"pool"`
+	Weight int `yaml:"weight" json:"weight"`
+}
+
+type BundleSlot struct {
+	Type string `yaml:"type" json:"type"`
+	// fixed slots
+	Products []string `yaml:"products" json:"products"`
+	Pools []string `yaml:"pools" json:"pools"`
+	// weighted and guaranteed slots, defaults to 1
+	Count int `yaml:"count" json:"count"`
+	// weighted slots
+	Weights []PoolWeight `yaml:"weights" json:"weights"`
+	// guaranteed slots, e.g. the set's rares
+	Pool string `yaml:"pool" json:"pool"`
+	// overrides the catalog's out-of-stock policy
+	OutOfStock string `yaml:"out-of-stock" json:"out_of_stock,omitempty"`
+}
+
+// a product that is unpacked into other products when ordered
+type Bundle struct {
+	ProductID string `yaml:"product-id" json:"product_id"`
+	Name string `yaml:"name" json:"name"`
+	// number of products the bundle unpacks into, checked when the catalog is loaded
+	Size int `yaml:"size" json:"size"`
+	Slots []BundleSlot `yaml:"slots" json:"slots"`
+}
+
+// bundle definitions, so that new sets only need a catalog change
+type Catalog struct {
+	// named lists of product IDs, e.g. a set's rarity tiers
+	Pools map[string][]string `yaml:"pools" json:"pools"`
+	Bundles []Bundle `yaml:"bundles" json:"bundles"`
+	// one of OUT_OF_STOCK_*, defaults to OUT_OF_STOCK_REDISTRIBUTE
+	OutOfStock string `yaml:"out-of-stock" json:"out_of_stock,omitempty"`
+}
+
+// loads and validates a catalog YAML
+func LoadCatalog(path string) (*Catalog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var catalog Catalog
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&catalog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse catalog %s: %v", path, err)
+	}
+
+	err = catalog.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &catalog, nil
+}
+
+// hex SHA-256 of the catalog's JSON, committed with each sale's seed so that pulls are checked against the catalog they were drawn from
+func (c *Catalog) Hash() string {
+	if c == nil {
+		return ""
+	}
+	// maps are encoded with sorted keys, so the same catalog always has the same hash
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// checks that slots are well formed, only use pools that exist and add up to each bundle's size
+func (c *Catalog) Validate() error {
+	if !validOutOfStock(c.OutOfStock) {
+		return fmt.Errorf("catalog has unknown out-of-stock policy %q", c.OutOfStock)
+	}
+	for name, pool := range c.Pools {
+		if len(pool) == 0 {
+			return fmt.Errorf("catalog pool %s is empty", name)
+		}
+	}
+
+	bundles := map[string]bool{}
+	for _, b := range c.Bundles {
+		if b.ProductID == "" {
+			return fmt.Errorf("catalog bundle %s has no product-id", b.Name)
+		}
+		if bundles[b.ProductID] {
+			return fmt.Errorf("duplicate catalog bundle %s", b.ProductID)
+		}
+		bundles[b.ProductID] = true
+
+		size := 0
+		for i, slot := range b.Slots {
+			if !validOutOfStock(slot.OutOfStock) {
+				return fmt.Errorf("catalog bundle %s slot %d has unknown out-of-stock policy %q", b.ProductID, i, slot.OutOfStock)
+			}
+			n, err := c.slotSize(slot)
+			if err != nil {
+				return fmt.Errorf("catalog bundle %s slot %d: %v", b.ProductID, i, err)
+			}
+			size += n
+		}
+		if size == 0 {
+			return fmt.Errorf("catalog bundle %s unpacks into nothing", b.ProductID)
+		}
+		if b.Size != 0 && size != b.Size {
+			return fmt.Errorf("catalog bundle %s must have %d products, slots add up to %d", b.ProductID, b.Size, size)
+		}
+	}
+	return nil
+}
+
+func validOutOfStock(policy string) bool {
+	return policy == "" || policy == OUT_OF_STOCK_REDISTRIBUTE || policy == OUT_OF_STOCK_FAIL
+}
+
+// the out-of-stock policy of a slot
+func (c *Catalog) OutOfStockPolicy(slot BundleSlot) string {
+	if slot.OutOfStock != "" {
+		return slot.OutOfStock
+	}
+	if c.OutOfStock != "" {
+		return c.OutOfStock
+	}
+	return OUT_OF_STOCK_REDISTRIBUTE
+}
+
+// number of products a slot unpacks into
+func (c *Catalog) slotSize(slot BundleSlot) (int, error) {
+	count := slot.Count
+	if count == 0 {
+		count = 1
+	}
+	if count < 0 {
+		return 0, fmt.Errorf("count must be positive")
+	}
+
+	switch slot.Type {
+	case SLOT_FIXED:
+		size := len(slot.Products)
+		for _, name := range slot.Pools {
+			if _, ok := c.Pools[name]; !ok {
+				return 0, fmt.Errorf("unknown pool %s", name)
+			}
+			size += len(c.Pools[name])
+		}
+		return size, nil
+	case SLOT_WEIGHTED:
+		if len(slot.Weights) == 0 {
+			return 0, fmt.Errorf("weighted slots need weights")
+		}
+		for _, w := range slot.Weights {
+			if _, ok := c.Pools[w.Pool]; !ok {
+				return 0, fmt.Errorf("unknown pool %s", w.Pool)
+			}
+			if w.Weight <= 0 {
+				return 0, fmt.Errorf("weight of pool %s must be positive", w.Pool)
+			}
+		}
+		return count, nil
+	case SLOT_GUARANTEED:
+		if _, ok := c.Pools[slot.Pool]; !ok {
+			return 0, fmt.Errorf("unknown pool %s", slot.Pool)
+		}
+		return count, nil
+	default:
+		return 0, fmt.Errorf("unknown slot type %q", slot.Type)
+	}
+}
+
+// gets the bundle for a product, nil if the product is not a bundle or there is no catalog
+func (c *Catalog) Bundle(productID string) *Bundle {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Bundles {
+		if c.Bundles[i].ProductID == productID {
+			return &c.Bundles[i]
+		}
+	}
+	return nil
+}
+
+// products a product can unpack into and how many it unpacks into, a product that is not a bundle unpacks into itself
+func (c *Catalog) Contents(productID string) ([]string, int) {
+	bundle := c.Bundle(productID)
+	if bundle == nil {
+		return []string{productID}, 1
+	}
+
+	contents := []string{}
+	size := 0
+	for _, slot := range bundle.Slots {
+		n, _ := c.slotSize(slot)
+		size += n
+		switch slot.Type {
+		case SLOT_FIXED:
+			contents = append(contents, slot.Products...)
+			for _, name := range slot.Pools {
+				contents = append(contents, c.Pools[name]...)
+			}
+		case SLOT_WEIGHTED:
+			for _, w := range slot.Weights {
+				contents = append(contents, c.Pools[w.Pool]...)
+			}
+		case SLOT_GUARANTEED:
+			contents = append(contents, c.Pools[slot.Pool]...)
+		}
+	}
+	return contents, size
+}
@@ -6,7 +6,32 @@ import (
 )
 
 type Service interface {
+	// products are cached until the cache expires or is invalidated
 	GetProducts(ctx context.Context) (map[string]novellia_database.Product, error)
-	// converts a product ID representing a bundle into a list of atomic product IDs
-	UnpackBundleProduct(productID string) ([]string, error)
+	InvalidateProducts()
+	GetCacheStatus() CacheStatus
+	// converts a product ID representing a bundle into a list of atomic product IDs, drawing from r or a shared source if it is nil
+	// random draws skip products with no stock left and a unit of each product unpacked is taken from stock, a nil stock is not checked
+	// returns the odds each random draw was made with
+	UnpackBundleProduct(productID string, r Rand, stock Stock) ([]string, []novellia_database.DrawOdds, error)
+	// unpacks a bundle again with the odds recorded when it was unpacked, which must be allowed by the catalog
+	// bundles recorded without odds are unpacked with the catalog's, returns whether the recorded odds left out any of the catalog's products
+	ReplayBundleProduct(productID string, r Rand, odds []novellia_database.DrawOdds) ([]string, bool, error)
+	GetCatalog() *Catalog
+	// the odds of the next draw of each random slot of a bundle with stock, nil for products that are not bundles
+	BundleOdds(productID string, stock Stock) ([]novellia_database.DrawOdds, error)
+}
+
+// a source of uniformly random ints in [0, n), e.g. *rand.Rand or fairness.Rand
+type Rand interface {
+	Intn(n int) int
+}
+
+// units left of each product, products that are not listed have none
+type Stock map[string]int64
+
+func (s Stock) take(productID string) {
+	if s != nil {
+		s[productID] -= 1
+	}
 }
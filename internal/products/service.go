@@ -1,137 +1,332 @@
 package products
 
 import (
-	"context"
 	"math/rand"
 	"time"
 	"fmt"
+	"sync"
+	"errors"
 
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
 )
 
-const (
-	RARE = "RARE"
-	KINDA_RARE = "KINDA_RARE"
-	NOT_THAT_RARE = "NOT_THAT_RARE"
+var (
+	ErrOutOfStock = errors.New("bundle draw is out of stock")
 )
 
-func OccultaNovelliaRare() []string {
-	return []string{
-		"PROD-01F4MK4ZCVTKAAZF1QZAPWMPFP",
-		"PROD-01F4MK4ZNC8FMVR2ANHDW9E1N4",
-		"PROD-01F4MK4ZYC6P9EGG4W0DNFQTWS",
-	}
+// a math/rand source that is safe to share between goroutines
+type lockedRand struct {
+	mutex sync.Mutex
+	r *rand.Rand
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.r.Intn(n)
+}
+
+type ServiceImpl struct {
+	store Store
+	catalog *Catalog
+	// used when unpacking without a reproducible source, e.g. for quotes
+	rand *lockedRand
+	cacheTTL time.Duration
+	cacheMutex sync.Mutex
+	products map[string]novellia_database.Product
+	loadedAt time.Time
+	expiresAt time.Time
 }
 
-func OccultaNovelliaKindaRare() []string {
-	return []string{
-		"PROD-01F4MK45QJS4WZ1VBZW1A1THD7",
-		"PROD-01F4MK4NTCXGVA35CAD7TCHEM8",
-		"PROD-01F4MK4P5SMNGKBF5B7AKN35YD",
-		"PROD-01F4MK4PF52A72Y7P77TEPA2CW",
-		"PROD-01F4MK4PRD20D3Z95T84ZYA0SX",
+// creates a new ServiceImpl, bundles are unpacked as defined in catalog and products are cached for cacheTTL
+func New(store Store, catalog *Catalog, cacheTTL time.Duration) *ServiceImpl {
+	if cacheTTL <= 0 {
+		cacheTTL = defaultCacheTTL
+	}
+
+	return &ServiceImpl {
+		store: store,
+		catalog: catalog,
+		rand: &lockedRand{
+			r: rand.New(rand.NewSource(time.Now().UnixNano())),
+		},
+		cacheTTL: cacheTTL,
 	}
 }
 
-func OccultaNovelliaNotThatRare() []string {
-	return []string{
-		"PROD-01F4MK4XRGJV2NR9XNQY9GCPGQ",
-		"PROD-01F4MK4Y26J6A66YQ1PXH8NXMC",
-		"PROD-01F4MK4YAR07BTRSQFHDWNXC55",
-		"PROD-01F4MK4YKAJ0REHHDY63TTTEWM",
-		"PROD-01F4MK4YVW4JSV717E0XK920AZ",
-		"PROD-01F4MK4Z489EBKGGFXA2HKZ1MA",
+// creates a new ServiceImpl with the catalog in products.catalog-path, caching products for products.cache-ttl-seconds
+func NewFromConfig(cfg *config.Config, store Store) (*ServiceImpl, error) {
+	if cfg.Products.CatalogPath == "" {
+		return nil, fmt.Errorf("products.catalog-path must be set")
 	}
+	catalog, err := LoadCatalog(cfg.Products.CatalogPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(store, catalog, time.Duration(cfg.Products.CacheTTLSeconds) * time.Second), nil
 }
 
-type ServiceImpl struct {
-	novelliaDatabaseService novellia_database.Service
-	products map[string]novellia_database.Product
-	randSource rand.Source
+func (s *ServiceImpl) GetCatalog() *Catalog {
+	return s.catalog
 }
 
-// creates a new ServiceImpl
-func New(novelliaDatabaseService novellia_database.Service) *ServiceImpl {
-	randSource := rand.NewSource(time.Now().Unix())
+// picks the odds of the next random draw of a slot
+type oddsFunc func(slotIndex int, slot BundleSlot) (novellia_database.DrawOdds, error)
 
-	return &ServiceImpl {
-		novelliaDatabaseService: novelliaDatabaseService,
-		randSource: randSource,
+// the odds of a random draw of a slot with every product in stock
+func (s *ServiceImpl) catalogOdds(slotIndex int, slot BundleSlot) novellia_database.DrawOdds {
+	odds := novellia_database.DrawOdds{
+		Slot: slotIndex,
+		Pools: []novellia_database.PoolOdds{},
+	}
+	if slot.Type == SLOT_GUARANTEED {
+		odds.Pools = append(odds.Pools, novellia_database.PoolOdds{
+			Pool: slot.Pool,
+			Weight: 1,
+			Products: s.catalog.Pools[slot.Pool],
+		})
+		return odds
 	}
+	for _, w := range slot.Weights {
+		odds.Pools = append(odds.Pools, novellia_database.PoolOdds{
+			Pool: w.Pool,
+			Weight: w.Weight,
+			Products: s.catalog.Pools[w.Pool],
+		})
+	}
+	return odds
 }
 
-func (s *ServiceImpl) GetProducts(ctx context.Context) (map[string]novellia_database.Product, error) {
-	// fetch and cache products
-	if len(s.products) == 0 {
-		products, err := s.novelliaDatabaseService.QueryProducts(ctx)
-		if err != nil {
-			return nil, err
+// the catalog's odds without products that have no stock left, pools left empty are handled by the slot's out-of-stock policy
+func (s *ServiceImpl) stockOdds(stock Stock) oddsFunc {
+	return func(slotIndex int, slot BundleSlot) (novellia_database.DrawOdds, error) {
+		odds := s.catalogOdds(slotIndex, slot)
+		if stock == nil {
+			return odds, nil
 		}
 
-		m := make(map[string]novellia_database.Product)
-		for _, v := range products {
-			m[v.ProductID] = v
+		pools := []novellia_database.PoolOdds{}
+		for _, pool := range odds.Pools {
+			inStock := []string{}
+			for _, productID := range pool.Products {
+				if stock[productID] > 0 {
+					inStock = append(inStock, productID)
+				}
+			}
+			if len(inStock) == 0 {
+				if s.catalog.OutOfStockPolicy(slot) == OUT_OF_STOCK_FAIL {
+					return odds, fmt.Errorf("%w: pool %s", ErrOutOfStock, pool.Pool)
+				}
+				continue
+			}
+			pool.Products = inStock
+			pools = append(pools, pool)
 		}
-		s.products = m
+		if len(pools) == 0 {
+			return odds, fmt.Errorf("%w: every pool of slot %d", ErrOutOfStock, slotIndex)
+		}
+		odds.Pools = pools
+		return odds, nil
 	}
+}
 
-	return s.products, nil
+// the recorded odds in order, each checked against the catalog, setting reduced if any leave out products of the catalog
+func (s *ServiceImpl) recordedOdds(recorded []novellia_database.DrawOdds, reduced *bool) oddsFunc {
+	next := 0
+	return func(slotIndex int, slot BundleSlot) (novellia_database.DrawOdds, error) {
+		if next >= len(recorded) {
+			return novellia_database.DrawOdds{}, fmt.Errorf("fewer odds recorded than draws")
+		}
+		odds := recorded[next]
+		next += 1
+		if odds.Slot != slotIndex || len(odds.Pools) == 0 {
+			return odds, fmt.Errorf("odds recorded for slot %d do not match slot %d", odds.Slot, slotIndex)
+		}
+
+		catalogPools := s.catalogOdds(slotIndex, slot).Pools
+		allowed := map[string]novellia_database.PoolOdds{}
+		for _, pool := range catalogPools {
+			allowed[pool.Pool] = pool
+		}
+		if len(odds.Pools) < len(catalogPools) {
+			*reduced = true
+		}
+		for _, pool := range odds.Pools {
+			catalogPool, ok := allowed[pool.Pool]
+			if !ok || pool.Weight != catalogPool.Weight || len(pool.Products) == 0 {
+				return odds, fmt.Errorf("odds recorded for pool %s are not in the catalog", pool.Pool)
+			}
+			for _, productID := range pool.Products {
+				if !contains(catalogPool.Products, productID) {
+					return odds, fmt.Errorf("odds recorded for pool %s include %s, which is not in it", pool.Pool, productID)
+				}
+			}
+			if len(pool.Products) < len(catalogPool.Products) {
+				*reduced = true
+			}
+		}
+		return odds, nil
+	}
 }
 
-func (s *ServiceImpl) GetBoosterCard() string {
-	r := rand.New(s.randSource)
+func contains(productIDs []string, productID string) bool {
+	for _, id := range productIDs {
+		if id == productID {
+			return true
+		}
+	}
+	return false
+}
 
-	var t string
-	p := r.Intn(100)
-	if p < 1 { // 0 / [0,99]
-		t = RARE
-	} else if p < 25 { // 1-24 / [0,99]
-		t = KINDA_RARE
-	} else { // 25-99 / [0,99]
-		t = NOT_THAT_RARE
+// draws a product with odds, weighted slots pick the pool by weight first and every slot then picks a product uniformly
+func drawOdds(slotType string, odds novellia_database.DrawOdds, r Rand) (string, error) {
+	if len(odds.Pools) == 0 {
+		return "", fmt.Errorf("draw has no pools")
 	}
 
-	switch t {
-	case RARE:
-		cardIndex := r.Intn(len(OccultaNovelliaRare()))
-		return OccultaNovelliaRare()[cardIndex]
-	case KINDA_RARE:
-		cardIndex := r.Intn(len(OccultaNovelliaKindaRare()))
-		return OccultaNovelliaKindaRare()[cardIndex]
-	default: // NOT_THAT_RARE
-		cardIndex := r.Intn(len(OccultaNovelliaNotThatRare()))
-		return OccultaNovelliaNotThatRare()[cardIndex]
+	pool := odds.Pools[0]
+	if slotType == SLOT_WEIGHTED {
+		total := 0
+		for _, p := range odds.Pools {
+			total += p.Weight
+		}
+		if total <= 0 {
+			return "", fmt.Errorf("weighted slot has no weights")
+		}
+
+		n := r.Intn(total)
+		for _, p := range odds.Pools {
+			if n < p.Weight {
+				pool = p
+				break
+			}
+			n -= p.Weight
+		}
 	}
+	if len(pool.Products) == 0 {
+		return "", fmt.Errorf("pool %s has no products", pool.Pool)
+	}
+	return pool.Products[r.Intn(len(pool.Products))], nil
 }
 
-// converts a product ID representing a bundle into a list of atomic product IDs
-func (s *ServiceImpl) UnpackBundleProduct(productID string) ([]string, error) {
-	// initialize local pseudorandom generator 
-	r := rand.New(s.randSource)
+// draws one product from a weighted slot with every product in stock, picking the pool and then the product in it from r
+func (s *ServiceImpl) DrawWeighted(slot BundleSlot, r Rand) (string, error) {
+	if r == nil {
+		r = s.rand
+	}
+	return drawOdds(SLOT_WEIGHTED, s.catalogOdds(0, slot), r)
+}
 
+// slots are filled in catalog order, so the same draws from r with the same odds always unpack the same products
+func (s *ServiceImpl) unpack(bundle *Bundle, r Rand, nextOdds oddsFunc, stock Stock) ([]string, []novellia_database.DrawOdds, error) {
 	unpackedProducts := []string{}
-	switch productID {
-	// Starter Deck
-	case "PROD-01F4NAFJCAG5JDEGMR0XQARBW2":
-		rareIndex := r.Intn(len(OccultaNovelliaRare()))
-		unpackedProducts = append(unpackedProducts, OccultaNovelliaRare()[rareIndex])
-		unpackedProducts = append(unpackedProducts, OccultaNovelliaKindaRare()...)
-		unpackedProducts = append(unpackedProducts, OccultaNovelliaNotThatRare()...)
-		if len(unpackedProducts) != 12 {
-			return nil, fmt.Errorf("starter deck must have 12 cards, got %+v", unpackedProducts)
-		}
-		return unpackedProducts, nil
-	// Booster Pack
-	case "PROD-01F4NAF8MANXDT26MGA5E0QXNJ":
-		for i := 0; i < 3; i++ {
-			t := s.GetBoosterCard()
-			unpackedProducts = append(unpackedProducts, t)
-		}
-		if len(unpackedProducts) != 3 {
-			return nil, fmt.Errorf("booster pack must have 3 cards, got %+v", unpackedProducts)
-		}
-		return unpackedProducts, nil
-	default:
-		return []string{productID}, nil
+	drawn := []novellia_database.DrawOdds{}
+	for i, slot := range bundle.Slots {
+		count := slot.Count
+		if count == 0 {
+			count = 1
+		}
+
+		switch slot.Type {
+		case SLOT_FIXED:
+			products := append([]string{}, slot.Products...)
+			for _, name := range slot.Pools {
+				products = append(products, s.catalog.Pools[name]...)
+			}
+			for _, productID := range products {
+				stock.take(productID)
+			}
+			unpackedProducts = append(unpackedProducts, products...)
+		case SLOT_WEIGHTED, SLOT_GUARANTEED:
+			for j := 0; j < count; j++ {
+				odds, err := nextOdds(i, slot)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s: %w", bundle.Name, err)
+				}
+				productID, err := drawOdds(slot.Type, odds, r)
+				if err != nil {
+					return nil, nil, err
+				}
+				odds.ProductID = productID
+				stock.take(productID)
+				unpackedProducts = append(unpackedProducts, productID)
+				drawn = append(drawn, odds)
+			}
+		default:
+			return nil, nil, fmt.Errorf("%s has unknown slot type %q", bundle.Name, slot.Type)
+		}
+	}
+
+	if bundle.Size != 0 && len(unpackedProducts) != bundle.Size {
+		return nil, nil, fmt.Errorf("%s must have %d products, got %+v", bundle.Name, bundle.Size, unpackedProducts)
+	}
+	return unpackedProducts, drawn, nil
+}
+
+func (s *ServiceImpl) UnpackBundleProduct(productID string, r Rand, stock Stock) ([]string, []novellia_database.DrawOdds, error) {
+	bundle := s.catalog.Bundle(productID)
+	if bundle == nil {
+		stock.take(productID)
+		return []string{productID}, nil, nil
+	}
+	if r == nil {
+		r = s.rand
+	}
+
+	nextOdds := s.stockOdds(stock)
+	return s.unpack(bundle, r, func(slotIndex int, slot BundleSlot) (novellia_database.DrawOdds, error) {
+		odds, err := nextOdds(slotIndex, slot)
+		if errors.Is(err, ErrOutOfStock) || len(odds.Pools) < len(s.catalogOdds(slotIndex, slot).Pools) {
+			prometheus_monitoring.TickBundlePoolOutOfStock()
+		}
+		return odds, err
+	}, stock)
+}
+
+func (s *ServiceImpl) ReplayBundleProduct(productID string, r Rand, odds []novellia_database.DrawOdds) ([]string, bool, error) {
+	bundle := s.catalog.Bundle(productID)
+	if bundle == nil {
+		return []string{productID}, false, nil
+	}
+	if r == nil {
+		r = s.rand
+	}
+	if len(odds) == 0 {
+		unpacked, _, err := s.unpack(bundle, r, s.stockOdds(nil), nil)
+		return unpacked, false, err
+	}
+
+	reduced := false
+	unpacked, drawn, err := s.unpack(bundle, r, s.recordedOdds(odds, &reduced), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(drawn) != len(odds) {
+		return nil, false, fmt.Errorf("%s: more odds recorded than draws", bundle.Name)
+	}
+	return unpacked, reduced, nil
+}
+
+func (s *ServiceImpl) BundleOdds(productID string, stock Stock) ([]novellia_database.DrawOdds, error) {
+	bundle := s.catalog.Bundle(productID)
+	if bundle == nil {
+		return nil, nil
+	}
+
+	nextOdds := s.stockOdds(stock)
+	bundleOdds := []novellia_database.DrawOdds{}
+	for i, slot := range bundle.Slots {
+		if slot.Type == SLOT_FIXED {
+			continue
+		}
+		odds, err := nextOdds(i, slot)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", bundle.Name, err)
+		}
+		bundleOdds = append(bundleOdds, odds)
 	}
+	return bundleOdds, nil
 }
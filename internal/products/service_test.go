@@ -3,7 +3,14 @@ package products_test
 import (
 	"fmt"
 	"context"
+	"errors"
+	"math/rand"
 	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
@@ -11,16 +18,22 @@ import (
 
 const (
 	configPath = "/config/prod-live.yaml"
+	catalogPath = "../../config/catalog.yaml"
 )
 
-func setupTest(ctx context.Context) (novellia_database.Service, error) {
+func setupTest(ctx context.Context) (novellia_database.Service, *products.Catalog, error) {
 	err := config.LoadConfig(configPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	config, err := config.GetConfig()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	catalog, err := products.LoadCatalog(config.Products.CatalogPath)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	novelliaDatabaseService, err := novellia_database.New(
@@ -32,21 +45,21 @@ func setupTest(ctx context.Context) (novellia_database.Service, error) {
 		config.Postgres.QueriesPath,
 	)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return novelliaDatabaseService, nil
+	return novelliaDatabaseService, catalog, nil
 }
 
 func TestGetProducts(t *testing.T) {
 	ctx := context.Background()
 
-	novelliaDatabaseService, err := setupTest(ctx)
+	novelliaDatabaseService, catalog, err := setupTest(ctx)
 	if err != nil {
 		t.Errorf("failed to setup test: %+v", err)
 	}
 	defer novelliaDatabaseService.Close()
-	productsService := products.New(novelliaDatabaseService)
+	productsService := products.New(novelliaDatabaseService, catalog, 0)
 
 	products, err := productsService.GetProducts(ctx)
 	if err != nil {
@@ -67,18 +80,18 @@ func stringInSlice(a string, list []string) bool {
 func TestUnpackBundleProduct(t *testing.T) {
 	ctx := context.Background()
 
-	novelliaDatabaseService, err := setupTest(ctx)
+	novelliaDatabaseService, catalog, err := setupTest(ctx)
 	if err != nil {
 		t.Errorf("failed to setup test: %+v", err)
 	}
 	defer novelliaDatabaseService.Close()
-	productsService := products.New(novelliaDatabaseService)
+	productsService := products.New(novelliaDatabaseService, catalog, 0)
 
 	// test Starter Deck
 	randStarterRare := map[string]int{}
 	// iterate to test RNG
 	for i := 0; i < 1000; i++ {
-		unbundled, err := productsService.UnpackBundleProduct("PROD-01F4NAFJCAG5JDEGMR0XQARBW2")
+		unbundled, _, err := productsService.UnpackBundleProduct("PROD-01F4NAFJCAG5JDEGMR0XQARBW2", nil, nil)
 		if err != nil {
 			t.Errorf("failed to unbundle starter deck: %+v", err)
 		}
@@ -87,7 +100,7 @@ func TestUnpackBundleProduct(t *testing.T) {
 		}
 
 		// check that base 11 cards exist
-		baseStarterDeckCards := append(products.OccultaNovelliaNotThatRare(), products.OccultaNovelliaKindaRare()...)
+		baseStarterDeckCards := append(catalog.Pools["occulta-novellia-not-that-rare"], catalog.Pools["occulta-novellia-kinda-rare"]...)
 		for _, c := range baseStarterDeckCards {
 			if !stringInSlice(c, unbundled) {
 				t.Errorf("missing %s in unbundled starter deck: %+v", c, err)
@@ -95,7 +108,7 @@ func TestUnpackBundleProduct(t *testing.T) {
 		}
 
 		// tally distribution of rares
-		for _, r := range products.OccultaNovelliaRare() {
+		for _, r := range catalog.Pools["occulta-novellia-rare"] {
 			if stringInSlice(r, unbundled) {
 				randStarterRare[r] += 1
 				break
@@ -103,7 +116,7 @@ func TestUnpackBundleProduct(t *testing.T) {
 		}
 	}
 	// validate tally of rares
-	for _, r := range products.OccultaNovelliaRare() {
+	for _, r := range catalog.Pools["occulta-novellia-rare"] {
 		if randStarterRare[r] < 300 {
 			t.Errorf("low count of %s rare in unbundled starter deck", r)
 		}
@@ -111,11 +124,11 @@ func TestUnpackBundleProduct(t *testing.T) {
 	fmt.Printf("Starter rares distribution: %+v", randStarterRare)
 
 	// test Booster Pack
-	booster1, err := productsService.UnpackBundleProduct("PROD-01F4NAF8MANXDT26MGA5E0QXNJ")
+	booster1, _, err := productsService.UnpackBundleProduct("PROD-01F4NAF8MANXDT26MGA5E0QXNJ", nil, nil)
 	if err != nil {
 		t.Errorf("failed to unbundle booster pack 1: %+v", err)
 	}
-	booster2, err := productsService.UnpackBundleProduct("PROD-01F4NAF8MANXDT26MGA5E0QXNJ")
+	booster2, _, err := productsService.UnpackBundleProduct("PROD-01F4NAF8MANXDT26MGA5E0QXNJ", nil, nil)
 	if err != nil {
 		t.Errorf("failed to unbundle booster pack 2: %+v", err)
 	}
@@ -137,17 +150,25 @@ func TestUnpackBundleProduct(t *testing.T) {
 func TestGetBoosterCard(t *testing.T) {
 	ctx := context.Background()
 
-	novelliaDatabaseService, err := setupTest(ctx)
+	novelliaDatabaseService, catalog, err := setupTest(ctx)
 	if err != nil {
 		t.Errorf("failed to setup test: %+v", err)
 	}
 	defer novelliaDatabaseService.Close()
-	productsService := products.New(novelliaDatabaseService)
+	productsService := products.New(novelliaDatabaseService, catalog, 0)
+
+	booster := catalog.Bundle("PROD-01F4NAF8MANXDT26MGA5E0QXNJ")
+	if booster == nil {
+		t.Fatalf("booster pack missing from catalog")
+	}
 
 	randCards := map[string]int{}
 	cardIters := 1000000
 	for i := 0; i < cardIters; i++ {
-		c := productsService.GetBoosterCard()
+		c, err := productsService.DrawWeighted(booster.Slots[0], nil)
+		if err != nil {
+			t.Fatalf("failed to draw booster card: %+v", err)
+		}
 		randCards[c] += 1
 	}
 
@@ -157,8 +178,8 @@ func TestGetBoosterCard(t *testing.T) {
 	}
 
 	toleranceFactor := 0.05
-	for _, c := range products.OccultaNovelliaRare() {
-		target := float64(cardIters) * 0.01 / float64(len(products.OccultaNovelliaRare()))
+	for _, c := range catalog.Pools["occulta-novellia-rare"] {
+		target := float64(cardIters) * 0.01 / float64(len(catalog.Pools["occulta-novellia-rare"]))
 		v := float64(randCards[c])
 		lb := target * (1 - toleranceFactor)
 		ub := target * (1 + toleranceFactor)
@@ -167,8 +188,8 @@ func TestGetBoosterCard(t *testing.T) {
 			t.Errorf("Range: %f, %f", lb, ub)
 		}
 	}
-	for _, c := range products.OccultaNovelliaKindaRare() {
-		target := float64(cardIters) * 0.24 / float64(len(products.OccultaNovelliaKindaRare()))
+	for _, c := range catalog.Pools["occulta-novellia-kinda-rare"] {
+		target := float64(cardIters) * 0.24 / float64(len(catalog.Pools["occulta-novellia-kinda-rare"]))
 		v := float64(randCards[c])
 		lb := target * (1 - toleranceFactor)
 		ub := target * (1 + toleranceFactor)
@@ -177,8 +198,8 @@ func TestGetBoosterCard(t *testing.T) {
 			t.Errorf("Range: %f, %f", lb, ub)
 		}
 	}
-	for _, c := range products.OccultaNovelliaNotThatRare() {
-		target := float64(cardIters) * 0.75 / float64(len(products.OccultaNovelliaNotThatRare()))
+	for _, c := range catalog.Pools["occulta-novellia-not-that-rare"] {
+		target := float64(cardIters) * 0.75 / float64(len(catalog.Pools["occulta-novellia-not-that-rare"]))
 		v := float64(randCards[c])
 		lb := target * (1 - toleranceFactor)
 		ub := target * (1 + toleranceFactor)
@@ -190,3 +211,307 @@ func TestGetBoosterCard(t *testing.T) {
 
 	t.Errorf("Cards distribution: %+v", randCards)
 }
+
+func TestLoadCatalog(t *testing.T) {
+	catalog, err := products.LoadCatalog(catalogPath)
+	if err != nil {
+		t.Fatalf("failed to load %s: %+v", catalogPath, err)
+	}
+	productsService := products.New(nil, catalog, 0)
+
+	starterDeck, _, err := productsService.UnpackBundleProduct("PROD-01F4NAFJCAG5JDEGMR0XQARBW2", nil, nil)
+	if err != nil || len(starterDeck) != 12 {
+		t.Errorf("expected 12 starter deck cards, got %+v (%v)", starterDeck, err)
+	}
+	// products that are not bundles unpack into themselves
+	unpacked, _, err := productsService.UnpackBundleProduct("PROD-01F4MK4ZCVTKAAZF1QZAPWMPFP", nil, nil)
+	if err != nil || len(unpacked) != 1 || unpacked[0] != "PROD-01F4MK4ZCVTKAAZF1QZAPWMPFP" {
+		t.Errorf("expected an atomic product to unpack into itself, got %+v (%v)", unpacked, err)
+	}
+
+	// quotes are priced from every product a bundle could unpack into
+	contents, size := catalog.Contents("PROD-01F4NAF8MANXDT26MGA5E0QXNJ")
+	possible := map[string]bool{}
+	for _, productID := range contents {
+		possible[productID] = true
+	}
+	for i := 0; i < 20; i++ {
+		booster, _, err := productsService.UnpackBundleProduct("PROD-01F4NAF8MANXDT26MGA5E0QXNJ", nil, nil)
+		if err != nil || len(booster) != size {
+			t.Fatalf("expected %d booster cards, got %+v (%v)", size, booster, err)
+		}
+		for _, productID := range booster {
+			if !possible[productID] {
+				t.Errorf("booster card %s is missing from its contents %+v", productID, contents)
+			}
+		}
+	}
+	contents, size = catalog.Contents("PROD-01F4MK4ZCVTKAAZF1QZAPWMPFP")
+	if len(contents) != 1 || contents[0] != "PROD-01F4MK4ZCVTKAAZF1QZAPWMPFP" || size != 1 {
+		t.Errorf("expected an atomic product to contain itself, got %+v of size %d", contents, size)
+	}
+
+	invalid := map[string]string{
+		"unknown pool": `
+bundles:
+  - product-id: PROD-1
+    slots:
+      - type: guaranteed
+        pool: missing
+`,
+		"wrong size": `
+pools:
+  rare: [PROD-2]
+bundles:
+  - product-id: PROD-1
+    size: 2
+    slots:
+      - type: weighted
+        weights:
+          - pool: rare
+            weight: 1
+`,
+		"zero weight": `
+pools:
+  rare: [PROD-2]
+bundles:
+  - product-id: PROD-1
+    slots:
+      - type: weighted
+        weights:
+          - pool: rare
+            weight: 0
+`,
+		"unknown out-of-stock policy": `
+out-of-stock: substitute
+pools:
+  rare: [PROD-2]
+bundles:
+  - product-id: PROD-1
+    slots:
+      - type: guaranteed
+        pool: rare
+`,
+		"unknown slot type": `
+bundles:
+  - product-id: PROD-1
+    slots:
+      - type: mystery
+        products: [PROD-2]
+`,
+	}
+	dir := t.TempDir()
+	for name, catalogYAML := range invalid {
+		path := filepath.Join(dir, "catalog.yaml")
+		err := ioutil.WriteFile(path, []byte(catalogYAML), os.ModePerm)
+		if err != nil {
+			t.Fatalf("failed to write catalog: %+v", err)
+		}
+		_, err = products.LoadCatalog(path)
+		if err == nil {
+			t.Errorf("%s: expected catalog to be rejected", name)
+		}
+	}
+}
+
+func TestUnpackBundleProductStock(t *testing.T) {
+	catalog, err := products.LoadCatalog(catalogPath)
+	if err != nil {
+		t.Fatalf("failed to load catalog: %+v", err)
+	}
+	productsService := products.New(nil, catalog, 0)
+	booster := "PROD-01F4NAF8MANXDT26MGA5E0QXNJ"
+	rares := catalog.Pools["occulta-novellia-rare"]
+	kindaRares := catalog.Pools["occulta-novellia-kinda-rare"]
+
+	// no rares left and one kinda rare with a single unit
+	newStock := func() products.Stock {
+		stock := products.Stock{}
+		for _, productID := range catalog.Pools["occulta-novellia-not-that-rare"] {
+			stock[productID] = 100
+		}
+		stock[kindaRares[0]] = 1
+		return stock
+	}
+
+	stock := newStock()
+	kindaRaresDrawn := 0
+	for i := 0; i < 100; i++ {
+		unpacked, odds, err := productsService.UnpackBundleProduct(booster, rand.New(rand.NewSource(int64(i))), stock)
+		if err != nil {
+			t.Fatalf("failed to unpack booster: %+v", err)
+		}
+		if len(odds) != 3 {
+			t.Fatalf("expected odds for 3 draws, got %+v", odds)
+		}
+		for j, productID := range unpacked {
+			if stringInSlice(productID, rares) {
+				t.Fatalf("drew %s with no stock", productID)
+			}
+			if productID == kindaRares[0] {
+				kindaRaresDrawn += 1
+			}
+			if odds[j].ProductID != productID {
+				t.Errorf("expected odds for %s, got %+v", productID, odds[j])
+			}
+			for _, pool := range odds[j].Pools {
+				if pool.Pool == "occulta-novellia-rare" {
+					t.Errorf("expected the rare pool to be left out, got %+v", odds[j])
+				}
+			}
+		}
+
+		// the same draws with the recorded odds unpack the same products
+		replayed, reduced, err := productsService.ReplayBundleProduct(booster, rand.New(rand.NewSource(int64(i))), odds)
+		if err != nil {
+			t.Fatalf("failed to replay booster: %+v", err)
+		}
+		if !reduced {
+			t.Errorf("expected the odds without rares to be reported reduced")
+		}
+		if fmt.Sprint(replayed) != fmt.Sprint(unpacked) {
+			t.Errorf("expected %v from replay, got %v", unpacked, replayed)
+		}
+	}
+	if kindaRaresDrawn > 1 {
+		t.Errorf("expected the kinda rare with one unit to be drawn at most once, got %d", kindaRaresDrawn)
+	}
+	if stock[kindaRares[0]] != 1 - int64(kindaRaresDrawn) {
+		t.Errorf("expected drawn units to be taken from stock, got %d left", stock[kindaRares[0]])
+	}
+
+	// a starter deck's guaranteed rare has nowhere to go
+	_, _, err = productsService.UnpackBundleProduct("PROD-01F4NAFJCAG5JDEGMR0XQARBW2", nil, newStock())
+	if !errors.Is(err, products.ErrOutOfStock) {
+		t.Errorf("expected ErrOutOfStock, got %+v", err)
+	}
+
+	catalog.OutOfStock = products.OUT_OF_STOCK_FAIL
+	_, _, err = productsService.UnpackBundleProduct(booster, nil, newStock())
+	if !errors.Is(err, products.ErrOutOfStock) {
+		t.Errorf("expected ErrOutOfStock with the fail policy, got %+v", err)
+	}
+
+	// odds that add products the catalog does not have are rejected
+	_, _, err = productsService.ReplayBundleProduct(booster, nil, []novellia_database.DrawOdds{
+		novellia_database.DrawOdds{
+			Slot: 0,
+			Pools: []novellia_database.PoolOdds{
+				novellia_database.PoolOdds{Pool: "occulta-novellia-rare", Weight: 1, Products: []string{"PROD-NOT-IN-CATALOG"}},
+			},
+		},
+	})
+	if err == nil {
+		t.Errorf("expected odds outside the catalog to be rejected")
+	}
+}
+
+// serves products from memory, notifying a change to the listener once it is listening
+type testStore struct {
+	mutex sync.Mutex
+	products []novellia_database.Product
+	err error
+	queries int
+	changes chan string
+}
+
+func (s *testStore) QueryProducts(ctx context.Context) ([]novellia_database.Product, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queries += 1
+	return s.products, s.err
+}
+
+func (s *testStore) ListenProductChanges(ctx context.Context, handler func(payload string)) error {
+	for {
+		select {
+		case payload := <-s.changes:
+			handler(payload)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *testStore) setProducts(products []novellia_database.Product, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.products = products
+	s.err = err
+}
+
+func (s *testStore) queryCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queries
+}
+
+func TestProductCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &testStore{
+		products: []novellia_database.Product{
+			novellia_database.Product{ProductID: "PROD-1", PriceUnitAmount: 3},
+		},
+		changes: make(chan string),
+	}
+	productsService := products.New(store, nil, time.Hour)
+
+	// concurrent misses share one query
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := productsService.GetProducts(ctx)
+			if err != nil || p["PROD-1"].PriceUnitAmount != 3 {
+				t.Errorf("unexpected products %+v: %v", p, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if store.queryCount() != 1 {
+		t.Errorf("expected products to be cached, queried %d times", store.queryCount())
+	}
+
+	// the price changes and is picked up after invalidating
+	store.setProducts([]novellia_database.Product{
+		novellia_database.Product{ProductID: "PROD-1", PriceUnitAmount: 4},
+	}, nil)
+	productsService.InvalidateProducts()
+	p, err := productsService.GetProducts(ctx)
+	if err != nil || p["PROD-1"].PriceUnitAmount != 4 || store.queryCount() != 2 {
+		t.Errorf("expected invalidated products to be reloaded, got %+v (%d queries): %v", p, store.queryCount(), err)
+	}
+
+	// cached products are served when a reload fails
+	store.setProducts(nil, fmt.Errorf("database is down"))
+	productsService.InvalidateProducts()
+	p, err = productsService.GetProducts(ctx)
+	if err != nil || p["PROD-1"].PriceUnitAmount != 4 {
+		t.Errorf("expected cached products while the database is down, got %+v: %v", p, err)
+	}
+	status := productsService.GetCacheStatus()
+	if status.Products != 1 || status.ExpiresAt == nil || status.ExpiresAt.After(time.Now()) {
+		t.Errorf("expected the cache to stay expired after a failed reload, got %+v", status)
+	}
+
+	// a notified change expires the cache
+	store.setProducts([]novellia_database.Product{
+		novellia_database.Product{ProductID: "PROD-1", PriceUnitAmount: 5},
+	}, nil)
+	_, err = productsService.GetProducts(ctx)
+	if err != nil {
+		t.Fatalf("failed to get products: %v", err)
+	}
+	productsService.WatchProductChanges(ctx)
+	// the send returns once the listener has the change, handling it is done before it takes the next one
+	store.changes <- "UPDATE"
+	store.changes <- "UPDATE"
+	queries := store.queryCount()
+	_, err = productsService.GetProducts(ctx)
+	if err != nil || store.queryCount() != queries + 1 {
+		t.Errorf("expected a notified change to reload products: %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+package promotions
+
+import (
+	"context"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+)
+
+type Service interface {
+	// checks that a code can be used by a delivery address, returning the discount it gives on line amounts keyed by product ID
+	Apply(ctx context.Context, code string, deliveryAddress string, lineAmounts map[string]float64) (*Discount, error)
+	CreateCode(ctx context.Context, code novellia_database.PromotionCode) error
+	DisableCode(ctx context.Context, code string) error
+	GetCodes(ctx context.Context) ([]novellia_database.PromotionCode, error)
+}
@@ -0,0 +1,181 @@
+package promotions
+
+import (
+	"fmt"
+	"context"
+	"time"
+	"math"
+	"errors"
+	"strings"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/constants"
+)
+
+const (
+	DISCOUNT_TYPE_PERCENTAGE = "percentage"
+	DISCOUNT_TYPE_FLAT = "flat"
+)
+
+var (
+	ErrCodeNotFound = errors.New("promotion code not found")
+	ErrCodeNotApplicable = errors.New("promotion code cannot be applied")
+)
+
+// a discount as applied to an order
+type Discount struct {
+	Code string `json:"code"`
+	Type string `json:"type"`
+	Amount float64 `json:"amount"`
+}
+
+type ServiceImpl struct {
+	novelliaDatabaseService novellia_database.Service
+}
+
+// creates a new ServiceImpl
+func New(novelliaDatabaseService novellia_database.Service) *ServiceImpl {
+	return &ServiceImpl {
+		novelliaDatabaseService: novelliaDatabaseService,
+	}
+}
+
+// codes are case insensitive
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// checks that a code is active at a time, ignoring usage limits
+func checkActive(code novellia_database.PromotionCode, at time.Time) error {
+	if code.Disabled {
+		return fmt.Errorf("%w: %s is disabled", ErrCodeNotApplicable, code.Code)
+	}
+	if code.ValidFrom != nil && at.Before(*code.ValidFrom) {
+		return fmt.Errorf("%w: %s is valid from %s", ErrCodeNotApplicable, code.Code, code.ValidFrom.Format(constants.ISO8601DateFormat))
+	}
+	if code.ValidUntil != nil && !at.Before(*code.ValidUntil) {
+		return fmt.Errorf("%w: %s expired at %s", ErrCodeNotApplicable, code.Code, code.ValidUntil.Format(constants.ISO8601DateFormat))
+	}
+	return nil
+}
+
+// computes the discount a code gives, only products in scope count towards it
+func Discounted(code novellia_database.PromotionCode, lineAmounts map[string]float64) (*Discount, error) {
+	var eligibleAmount float64 = 0
+	for productID, amount := range lineAmounts {
+		if len(code.ProductIDs) == 0 {
+			eligibleAmount += amount
+			continue
+		}
+		for _, scopedProductID := range code.ProductIDs {
+			if scopedProductID == productID {
+				eligibleAmount += amount
+				break
+			}
+		}
+	}
+	if eligibleAmount <= 0 {
+		return nil, fmt.Errorf("%w: %s does not apply to any product in the order", ErrCodeNotApplicable, code.Code)
+	}
+
+	d := Discount{
+		Code: code.Code,
+		Type: code.DiscountType,
+	}
+	switch code.DiscountType {
+	case DISCOUNT_TYPE_PERCENTAGE:
+		d.Amount = eligibleAmount * code.DiscountValue
+	case DISCOUNT_TYPE_FLAT:
+		d.Amount = math.Min(code.DiscountValue, eligibleAmount)
+	default:
+		return nil, fmt.Errorf("promotion code %s has unknown discount type: %s", code.Code, code.DiscountType)
+	}
+	// round to lovelace
+	d.Amount = math.Round(d.Amount * 1000000) / 1000000
+
+	return &d, nil
+}
+
+func (s *ServiceImpl) getCode(ctx context.Context, code string) (*novellia_database.PromotionCode, error) {
+	codes, err := s.novelliaDatabaseService.QueryPromotionCodes(ctx, normalizeCode(code))
+	if err != nil {
+		return nil, err
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrCodeNotFound, code)
+	}
+	return &codes[0], nil
+}
+
+func (s *ServiceImpl) Apply(ctx context.Context, code string, deliveryAddress string, lineAmounts map[string]float64) (*Discount, error) {
+	c, err := s.getCode(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkActive(*c, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// limits are checked again when the redemption is inserted with the order
+	uses, addressUses, err := s.novelliaDatabaseService.QueryPromotionCodeUses(ctx, c.Code, deliveryAddress)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxUses > 0 && uses >= c.MaxUses {
+		return nil, fmt.Errorf("%w: %s has been used the maximum number of times", ErrCodeNotApplicable, c.Code)
+	}
+	if c.MaxUsesPerAddress > 0 && addressUses >= c.MaxUsesPerAddress {
+		return nil, fmt.Errorf("%w: %s has been used the maximum number of times by %s", ErrCodeNotApplicable, c.Code, deliveryAddress)
+	}
+
+	return Discounted(*c, lineAmounts)
+}
+
+func (s *ServiceImpl) CreateCode(ctx context.Context, code novellia_database.PromotionCode) error {
+	code.Code = normalizeCode(code.Code)
+	if code.Code == "" {
+		return fmt.Errorf("promotion code cannot be empty")
+	}
+
+	switch code.DiscountType {
+	case DISCOUNT_TYPE_PERCENTAGE:
+		if code.DiscountValue <= 0 || code.DiscountValue > 1 {
+			return fmt.Errorf("percentage discount must be in (0, 1], got %f", code.DiscountValue)
+		}
+	case DISCOUNT_TYPE_FLAT:
+		if code.DiscountValue <= 0 {
+			return fmt.Errorf("flat discount must be greater than 0, got %f", code.DiscountValue)
+		}
+	default:
+		return fmt.Errorf("unknown discount type: %s", code.DiscountType)
+	}
+
+	if code.MaxUses < 0 || code.MaxUsesPerAddress < 0 {
+		return fmt.Errorf("usage limits cannot be negative")
+	}
+	if code.ValidFrom != nil && code.ValidUntil != nil && !code.ValidUntil.After(*code.ValidFrom) {
+		return fmt.Errorf("promotion code must be valid until after it is valid from")
+	}
+	if code.ProductIDs == nil {
+		code.ProductIDs = []string{}
+	}
+
+	return s.novelliaDatabaseService.InsertPromotionCode(ctx, code)
+}
+
+func (s *ServiceImpl) DisableCode(ctx context.Context, code string) error {
+	disabled, err := s.novelliaDatabaseService.DisablePromotionCode(ctx, normalizeCode(code))
+	if err != nil {
+		return err
+	}
+	if !disabled {
+		return fmt.Errorf("%w: %s", ErrCodeNotFound, code)
+	}
+	return nil
+}
+
+func (s *ServiceImpl) GetCodes(ctx context.Context) ([]novellia_database.PromotionCode, error) {
+	return s.novelliaDatabaseService.QueryPromotionCodes(ctx, "")
+}
@@ -0,0 +1,52 @@
+package promotions_test
+
+import (
+	"errors"
+	"testing"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/promotions"
+)
+
+func TestDiscounted(t *testing.T) {
+	lineAmounts := map[string]float64{
+		"PROD-A": 30,
+		"PROD-B": 10,
+	}
+
+	cases := []struct {
+		code novellia_database.PromotionCode
+		expected float64
+	}{
+		// percentage of the whole order
+		{novellia_database.PromotionCode{Code: "TEN", DiscountType: promotions.DISCOUNT_TYPE_PERCENTAGE, DiscountValue: 0.1}, 4},
+		// percentage of scoped products only
+		{novellia_database.PromotionCode{Code: "HALF-B", DiscountType: promotions.DISCOUNT_TYPE_PERCENTAGE, DiscountValue: 0.5, ProductIDs: []string{"PROD-B"}}, 5},
+		// flat discounts are capped at the eligible amount
+		{novellia_database.PromotionCode{Code: "FIVE", DiscountType: promotions.DISCOUNT_TYPE_FLAT, DiscountValue: 5}, 5},
+		{novellia_database.PromotionCode{Code: "BIG-B", DiscountType: promotions.DISCOUNT_TYPE_FLAT, DiscountValue: 50, ProductIDs: []string{"PROD-B"}}, 10},
+		// rounded to lovelace
+		{novellia_database.PromotionCode{Code: "THIRD", DiscountType: promotions.DISCOUNT_TYPE_PERCENTAGE, DiscountValue: 1.0 / 3}, 13.333333},
+	}
+	for _, c := range cases {
+		discount, err := promotions.Discounted(c.code, lineAmounts)
+		if err != nil {
+			t.Errorf("failed to apply %s: %+v", c.code.Code, err)
+			continue
+		}
+		if discount.Amount != c.expected {
+			t.Errorf("wrong discount for %s, expected %f, got %f", c.code.Code, c.expected, discount.Amount)
+		}
+	}
+
+	// codes scoped to products that are not in the order do not apply
+	_, err := promotions.Discounted(novellia_database.PromotionCode{
+		Code: "OTHER",
+		DiscountType: promotions.DISCOUNT_TYPE_FLAT,
+		DiscountValue: 5,
+		ProductIDs: []string{"PROD-C"},
+	}, lineAmounts)
+	if !errors.Is(err, promotions.ErrCodeNotApplicable) {
+		t.Errorf("expected ErrCodeNotApplicable, got %+v", err)
+	}
+}
@@ -0,0 +1,14 @@
+package quotes
+
+import (
+	"context"
+
+	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
+)
+
+type Service interface {
+	// prices a list of items less any discount code, persisting a signed quote that expires after the configured TTL
+	CreateQuote(ctx context.Context, items []ordf.OrderItems, priceCurrencyID string, discountCode string, deliveryAddress string) (*Quote, error)
+	// loads a quote, verifying its signature and that it has not expired
+	GetQuote(ctx context.Context, quoteID string) (*Quote, error)
+}
@@ -0,0 +1,238 @@
+package quotes
+
+import (
+	"fmt"
+	"context"
+	"time"
+	"errors"
+	"encoding/json"
+	"encoding/hex"
+	"crypto/hmac"
+	"crypto/sha256"
+
+	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/constants"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/promotions"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+)
+
+var (
+	ErrQuoteNotFound = errors.New("quote not found")
+	ErrQuoteExpired = errors.New("quote has expired")
+	// quotes are redeemed when their order is inserted, see novellia_database.InsertPendingOrder
+	ErrQuoteRedeemed = novellia_database.ErrQuoteRedeemed
+	ErrQuoteInvalidSignature = errors.New("quote signature is invalid")
+)
+
+type LineItem struct {
+	ProductID string `json:"product_id"`
+	Quantity int32 `json:"quantity"`
+	PriceUnitAmount float64 `json:"price_unit_amount"`
+	PriceAmount float64 `json:"price_amount"`
+}
+
+type Quote struct {
+	QuoteID string `json:"quote_id"`
+	Items []LineItem `json:"items"`
+	PriceCurrencyID string `json:"price_currency_id"`
+	// sale phase the prices were taken from, empty when no phases are scheduled
+	Phase string `json:"phase,omitempty"`
+	// discount taken off the listed prices, the subtotal is after the discount
+	Discount *promotions.Discount `json:"discount,omitempty"`
+	// subtotal, fees, min-ada deposit and total due from the customer
+	fees.Breakdown
+	// amount requested from NowPayments, which is the total less processing fees
+	PaymentAmount float64 `json:"payment_amount"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Signature string `json:"signature"`
+}
+
+// checks that a quote was made for exactly the given items
+func (q *Quote) MatchesItems(items []ordf.OrderItems) bool {
+	quantities := map[string]int32{}
+	for _, v := range items {
+		quantities[v.ProductId] += v.Quantity
+	}
+	for _, v := range q.Items {
+		quantities[v.ProductID] -= v.Quantity
+	}
+	for _, quantity := range quantities {
+		if quantity != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type ServiceImpl struct {
+	novelliaDatabaseService novellia_database.Service
+	productsService products.Service
+	cardanoService cardano.Service
+	feesService fees.Service
+	promotionsService promotions.Service
+	phasesService phases.Service
+	signingKey []byte
+	ttl time.Duration
+}
+
+// creates a new ServiceImpl
+func New(
+	novelliaDatabaseService novellia_database.Service,
+	productsService products.Service,
+	cardanoService cardano.Service,
+	feesService fees.Service,
+	promotionsService promotions.Service,
+	phasesService phases.Service,
+	signingKey string,
+	ttl time.Duration,
+) (*ServiceImpl, error) {
+	if len(signingKey) == 0 {
+		return nil, fmt.Errorf("quote signing key cannot be empty")
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("quote TTL must be greater than 0, got %s", ttl)
+	}
+
+	return &ServiceImpl {
+		novelliaDatabaseService: novelliaDatabaseService,
+		productsService: productsService,
+		cardanoService: cardanoService,
+		feesService: feesService,
+		promotionsService: promotionsService,
+		phasesService: phasesService,
+		signingKey: []byte(signingKey),
+		ttl: ttl,
+	}, nil
+}
+
+// signs the JSON encoding of the quote, excluding the signature itself
+func (s *ServiceImpl) sign(quote Quote) (string, error) {
+	quote.Signature = ""
+	quoteBytes, err := json.Marshal(quote)
+	if err != nil {
+		return "", err
+	}
+
+	h := hmac.New(sha256.New, s.signingKey)
+	h.Write(quoteBytes)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *ServiceImpl) CreateQuote(ctx context.Context, items []ordf.OrderItems, priceCurrencyID string, discountCode string, deliveryAddress string) (*Quote, error) {
+	products, err := s.productsService.GetProducts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	quote := Quote{
+		QuoteID: s.novelliaDatabaseService.GenerateULID("QUOTE"),
+		Items: []LineItem{},
+		PriceCurrencyID: priceCurrencyID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+
+	var subtotal float64 = 0
+	lineAmounts := map[string]float64{}
+	for _, v := range items {
+		p, ok := products[v.ProductId]
+		if !ok {
+			return nil, fmt.Errorf("product ID does not exist: %s", v.ProductId)
+		}
+		if p.PriceCurrencyID != priceCurrencyID {
+			return nil, fmt.Errorf("quote currency_id does not match listed currency_id: %s, %s (listing) != %s (quote)", p.ProductID, p.PriceCurrencyID, priceCurrencyID)
+		}
+		// the running phase may override the listed price
+		phase, err := s.phasesService.CheckPurchasable(p, now)
+		if err != nil {
+			return nil, err
+		}
+		if phase != nil {
+			quote.Phase = phase.Name
+		}
+		priceUnitAmount := s.phasesService.Price(p, phase)
+
+		lineItem := LineItem{
+			ProductID: p.ProductID,
+			Quantity: v.Quantity,
+			PriceUnitAmount: priceUnitAmount,
+			PriceAmount: float64(v.Quantity) * priceUnitAmount,
+		}
+		quote.Items = append(quote.Items, lineItem)
+		subtotal += lineItem.PriceAmount
+		lineAmounts[lineItem.ProductID] += lineItem.PriceAmount
+	}
+
+	if discountCode != "" {
+		quote.Discount, err = s.promotionsService.Apply(ctx, discountCode, deliveryAddress, lineAmounts)
+		if err != nil {
+			return nil, err
+		}
+		subtotal -= quote.Discount.Amount
+	}
+
+	// the deposit depends on which native tokens end up in the delivery output, which is only known once bundles are drawn
+	// so it covers the most the order's bundles could unpack into
+	nativeTokenIDs, units, err := s.cardanoService.PossibleNativeTokens(ctx, &ordf.Order{
+		Items: items,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown, err := s.feesService.Calculate(subtotal, s.feesService.MaxMinLovelace(nativeTokenIDs, units), now)
+	if err != nil {
+		return nil, err
+	}
+	quote.Breakdown = *breakdown
+	quote.PaymentAmount = quote.Total - quote.FeesAmount()
+
+	quote.Signature, err = s.sign(quote)
+	if err != nil {
+		return nil, err
+	}
+
+	quoteBytes, err := json.Marshal(quote)
+	if err != nil {
+		return nil, err
+	}
+	err = s.novelliaDatabaseService.InsertPriceQuote(ctx, quote.QuoteID, quoteBytes, quote.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &quote, nil
+}
+
+func (s *ServiceImpl) GetQuote(ctx context.Context, quoteID string) (*Quote, error) {
+	quoteBytes, err := s.novelliaDatabaseService.QueryPriceQuote(ctx, quoteID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s (%v)", ErrQuoteNotFound, quoteID, err)
+	}
+
+	var quote Quote
+	err = json.Unmarshal(quoteBytes, &quote)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := s.sign(quote)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(signature), []byte(quote.Signature)) {
+		return nil, fmt.Errorf("%w: %s", ErrQuoteInvalidSignature, quoteID)
+	}
+
+	if time.Now().After(quote.ExpiresAt) {
+		return nil, fmt.Errorf("%w: %s expired at %s", ErrQuoteExpired, quoteID, quote.ExpiresAt.Format(constants.ISO8601DateFormat))
+	}
+
+	return &quote, nil
+}
@@ -0,0 +1,55 @@
+package quotes_test
+
+import (
+	"testing"
+
+	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/quotes"
+)
+
+func TestMatchesItems(t *testing.T) {
+	quote := quotes.Quote{
+		Items: []quotes.LineItem{
+			quotes.LineItem{
+				ProductID: "PROD-01F4MK45QJS4WZ1VBZW1A1THD7",
+				Quantity: 3,
+			},
+			quotes.LineItem{
+				ProductID: "PROD-01F4MK4YVW4JSV717E0XK920AZ",
+				Quantity: 2,
+			},
+		},
+	}
+
+	// same products split across lines still match
+	items := []ordf.OrderItems{
+		ordf.OrderItems{
+			ProductId: "PROD-01F4MK4YVW4JSV717E0XK920AZ",
+			Quantity: 2,
+		},
+		ordf.OrderItems{
+			ProductId: "PROD-01F4MK45QJS4WZ1VBZW1A1THD7",
+			Quantity: 1,
+		},
+		ordf.OrderItems{
+			ProductId: "PROD-01F4MK45QJS4WZ1VBZW1A1THD7",
+			Quantity: 2,
+		},
+	}
+	if !quote.MatchesItems(items) {
+		t.Errorf("items should match quote: %+v", items)
+	}
+
+	items[0].Quantity = 3
+	if quote.MatchesItems(items) {
+		t.Errorf("items with a different quantity should not match quote: %+v", items)
+	}
+
+	items = append(items[1:], ordf.OrderItems{
+		ProductId: "PROD-01F4MK4Z489EBKGGFXA2HKZ1MA",
+		Quantity: 2,
+	})
+	if quote.MatchesItems(items) {
+		t.Errorf("items with a different product should not match quote: %+v", items)
+	}
+}
@@ -0,0 +1,13 @@
+package reconciliation
+
+import (
+	"context"
+	"time"
+)
+
+type Service interface {
+	// compares payments NowPayments created in [from, to) against what orders recorded
+	Reconcile(ctx context.Context, from time.Time, to time.Time) (*Report, error)
+	// periodically reconciles the trailing lookback window and publishes discrepancy counts as metrics
+	WatchReconciliation(ctx context.Context, interval time.Duration, lookback time.Duration)
+}
@@ -0,0 +1,299 @@
+package reconciliation
+
+import (
+	"fmt"
+	"context"
+	"time"
+	"math"
+	"io"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/constants"
+	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
+)
+
+const (
+	DISCREPANCY_PAID_NOT_FILLED = "PAID_NOT_FILLED"
+	DISCREPANCY_FILLED_NOT_PAID = "FILLED_NOT_PAID"
+	DISCREPANCY_AMOUNT_MISMATCH = "AMOUNT_MISMATCH"
+	DISCREPANCY_PAYMENT_WITHOUT_ORDER = "PAYMENT_WITHOUT_ORDER"
+)
+
+const (
+	// NowPayments allows up to 500
+	listPaymentsPageLimit = 100
+	// a finished payment has this long to be fulfilled before it is reported, covers WatchOrdersForFulfillment
+	paidNotFilledGrace = 1 * time.Hour
+	// amounts are crypto amounts with rounding from NowPayments
+	amountTolerance = 0.000001
+	nowPaymentsStatusFinished = "finished"
+)
+
+var discrepancyTypes = []string{
+	DISCREPANCY_PAID_NOT_FILLED,
+	DISCREPANCY_FILLED_NOT_PAID,
+	DISCREPANCY_AMOUNT_MISMATCH,
+	DISCREPANCY_PAYMENT_WITHOUT_ORDER,
+}
+
+type Discrepancy struct {
+	Type string `json:"type"`
+	OrderID string `json:"order_id"`
+	PaymentID string `json:"payment_id"`
+	// the value reported by NowPayments
+	Expected float64 `json:"expected"`
+	// the value recorded by the order
+	Actual float64 `json:"actual"`
+	Detail string `json:"detail"`
+}
+
+type Report struct {
+	From time.Time `json:"from"`
+	To time.Time `json:"to"`
+	GeneratedAt time.Time `json:"generated_at"`
+	PaymentsChecked int `json:"payments_checked"`
+	Counts map[string]int `json:"counts"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+// writes the report as JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// writes the discrepancies as CSV with a header row
+func (r *Report) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"type", "order_id", "payment_id", "expected", "actual", "detail"})
+	if err != nil {
+		return err
+	}
+	for _, d := range r.Discrepancies {
+		err = writer.Write([]string{
+			d.Type,
+			d.OrderID,
+			d.PaymentID,
+			strconv.FormatFloat(d.Expected, 'f', -1, 64),
+			strconv.FormatFloat(d.Actual, 'f', -1, 64),
+			d.Detail,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+type ServiceImpl struct {
+	novelliaDatabaseService novellia_database.Service
+	nowPaymentsService now_payments.Service
+}
+
+// creates a new ServiceImpl
+func New(
+	novelliaDatabaseService novellia_database.Service,
+	nowPaymentsService now_payments.Service,
+) *ServiceImpl {
+	return &ServiceImpl {
+		novelliaDatabaseService: novelliaDatabaseService,
+		nowPaymentsService: nowPaymentsService,
+	}
+}
+
+// NowPayments uses RFC3339, the database uses ISO8601
+func parseTime(t string) (time.Time, error) {
+	parsed, err := time.Parse(time.RFC3339, t)
+	if err == nil {
+		return parsed, nil
+	}
+	return time.Parse(constants.ISO8601DateFormat, t)
+}
+
+func amountsDiffer(a float64, b float64) bool {
+	return math.Abs(a - b) > amountTolerance
+}
+
+// compares payments listed by NowPayments against recorded payments, payments are finished only per NowPayments
+func Compare(listed []now_payments.GetPaymentStatusResponse, recorded []novellia_database.ReconciliationPayment, now time.Time) []Discrepancy {
+	discrepancies := []Discrepancy{}
+
+	recordedByID := map[string]novellia_database.ReconciliationPayment{}
+	for _, r := range recorded {
+		recordedByID[r.PaymentID] = r
+	}
+
+	// order ID -> time its latest finished payment was last updated
+	finishedOrders := map[string]time.Time{}
+	for _, p := range listed {
+		paymentID := p.PaymentID.String()
+		r, ok := recordedByID[paymentID]
+		if !ok {
+			discrepancies = append(discrepancies, Discrepancy{
+				Type: DISCREPANCY_PAYMENT_WITHOUT_ORDER,
+				OrderID: p.OrderID,
+				PaymentID: paymentID,
+				Expected: p.ActuallyPaid,
+				Detail: fmt.Sprintf("payment is %s on NowPayments but was not recorded", p.PaymentStatus),
+			})
+			continue
+		}
+
+		if amountsDiffer(p.ActuallyPaid, r.ActuallyPaid) {
+			discrepancies = append(discrepancies, Discrepancy{
+				Type: DISCREPANCY_AMOUNT_MISMATCH,
+				OrderID: r.OrderID,
+				PaymentID: paymentID,
+				Expected: p.ActuallyPaid,
+				Actual: r.ActuallyPaid,
+				Detail: "actually paid differs from recorded",
+			})
+		}
+		if p.PaymentStatus != nowPaymentsStatusFinished {
+			continue
+		}
+
+		if p.ActuallyPaid < p.PayAmount && amountsDiffer(p.ActuallyPaid, p.PayAmount) {
+			discrepancies = append(discrepancies, Discrepancy{
+				Type: DISCREPANCY_AMOUNT_MISMATCH,
+				OrderID: r.OrderID,
+				PaymentID: paymentID,
+				Expected: p.PayAmount,
+				Actual: p.ActuallyPaid,
+				Detail: "payment finished but actually paid is less than pay amount",
+			})
+		}
+		if r.OutcomeAmount != 0 && amountsDiffer(p.OutcomeAmount, r.OutcomeAmount) {
+			discrepancies = append(discrepancies, Discrepancy{
+				Type: DISCREPANCY_AMOUNT_MISMATCH,
+				OrderID: r.OrderID,
+				PaymentID: paymentID,
+				Expected: p.OutcomeAmount,
+				Actual: r.OutcomeAmount,
+				Detail: fmt.Sprintf("outcome amount in %s differs from recorded", p.OutcomeCurrency),
+			})
+		}
+
+		updatedAt, err := parseTime(p.UpdatedAt)
+		if err != nil {
+			// treat as old enough to be reported
+			updatedAt = time.Time{}
+		}
+		if last, ok := finishedOrders[r.OrderID]; !ok || updatedAt.After(last) {
+			finishedOrders[r.OrderID] = updatedAt
+		}
+	}
+
+	// order level checks, once per order in recorded order
+	checked := map[string]bool{}
+	for _, r := range recorded {
+		if checked[r.OrderID] {
+			continue
+		}
+		checked[r.OrderID] = true
+
+		updatedAt, paid := finishedOrders[r.OrderID]
+		filled := r.OrderStatus == orders.ORDER_STATUS_FILLED || r.OrderStatus == orders.ORDER_STATUS_PARTIALLY_FILLED
+		if paid && !filled && r.OrderStatus != orders.ORDER_STATUS_REFUND && now.Sub(updatedAt) > paidNotFilledGrace {
+			discrepancies = append(discrepancies, Discrepancy{
+				Type: DISCREPANCY_PAID_NOT_FILLED,
+				OrderID: r.OrderID,
+				Detail: fmt.Sprintf("payment finished but order is %s", r.OrderStatus),
+			})
+		}
+		if filled && !paid {
+			discrepancies = append(discrepancies, Discrepancy{
+				Type: DISCREPANCY_FILLED_NOT_PAID,
+				OrderID: r.OrderID,
+				Detail: fmt.Sprintf("order is %s but no payment finished on NowPayments", r.OrderStatus),
+			})
+		}
+	}
+
+	return discrepancies
+}
+
+func (s *ServiceImpl) listPayments(ctx context.Context, from time.Time, to time.Time) ([]now_payments.GetPaymentStatusResponse, error) {
+	payments := []now_payments.GetPaymentStatusResponse{}
+	for page := 0; ; page++ {
+		resp, err := s.nowPaymentsService.ListPayments(ctx, now_payments.ListPaymentsRequest{
+			DateFrom: from,
+			DateTo: to,
+			Limit: listPaymentsPageLimit,
+			Page: page,
+		})
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, resp.Data...)
+		if page + 1 >= resp.PagesCount || len(resp.Data) == 0 {
+			break
+		}
+	}
+	return payments, nil
+}
+
+func (s *ServiceImpl) Reconcile(ctx context.Context, from time.Time, to time.Time) (*Report, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("reconciliation range is empty")
+	}
+
+	listed, err := s.listPayments(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NowPayments payments: %v", err)
+	}
+	recorded, err := s.novelliaDatabaseService.QueryReconciliationPayments(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recorded payments: %v", err)
+	}
+
+	now := time.Now().UTC()
+	report := Report{
+		From: from,
+		To: to,
+		GeneratedAt: now,
+		PaymentsChecked: len(listed),
+		Counts: map[string]int{},
+		Discrepancies: Compare(listed, recorded, now),
+	}
+	for _, t := range discrepancyTypes {
+		report.Counts[t] = 0
+	}
+	for _, d := range report.Discrepancies {
+		report.Counts[d.Type]++
+	}
+
+	return &report, nil
+}
+
+func (s *ServiceImpl) WatchReconciliation(ctx context.Context, interval time.Duration, lookback time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			fmt.Printf("WatchReconciliation, running iteration\n")
+
+			to := time.Now().UTC()
+			report, err := s.Reconcile(ctx, to.Add(-lookback), to)
+			if err != nil {
+				fmt.Printf("WatchReconciliation error: %+v\n", err)
+				prometheus_monitoring.SetWatchReconciliationStatus(0)
+				continue
+			}
+
+			for t, count := range report.Counts {
+				prometheus_monitoring.SetReconciliationDiscrepancies(t, float64(count))
+			}
+			for _, d := range report.Discrepancies {
+				fmt.Printf("WatchReconciliation discrepancy: %+v\n", d)
+			}
+
+			prometheus_monitoring.SetWatchReconciliationStatus(1)
+			fmt.Printf("WatchReconciliation, completed iteration with %d discrepancies\n", len(report.Discrepancies))
+		}
+	}()
+}
@@ -0,0 +1,68 @@
+package reconciliation_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/reconciliation"
+)
+
+func TestCompare(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-2 * time.Hour).Format(time.RFC3339)
+	recent := now.Add(-5 * time.Minute).Format(time.RFC3339)
+
+	listed := []now_payments.GetPaymentStatusResponse{
+		// paid and filled
+		{PaymentID: "1", OrderID: "ORDER-OK", PaymentStatus: "finished", PayAmount: 10, ActuallyPaid: 10, UpdatedAt: old},
+		// paid long ago, still not filled
+		{PaymentID: "2", OrderID: "ORDER-STUCK", PaymentStatus: "finished", PayAmount: 10, ActuallyPaid: 10, UpdatedAt: old},
+		// paid recently, fulfillment still has time
+		{PaymentID: "3", OrderID: "ORDER-RECENT", PaymentStatus: "finished", PayAmount: 10, ActuallyPaid: 10, UpdatedAt: recent},
+		// filled but payment expired
+		{PaymentID: "4", OrderID: "ORDER-UNPAID", PaymentStatus: "expired", PayAmount: 10, UpdatedAt: old},
+		// recorded amount is stale
+		{PaymentID: "5", OrderID: "ORDER-STALE", PaymentStatus: "partially_paid", PayAmount: 10, ActuallyPaid: 4, UpdatedAt: old},
+		// no order
+		{PaymentID: "6", OrderID: "ORDER-MISSING", PaymentStatus: "waiting", PayAmount: 10, UpdatedAt: old},
+	}
+	recorded := []novellia_database.ReconciliationPayment{
+		{PaymentID: "1", OrderID: "ORDER-OK", ActuallyPaid: 10, OrderStatus: "FILLED"},
+		{PaymentID: "2", OrderID: "ORDER-STUCK", ActuallyPaid: 10, OrderStatus: "PAID"},
+		{PaymentID: "3", OrderID: "ORDER-RECENT", ActuallyPaid: 10, OrderStatus: "PAID"},
+		{PaymentID: "4", OrderID: "ORDER-UNPAID", OrderStatus: "FILLED"},
+		{PaymentID: "5", OrderID: "ORDER-STALE", ActuallyPaid: 2, OrderStatus: "AWAITING_PAYMENT"},
+	}
+
+	expected := map[string]string{
+		"ORDER-STUCK": reconciliation.DISCREPANCY_PAID_NOT_FILLED,
+		"ORDER-UNPAID": reconciliation.DISCREPANCY_FILLED_NOT_PAID,
+		"ORDER-STALE": reconciliation.DISCREPANCY_AMOUNT_MISMATCH,
+		"ORDER-MISSING": reconciliation.DISCREPANCY_PAYMENT_WITHOUT_ORDER,
+	}
+
+	discrepancies := reconciliation.Compare(listed, recorded, now)
+	if len(discrepancies) != len(expected) {
+		t.Fatalf("expected %d discrepancies, got %+v", len(expected), discrepancies)
+	}
+	for _, d := range discrepancies {
+		if expected[d.OrderID] != d.Type {
+			t.Errorf("unexpected discrepancy %+v", d)
+		}
+	}
+
+	report := reconciliation.Report{Discrepancies: discrepancies}
+	var buf bytes.Buffer
+	err := report.WriteCSV(&buf)
+	if err != nil {
+		t.Fatalf("failed to write CSV: %+v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(discrepancies) + 1 {
+		t.Errorf("expected header and %d rows, got %q", len(discrepancies), buf.String())
+	}
+}
@@ -0,0 +1,202 @@
+package smtp_sink
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hostname = "smtp-sink.local"
+	// connections are dropped after this long without a command
+	idleTimeout = 1 * time.Minute
+)
+
+// a message as received by the sink
+type Message struct {
+	From string
+	To []string
+	// headers and body, as sent after DATA
+	Data string
+	ReceivedAt time.Time
+}
+
+// returns the value of a header in the message, empty if it is not set
+func (m Message) Header(name string) string {
+	headers := m.Data
+	if i := strings.Index(headers, "\r\n\r\n"); i >= 0 {
+		headers = headers[:i]
+	}
+	for _, line := range strings.Split(headers, "\r\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), name) {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+// the body of the message, after its headers
+func (m Message) Body() string {
+	if i := strings.Index(m.Data, "\r\n\r\n"); i >= 0 {
+		return m.Data[i + 4:]
+	}
+	return ""
+}
+
+// an SMTP server that accepts every message and keeps it in memory, for local runs and tests
+type Sink struct {
+	mutex sync.Mutex
+	messages []Message
+	listener net.Listener
+	connections sync.WaitGroup
+}
+
+// creates a new Sink
+func New() *Sink {
+	return &Sink{
+		messages: []Message{},
+	}
+}
+
+// starts serving on addr, e.g. "127.0.0.1:0", and returns the address to configure the SMTP client with
+func (s *Sink) Start(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	s.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.connections.Add(1)
+			go func() {
+				defer s.connections.Done()
+				err := s.serve(conn)
+				if err != nil {
+					fmt.Printf("SMTP sink connection failed: %v\n", err)
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), nil
+}
+
+// stops accepting connections and waits for open ones to finish
+func (s *Sink) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.connections.Wait()
+	return err
+}
+
+// every message received so far
+func (s *Sink) Messages() []Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages := make([]Message, len(s.messages))
+	copy(messages, s.messages)
+	return messages
+}
+
+// handles one SMTP session, only the commands net/smtp sends without authentication are supported
+func (s *Sink) serve(conn net.Conn) error {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+
+	err := text.PrintfLine("220 %s ESMTP sink", hostname)
+	if err != nil {
+		return err
+	}
+
+	var message *Message
+	for {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		line, err := text.ReadLine()
+		if err != nil {
+			return nil
+		}
+		command := strings.ToUpper(line)
+		if i := strings.IndexAny(command, " :"); i >= 0 {
+			command = command[:i]
+		}
+
+		switch command {
+		case "EHLO":
+			err = text.PrintfLine("250-%s\r\n250 8BITMIME", hostname)
+		case "HELO":
+			err = text.PrintfLine("250 %s", hostname)
+		case "MAIL":
+			message = &Message{
+				From: parseAddress(line),
+				To: []string{},
+			}
+			err = text.PrintfLine("250 OK")
+		case "RCPT":
+			if message == nil {
+				err = text.PrintfLine("503 MAIL first")
+				break
+			}
+			message.To = append(message.To, parseAddress(line))
+			err = text.PrintfLine("250 OK")
+		case "DATA":
+			if message == nil || len(message.To) == 0 {
+				err = text.PrintfLine("503 RCPT first")
+				break
+			}
+			err = text.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			if err != nil {
+				return err
+			}
+			var lines []string
+			lines, err = text.ReadDotLines()
+			if err != nil {
+				return err
+			}
+			message.Data = strings.Join(lines, "\r\n")
+			message.ReceivedAt = time.Now().UTC()
+			s.mutex.Lock()
+			s.messages = append(s.messages, *message)
+			s.mutex.Unlock()
+			fmt.Printf("SMTP sink received %q from %s to %v\n", message.Header("Subject"), message.From, message.To)
+			message = nil
+			err = text.PrintfLine("250 OK")
+		case "RSET":
+			message = nil
+			err = text.PrintfLine("250 OK")
+		case "NOOP":
+			err = text.PrintfLine("250 OK")
+		case "QUIT":
+			return text.PrintfLine("221 bye")
+		default:
+			err = text.PrintfLine("502 command not implemented")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// gets the address from "MAIL FROM:<a@b>" or "RCPT TO:<a@b>"
+func parseAddress(line string) string {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return ""
+	}
+	address := strings.TrimSpace(line[i + 1:])
+	if j := strings.Index(address, " "); j >= 0 {
+		address = address[:j]
+	}
+	return strings.Trim(address, "<>")
+}
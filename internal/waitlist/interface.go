@@ -0,0 +1,18 @@
+package waitlist
+
+import (
+	"context"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+)
+
+type Service interface {
+	// queues a delivery address for units of a sold-out product
+	Join(ctx context.Context, request JoinRequest) (*novellia_database.WaitlistEntry, error)
+	GetEntry(ctx context.Context, waitlistEntryID string) (*novellia_database.WaitlistEntry, error)
+	// checks that stock is still held by an entry for an order to deliveryAddress
+	CheckReservation(ctx context.Context, waitlistEntryID string, deliveryAddress string) (*novellia_database.WaitlistEntry, error)
+	// expires lapsed reservations and reserves unreserved stock for waiting entries in FIFO order, returning how many were reserved
+	ReserveAvailable(ctx context.Context) (int, error)
+	WatchWaitlist(ctx context.Context)
+}
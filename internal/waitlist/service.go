@@ -0,0 +1,267 @@
+package waitlist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano/address"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/notifications"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
+)
+
+const (
+	defaultReservation = 30 * time.Minute
+	defaultCheckInterval = 1 * time.Minute
+)
+
+var (
+	ErrInvalidRequest = errors.New("invalid waitlist request")
+	ErrInStock = errors.New("product is in stock")
+	ErrAlreadyWaiting = errors.New("delivery address is already on the waitlist for this product")
+	ErrEntryNotFound = errors.New("waitlist entry not found")
+)
+
+// the body of POST /waitlist
+type JoinRequest struct {
+	ProductID string `json:"product_id"`
+	DeliveryAddress string `json:"delivery_address"`
+	Quantity int64 `json:"quantity"`
+	// optional, notified when stock is reserved, otherwise the entry has to be polled
+	Contact *novellia_database.OrderContact `json:"contact,omitempty"`
+}
+
+// the waitlist queries of novellia_database.Service
+type Store interface {
+	GenerateULID(prefix string) string
+	InsertWaitlistEntry(ctx context.Context, entry novellia_database.WaitlistEntry) (bool, error)
+	QueryWaitlistEntry(ctx context.Context, waitlistEntryID string) (*novellia_database.WaitlistEntry, error)
+	QueryWaitingWaitlistEntries(ctx context.Context) ([]novellia_database.WaitlistEntry, error)
+	UpdateWaitlistEntryReserved(ctx context.Context, waitlistEntryID string, reservedUntil time.Time) (bool, error)
+	UpdateWaitlistEntriesExpired(ctx context.Context) (int64, error)
+	WithWaitlistLock(ctx context.Context, fn func(ctx context.Context) error) (bool, error)
+}
+
+// the parts of cardano.Service used to read stock, waitlist reservations are already subtracted
+type StockSource interface {
+	GetUnreservedStock(ctx context.Context) (map[string]*big.Int, error)
+}
+
+type ServiceImpl struct {
+	store Store
+	productsService products.Service
+	stockSource StockSource
+	notificationsService notifications.Service
+	reservation time.Duration
+	checkInterval time.Duration
+}
+
+// creates a new ServiceImpl holding reservations for reservation and checking for stock every checkInterval, zero values use defaults
+func New(store Store, productsService products.Service, stockSource StockSource, notificationsService notifications.Service, reservation time.Duration, checkInterval time.Duration) *ServiceImpl {
+	if reservation <= 0 {
+		reservation = defaultReservation
+	}
+	if checkInterval <= 0 {
+		checkInterval = defaultCheckInterval
+	}
+
+	return &ServiceImpl{
+		store: store,
+		productsService: productsService,
+		stockSource: stockSource,
+		notificationsService: notificationsService,
+		reservation: reservation,
+		checkInterval: checkInterval,
+	}
+}
+
+// creates a new ServiceImpl from waitlist in the config
+func NewFromConfig(cfg *config.Config, store Store, productsService products.Service, stockSource StockSource, notificationsService notifications.Service) *ServiceImpl {
+	return New(
+		store,
+		productsService,
+		stockSource,
+		notificationsService,
+		time.Duration(cfg.Waitlist.ReservationMinutes) * time.Minute,
+		time.Duration(cfg.Waitlist.CheckIntervalSeconds) * time.Second,
+	)
+}
+
+func (s *ServiceImpl) Join(ctx context.Context, request JoinRequest) (*novellia_database.WaitlistEntry, error) {
+	deliveryAddress := strings.TrimSpace(request.DeliveryAddress)
+	err := address.Validate(deliveryAddress)
+	if err != nil {
+		return nil, fmt.Errorf("%w: delivery address %s: %v", ErrInvalidRequest, deliveryAddress, err)
+	}
+	err = notifications.ValidateContact(request.Contact)
+	if err != nil {
+		return nil, err
+	}
+
+	productsMap, err := s.productsService.GetProducts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	product, ok := productsMap[request.ProductID]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown product %s", ErrInvalidRequest, request.ProductID)
+	}
+	// bundles are only unpacked into tokens when ordered, so there is nothing to reserve for them
+	if s.productsService.GetCatalog().Bundle(product.ProductID) != nil || product.NativeTokenID == "" {
+		return nil, fmt.Errorf("%w: %s is not a native token, bundles cannot be waitlisted", ErrInvalidRequest, product.ProductID)
+	}
+	if request.Quantity <= 0 {
+		return nil, fmt.Errorf("%w: quantity must be positive, got %d", ErrInvalidRequest, request.Quantity)
+	}
+	if product.MaxOrderSize > 0 && request.Quantity > int64(product.MaxOrderSize) {
+		return nil, fmt.Errorf("%w: at most %d of %s can be ordered at once, got %d", ErrInvalidRequest, product.MaxOrderSize, product.ProductID, request.Quantity)
+	}
+
+	stock, err := s.stockSource.GetUnreservedStock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if available, ok := stock[product.NativeTokenID]; ok && available.Cmp(big.NewInt(request.Quantity)) >= 0 {
+		return nil, fmt.Errorf("%w: %d of %s are available to order", ErrInStock, available, product.ProductID)
+	}
+
+	entry := novellia_database.WaitlistEntry{
+		WaitlistEntryID: s.store.GenerateULID("WAITLIST"),
+		ProductID: product.ProductID,
+		NativeTokenID: product.NativeTokenID,
+		DeliveryAddress: deliveryAddress,
+		Quantity: request.Quantity,
+	}
+	if request.Contact != nil {
+		entry.Contact = *request.Contact
+	}
+	inserted, err := s.store.InsertWaitlistEntry(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	if !inserted {
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyWaiting, product.ProductID)
+	}
+	prometheus_monitoring.TickWaitlistJoined()
+
+	return s.GetEntry(ctx, entry.WaitlistEntryID)
+}
+
+func (s *ServiceImpl) GetEntry(ctx context.Context, waitlistEntryID string) (*novellia_database.WaitlistEntry, error) {
+	entry, err := s.store.QueryWaitlistEntry(ctx, waitlistEntryID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("%w: %s", ErrEntryNotFound, waitlistEntryID)
+	}
+	return entry, nil
+}
+
+// the order claims the reservation when it is inserted, which checks this again
+func (s *ServiceImpl) CheckReservation(ctx context.Context, waitlistEntryID string, deliveryAddress string) (*novellia_database.WaitlistEntry, error) {
+	entry, err := s.GetEntry(ctx, waitlistEntryID)
+	if err != nil {
+		return nil, err
+	}
+	if entry.DeliveryAddress != deliveryAddress {
+		return nil, fmt.Errorf("%w: %s was made for another delivery address", novellia_database.ErrWaitlistReservationUnavailable, waitlistEntryID)
+	}
+	if entry.Status != novellia_database.WAITLIST_STATUS_RESERVED || entry.ReservedUntil == nil || !time.Now().Before(*entry.ReservedUntil) {
+		return nil, fmt.Errorf("%w: %s is %s", novellia_database.ErrWaitlistReservationUnavailable, waitlistEntryID, entry.Status)
+	}
+	return entry, nil
+}
+
+func (s *ServiceImpl) ReserveAvailable(ctx context.Context) (int, error) {
+	reserved := 0
+	// one instance reserves at a time, so that the same stock is not reserved twice
+	_, err := s.store.WithWaitlistLock(ctx, func(ctx context.Context) error {
+		expired, err := s.store.UpdateWaitlistEntriesExpired(ctx)
+		if err != nil {
+			return err
+		}
+		if expired > 0 {
+			fmt.Printf("Expired %d waitlist reservations\n", expired)
+			prometheus_monitoring.AddWaitlistReservationsExpired(float64(expired))
+		}
+
+		entries, err := s.store.QueryWaitingWaitlistEntries(ctx)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		stock, err := s.stockSource.GetUnreservedStock(ctx)
+		if err != nil {
+			return err
+		}
+
+		// native tokens whose next entry in line could not be reserved
+		blocked := map[string]bool{}
+		for _, entry := range entries {
+			if blocked[entry.NativeTokenID] {
+				continue
+			}
+			available, ok := stock[entry.NativeTokenID]
+			if !ok || available.Cmp(big.NewInt(entry.Quantity)) < 0 {
+				// entries behind wait their turn even if they want fewer units
+				blocked[entry.NativeTokenID] = true
+				continue
+			}
+
+			reservedUntil := time.Now().Add(s.reservation)
+			updated, err := s.store.UpdateWaitlistEntryReserved(ctx, entry.WaitlistEntryID, reservedUntil)
+			if err != nil {
+				return err
+			}
+			if !updated {
+				continue
+			}
+			available.Sub(available, big.NewInt(entry.Quantity))
+			reserved += 1
+			prometheus_monitoring.TickWaitlistReserved()
+
+			// customers without a contact poll their entry
+			if s.notificationsService == nil || entry.Contact == (novellia_database.OrderContact{}) {
+				continue
+			}
+			err = s.notificationsService.NotifyContact(ctx, &entry.Contact, notifications.EVENT_BACK_IN_STOCK, notifications.EventData{
+				WaitlistEntryID: entry.WaitlistEntryID,
+				ProductID: entry.ProductID,
+				Quantity: entry.Quantity,
+				ReservedUntil: reservedUntil,
+			})
+			if err != nil {
+				// the reservation stands, the customer can still find it by polling the entry
+				fmt.Printf("ReserveAvailable error (notify %s): %+v\n", entry.WaitlistEntryID, err)
+			}
+		}
+		return nil
+	})
+	return reserved, err
+}
+
+// reserves stock as it frees up, whether from lapsed reservations, failed orders or the hot wallet being topped up
+func (s *ServiceImpl) WatchWaitlist(ctx context.Context) {
+	go func() {
+		for {
+			time.Sleep(s.checkInterval)
+
+			_, err := s.ReserveAvailable(ctx)
+			if err != nil {
+				fmt.Printf("WatchWaitlist error: %+v\n", err)
+				prometheus_monitoring.SetWatchWaitlistStatus(0)
+				continue
+			}
+			prometheus_monitoring.SetWatchWaitlistStatus(1)
+		}
+	}()
+}
@@ -0,0 +1,257 @@
+package waitlist_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/notifications"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/waitlist"
+)
+
+const (
+	catalogPath = "../../config/catalog.yaml"
+	boosterProductID = "PROD-01F4NAF8MANXDT26MGA5E0QXNJ"
+	cardProductID = "PROD-CARD"
+	cardTokenID = "policy.card"
+	// CIP-19 test vectors
+	baseAddress = "addr1qx2fxv2umyhttkxyxp8x0dlpdt3k6cwng5pxj3jhsydzer3n0d3vllmyqwsx5wktcd8cc3sq835lu7drv2xwl2wywfgse35a3x"
+	enterpriseAddress = "addr1vx2fxv2umyhttkxyxp8x0dlpdt3k6cwng5pxj3jhsydzers66hrl8"
+	scriptAddress = "addr1w8phkx6acpnf78fuvxn0mkew3l0fd058hzquvz7w36x4gtcyjy7wx"
+)
+
+// serves products from memory instead of the database
+type testProducts struct {
+	*products.ServiceImpl
+	products map[string]novellia_database.Product
+}
+
+func (p *testProducts) GetProducts(ctx context.Context) (map[string]novellia_database.Product, error) {
+	return p.products, nil
+}
+
+type testStock struct {
+	stock map[string]*big.Int
+}
+
+// a copy, as the real source returns a new map each time
+func (s *testStock) GetUnreservedStock(ctx context.Context) (map[string]*big.Int, error) {
+	stock := map[string]*big.Int{}
+	for k, v := range s.stock {
+		stock[k] = big.NewInt(0).Set(v)
+	}
+	return stock, nil
+}
+
+// keeps entries in memory, reservations take stock from testStock like the reserved tokens query does
+type testStore struct {
+	entries []*novellia_database.WaitlistEntry
+	stock *testStock
+	ulids int
+}
+
+func (s *testStore) GenerateULID(prefix string) string {
+	s.ulids += 1
+	return fmt.Sprintf("%s-%03d", prefix, s.ulids)
+}
+
+func (s *testStore) InsertWaitlistEntry(ctx context.Context, entry novellia_database.WaitlistEntry) (bool, error) {
+	for _, e := range s.entries {
+		active := e.Status == novellia_database.WAITLIST_STATUS_WAITING || e.Status == novellia_database.WAITLIST_STATUS_RESERVED
+		if active && e.ProductID == entry.ProductID && e.DeliveryAddress == entry.DeliveryAddress {
+			return false, nil
+		}
+	}
+	entry.Status = novellia_database.WAITLIST_STATUS_WAITING
+	entry.CreatedAt = time.Now()
+	s.entries = append(s.entries, &entry)
+	return true, nil
+}
+
+func (s *testStore) QueryWaitlistEntry(ctx context.Context, waitlistEntryID string) (*novellia_database.WaitlistEntry, error) {
+	for _, e := range s.entries {
+		if e.WaitlistEntryID == waitlistEntryID {
+			entry := *e
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *testStore) QueryWaitingWaitlistEntries(ctx context.Context) ([]novellia_database.WaitlistEntry, error) {
+	entries := []novellia_database.WaitlistEntry{}
+	for _, e := range s.entries {
+		if e.Status == novellia_database.WAITLIST_STATUS_WAITING {
+			entries = append(entries, *e)
+		}
+	}
+	return entries, nil
+}
+
+func (s *testStore) UpdateWaitlistEntryReserved(ctx context.Context, waitlistEntryID string, reservedUntil time.Time) (bool, error) {
+	for _, e := range s.entries {
+		if e.WaitlistEntryID == waitlistEntryID && e.Status == novellia_database.WAITLIST_STATUS_WAITING {
+			e.Status = novellia_database.WAITLIST_STATUS_RESERVED
+			e.ReservedUntil = &reservedUntil
+			s.stock.stock[e.NativeTokenID].Sub(s.stock.stock[e.NativeTokenID], big.NewInt(e.Quantity))
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *testStore) UpdateWaitlistEntriesExpired(ctx context.Context) (int64, error) {
+	expired := int64(0)
+	for _, e := range s.entries {
+		if e.Status == novellia_database.WAITLIST_STATUS_RESERVED && !time.Now().Before(*e.ReservedUntil) {
+			e.Status = novellia_database.WAITLIST_STATUS_EXPIRED
+			s.stock.stock[e.NativeTokenID].Add(s.stock.stock[e.NativeTokenID], big.NewInt(e.Quantity))
+			expired += 1
+		}
+	}
+	return expired, nil
+}
+
+func (s *testStore) WithWaitlistLock(ctx context.Context, fn func(ctx context.Context) error) (bool, error) {
+	return true, fn(ctx)
+}
+
+// records notifications instead of queueing them
+type testNotifications struct {
+	notifications.Service
+	notified []notifications.EventData
+}
+
+func (n *testNotifications) NotifyContact(ctx context.Context, contact *novellia_database.OrderContact, eventType string, data notifications.EventData) error {
+	if eventType != notifications.EVENT_BACK_IN_STOCK || contact == nil || contact.Email == "" {
+		return fmt.Errorf("unexpected %s notification to %+v", eventType, contact)
+	}
+	n.notified = append(n.notified, data)
+	return nil
+}
+
+func TestWaitlist(t *testing.T) {
+	ctx := context.Background()
+
+	catalog, err := products.LoadCatalog(catalogPath)
+	if err != nil {
+		t.Fatalf("failed to load catalog: %v", err)
+	}
+	productsService := &testProducts{
+		ServiceImpl: products.New(nil, catalog, 0),
+		products: map[string]novellia_database.Product{
+			boosterProductID: novellia_database.Product{ProductID: boosterProductID, MaxOrderSize: 10},
+			cardProductID: novellia_database.Product{ProductID: cardProductID, NativeTokenID: cardTokenID, MaxOrderSize: 5},
+		},
+	}
+	stock := &testStock{stock: map[string]*big.Int{cardTokenID: big.NewInt(0)}}
+	store := &testStore{stock: stock}
+	notifier := &testNotifications{}
+	s := waitlist.New(store, productsService, stock, notifier, time.Hour, time.Minute)
+
+	contact := &novellia_database.OrderContact{Email: "customer@example.com"}
+	invalid := map[string]waitlist.JoinRequest{
+		"bundle": waitlist.JoinRequest{ProductID: boosterProductID, DeliveryAddress: baseAddress, Quantity: 1},
+		"unknown product": waitlist.JoinRequest{ProductID: "PROD-UNKNOWN", DeliveryAddress: baseAddress, Quantity: 1},
+		"no units": waitlist.JoinRequest{ProductID: cardProductID, DeliveryAddress: baseAddress, Quantity: 0},
+		"over max order size": waitlist.JoinRequest{ProductID: cardProductID, DeliveryAddress: baseAddress, Quantity: 6},
+		"invalid address": waitlist.JoinRequest{ProductID: cardProductID, DeliveryAddress: "addr1", Quantity: 1},
+	}
+	for name, request := range invalid {
+		_, err := s.Join(ctx, request)
+		if !errors.Is(err, waitlist.ErrInvalidRequest) {
+			t.Errorf("expected ErrInvalidRequest for %s, got %v", name, err)
+		}
+	}
+
+	// three customers join in order, the first wants more than the others
+	first, err := s.Join(ctx, waitlist.JoinRequest{ProductID: cardProductID, DeliveryAddress: baseAddress, Quantity: 3, Contact: contact})
+	if err != nil {
+		t.Fatalf("failed to join waitlist: %v", err)
+	}
+	second, err := s.Join(ctx, waitlist.JoinRequest{ProductID: cardProductID, DeliveryAddress: enterpriseAddress, Quantity: 1, Contact: contact})
+	if err != nil {
+		t.Fatalf("failed to join waitlist: %v", err)
+	}
+	third, err := s.Join(ctx, waitlist.JoinRequest{ProductID: cardProductID, DeliveryAddress: scriptAddress, Quantity: 1})
+	if err != nil {
+		t.Fatalf("failed to join waitlist: %v", err)
+	}
+	_, err = s.Join(ctx, waitlist.JoinRequest{ProductID: cardProductID, DeliveryAddress: baseAddress, Quantity: 1})
+	if !errors.Is(err, waitlist.ErrAlreadyWaiting) {
+		t.Errorf("expected ErrAlreadyWaiting, got %v", err)
+	}
+
+	// 2 units are not enough for the first customer, and the others wait behind them
+	stock.stock[cardTokenID] = big.NewInt(2)
+	reserved, err := s.ReserveAvailable(ctx)
+	if err != nil || reserved != 0 {
+		t.Errorf("expected no reservations ahead of the first customer, got %d: %v", reserved, err)
+	}
+
+	stock.stock[cardTokenID] = big.NewInt(4)
+	reserved, err = s.ReserveAvailable(ctx)
+	if err != nil || reserved != 2 {
+		t.Fatalf("expected the first two customers to be reserved, got %d: %v", reserved, err)
+	}
+	if len(notifier.notified) != 2 || notifier.notified[0].WaitlistEntryID != first.WaitlistEntryID || notifier.notified[0].Quantity != 3 || notifier.notified[1].WaitlistEntryID != second.WaitlistEntryID {
+		t.Errorf("expected the first two customers to be notified in order, got %+v", notifier.notified)
+	}
+	entry, err := s.GetEntry(ctx, third.WaitlistEntryID)
+	if err != nil || entry.Status != novellia_database.WAITLIST_STATUS_WAITING {
+		t.Errorf("expected the third customer to keep waiting, got %+v: %v", entry, err)
+	}
+
+	// a reservation can only be claimed by an order to its delivery address
+	entry, err = s.CheckReservation(ctx, first.WaitlistEntryID, baseAddress)
+	if err != nil || entry.Quantity != 3 {
+		t.Errorf("expected the first reservation to be held, got %+v: %v", entry, err)
+	}
+	_, err = s.CheckReservation(ctx, first.WaitlistEntryID, enterpriseAddress)
+	if !errors.Is(err, novellia_database.ErrWaitlistReservationUnavailable) {
+		t.Errorf("expected ErrWaitlistReservationUnavailable for another address, got %v", err)
+	}
+	_, err = s.CheckReservation(ctx, third.WaitlistEntryID, scriptAddress)
+	if !errors.Is(err, novellia_database.ErrWaitlistReservationUnavailable) {
+		t.Errorf("expected ErrWaitlistReservationUnavailable while waiting, got %v", err)
+	}
+
+	// the second reservation lapses and its unit goes to the third customer
+	past := time.Now().Add(-time.Minute)
+	for _, e := range store.entries {
+		if e.WaitlistEntryID == second.WaitlistEntryID {
+			e.ReservedUntil = &past
+		}
+	}
+	_, err = s.CheckReservation(ctx, second.WaitlistEntryID, enterpriseAddress)
+	if !errors.Is(err, novellia_database.ErrWaitlistReservationUnavailable) {
+		t.Errorf("expected ErrWaitlistReservationUnavailable once expired, got %v", err)
+	}
+	reserved, err = s.ReserveAvailable(ctx)
+	if err != nil || reserved != 1 {
+		t.Fatalf("expected the third customer to be reserved, got %d: %v", reserved, err)
+	}
+	entry, err = s.GetEntry(ctx, third.WaitlistEntryID)
+	if err != nil || entry.Status != novellia_database.WAITLIST_STATUS_RESERVED {
+		t.Errorf("expected the third customer to be reserved, got %+v: %v", entry, err)
+	}
+	if len(notifier.notified) != 2 {
+		t.Errorf("expected customers without a contact not to be notified")
+	}
+
+	// customers who can order now are told to
+	stock.stock[cardTokenID] = big.NewInt(5)
+	_, err = s.Join(ctx, waitlist.JoinRequest{ProductID: cardProductID, DeliveryAddress: enterpriseAddress, Quantity: 2})
+	if !errors.Is(err, waitlist.ErrInStock) {
+		t.Errorf("expected ErrInStock, got %v", err)
+	}
+	_, err = s.GetEntry(ctx, "WAITLIST-UNKNOWN")
+	if !errors.Is(err, waitlist.ErrEntryNotFound) {
+		t.Errorf("expected ErrEntryNotFound, got %v", err)
+	}
+}
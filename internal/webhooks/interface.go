@@ -0,0 +1,20 @@
+package webhooks
+
+import (
+	"context"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+)
+
+type Service interface {
+	// queues an event for every endpoint subscribed to it
+	Enqueue(ctx context.Context, eventType string, data EventData) error
+	// builds the deliveries Enqueue would queue, for the caller to write alongside its own changes
+	Deliveries(eventType string, data EventData) ([]novellia_database.WebhookDelivery, error)
+	// attempts deliveries that are due, retrying failures with exponential backoff
+	DeliverDue(ctx context.Context) error
+	GetDeadLetters(ctx context.Context) ([]novellia_database.WebhookDeadLetter, error)
+	// queues a dead letter for delivery again with its attempts reset
+	ReplayDeadLetter(ctx context.Context, deliveryID string) error
+	WatchWebhookDeliveries(ctx context.Context)
+}
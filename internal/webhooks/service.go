@@ -0,0 +1,373 @@
+package webhooks
+
+import (
+	"fmt"
+	"time"
+	"io"
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"io/ioutil"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders/statemachine"
+	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
+)
+
+const (
+	EVENT_ORDER_CREATED = "order.created"
+	EVENT_ORDER_PAID = "order.paid"
+	// the order's tokens were sent on Cardano and the order is FILLED, confirmations are not tracked
+	EVENT_ORDER_SUBMITTED = "order.submitted"
+	EVENT_ORDER_FAILED = "order.failed"
+	EVENT_ORDER_REFUNDED = "order.refunded"
+)
+
+const (
+	// hex HMAC-SHA512 of the body with the endpoint secret, like NowPayments' x-nowpayments-sig
+	SignatureHeader = "X-Novellia-Sig"
+	eventHeader = "X-Novellia-Event"
+	deliveryHeader = "X-Novellia-Delivery"
+
+	defaultMaxAttempts = 10
+	defaultRetryBaseDelay = 30 * time.Second
+	defaultTimeout = 10 * time.Second
+	maxRetryDelay = 6 * time.Hour
+	// deliveries attempted per claim
+	deliveryBatchSize = 20
+	checkWebhookDeliveriesInterval = 5 * time.Second
+	// responses are only read this far for error messages
+	maxErrorBodyBytes = 512
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("webhook dead letter not found")
+	eventTypes = map[string]bool{
+		EVENT_ORDER_CREATED: true,
+		EVENT_ORDER_PAID: true,
+		EVENT_ORDER_SUBMITTED: true,
+		EVENT_ORDER_FAILED: true,
+		EVENT_ORDER_REFUNDED: true,
+	}
+)
+
+// an order lifecycle event as sent to endpoints
+type Event struct {
+	// shared by the deliveries of this event to each endpoint
+	ID string `json:"id"`
+	Type string `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data EventData `json:"data"`
+}
+
+type EventData struct {
+	OrderID string `json:"order_id"`
+	// the status transition, if the event came from one
+	From string `json:"from,omitempty"`
+	To string `json:"to,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Cardano transaction for order.submitted
+	TxID string `json:"txid,omitempty"`
+}
+
+type Endpoint struct {
+	Name string
+	URL string
+	Secret string
+	// every event if empty
+	Events []string
+}
+
+func (e Endpoint) subscribes(eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, t := range e.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// the parts of novellia_database.Service used to queue and deliver webhooks
+type Store interface {
+	GenerateULID(prefix string) string
+	InsertWebhookDeliveries(ctx context.Context, deliveries []novellia_database.WebhookDelivery) error
+	ClaimWebhookDeliveries(ctx context.Context, lease time.Duration, limit int) ([]novellia_database.WebhookDelivery, error)
+	UpdateWebhookDelivered(ctx context.Context, deliveryID string, attempts int) error
+	UpdateWebhookRetry(ctx context.Context, deliveryID string, attempts int, lastError string, delay time.Duration) error
+	DeadLetterWebhookDelivery(ctx context.Context, deliveryID string, attempts int, lastError string) error
+	QueryWebhookDeadLetters(ctx context.Context) ([]novellia_database.WebhookDeadLetter, error)
+	ReplayWebhookDeadLetter(ctx context.Context, deliveryID string) (bool, error)
+}
+
+type ServiceImpl struct {
+	store Store
+	// name -> endpoint
+	endpoints map[string]Endpoint
+	client *http.Client
+	maxAttempts int
+	retryBaseDelay time.Duration
+}
+
+// creates a new ServiceImpl, zero values of maxAttempts, retryBaseDelay and timeout use defaults
+func New(store Store, endpoints []Endpoint, maxAttempts int, retryBaseDelay time.Duration, timeout time.Duration) (*ServiceImpl, error) {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	if retryBaseDelay <= 0 {
+		retryBaseDelay = defaultRetryBaseDelay
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	s := ServiceImpl{
+		store: store,
+		endpoints: make(map[string]Endpoint),
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		maxAttempts: maxAttempts,
+		retryBaseDelay: retryBaseDelay,
+	}
+	for _, e := range endpoints {
+		if e.Name == "" || e.URL == "" || e.Secret == "" {
+			return nil, fmt.Errorf("webhook endpoints require a name, URL and secret")
+		}
+		if _, ok := s.endpoints[e.Name]; ok {
+			return nil, fmt.Errorf("duplicate webhook endpoint %s", e.Name)
+		}
+		for _, t := range e.Events {
+			if !eventTypes[t] {
+				return nil, fmt.Errorf("webhook endpoint %s has unknown event %s", e.Name, t)
+			}
+		}
+		s.endpoints[e.Name] = e
+	}
+
+	return &s, nil
+}
+
+// creates a new ServiceImpl from webhooks in the config
+func NewFromConfig(cfg *config.Config, store Store) (*ServiceImpl, error) {
+	endpoints := []Endpoint{}
+	for _, e := range cfg.Webhooks.Endpoints {
+		endpoints = append(endpoints, Endpoint{
+			Name: e.Name,
+			URL: e.URL,
+			Secret: e.Secret,
+			Events: e.Events,
+		})
+	}
+
+	return New(
+		store,
+		endpoints,
+		cfg.Webhooks.MaxAttempts,
+		time.Duration(cfg.Webhooks.RetryBaseDelaySeconds) * time.Second,
+		time.Duration(cfg.Webhooks.TimeoutSeconds) * time.Second,
+	)
+}
+
+// the event sent when an order moves between statuses, empty if none is
+// fills are sent as order.submitted with their Cardano transaction, see orders.CheckAndUpdateOrderFulfillment
+func EventTypeForTransition(from string, to string) string {
+	switch {
+	case from == statemachine.STATE_PENDING && to == statemachine.STATE_AWAITING_PAYMENT:
+		return EVENT_ORDER_CREATED
+	case from == to:
+		return ""
+	case to == statemachine.STATE_PAID:
+		return EVENT_ORDER_PAID
+	case to == statemachine.STATE_FAILED:
+		return EVENT_ORDER_FAILED
+	case to == statemachine.STATE_REFUND:
+		return EVENT_ORDER_REFUNDED
+	default:
+		return ""
+	}
+}
+
+// signs a body with an endpoint secret, receivers compare this to the X-Novellia-Sig header
+func Sign(secret string, body []byte) string {
+	h := hmac.New(sha512.New, []byte(secret))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// marshals an event with its keys sorted alphabetically, as NowPayments does for IPN callbacks
+func marshalSorted(event Event) ([]byte, error) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func (s *ServiceImpl) Enqueue(ctx context.Context, eventType string, data EventData) error {
+	deliveries, err := s.Deliveries(eventType, data)
+	if err != nil {
+		return err
+	}
+
+	err = s.store.InsertWebhookDeliveries(ctx, deliveries)
+	if err != nil {
+		return fmt.Errorf("failed to queue %s webhooks for order %s: %v", eventType, data.OrderID, err)
+	}
+	return nil
+}
+
+func (s *ServiceImpl) Deliveries(eventType string, data EventData) ([]novellia_database.WebhookDelivery, error) {
+	if !eventTypes[eventType] {
+		return nil, fmt.Errorf("unknown webhook event %s", eventType)
+	}
+
+	event := Event{
+		ID: s.store.GenerateULID("EVENT"),
+		Type: eventType,
+		CreatedAt: time.Now().UTC(),
+		Data: data,
+	}
+	payload, err := marshalSorted(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal webhook event: %v", err)
+	}
+
+	deliveries := []novellia_database.WebhookDelivery{}
+	for _, e := range s.endpoints {
+		if !e.subscribes(eventType) {
+			continue
+		}
+		deliveries = append(deliveries, novellia_database.WebhookDelivery{
+			DeliveryID: s.store.GenerateULID("WEBHOOK"),
+			EndpointName: e.Name,
+			EventType: eventType,
+			OrderID: data.OrderID,
+			Payload: string(payload),
+		})
+	}
+	return deliveries, nil
+}
+
+// how long to wait after a number of failed attempts
+func (s *ServiceImpl) retryDelay(attempts int) time.Duration {
+	delay := s.retryBaseDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i += 1 {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// sends a delivery once, returning why it failed
+func (s *ServiceImpl) send(ctx context.Context, endpoint Endpoint, delivery novellia_database.WebhookDelivery) error {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(endpoint.Secret, body))
+	req.Header.Set(eventHeader, delivery.EventType)
+	req.Header.Set(deliveryHeader, delivery.DeliveryID)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		return fmt.Errorf("endpoint responded %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// attempts a delivery, recording the outcome
+func (s *ServiceImpl) deliver(ctx context.Context, delivery novellia_database.WebhookDelivery) error {
+	attempts := delivery.Attempts + 1
+	endpoint, ok := s.endpoints[delivery.EndpointName]
+	if !ok {
+		prometheus_monitoring.TickWebhookDeadLettered()
+		return s.store.DeadLetterWebhookDelivery(ctx, delivery.DeliveryID, delivery.Attempts, fmt.Sprintf("endpoint %s is no longer configured", delivery.EndpointName))
+	}
+
+	err := s.send(ctx, endpoint, delivery)
+	if err == nil {
+		prometheus_monitoring.TickWebhookDelivered()
+		return s.store.UpdateWebhookDelivered(ctx, delivery.DeliveryID, attempts)
+	}
+
+	fmt.Printf("Webhook %s (%s for order %s) to %s failed, attempt %d: %+v\n", delivery.DeliveryID, delivery.EventType, delivery.OrderID, endpoint.Name, attempts, err)
+	prometheus_monitoring.TickWebhookFailed()
+	if attempts >= s.maxAttempts {
+		prometheus_monitoring.TickWebhookDeadLettered()
+		return s.store.DeadLetterWebhookDelivery(ctx, delivery.DeliveryID, attempts, err.Error())
+	}
+	return s.store.UpdateWebhookRetry(ctx, delivery.DeliveryID, attempts, err.Error(), s.retryDelay(attempts))
+}
+
+func (s *ServiceImpl) DeliverDue(ctx context.Context) error {
+	// leased long enough for every claimed delivery to time out before another instance retries them
+	lease := time.Duration(deliveryBatchSize) * s.client.Timeout + time.Minute
+	deliveries, err := s.store.ClaimWebhookDeliveries(ctx, lease, deliveryBatchSize)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, d := range deliveries {
+		err = s.deliver(ctx, d)
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (s *ServiceImpl) GetDeadLetters(ctx context.Context) ([]novellia_database.WebhookDeadLetter, error) {
+	return s.store.QueryWebhookDeadLetters(ctx)
+}
+
+func (s *ServiceImpl) ReplayDeadLetter(ctx context.Context, deliveryID string) error {
+	replayed, err := s.store.ReplayWebhookDeadLetter(ctx, deliveryID)
+	if err != nil {
+		return err
+	}
+	if !replayed {
+		return fmt.Errorf("%w: %s", ErrDeadLetterNotFound, deliveryID)
+	}
+	return nil
+}
+
+func (s *ServiceImpl) WatchWebhookDeliveries(ctx context.Context) {
+	go func() {
+		for {
+			time.Sleep(checkWebhookDeliveriesInterval)
+
+			err := s.DeliverDue(ctx)
+			if err != nil {
+				fmt.Printf("WatchWebhookDeliveries error: %+v\n", err)
+				prometheus_monitoring.SetWatchWebhookDeliveriesStatus(0)
+				continue
+			}
+			prometheus_monitoring.SetWatchWebhookDeliveriesStatus(1)
+		}
+	}()
+}
@@ -0,0 +1,213 @@
+package webhooks_test
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"sync/atomic"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"io/ioutil"
+
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/webhooks"
+)
+
+// keeps deliveries in memory, every pending delivery is due
+type testStore struct {
+	ids int
+	deliveries map[string]*novellia_database.WebhookDelivery
+	statuses map[string]string
+	delays map[string]time.Duration
+	deadLetters map[string]string
+}
+
+func newTestStore() *testStore {
+	return &testStore{
+		deliveries: make(map[string]*novellia_database.WebhookDelivery),
+		statuses: make(map[string]string),
+		delays: make(map[string]time.Duration),
+		deadLetters: make(map[string]string),
+	}
+}
+
+func (s *testStore) GenerateULID(prefix string) string {
+	s.ids += 1
+	return fmt.Sprintf("%s-%d", prefix, s.ids)
+}
+
+func (s *testStore) InsertWebhookDeliveries(ctx context.Context, deliveries []novellia_database.WebhookDelivery) error {
+	for i := range deliveries {
+		d := deliveries[i]
+		s.deliveries[d.DeliveryID] = &d
+		s.statuses[d.DeliveryID] = "PENDING"
+	}
+	return nil
+}
+
+func (s *testStore) ClaimWebhookDeliveries(ctx context.Context, lease time.Duration, limit int) ([]novellia_database.WebhookDelivery, error) {
+	claimed := []novellia_database.WebhookDelivery{}
+	for id, d := range s.deliveries {
+		if s.statuses[id] == "PENDING" && len(claimed) < limit {
+			claimed = append(claimed, *d)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *testStore) UpdateWebhookDelivered(ctx context.Context, deliveryID string, attempts int) error {
+	s.statuses[deliveryID] = "DELIVERED"
+	s.deliveries[deliveryID].Attempts = attempts
+	return nil
+}
+
+func (s *testStore) UpdateWebhookRetry(ctx context.Context, deliveryID string, attempts int, lastError string, delay time.Duration) error {
+	s.deliveries[deliveryID].Attempts = attempts
+	s.delays[deliveryID] = delay
+	return nil
+}
+
+func (s *testStore) DeadLetterWebhookDelivery(ctx context.Context, deliveryID string, attempts int, lastError string) error {
+	s.statuses[deliveryID] = "DEAD"
+	s.deliveries[deliveryID].Attempts = attempts
+	s.deadLetters[deliveryID] = lastError
+	return nil
+}
+
+func (s *testStore) QueryWebhookDeadLetters(ctx context.Context) ([]novellia_database.WebhookDeadLetter, error) {
+	deadLetters := []novellia_database.WebhookDeadLetter{}
+	for id, lastError := range s.deadLetters {
+		deadLetters = append(deadLetters, novellia_database.WebhookDeadLetter{DeliveryID: id, LastError: lastError})
+	}
+	return deadLetters, nil
+}
+
+func (s *testStore) ReplayWebhookDeadLetter(ctx context.Context, deliveryID string) (bool, error) {
+	if _, ok := s.deadLetters[deliveryID]; !ok {
+		return false, nil
+	}
+	delete(s.deadLetters, deliveryID)
+	s.statuses[deliveryID] = "PENDING"
+	s.deliveries[deliveryID].Attempts = 0
+	return true, nil
+}
+
+func TestEventTypeForTransition(t *testing.T) {
+	tests := []struct {
+		from string
+		to string
+		eventType string
+	}{
+		{"", "PENDING", ""},
+		{"PENDING", "AWAITING_PAYMENT", webhooks.EVENT_ORDER_CREATED},
+		{"AWAITING_PAYMENT", "PAID", webhooks.EVENT_ORDER_PAID},
+		{"FAILED", "PAID", webhooks.EVENT_ORDER_PAID},
+		// announced as order.submitted along with the transaction
+		{"PAID", "FILLED", ""},
+		{"AWAITING_PAYMENT", "FAILED", webhooks.EVENT_ORDER_FAILED},
+		{"ORPHANED", "REFUND", webhooks.EVENT_ORDER_REFUNDED},
+		{"PENDING", "ORPHANED", ""},
+		// interventions recorded without a status change
+		{"PAID", "PAID", ""},
+	}
+
+	for _, test := range tests {
+		eventType := webhooks.EventTypeForTransition(test.from, test.to)
+		if eventType != test.eventType {
+			t.Errorf("%s -> %s: expected %q, got %q", test.from, test.to, test.eventType, eventType)
+		}
+	}
+}
+
+func TestDeliverDue(t *testing.T) {
+	ctx := context.Background()
+
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	// set from the test while the server reads it
+	var failing int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/failing" && atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- r
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	store := newTestStore()
+	s, err := webhooks.New(store, []webhooks.Endpoint{
+		{Name: "storefront", URL: server.URL + "/storefront", Secret: "storefront-secret"},
+		{Name: "accounting", URL: server.URL + "/failing", Secret: "accounting-secret", Events: []string{webhooks.EVENT_ORDER_PAID}},
+		{Name: "discord", URL: server.URL + "/discord", Secret: "discord-secret", Events: []string{webhooks.EVENT_ORDER_SUBMITTED}},
+	}, 2, time.Minute, time.Second)
+	if err != nil {
+		t.Fatalf("failed to create webhooks service: %v", err)
+	}
+
+	err = s.Enqueue(ctx, webhooks.EVENT_ORDER_PAID, webhooks.EventData{OrderID: "ORDER-1", From: "AWAITING_PAYMENT", To: "PAID"})
+	if err != nil {
+		t.Fatalf("failed to enqueue: %v", err)
+	}
+	// discord is not subscribed to order.paid
+	if len(store.deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries, got %d", len(store.deliveries))
+	}
+
+	err = s.DeliverDue(ctx)
+	if err != nil {
+		t.Fatalf("failed to deliver: %v", err)
+	}
+	r := <-received
+	body := <-bodies
+	if r.URL.Path != "/storefront" || r.Header.Get(webhooks.SignatureHeader) != webhooks.Sign("storefront-secret", body) {
+		t.Errorf("unexpected delivery to %s with signature %s", r.URL.Path, r.Header.Get(webhooks.SignatureHeader))
+	}
+	expectedPrefix := `{"created_at":`
+	if string(body[:len(expectedPrefix)]) != expectedPrefix {
+		t.Errorf("payload keys are not sorted: %s", body)
+	}
+
+	// accounting failed once and is retried after the base delay
+	var accountingID string
+	for id, d := range store.deliveries {
+		if d.EndpointName == "accounting" {
+			accountingID = id
+		}
+	}
+	if store.statuses[accountingID] != "PENDING" || store.deliveries[accountingID].Attempts != 1 || store.delays[accountingID] != time.Minute {
+		t.Fatalf("expected a retry, got %s after %d attempts with delay %v", store.statuses[accountingID], store.deliveries[accountingID].Attempts, store.delays[accountingID])
+	}
+
+	// the second failure exhausts the attempts
+	err = s.DeliverDue(ctx)
+	if err != nil {
+		t.Fatalf("failed to deliver: %v", err)
+	}
+	if store.statuses[accountingID] != "DEAD" {
+		t.Fatalf("expected a dead letter, got %s", store.statuses[accountingID])
+	}
+
+	// replayed once the endpoint recovers
+	atomic.StoreInt32(&failing, 0)
+	err = s.ReplayDeadLetter(ctx, accountingID)
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	err = s.DeliverDue(ctx)
+	if err != nil {
+		t.Fatalf("failed to deliver: %v", err)
+	}
+	if store.statuses[accountingID] != "DELIVERED" {
+		t.Errorf("expected replay to be delivered, got %s", store.statuses[accountingID])
+	}
+
+	err = s.ReplayDeadLetter(ctx, accountingID)
+	if err == nil {
+		t.Errorf("expected replaying a delivered webhook to fail")
+	}
+}
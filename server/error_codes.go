@@ -9,4 +9,11 @@ const (
 	routerErr = 5
 	nowPaymentsErr = 6
 	cardanoErr = 7
+	quotesErr = 8
+	feesErr = 9
+	authErr = 10
+	webhooksErr = 11
+	notificationsErr = 12
+	productsErr = 13
+	phasesErr = 14
 )
@@ -3,23 +3,83 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"context"
+	"time"
 	
 	ordf "github.com/RektangularStudios/novellia-sdk/sdk/server/go/order_fulfillment/v0"
 	
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/config"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/api"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/auth"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/novellia_database"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/now_payments_emulator"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/orders"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/events"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/webhooks"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/notifications"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fairness"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/listings"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/phases"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/eligibility"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/waitlist"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/smtp_sink"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/products"
 	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/cardano"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/quotes"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/fees"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/promotions"
+	"bitbucket.org/ConcurrentDragon/order-fulfillment/internal/reconciliation"
 	prometheus_monitoring "bitbucket.org/ConcurrentDragon/order-fulfillment/internal/monitoring"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// starts the NowPayments emulator on the host in now-payments.base-url, running emulator-script for each payment
+func startNowPaymentsEmulator(cfg *config.Config) (*now_payments_emulator.Emulator, error) {
+	u, err := url.Parse(cfg.NowPayments.BaseURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("now-payments.base-url must be set to run the emulator, got %q", cfg.NowPayments.BaseURL)
+	}
+
+	emulator := now_payments_emulator.New(cfg.NowPayments.APIKey, cfg.NowPayments.IPNSecretKey)
+	script := []now_payments_emulator.Step{}
+	for _, step := range cfg.NowPayments.EmulatorScript {
+		script = append(script, now_payments_emulator.Step{
+			Status: step.Status,
+			After: time.Duration(step.AfterSeconds) * time.Second,
+			PaidFraction: step.PaidFraction,
+		})
+	}
+	emulator.SetScript(script)
+
+	baseURL, err := emulator.Start(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("NowPayments emulator listening on %s\n", baseURL)
+
+	return emulator, nil
+}
+
+// starts the SMTP sink on notifications.smtp.host and port, messages are only kept in memory and logged
+func startSMTPSink(cfg *config.Config) (*smtp_sink.Sink, error) {
+	if cfg.Notifications.SMTP.Host == "" {
+		return nil, fmt.Errorf("notifications.smtp.host must be set to run the SMTP sink")
+	}
+
+	sink := smtp_sink.New()
+	addr, err := sink.Start(fmt.Sprintf("%s:%d", cfg.Notifications.SMTP.Host, cfg.Notifications.SMTP.Port))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("SMTP sink listening on %s\n", addr)
+
+	return sink, nil
+}
+
 func main() {
 	ctx := context.Background()
 
@@ -45,6 +105,8 @@ func main() {
 	fmt.Printf("Starting server with configuration (%s):\n %+v\n", configPath, config)
 
 	var apiService api.ApiServicer
+	// mutating admin requests are written to the audit log, only printed when mocked
+	var auditLog auth.AuditLog
 	if config.Mocked {
 		apiService = api.NewMockedApiService()
 	} else {	
@@ -61,6 +123,17 @@ func main() {
 			os.Exit(novelliaDatabaseErr)
 		}
 		defer novelliaDatabaseService.Close()
+		auditLog = novelliaDatabaseService
+
+		// serve the emulator where the NowPayments client is configured to look for the API
+		if config.NowPayments.Emulated {
+			nowPaymentsEmulator, err := startNowPaymentsEmulator(config)
+			if err != nil {
+				fmt.Printf("Failed to start NowPayments emulator: %+v\n", err)
+				os.Exit(nowPaymentsErr)
+			}
+			defer nowPaymentsEmulator.Close()
+		}
 
 		nowPaymentsService, err := now_payments.New(config.NowPayments.APIKey, config.NowPayments.IPNSecretKey, config.NowPayments.IsSandbox)
 		if err != nil {
@@ -68,31 +141,138 @@ func main() {
 			os.Exit(nowPaymentsErr)
 		}
 
-		productsService := products.New(novelliaDatabaseService)
+		productsService, err := products.NewFromConfig(config, novelliaDatabaseService)
+		if err != nil {
+			fmt.Printf("Failed to create products service: %+v\n", err)
+			os.Exit(productsErr)
+		}
 
-		cardanoService, err := cardano.New(novelliaDatabaseService, productsService)
+		// products are cached, changes to novellia.product are notified through Postgres LISTEN/NOTIFY
+		productsService.WatchProductChanges(ctx)
+
+		feesService, err := fees.NewFromConfig(config)
+		if err != nil {
+			fmt.Printf("Failed to create fees service: %+v\n", err)
+			os.Exit(feesErr)
+		}
+
+		cardanoService, err := cardano.New(novelliaDatabaseService, productsService, feesService)
 		if err != nil {
 			fmt.Printf("Failed to create Cardano service: %+v\n", err)
 			os.Exit(cardanoErr)
 		}
 
+		promotionsService := promotions.New(novelliaDatabaseService)
+
+		phasesService, err := phases.NewFromConfig(config)
+		if err != nil {
+			fmt.Printf("Failed to create sale phases service: %+v\n", err)
+			os.Exit(phasesErr)
+		}
+
+		quotesService, err := quotes.New(
+			novelliaDatabaseService,
+			productsService,
+			cardanoService,
+			feesService,
+			promotionsService,
+			phasesService,
+			config.Quotes.SigningKey,
+			time.Duration(config.Quotes.TTLSeconds) * time.Second,
+		)
+		if err != nil {
+			fmt.Printf("Failed to create quotes service: %+v\n", err)
+			os.Exit(quotesErr)
+		}
+
+		// status changes fan out to every instance through Postgres LISTEN/NOTIFY
+		eventsService := events.New(novelliaDatabaseService)
+		eventsService.Listen(ctx)
+
+		webhooksService, err := webhooks.NewFromConfig(config, novelliaDatabaseService)
+		if err != nil {
+			fmt.Printf("Failed to create webhooks service: %+v\n", err)
+			os.Exit(webhooksErr)
+		}
+		webhooksService.WatchWebhookDeliveries(ctx)
+
+		// serve the sink where email notifications are configured to be sent
+		if config.Notifications.SMTP.Sink {
+			smtpSink, err := startSMTPSink(config)
+			if err != nil {
+				fmt.Printf("Failed to start SMTP sink: %+v\n", err)
+				os.Exit(notificationsErr)
+			}
+			defer smtpSink.Close()
+		}
+
+		notificationsService, err := notifications.NewFromConfig(config, novelliaDatabaseService)
+		if err != nil {
+			fmt.Printf("Failed to create notifications service: %+v\n", err)
+			os.Exit(notificationsErr)
+		}
+		notificationsService.WatchNotifications(ctx)
+
+		fairnessService := fairness.New(novelliaDatabaseService, productsService)
+		// token holdings are checked with the same UTXO query as stock
+		eligibilityService := eligibility.New(novelliaDatabaseService, cardanoService)
+		listingsService := listings.NewFromConfig(config, productsService, phasesService, cardanoService)
+		// customers waiting for sold-out products get stock as it frees up, in the order they joined
+		waitlistService := waitlist.NewFromConfig(config, novelliaDatabaseService, productsService, cardanoService, notificationsService)
+		waitlistService.WatchWaitlist(ctx)
+
 		ordersService := orders.New(
 			novelliaDatabaseService,
 			nowPaymentsService,	
 			productsService,
 			cardanoService,
+			quotesService,
+			feesService,
+			promotionsService,
+			eventsService,
+			webhooksService,
+			notificationsService,
+			fairnessService,
+			phasesService,
+			eligibilityService,
+			waitlistService,
 		)
 		ordersService.WatchOrdersForPayment(ctx)
 		ordersService.WatchOrdersForFulfillment(ctx)
+		ordersService.WatchPaymentCompensations(ctx)
+
+		reconciliationService := reconciliation.New(novelliaDatabaseService, nowPaymentsService)
+		if config.Reconciliation.IntervalMinutes > 0 && config.Reconciliation.LookbackHours > 0 {
+			reconciliationService.WatchReconciliation(
+				ctx,
+				time.Duration(config.Reconciliation.IntervalMinutes) * time.Minute,
+				time.Duration(config.Reconciliation.LookbackHours) * time.Hour,
+			)
+		}
 
 		apiService = api.NewApiService(
 			nowPaymentsService,
 			ordersService,
+			promotionsService,
+			reconciliationService,
+			webhooksService,
+			fairnessService,
+			listingsService,
+			phasesService,
+			eligibilityService,
+			productsService,
+			waitlistService,
 		)
 	}
 
+	authService, err := auth.New(config, auditLog)
+	if err != nil {
+		fmt.Printf("Failed to create auth service: %+v\n", err)
+		os.Exit(authErr)
+	}
+
 	apiController := ordf.NewDefaultApiController(apiService)
-	router := ordf.NewRouter(apiController)
+	router := ordf.NewRouter(api.NewApiController(apiService, authService), apiController)
 	
 	// add IPN webhook to router
 	router.Handle("/order-fulfillment/v0/ipn", http.HandlerFunc(apiService.IPNWebhook)).
@@ -106,7 +286,11 @@ func main() {
 
 	// add Prometheus metrics to router
 	prometheus_monitoring.RecordMetrics()
-	router.Handle("/metrics", promhttp.Handler())
+	if config.Auth.ProtectMetrics {
+		router.Handle("/metrics", authService.Require(auth.ROLE_VIEWER, promhttp.Handler().ServeHTTP))
+	} else {
+		router.Handle("/metrics", promhttp.Handler())
+	}
 
 	hostString := fmt.Sprintf("%s:%s", config.Server.Host, config.Server.Port)
 	server := http.Server {
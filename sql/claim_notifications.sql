@@ -0,0 +1,25 @@
+-- leases due notifications so that other instances skip them while they are sent
+UPDATE order_fulfillment.notification
+SET
+  next_attempt_at = NOW() + make_interval(secs => $1),
+  updated_at = NOW()
+WHERE notification_id IN (
+  SELECT notification_id
+  FROM order_fulfillment.notification
+  WHERE
+    notification_status = 'PENDING' AND
+    next_attempt_at <= NOW()
+  ORDER BY next_attempt_at
+  LIMIT $2
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING
+  notification_id,
+  COALESCE(customer_order_id, ''),
+  COALESCE(waitlist_entry_id, ''),
+  channel,
+  recipient,
+  event_type,
+  subject,
+  body,
+  attempts;
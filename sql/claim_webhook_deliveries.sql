@@ -0,0 +1,22 @@
+-- leases due deliveries so that other instances skip them while they are attempted
+UPDATE order_fulfillment.webhook_delivery
+SET
+  next_attempt_at = NOW() + make_interval(secs => $1),
+  updated_at = NOW()
+WHERE webhook_delivery_id IN (
+  SELECT webhook_delivery_id
+  FROM order_fulfillment.webhook_delivery
+  WHERE
+    delivery_status = 'PENDING' AND
+    next_attempt_at <= NOW()
+  ORDER BY next_attempt_at
+  LIMIT $2
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING
+  webhook_delivery_id,
+  endpoint_name,
+  event_type,
+  customer_order_id,
+  payload,
+  attempts;
@@ -0,0 +1,2 @@
+DELETE FROM order_fulfillment.allowlist_address
+WHERE allowlist_id = $1;
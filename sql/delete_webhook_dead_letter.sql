@@ -0,0 +1,2 @@
+DELETE FROM order_fulfillment.webhook_dead_letter
+WHERE webhook_delivery_id = $1;
@@ -0,0 +1,7 @@
+INSERT INTO order_fulfillment.allowlist_address
+(
+  allowlist_id,
+  address
+)
+VALUES($1, $2)
+ON CONFLICT DO NOTHING;
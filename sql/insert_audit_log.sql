@@ -0,0 +1,10 @@
+INSERT INTO order_fulfillment.audit_log
+(
+  actor_id,
+  actor_role,
+  auth_method,
+  request_method,
+  request_path,
+  status_code
+)
+VALUES($1, $2, $3, $4, $5, $6);
@@ -0,0 +1,7 @@
+INSERT INTO order_fulfillment.customer_order_contact
+(
+  customer_order_id,
+  email,
+  discord_webhook_url
+)
+VALUES($1, $2, $3);
@@ -0,0 +1,20 @@
+-- only inserts if the address stays within the phase's cap, so caps hold even if other orders were placed since validation
+INSERT INTO order_fulfillment.customer_order_eligibility
+(
+  customer_order_id,
+  sale_phase,
+  address,
+  units
+)
+SELECT $1, $2, $3, $4::INTEGER
+WHERE
+  $5::INTEGER = 0 OR
+  $5::INTEGER >= $4::INTEGER + (
+    SELECT COALESCE(SUM(order_fulfillment.customer_order_eligibility.units), 0)
+    FROM order_fulfillment.customer_order_eligibility
+    INNER JOIN order_fulfillment.customer_order ON order_fulfillment.customer_order.customer_order_id = order_fulfillment.customer_order_eligibility.customer_order_id
+    WHERE
+      order_fulfillment.customer_order_eligibility.sale_phase = $2 AND
+      order_fulfillment.customer_order_eligibility.address = $3 AND
+      order_fulfillment.customer_order.order_status <> 'FAILED'
+  );
@@ -0,0 +1,9 @@
+INSERT INTO order_fulfillment.customer_order_fee
+(
+  customer_order_id,
+  fee_name,
+  fee_type,
+  amount,
+  waived_by
+)
+VALUES($1, $2, $3, $4, NULLIF($5, ''));
@@ -0,0 +1,10 @@
+INSERT INTO order_fulfillment.customer_order_pull
+(
+  customer_order_id,
+  item_index,
+  product_id,
+  sale_seed_id,
+  unpacked_product_ids,
+  odds
+)
+VALUES($1, $2, $3, $4, $5, $6);
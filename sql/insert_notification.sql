@@ -0,0 +1,13 @@
+INSERT INTO order_fulfillment.notification
+(
+  notification_id,
+  customer_order_id,
+  waitlist_entry_id,
+  channel,
+  recipient,
+  event_type,
+  subject,
+  body,
+  notification_status
+)
+VALUES($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6, $7, $8, 'PENDING');
@@ -0,0 +1,10 @@
+INSERT INTO order_fulfillment.order_status_history
+(
+  customer_order_id,
+  from_status,
+  to_status,
+  reason,
+  actor,
+  actor_id
+)
+VALUES($1, $2, $3, $4, $5, $6);
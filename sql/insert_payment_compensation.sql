@@ -0,0 +1,10 @@
+INSERT INTO order_fulfillment.payment_compensation
+(
+  customer_order_id,
+  payment_id,
+  pay_address,
+  compensation_status,
+  detail
+)
+VALUES($1, $2, $3, $4, $5)
+ON CONFLICT (customer_order_id) DO NOTHING;
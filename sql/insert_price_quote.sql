@@ -0,0 +1,7 @@
+INSERT INTO order_fulfillment.price_quote
+(
+  price_quote_id,
+  quote,
+  expires_at
+)
+VALUES($1, $2, $3);
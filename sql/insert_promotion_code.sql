@@ -0,0 +1,12 @@
+INSERT INTO order_fulfillment.promotion_code
+(
+  promotion_code,
+  discount_type,
+  discount_value,
+  max_uses,
+  max_uses_per_address,
+  valid_from,
+  valid_until,
+  product_ids
+)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8);
@@ -0,0 +1,38 @@
+-- only inserts if the code is still usable, so limits hold even if the code changed since it was quoted
+-- run after lock_promotion_code.sql in the same transaction, so the counts include every committed redemption
+INSERT INTO order_fulfillment.promotion_redemption
+(
+  promotion_code,
+  customer_order_id,
+  discount_amount
+)
+SELECT $1, $2, $4
+FROM order_fulfillment.promotion_code
+WHERE
+  order_fulfillment.promotion_code.promotion_code = $1 AND
+  NOT order_fulfillment.promotion_code.disabled AND
+  (order_fulfillment.promotion_code.valid_from IS NULL OR order_fulfillment.promotion_code.valid_from <= NOW()) AND
+  (order_fulfillment.promotion_code.valid_until IS NULL OR order_fulfillment.promotion_code.valid_until > NOW()) AND
+  (
+    order_fulfillment.promotion_code.max_uses = 0 OR
+    order_fulfillment.promotion_code.max_uses > (
+      SELECT COUNT(*)
+      FROM order_fulfillment.promotion_redemption
+      INNER JOIN order_fulfillment.customer_order ON order_fulfillment.customer_order.customer_order_id = order_fulfillment.promotion_redemption.customer_order_id
+      WHERE
+        order_fulfillment.promotion_redemption.promotion_code = $1 AND
+        order_fulfillment.customer_order.order_status <> 'FAILED'
+    )
+  ) AND
+  (
+    order_fulfillment.promotion_code.max_uses_per_address = 0 OR
+    order_fulfillment.promotion_code.max_uses_per_address > (
+      SELECT COUNT(*)
+      FROM order_fulfillment.promotion_redemption
+      INNER JOIN order_fulfillment.customer_order ON order_fulfillment.customer_order.customer_order_id = order_fulfillment.promotion_redemption.customer_order_id
+      WHERE
+        order_fulfillment.promotion_redemption.promotion_code = $1 AND
+        order_fulfillment.customer_order.order_status <> 'FAILED' AND
+        order_fulfillment.customer_order.delivery_address = $3
+    )
+  );
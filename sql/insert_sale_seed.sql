@@ -0,0 +1,11 @@
+-- does nothing if another instance started a sale first
+INSERT INTO order_fulfillment.sale_seed
+(
+  sale_seed_id,
+  seed_hash,
+  seed,
+  catalog_hash,
+  active
+)
+VALUES($1, $2, $3, $4, TRUE)
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,13 @@
+INSERT INTO order_fulfillment.waitlist_entry
+(
+  waitlist_entry_id,
+  product_id,
+  native_token_id,
+  delivery_address,
+  quantity,
+  email,
+  discord_webhook_url,
+  waitlist_status
+)
+VALUES($1, $2, $3, $4, $5, $6, $7, 'WAITING')
+ON CONFLICT (product_id, delivery_address) WHERE waitlist_status IN ('WAITING', 'RESERVED') DO NOTHING;
@@ -0,0 +1,7 @@
+INSERT INTO order_fulfillment.webhook_dead_letter
+(
+  webhook_delivery_id,
+  attempts,
+  last_error
+)
+VALUES($1, $2, $3);
@@ -0,0 +1,10 @@
+INSERT INTO order_fulfillment.webhook_delivery
+(
+  webhook_delivery_id,
+  endpoint_name,
+  event_type,
+  customer_order_id,
+  payload,
+  delivery_status
+)
+VALUES($1, $2, $3, $4, $5, 'PENDING');
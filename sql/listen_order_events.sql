@@ -0,0 +1 @@
+LISTEN order_fulfillment_order_events;
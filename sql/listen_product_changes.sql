@@ -0,0 +1 @@
+LISTEN order_fulfillment_product_changes;
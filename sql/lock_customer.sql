@@ -0,0 +1,2 @@
+-- held until the transaction ends, so orders by the same customer are inserted one at a time across instances
+SELECT pg_advisory_xact_lock(hashtext('customer:' || $1::TEXT));
@@ -0,0 +1,5 @@
+-- held until the transaction ends, so redemptions of a code are counted one order at a time across instances
+SELECT promotion_code
+FROM order_fulfillment.promotion_code
+WHERE promotion_code = $1
+FOR UPDATE;
@@ -0,0 +1,8 @@
+CREATE TABLE order_fulfillment.price_quote
+(
+  price_quote_id TEXT PRIMARY KEY,
+  quote JSONB NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  customer_order_id TEXT
+);
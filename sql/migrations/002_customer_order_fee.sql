@@ -0,0 +1,9 @@
+CREATE TABLE order_fulfillment.customer_order_fee
+(
+  customer_order_id TEXT NOT NULL REFERENCES order_fulfillment.customer_order(customer_order_id),
+  fee_name TEXT NOT NULL,
+  fee_type TEXT NOT NULL,
+  amount NUMERIC NOT NULL,
+  waived_by TEXT,
+  PRIMARY KEY (customer_order_id, fee_name)
+);
@@ -0,0 +1,21 @@
+CREATE TABLE order_fulfillment.promotion_code
+(
+  promotion_code TEXT PRIMARY KEY,
+  discount_type TEXT NOT NULL,
+  discount_value NUMERIC NOT NULL,
+  max_uses INTEGER NOT NULL DEFAULT 0,
+  max_uses_per_address INTEGER NOT NULL DEFAULT 0,
+  valid_from TIMESTAMPTZ,
+  valid_until TIMESTAMPTZ,
+  product_ids TEXT[] NOT NULL DEFAULT '{}',
+  disabled BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE order_fulfillment.promotion_redemption
+(
+  promotion_code TEXT NOT NULL REFERENCES order_fulfillment.promotion_code(promotion_code),
+  customer_order_id TEXT NOT NULL REFERENCES order_fulfillment.customer_order(customer_order_id),
+  discount_amount NUMERIC NOT NULL,
+  PRIMARY KEY (promotion_code, customer_order_id)
+);
@@ -0,0 +1,4 @@
+-- orders can have several payment attempts, only one of which is active
+ALTER TABLE order_fulfillment.now_payments_payment DROP CONSTRAINT IF EXISTS now_payments_payment_customer_order_id_key;
+ALTER TABLE order_fulfillment.now_payments_payment ADD COLUMN active BOOLEAN NOT NULL DEFAULT TRUE;
+CREATE UNIQUE INDEX now_payments_payment_active_idx ON order_fulfillment.now_payments_payment (customer_order_id) WHERE active;
@@ -0,0 +1,14 @@
+-- payments created on NowPayments that could not be attached to their order, worked through by WatchPaymentCompensations
+CREATE TABLE order_fulfillment.payment_compensation
+(
+  customer_order_id TEXT PRIMARY KEY REFERENCES order_fulfillment.customer_order(customer_order_id),
+  -- empty if the order was left pending and the payment is unknown
+  payment_id TEXT NOT NULL,
+  pay_address TEXT NOT NULL,
+  compensation_status TEXT NOT NULL,
+  detail TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX payment_compensation_status_idx ON order_fulfillment.payment_compensation (compensation_status);
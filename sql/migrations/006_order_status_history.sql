@@ -0,0 +1,19 @@
+-- every change of customer_order.order_status, see internal/orders/statemachine
+CREATE TABLE order_fulfillment.order_status_history
+(
+  order_status_history_id BIGSERIAL PRIMARY KEY,
+  customer_order_id TEXT NOT NULL REFERENCES order_fulfillment.customer_order(customer_order_id),
+  -- empty when the order was created
+  from_status TEXT NOT NULL,
+  to_status TEXT NOT NULL,
+  reason TEXT NOT NULL,
+  actor TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX order_status_history_customer_order_id_idx ON order_fulfillment.order_status_history (customer_order_id);
+
+-- orders created before history was recorded start at their current status
+INSERT INTO order_fulfillment.order_status_history (customer_order_id, from_status, to_status, reason, actor)
+SELECT customer_order_id, '', order_status, 'recorded when order status history was added', 'system'
+FROM order_fulfillment.customer_order;
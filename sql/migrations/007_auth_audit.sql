@@ -0,0 +1,15 @@
+-- who made a transition, empty for automated flows
+ALTER TABLE order_fulfillment.order_status_history ADD COLUMN actor_id TEXT NOT NULL DEFAULT '';
+
+-- every mutating request to an authenticated route
+CREATE TABLE order_fulfillment.audit_log
+(
+  audit_log_id BIGSERIAL PRIMARY KEY,
+  actor_id TEXT NOT NULL,
+  actor_role TEXT NOT NULL,
+  auth_method TEXT NOT NULL,
+  request_method TEXT NOT NULL,
+  request_path TEXT NOT NULL,
+  status_code INTEGER NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
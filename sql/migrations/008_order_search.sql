@@ -0,0 +1,4 @@
+-- filters for GET /orders, creation time comes from the ULID in customer_order_id
+CREATE INDEX customer_order_delivery_address_idx ON order_fulfillment.customer_order (delivery_address);
+CREATE INDEX customer_order_order_status_idx ON order_fulfillment.customer_order (order_status);
+CREATE INDEX customer_order_item_product_id_idx ON order_fulfillment.customer_order_item (product_id);
@@ -0,0 +1,29 @@
+-- outbound webhooks, one delivery per configured endpoint and event, see internal/webhooks
+CREATE TABLE order_fulfillment.webhook_delivery
+(
+  webhook_delivery_id TEXT PRIMARY KEY,
+  -- webhooks.endpoints[].name in the config
+  endpoint_name TEXT NOT NULL,
+  event_type TEXT NOT NULL,
+  customer_order_id TEXT NOT NULL,
+  -- JSON body, signed with the endpoint secret on each attempt
+  payload TEXT NOT NULL,
+  -- PENDING, DELIVERED or DEAD
+  delivery_status TEXT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX webhook_delivery_pending_idx ON order_fulfillment.webhook_delivery (next_attempt_at) WHERE delivery_status = 'PENDING';
+
+-- deliveries that ran out of attempts, replayed with POST /admin/webhooks/dead-letters/{webhook_delivery_id}/replay
+CREATE TABLE order_fulfillment.webhook_dead_letter
+(
+  webhook_delivery_id TEXT PRIMARY KEY REFERENCES order_fulfillment.webhook_delivery(webhook_delivery_id),
+  attempts INTEGER NOT NULL,
+  last_error TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
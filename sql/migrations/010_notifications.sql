@@ -0,0 +1,30 @@
+-- optional customer contact details, given when the order is created
+CREATE TABLE order_fulfillment.customer_order_contact
+(
+  customer_order_id TEXT PRIMARY KEY REFERENCES order_fulfillment.customer_order(customer_order_id),
+  email TEXT NOT NULL DEFAULT '',
+  discord_webhook_url TEXT NOT NULL DEFAULT ''
+);
+
+-- customer notifications, rendered when queued and sent by internal/notifications
+CREATE TABLE order_fulfillment.notification
+(
+  notification_id TEXT PRIMARY KEY,
+  customer_order_id TEXT NOT NULL REFERENCES order_fulfillment.customer_order(customer_order_id),
+  -- email or discord
+  channel TEXT NOT NULL,
+  -- email address or Discord webhook URL
+  recipient TEXT NOT NULL,
+  event_type TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  body TEXT NOT NULL,
+  -- PENDING, SENT or FAILED
+  notification_status TEXT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX notification_pending_idx ON order_fulfillment.notification (next_attempt_at) WHERE notification_status = 'PENDING';
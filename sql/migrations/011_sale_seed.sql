@@ -0,0 +1,29 @@
+-- commit-reveal seeds that bundle pulls are derived from, see internal/fairness
+CREATE TABLE order_fulfillment.sale_seed
+(
+  sale_seed_id TEXT PRIMARY KEY,
+  -- hex SHA-256 of the seed bytes, published while the seed is active
+  seed_hash TEXT NOT NULL,
+  -- hex, kept secret until revealed
+  seed TEXT NOT NULL,
+  active BOOLEAN NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  ended_at TIMESTAMPTZ,
+  revealed_at TIMESTAMPTZ
+);
+
+-- at most one sale is running at a time
+CREATE UNIQUE INDEX sale_seed_active_idx ON order_fulfillment.sale_seed (active) WHERE active;
+
+-- what each bundle in an order unpacked into, with the inputs needed to recompute it
+CREATE TABLE order_fulfillment.customer_order_pull
+(
+  customer_order_id TEXT NOT NULL REFERENCES order_fulfillment.customer_order(customer_order_id),
+  -- position of the unit among the order's items, counting each unit of an item's quantity
+  item_index INTEGER NOT NULL,
+  -- the bundle product
+  product_id TEXT NOT NULL,
+  sale_seed_id TEXT NOT NULL REFERENCES order_fulfillment.sale_seed(sale_seed_id),
+  unpacked_product_ids TEXT[] NOT NULL,
+  PRIMARY KEY (customer_order_id, item_index)
+);
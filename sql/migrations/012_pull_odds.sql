@@ -0,0 +1,3 @@
+-- the stock-adjusted odds each random draw of a pull was made with, see novellia_database.DrawOdds
+-- pulls recorded before this are checked against the full catalog
+ALTER TABLE order_fulfillment.customer_order_pull ADD COLUMN odds JSONB NOT NULL DEFAULT '[]';
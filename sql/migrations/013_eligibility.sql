@@ -0,0 +1,20 @@
+-- addresses allowed to order in sale phases that name the allowlist, see internal/eligibility
+CREATE TABLE order_fulfillment.allowlist_address
+(
+  allowlist_id TEXT NOT NULL,
+  address TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (allowlist_id, address)
+);
+
+-- the address each order placed in a gated sale phase counts against, for per-address caps
+CREATE TABLE order_fulfillment.customer_order_eligibility
+(
+  customer_order_id TEXT PRIMARY KEY REFERENCES order_fulfillment.customer_order(customer_order_id),
+  sale_phase TEXT NOT NULL,
+  -- the delivery address, or the wallet that proved eligibility with a CIP-30 signature
+  address TEXT NOT NULL,
+  units INTEGER NOT NULL
+);
+
+CREATE INDEX customer_order_eligibility_address_idx ON order_fulfillment.customer_order_eligibility (sale_phase, address);
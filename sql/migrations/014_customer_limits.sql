@@ -0,0 +1,4 @@
+-- per-customer purchase limits count orders by delivery address or by the stake address derived from it
+ALTER TABLE order_fulfillment.customer_order ADD COLUMN stake_address TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX customer_order_stake_address_idx ON order_fulfillment.customer_order (stake_address) WHERE stake_address <> '';
@@ -0,0 +1,11 @@
+-- instances cache products, changes to novellia.product are notified so that they refresh, see internal/products
+CREATE FUNCTION order_fulfillment.notify_product_changes() RETURNS TRIGGER AS $$
+BEGIN
+  PERFORM pg_notify('order_fulfillment_product_changes', TG_OP);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER product_changes_notify
+  AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON novellia.product
+  FOR EACH STATEMENT EXECUTE PROCEDURE order_fulfillment.notify_product_changes();
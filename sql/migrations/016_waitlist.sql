@@ -0,0 +1,28 @@
+-- customers waiting for sold-out products, served in FIFO order as stock frees up, see internal/waitlist
+CREATE TABLE order_fulfillment.waitlist_entry
+(
+  -- ULID, entries for a product are reserved in this order
+  waitlist_entry_id TEXT PRIMARY KEY,
+  product_id TEXT NOT NULL,
+  native_token_id TEXT NOT NULL,
+  delivery_address TEXT NOT NULL,
+  quantity BIGINT NOT NULL,
+  email TEXT NOT NULL DEFAULT '',
+  discord_webhook_url TEXT NOT NULL DEFAULT '',
+  -- WAITING, RESERVED, CLAIMED or EXPIRED
+  waitlist_status TEXT NOT NULL,
+  -- stock stays reserved until then unless an order claims it
+  reserved_until TIMESTAMPTZ,
+  -- the order that claimed the reservation
+  customer_order_id TEXT REFERENCES order_fulfillment.customer_order(customer_order_id),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- a delivery address waits once per product
+CREATE UNIQUE INDEX waitlist_entry_active_idx ON order_fulfillment.waitlist_entry (product_id, delivery_address) WHERE waitlist_status IN ('WAITING', 'RESERVED');
+CREATE INDEX waitlist_entry_reserved_idx ON order_fulfillment.waitlist_entry (reserved_until) WHERE waitlist_status = 'RESERVED';
+
+-- customers are notified when their reservation is made, before they have an order
+ALTER TABLE order_fulfillment.notification ALTER COLUMN customer_order_id DROP NOT NULL;
+ALTER TABLE order_fulfillment.notification ADD COLUMN waitlist_entry_id TEXT REFERENCES order_fulfillment.waitlist_entry(waitlist_entry_id);
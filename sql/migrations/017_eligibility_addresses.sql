@@ -0,0 +1,3 @@
+-- an order counts against the cap of every address that qualified for the sale phase, see internal/eligibility
+ALTER TABLE order_fulfillment.customer_order_eligibility DROP CONSTRAINT customer_order_eligibility_pkey;
+ALTER TABLE order_fulfillment.customer_order_eligibility ADD PRIMARY KEY (customer_order_id, address);
@@ -0,0 +1,3 @@
+-- the bundle catalog a sale's pulls are drawn from is committed with its seed, see internal/fairness
+-- seeds started before this have no commitment and their pulls are never reported verified
+ALTER TABLE order_fulfillment.sale_seed ADD COLUMN catalog_hash TEXT NOT NULL DEFAULT '';
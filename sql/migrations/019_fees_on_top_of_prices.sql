@@ -0,0 +1,7 @@
+-- fees and the min-ada deposit are charged on top of listed prices since the fee schedule was added
+-- hacks/update_integrated_prices.sql had integrated 4 ADA of min-ada and a 1 ADA order fee into each unit price, take them out again
+UPDATE novellia.product
+SET price_unit_amount = price_unit_amount - 5
+WHERE
+  price_unit_amount IN (22, 13) OR
+  product_id IN ('PROD-01F4NAFJCAG5JDEGMR0XQARBW2', 'PROD-01F4NAF8MANXDT26MGA5E0QXNJ');
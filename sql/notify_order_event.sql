@@ -0,0 +1 @@
+SELECT pg_notify('order_fulfillment_order_events', $1);
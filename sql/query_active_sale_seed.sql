@@ -0,0 +1,11 @@
+SELECT
+  sale_seed_id,
+  seed_hash,
+  catalog_hash,
+  seed,
+  active,
+  created_at,
+  ended_at,
+  revealed_at
+FROM order_fulfillment.sale_seed
+WHERE active;
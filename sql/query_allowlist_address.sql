@@ -0,0 +1,7 @@
+SELECT EXISTS (
+  SELECT 1
+  FROM order_fulfillment.allowlist_address
+  WHERE
+    allowlist_id = $1 AND
+    address = ANY($2)
+);
@@ -0,0 +1,5 @@
+SELECT
+  email,
+  discord_webhook_url
+FROM order_fulfillment.customer_order_contact
+WHERE customer_order_id = $1;
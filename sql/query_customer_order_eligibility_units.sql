@@ -0,0 +1,7 @@
+SELECT COALESCE(SUM(order_fulfillment.customer_order_eligibility.units), 0)
+FROM order_fulfillment.customer_order_eligibility
+INNER JOIN order_fulfillment.customer_order ON order_fulfillment.customer_order.customer_order_id = order_fulfillment.customer_order_eligibility.customer_order_id
+WHERE
+  order_fulfillment.customer_order_eligibility.sale_phase = $1 AND
+  order_fulfillment.customer_order_eligibility.address = $2 AND
+  order_fulfillment.customer_order.order_status <> 'FAILED';
@@ -0,0 +1,7 @@
+SELECT
+  fee_name,
+  fee_type,
+  amount,
+  COALESCE(waived_by, '')
+FROM order_fulfillment.customer_order_fee
+WHERE $1 = customer_order_id;
@@ -0,0 +1,9 @@
+SELECT
+  item_index,
+  product_id,
+  sale_seed_id,
+  unpacked_product_ids,
+  odds
+FROM order_fulfillment.customer_order_pull
+WHERE customer_order_id = $1
+ORDER BY item_index;
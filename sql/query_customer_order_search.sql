@@ -0,0 +1,37 @@
+SELECT
+  o.customer_order_id,
+  o.order_status,
+  COALESCE(p.payment_status, ''),
+  o.delivery_address,
+  o.price_currency_id,
+  o.price_amount,
+  ARRAY(
+    SELECT i.product_id
+    FROM order_fulfillment.customer_order_item i
+    WHERE i.customer_order_id = o.customer_order_id
+    ORDER BY i.product_id
+  ),
+  h.updated_at
+FROM order_fulfillment.customer_order o
+LEFT JOIN order_fulfillment.now_payments_payment p ON p.customer_order_id = o.customer_order_id AND p.active
+LEFT JOIN LATERAL (
+  SELECT MAX(created_at) AS updated_at
+  FROM order_fulfillment.order_status_history
+  WHERE customer_order_id = o.customer_order_id
+) h ON TRUE
+WHERE
+  ($1 = '' OR o.customer_order_id < $1) AND
+  ($2 = '' OR o.order_status = $2) AND
+  ($3 = '' OR p.payment_status = $3) AND
+  ($4 = '' OR o.delivery_address = $4) AND
+  ($5 = '' OR EXISTS (
+    SELECT 1
+    FROM order_fulfillment.customer_order_item i
+    WHERE i.customer_order_id = o.customer_order_id AND i.product_id = $5
+  )) AND
+  ($6 = '' OR o.customer_order_id >= $6) AND
+  ($7 = '' OR o.customer_order_id < $7) AND
+  ($8 = '' OR h.updated_at >= $8::TIMESTAMPTZ) AND
+  ($9 = '' OR h.updated_at < $9::TIMESTAMPTZ)
+ORDER BY o.customer_order_id DESC
+LIMIT $10;
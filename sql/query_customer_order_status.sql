@@ -0,0 +1,5 @@
+SELECT
+  order_status,
+  delivery_address
+FROM order_fulfillment.customer_order
+WHERE customer_order_id = $1;
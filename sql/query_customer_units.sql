@@ -0,0 +1,12 @@
+SELECT COALESCE(SUM(order_fulfillment.customer_order_item.quantity), 0)
+FROM order_fulfillment.customer_order
+INNER JOIN order_fulfillment.customer_order_item ON order_fulfillment.customer_order_item.customer_order_id = order_fulfillment.customer_order.customer_order_id
+WHERE
+  (
+    order_fulfillment.customer_order.delivery_address = $1 OR
+    ($2::TEXT <> '' AND order_fulfillment.customer_order.stake_address = $2)
+  ) AND
+  order_fulfillment.customer_order.order_status <> 'FAILED' AND
+  ($3::TEXT = '' OR order_fulfillment.customer_order_item.product_id = $3) AND
+  ($4::TEXT = '' OR order_fulfillment.customer_order.customer_order_id >= $4) AND
+  ($5::TEXT = '' OR order_fulfillment.customer_order.customer_order_id < $5);
@@ -5,11 +5,14 @@ SELECT
   price_amount,
   price_currency,
   pay_amount,
+  COALESCE(actually_paid, 0),
   pay_currency,
   customer_order_id,
   order_description,
   purchase_id,
   now_payments_created_at,
-  now_payments_updated_at
+  now_payments_updated_at,
+  active
 FROM order_fulfillment.now_payments_payment
-WHERE $1 = customer_order_id;
+WHERE $1 = customer_order_id
+ORDER BY now_payments_created_at;
@@ -0,0 +1,11 @@
+SELECT
+  customer_order_id,
+  from_status,
+  to_status,
+  reason,
+  actor,
+  actor_id,
+  created_at
+FROM order_fulfillment.order_status_history
+WHERE customer_order_id = $1
+ORDER BY order_status_history_id;
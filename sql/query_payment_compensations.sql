@@ -0,0 +1,10 @@
+SELECT
+  customer_order_id,
+  payment_id,
+  pay_address,
+  compensation_status,
+  detail,
+  created_at
+FROM order_fulfillment.payment_compensation
+WHERE compensation_status = $1
+ORDER BY created_at;
@@ -0,0 +1,4 @@
+SELECT
+  quote
+FROM order_fulfillment.price_quote
+WHERE $1 = price_quote_id;
@@ -0,0 +1,8 @@
+SELECT
+  COUNT(*),
+  COUNT(*) FILTER (WHERE order_fulfillment.customer_order.delivery_address = $2)
+FROM order_fulfillment.promotion_redemption
+INNER JOIN order_fulfillment.customer_order ON order_fulfillment.customer_order.customer_order_id = order_fulfillment.promotion_redemption.customer_order_id
+WHERE
+  order_fulfillment.promotion_redemption.promotion_code = $1 AND
+  order_fulfillment.customer_order.order_status <> 'FAILED';
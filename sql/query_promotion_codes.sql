@@ -0,0 +1,13 @@
+SELECT
+  promotion_code,
+  discount_type,
+  discount_value,
+  max_uses,
+  max_uses_per_address,
+  valid_from,
+  valid_until,
+  product_ids,
+  disabled
+FROM order_fulfillment.promotion_code
+WHERE $1 = '' OR $1 = promotion_code
+ORDER BY created_at;
@@ -0,0 +1,16 @@
+SELECT
+  order_fulfillment.now_payments_payment.payment_id::TEXT,
+  order_fulfillment.now_payments_payment.customer_order_id,
+  order_fulfillment.now_payments_payment.payment_status,
+  order_fulfillment.now_payments_payment.pay_amount,
+  COALESCE(order_fulfillment.now_payments_payment.actually_paid, 0),
+  COALESCE(order_fulfillment.now_payments_payment.outcome_amount, 0),
+  COALESCE(order_fulfillment.now_payments_payment.outcome_currency, ''),
+  order_fulfillment.now_payments_payment.active,
+  order_fulfillment.customer_order.order_status
+FROM order_fulfillment.now_payments_payment
+INNER JOIN order_fulfillment.customer_order ON order_fulfillment.customer_order.customer_order_id = order_fulfillment.now_payments_payment.customer_order_id
+WHERE
+  order_fulfillment.now_payments_payment.now_payments_created_at >= $1 AND
+  order_fulfillment.now_payments_payment.now_payments_created_at < $2
+ORDER BY order_fulfillment.now_payments_payment.now_payments_created_at;
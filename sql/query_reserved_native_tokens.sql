@@ -1,9 +1,24 @@
 SELECT
   native_token_id,
   SUM(quantity)
-FROM order_fulfillment.customer_order_native_tokens
-INNER JOIN order_fulfillment.customer_order ON order_fulfillment.customer_order.customer_order_id = order_fulfillment.customer_order_native_tokens.customer_order_id
-WHERE
-  order_fulfillment.customer_order.order_status = 'AWAITING_PAYMENT' OR
-  order_fulfillment.customer_order.order_status = 'PAID'
+FROM (
+  SELECT
+    native_token_id,
+    quantity
+  FROM order_fulfillment.customer_order_native_tokens
+  INNER JOIN order_fulfillment.customer_order ON order_fulfillment.customer_order.customer_order_id = order_fulfillment.customer_order_native_tokens.customer_order_id
+  WHERE
+    order_fulfillment.customer_order.order_status = 'PENDING' OR
+    order_fulfillment.customer_order.order_status = 'AWAITING_PAYMENT' OR
+    order_fulfillment.customer_order.order_status = 'PAID'
+  UNION ALL
+  -- stock held for waitlisted customers until they order
+  SELECT
+    native_token_id,
+    quantity
+  FROM order_fulfillment.waitlist_entry
+  WHERE
+    waitlist_status = 'RESERVED' AND
+    reserved_until > NOW()
+) reserved
 GROUP BY native_token_id;
@@ -0,0 +1,7 @@
+-- stock waiting entries are in line for, freed stock goes to them before new orders
+SELECT
+  native_token_id,
+  SUM(quantity)
+FROM order_fulfillment.waitlist_entry
+WHERE waitlist_status = 'WAITING'
+GROUP BY native_token_id;
@@ -0,0 +1,16 @@
+SELECT
+  waitlist_entry_id,
+  product_id,
+  native_token_id,
+  delivery_address,
+  quantity,
+  email,
+  discord_webhook_url,
+  waitlist_status,
+  reserved_until,
+  COALESCE(customer_order_id, ''),
+  created_at,
+  0
+FROM order_fulfillment.waitlist_entry
+WHERE waitlist_status = 'WAITING'
+ORDER BY waitlist_entry_id;
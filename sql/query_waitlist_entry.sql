@@ -0,0 +1,22 @@
+SELECT
+  waitlist_entry_id,
+  product_id,
+  native_token_id,
+  delivery_address,
+  quantity,
+  email,
+  discord_webhook_url,
+  waitlist_status,
+  reserved_until,
+  COALESCE(customer_order_id, ''),
+  created_at,
+  (
+    SELECT COUNT(*)
+    FROM order_fulfillment.waitlist_entry ahead
+    WHERE
+      ahead.product_id = entry.product_id AND
+      ahead.waitlist_status = 'WAITING' AND
+      ahead.waitlist_entry_id < entry.waitlist_entry_id
+  )
+FROM order_fulfillment.waitlist_entry entry
+WHERE waitlist_entry_id = $1;
@@ -0,0 +1,12 @@
+SELECT
+  order_fulfillment.webhook_delivery.webhook_delivery_id,
+  order_fulfillment.webhook_delivery.endpoint_name,
+  order_fulfillment.webhook_delivery.event_type,
+  order_fulfillment.webhook_delivery.customer_order_id,
+  order_fulfillment.webhook_delivery.payload,
+  order_fulfillment.webhook_dead_letter.attempts,
+  order_fulfillment.webhook_dead_letter.last_error,
+  order_fulfillment.webhook_dead_letter.created_at
+FROM order_fulfillment.webhook_dead_letter
+INNER JOIN order_fulfillment.webhook_delivery ON order_fulfillment.webhook_delivery.webhook_delivery_id = order_fulfillment.webhook_dead_letter.webhook_delivery_id
+ORDER BY order_fulfillment.webhook_dead_letter.created_at;
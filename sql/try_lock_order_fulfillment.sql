@@ -0,0 +1 @@
+SELECT pg_try_advisory_xact_lock(hashtext('fulfillment:' || $1::TEXT));
@@ -0,0 +1 @@
+UNLISTEN order_fulfillment_order_events;
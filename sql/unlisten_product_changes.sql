@@ -0,0 +1 @@
+UNLISTEN order_fulfillment_product_changes;
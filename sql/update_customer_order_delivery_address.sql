@@ -0,0 +1,5 @@
+UPDATE order_fulfillment.customer_order
+SET
+  delivery_address = $2,
+  stake_address = $3
+WHERE customer_order_id = $1;
@@ -0,0 +1,3 @@
+UPDATE order_fulfillment.customer_order
+SET payment_address = $2
+WHERE customer_order_id = $1;
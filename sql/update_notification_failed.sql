@@ -0,0 +1,7 @@
+UPDATE order_fulfillment.notification
+SET
+  notification_status = 'FAILED',
+  attempts = $2,
+  last_error = $3,
+  updated_at = NOW()
+WHERE notification_id = $1;
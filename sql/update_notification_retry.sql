@@ -0,0 +1,7 @@
+UPDATE order_fulfillment.notification
+SET
+  attempts = $2,
+  last_error = $3,
+  next_attempt_at = NOW() + make_interval(secs => $4),
+  updated_at = NOW()
+WHERE notification_id = $1;
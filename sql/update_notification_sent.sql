@@ -0,0 +1,7 @@
+UPDATE order_fulfillment.notification
+SET
+  notification_status = 'SENT',
+  attempts = $2,
+  last_error = '',
+  updated_at = NOW()
+WHERE notification_id = $1;
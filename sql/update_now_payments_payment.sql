@@ -5,4 +5,4 @@ SET
   now_payments_updated_at = $4,
   outcome_amount = $5,
   outcome_currency = $6
-WHERE customer_order_id = $1;
+WHERE payment_id = $1;
@@ -0,0 +1,3 @@
+UPDATE order_fulfillment.now_payments_payment
+SET active = FALSE
+WHERE customer_order_id = $1;
@@ -0,0 +1,6 @@
+UPDATE order_fulfillment.payment_compensation
+SET
+  compensation_status = $2,
+  detail = $3,
+  updated_at = NOW()
+WHERE customer_order_id = $1;
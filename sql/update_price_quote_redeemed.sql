@@ -0,0 +1,6 @@
+UPDATE order_fulfillment.price_quote
+SET
+  customer_order_id = $2
+WHERE
+  price_quote_id = $1 AND
+  customer_order_id IS NULL;
@@ -0,0 +1,4 @@
+UPDATE order_fulfillment.promotion_code
+SET
+  disabled = TRUE
+WHERE promotion_code = $1;
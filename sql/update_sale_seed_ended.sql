@@ -0,0 +1,5 @@
+UPDATE order_fulfillment.sale_seed
+SET
+  active = FALSE,
+  ended_at = NOW()
+WHERE active;
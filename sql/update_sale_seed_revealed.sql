@@ -0,0 +1,7 @@
+-- only seeds of sales that have ended can be revealed
+UPDATE order_fulfillment.sale_seed
+SET
+  revealed_at = COALESCE(revealed_at, NOW())
+WHERE
+  sale_seed_id = $1 AND
+  NOT active;
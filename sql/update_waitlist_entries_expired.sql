@@ -0,0 +1,8 @@
+-- reservations that were not claimed in time release their stock
+UPDATE order_fulfillment.waitlist_entry
+SET
+  waitlist_status = 'EXPIRED',
+  updated_at = NOW()
+WHERE
+  waitlist_status = 'RESERVED' AND
+  reserved_until <= NOW();
@@ -0,0 +1,10 @@
+UPDATE order_fulfillment.waitlist_entry
+SET
+  waitlist_status = 'CLAIMED',
+  customer_order_id = $2,
+  updated_at = NOW()
+WHERE
+  waitlist_entry_id = $1 AND
+  delivery_address = $3 AND
+  waitlist_status = 'RESERVED' AND
+  reserved_until > NOW();
@@ -0,0 +1,16 @@
+-- a failed order hands its claimed reservation back, the watcher expires it if its time is up
+UPDATE order_fulfillment.waitlist_entry
+SET
+  waitlist_status = 'RESERVED',
+  customer_order_id = NULL,
+  updated_at = NOW()
+WHERE
+  customer_order_id = $1 AND
+  waitlist_status = 'CLAIMED' AND
+  EXISTS (
+    SELECT 1
+    FROM order_fulfillment.customer_order
+    WHERE
+      customer_order_id = $1 AND
+      order_status = 'FAILED'
+  );
@@ -0,0 +1,8 @@
+UPDATE order_fulfillment.waitlist_entry
+SET
+  waitlist_status = 'RESERVED',
+  reserved_until = $2,
+  updated_at = NOW()
+WHERE
+  waitlist_entry_id = $1 AND
+  waitlist_status = 'WAITING';
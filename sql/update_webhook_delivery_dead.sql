@@ -0,0 +1,7 @@
+UPDATE order_fulfillment.webhook_delivery
+SET
+  delivery_status = 'DEAD',
+  attempts = $2,
+  last_error = $3,
+  updated_at = NOW()
+WHERE webhook_delivery_id = $1;
@@ -0,0 +1,7 @@
+UPDATE order_fulfillment.webhook_delivery
+SET
+  delivery_status = 'PENDING',
+  attempts = 0,
+  next_attempt_at = NOW(),
+  updated_at = NOW()
+WHERE webhook_delivery_id = $1;